@@ -31,10 +31,31 @@ type Config struct {
 	IsInit               bool              `json:"isInit"`
 	WebPushUrl           string            `json:"webPushUrl"`
 	WebPushToken         string            `json:"webPushToken"`
+	SendQueueLifetime    int               `json:"sendQueueLifetime"`   //投递失败后重试的最长时间，单位小时，默认120（5天）
+	AttachmentPath       string            `json:"attachmentPath"`      //附件存储目录，默认./data/attachments
+	SmtpMaxMessageBytes  int64             `json:"smtpMaxMessageBytes"` //SMTP收信的最大邮件大小，单位字节，默认25MB
+	Relays               []*Relay          `json:"relays"`              //外发邮件的中继服务器，没有配置时直接投递到对方MX
 	Tables               map[string]string `json:"-"`
 	TablesInitData       map[string]string `json:"-"`
 }
 
+// Relay 外发中继服务器(smarthost)
+type Relay struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`     //默认tls为465，starttls为587，none为25
+	Security string   `json:"security"` //tls直接建立TLS连接，starttls(默认)，none不加密
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Domains  []string `json:"domains"` //使用该中继的收件域名，支持*.example.com，为空或者*表示其他所有域名
+}
+
+// 中继服务器加密方式
+const (
+	RelaySecurityTLS      = "tls"
+	RelaySecurityStartTLS = "starttls"
+	RelaySecurityNone     = "none"
+)
+
 const DBTypeMySQL = "mysql"
 const DBTypeSQLite = "sqlite"
 const SSLTypeAuto = "0" //自动生成证书
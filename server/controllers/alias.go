@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"pmail/dto/response"
+	"pmail/i18n"
+	"pmail/services/alias"
+	"pmail/utils/context"
+)
+
+type aliasRequest struct {
+	Address string   `json:"address"`
+	Targets []string `json:"targets"`
+}
+
+func readAliasRequest(ctx *context.Context, req *http.Request) *aliasRequest {
+	var reqData aliasRequest
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	return &reqData
+}
+
+// AliasList 别名、邮件列表和catch-all列表
+func AliasList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	items, err := alias.GetList(ctx)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(items).FPrint(w)
+}
+
+// AliasSet 设置别名的投递目标，多个目标即为邮件列表，地址为*@domain时是catch-all
+func AliasSet(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readAliasRequest(ctx, req)
+	if len(reqData.Targets) == 0 {
+		response.NewErrorResponse(response.ParamsError, "targets empty", "").FPrint(w)
+		return
+	}
+	address, err := alias.CheckAddress(reqData.Address)
+	if err != nil {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "account_error"), err.Error()).FPrint(w)
+		return
+	}
+	if _, err = alias.CheckTargets(address, reqData.Targets); err != nil {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "account_error"), err.Error()).FPrint(w)
+		return
+	}
+
+	err = alias.Set(ctx, address, reqData.Targets)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+// AliasDelete 删除别名
+func AliasDelete(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readAliasRequest(ctx, req)
+	if reqData.Address == "" {
+		response.NewErrorResponse(response.ParamsError, "params error", "").FPrint(w)
+		return
+	}
+	err := alias.Delete(ctx, reqData.Address)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
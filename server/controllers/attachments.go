@@ -3,6 +3,7 @@ package controllers
 import (
 	"fmt"
 	"github.com/spf13/cast"
+	"io"
 	"net/http"
 	"pmail/dto/response"
 	"pmail/services/attachments"
@@ -19,14 +20,16 @@ func GetAttachments(ctx *context.Context, w http.ResponseWriter, req *http.Reque
 	emailId := cast.ToInt(urlInfos[2])
 	cid := urlInfos[3]
 
-	contentType, content := attachments.GetAttachments(ctx, emailId, cid)
+	att, reader := attachments.GetAttachments(ctx, emailId, cid)
 
-	if len(content) == 0 {
+	if reader == nil {
 		response.NewErrorResponse(response.ParamsError, "", "").FPrint(w)
 		return
 	}
-	w.Header().Set("Content-Type", contentType)
-	w.Write(content)
+	defer reader.Close()
+	w.Header().Set("Content-Type", att.ContentType)
+	w.Header().Set("Content-Length", cast.ToString(att.Size))
+	io.Copy(w, reader)
 }
 
 func Download(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
@@ -38,13 +41,15 @@ func Download(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 	emailId := cast.ToInt(urlInfos[3])
 	index := cast.ToInt(urlInfos[4])
 
-	fileName, content := attachments.GetAttachmentsByIndex(ctx, emailId, index)
+	att, reader := attachments.GetAttachmentsByIndex(ctx, emailId, index)
 
-	if len(content) == 0 {
+	if reader == nil {
 		response.NewErrorResponse(response.ParamsError, "", "").FPrint(w)
 		return
 	}
+	defer reader.Close()
 	w.Header().Set("ContentType", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", fileName))
-	w.Write(content)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", att.Filename))
+	w.Header().Set("Content-Length", cast.ToString(att.Size))
+	io.Copy(w, reader)
 }
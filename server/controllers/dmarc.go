@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"io"
+	"math"
+	"net/http"
+	"pmail/dto/response"
+	"pmail/models"
+	"pmail/services/dmarc_report"
+	"pmail/utils/context"
+	"time"
+)
+
+type dmarcRequest struct {
+	Domain      string `json:"domain"`
+	Start       string `json:"start"` // 2006-01-02
+	End         string `json:"end"`   // 2006-01-02，包含当天
+	CurrentPage int    `json:"current_page"`
+	PageSize    int    `json:"page_size"`
+	Id          int    `json:"id"`
+}
+
+func (r *dmarcRequest) filter() *dmarc_report.Filter {
+	ret := &dmarc_report.Filter{Domain: r.Domain}
+	if t, err := time.ParseInLocation("2006-01-02", r.Start, time.Local); err == nil {
+		ret.Start = t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", r.End, time.Local); err == nil {
+		ret.End = t.AddDate(0, 0, 1)
+	}
+	return ret
+}
+
+func readDmarcRequest(ctx *context.Context, req *http.Request) *dmarcRequest {
+	var reqData dmarcRequest
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	if len(reqBytes) > 0 {
+		err = json.Unmarshal(reqBytes, &reqData)
+		if err != nil {
+			log.WithContext(ctx).Errorf("%+v", err)
+		}
+	}
+	return &reqData
+}
+
+// DmarcSummary 按来源IP汇总DMARC报告，可以看出谁在冒充本站域名，以及自己的哪些发信来源没有对齐
+func DmarcSummary(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readDmarcRequest(ctx, req)
+	items, err := dmarc_report.Summary(ctx, reqData.filter())
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(items).FPrint(w)
+}
+
+type dmarcReportsResponse struct {
+	CurrentPage int                        `json:"current_page"`
+	TotalPage   int                        `json:"total_page"`
+	List        []*dmarc_report.ReportItem `json:"list"`
+}
+
+// DmarcReports 报告列表
+func DmarcReports(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readDmarcRequest(ctx, req)
+	if reqData.PageSize == 0 {
+		reqData.PageSize = 15
+	}
+	offset := 0
+	if reqData.CurrentPage >= 1 {
+		offset = (reqData.CurrentPage - 1) * reqData.PageSize
+	}
+
+	items, total, err := dmarc_report.GetReports(ctx, reqData.filter(), offset, reqData.PageSize)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(dmarcReportsResponse{
+		CurrentPage: reqData.CurrentPage,
+		TotalPage:   cast.ToInt(math.Ceil(cast.ToFloat64(total) / cast.ToFloat64(reqData.PageSize))),
+		List:        items,
+	}).FPrint(w)
+}
+
+type dmarcDetailResponse struct {
+	Report  *models.DmarcReport   `json:"report"`
+	Records []*models.DmarcRecord `json:"records"`
+}
+
+// DmarcDetail 报告详情
+func DmarcDetail(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readDmarcRequest(ctx, req)
+	if reqData.Id <= 0 {
+		response.NewErrorResponse(response.ParamsError, "params error", "").FPrint(w)
+		return
+	}
+	report, records, err := dmarc_report.GetReport(ctx, reqData.Id)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	if report == nil {
+		response.NewErrorResponse(response.ParamsError, "report not found", "").FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(dmarcDetailResponse{Report: report, Records: records}).FPrint(w)
+}
@@ -10,6 +10,7 @@ import (
 	"pmail/dto/response"
 	"pmail/services/list"
 	"pmail/utils/context"
+	"pmail/utils/dmarc"
 )
 
 type emailListResponse struct {
@@ -19,13 +20,15 @@ type emailListResponse struct {
 }
 
 type emilItem struct {
-	ID        int    `json:"id"`
-	Title     string `json:"title"`
-	Desc      string `json:"desc"`
-	Datetime  string `json:"datetime"`
-	IsRead    bool   `json:"is_read"`
-	Sender    User   `json:"sender"`
-	Dangerous bool   `json:"dangerous"`
+	ID        int      `json:"id"`
+	Title     string   `json:"title"`
+	Desc      string   `json:"desc"`
+	Datetime  string   `json:"datetime"`
+	IsRead    bool     `json:"is_read"`
+	IsStar    bool     `json:"is_star"`
+	Tags      []string `json:"tags"`
+	Sender    User     `json:"sender"`
+	Dangerous bool     `json:"dangerous"`
 }
 
 type User struct {
@@ -66,6 +69,8 @@ func EmailList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 	for _, email := range emailList {
 		var sender User
 		_ = json.Unmarshal([]byte(email.Sender), &sender)
+		var tags []string
+		_ = json.Unmarshal([]byte(email.Tags), &tags)
 
 		lst = append(lst, &emilItem{
 			ID:        email.Id,
@@ -73,8 +78,10 @@ func EmailList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 			Desc:      email.Text.String,
 			Datetime:  email.SendDate.Format("2006-01-02 15:04:05"),
 			IsRead:    email.IsRead == 1,
+			IsStar:    email.IsStar == 1,
+			Tags:      tags,
 			Sender:    sender,
-			Dangerous: email.SPFCheck == 0 && email.DKIMCheck == 0,
+			Dangerous: email.DMARCCheck == dmarc.ResultFail || (email.SPFCheck == 0 && email.DKIMCheck == 0),
 		})
 	}
 
@@ -11,11 +11,12 @@ import (
 	"pmail/dto/parsemail"
 	"pmail/dto/response"
 	"pmail/hooks"
-	"pmail/hooks/framework"
 	"pmail/i18n"
-	"pmail/utils/async"
+	"pmail/services/attachments"
+	"pmail/services/auth"
+	"pmail/services/queue"
+	"pmail/services/search"
 	"pmail/utils/context"
-	"pmail/utils/send"
 	"strings"
 	"time"
 )
@@ -70,6 +71,11 @@ func Send(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !auth.HasSendAuth(ctx, reqData.From.Email) {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "from_not_allowed"), "").FPrint(w)
+		return
+	}
+
 	if reqData.Subject == "" {
 		response.NewErrorResponse(response.ParamsError, "邮件标题必填", "邮件标题必填").FPrint(w)
 		return
@@ -139,7 +145,7 @@ func Send(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 	log.WithContext(ctx).Debugf("插件执行--SendBefore End")
 
 	// 邮件落库
-	sql := "INSERT INTO email (type,subject, reply_to, from_name, from_address, `to`, bcc, cc, text, html, sender, attachments,spf_check, dkim_check, create_time,send_user_id,error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	sql := "INSERT INTO email (type,subject, reply_to, from_name, from_address, `to`, bcc, cc, text, html, sender, attachments,spf_check, dkim_check, create_time,send_user_id,user_id,error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	sqlRes, sqlerr := db.Instance.Exec(db.WithContext(ctx, sql),
 		1,
 		e.Subject,
@@ -152,11 +158,12 @@ func Send(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 		e.Text,
 		e.HTML,
 		json2string(e.Sender),
-		json2string(e.Attachments),
+		attachments.Meta(e.Attachments),
 		1,
 		1,
 		time.Now(),
 		ctx.UserID,
+		ctx.UserID,
 		"",
 	)
 	emailId, _ := sqlRes.LastInsertId()
@@ -168,39 +175,23 @@ func Send(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 	}
 
 	e.MessageId = emailId
+	err = attachments.Save(ctx, int(emailId), e.Attachments)
+	if err != nil {
+		log.WithContext(ctx).Errorf("attachment save error:%+v", err)
+	}
+	search.Index(ctx, int(emailId))
 
-	async.New(ctx).Process(func(p any) {
-		errMsg := ""
-		err, sendErr := send.Send(ctx, e)
-
-		log.WithContext(ctx).Debugf("插件执行--SendAfter")
-
-		as2 := async.New(ctx)
-		for _, hook := range hooks.HookList {
-			if hook == nil {
-				continue
-			}
-			as2.WaitProcess(func(hk any) {
-				hk.(framework.EmailHook).SendAfter(ctx, e, sendErr)
-			}, hook)
-		}
-		as2.Wait()
-		log.WithContext(ctx).Debugf("插件执行--SendAfter")
-
-		if err != nil {
-			errMsg = err.Error()
-			_, err := db.Instance.Exec(db.WithContext(ctx, "update email set status =2 ,error=? where id = ? "), errMsg, emailId)
-			if err != nil {
-				log.WithContext(ctx).Errorf("sql Error :%+v", err)
-			}
-		} else {
-			_, err := db.Instance.Exec(db.WithContext(ctx, "update email set status =1  where id = ? "), emailId)
-			if err != nil {
-				log.WithContext(ctx).Errorf("sql Error :%+v", err)
-			}
+	// 加入投递队列，失败后由队列自动重试
+	err = queue.Enqueue(ctx, e)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Enqueue Error :%+v", err)
+		_, err2 := db.Instance.Exec(db.WithContext(ctx, "update email set status =2 ,error=? where id = ? "), err.Error(), emailId)
+		if err2 != nil {
+			log.WithContext(ctx).Errorf("sql Error :%+v", err2)
 		}
-
-	}, nil)
+		response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "send_fail"), err.Error()).FPrint(w)
+		return
+	}
 
 	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
 }
@@ -0,0 +1,63 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"io"
+	"net/http"
+	"net/url"
+	"pmail/dto/response"
+	"pmail/services/detail"
+	"pmail/utils/context"
+	"strings"
+)
+
+// EmailSource 查看邮件原文
+func EmailSource(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var retData emailDetailRequest
+	err = json.Unmarshal(reqBytes, &retData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	if retData.ID <= 0 {
+		response.NewErrorResponse(response.ParamsError, "ID错误", "").FPrint(w)
+		return
+	}
+
+	_, source, err := detail.GetEmailSource(ctx, retData.ID)
+	if err != nil {
+		response.NewErrorResponse(response.ParamsError, "", "").FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(string(source)).FPrint(w)
+}
+
+// Download 下载EML格式的邮件原文，地址格式 /api/email/download/{id}
+func Download(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	id := cast.ToInt(strings.TrimPrefix(req.URL.Path, "/api/email/download/"))
+	if id <= 0 {
+		response.NewErrorResponse(response.ParamsError, "ID错误", "").FPrint(w)
+		return
+	}
+
+	email, source, err := detail.GetEmailSource(ctx, id)
+	if err != nil {
+		response.NewErrorResponse(response.ParamsError, "", "").FPrint(w)
+		return
+	}
+
+	fileName := email.Subject
+	if fileName == "" {
+		fileName = fmt.Sprintf("%d", email.Id)
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s.eml", url.PathEscape(fileName)))
+	w.Write(source)
+}
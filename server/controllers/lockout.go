@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"pmail/dto/response"
+	"pmail/i18n"
+	"pmail/models"
+	"pmail/services/throttle"
+	"pmail/utils/context"
+)
+
+type lockoutListResponse struct {
+	Locks  []*throttle.LockItem  `json:"locks"`
+	Events []*models.AuthLockout `json:"events"`
+}
+
+// LockoutList 当前生效的锁定以及最近的锁定记录
+func LockoutList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	events, err := throttle.GetEvents(ctx, 100)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(lockoutListResponse{
+		Locks:  throttle.GetLocks(),
+		Events: events,
+	}).FPrint(w)
+}
+
+type lockoutUnlockRequest struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+// LockoutUnlock 手动解除账号锁定或者IP封禁
+func LockoutUnlock(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData lockoutUnlockRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	if (reqData.Type != throttle.TypeAccount && reqData.Type != throttle.TypeIP) || reqData.Target == "" {
+		response.NewErrorResponse(response.ParamsError, "params error", "").FPrint(w)
+		return
+	}
+
+	throttle.Unlock(reqData.Type, reqData.Target)
+	log.WithContext(ctx).Infof("Unlock %s %s by %s", reqData.Type, reqData.Target, ctx.UserAccount)
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
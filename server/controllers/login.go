@@ -1,23 +1,22 @@
 package controllers
 
 import (
-	"database/sql"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
-	"pmail/db"
 	"pmail/dto/response"
 	"pmail/i18n"
-	"pmail/models"
+	"pmail/services/auth"
+	"pmail/services/throttle"
 	"pmail/session"
 	"pmail/utils/context"
-	"pmail/utils/password"
 )
 
 type loginRequest struct {
 	Account  string `json:"account"`
 	Password string `json:"password"`
+	Code     string `json:"code"` // 开启两步验证后需要提供验证码或者恢复码
 }
 
 func Login(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
@@ -32,19 +31,28 @@ func Login(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 		log.Errorf("%+v", err)
 	}
 
-	var user models.User
+	ip := throttle.IP(req.RemoteAddr)
+	user, err := auth.CheckLogin(ctx, auth.ProtocolHTTP, ip, reqData.Account, reqData.Password)
 
-	encodePwd := password.Encode(reqData.Password)
-	
-	_, err = db.Instance.Where("account =? and password =?", reqData.Account, encodePwd).Get(&user)
-	if err != nil && err != sql.ErrNoRows {
-		log.Errorf("%+v", err)
+	if err == nil && user.TotpEnabled == 1 {
+		if reqData.Code == "" {
+			response.NewErrorResponse(response.NeedTwoFactor, i18n.GetText(ctx.Lang, "need_two_factor"), "").FPrint(w)
+			return
+		}
+		if !auth.CheckSecondFactor(ctx, user, reqData.Code) {
+			throttle.Failed(ctx, auth.ProtocolHTTP, ip, reqData.Account)
+			response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "code_error"), "").FPrint(w)
+			return
+		}
 	}
 
-	if user.ID != 0 {
+	if err == nil {
+		throttle.Success(ip, reqData.Account)
 		userStr, _ := json.Marshal(user)
 		session.Instance.Put(req.Context(), "user", string(userStr))
 		response.NewSuccessResponse("").FPrint(w)
+	} else if err == auth.ErrLocked {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "login_locked"), "").FPrint(w)
 	} else {
 		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "aperror"), "").FPrint(w)
 	}
@@ -11,7 +11,6 @@ import (
 	"pmail/i18n"
 	"pmail/services/rule"
 	"pmail/utils/address"
-	"pmail/utils/array"
 	"pmail/utils/context"
 )
 
@@ -35,20 +34,30 @@ func UpsertRule(ctx *context.Context, w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if data.Action == dto.FORWARD && !address.IsValidEmailAddress(data.Params) {
+	// Encode会把老版本的Action和Params转换为Actions
+	ruleModel := data.Encode()
+	for _, a := range data.Actions {
+		if a != nil && a.Action == dto.FORWARD && !address.IsValidEmailAddress(a.Params) {
+			response.NewErrorResponse(response.ParamsError, "ParamsError error", i18n.GetText(ctx.Lang, "invalid_email_address")).FPrint(w)
+			return
+		}
+	}
 
-		response.NewErrorResponse(response.ParamsError, "ParamsError error", i18n.GetText(ctx.Lang, "invalid_email_address")).FPrint(w)
+	if err = rule.CheckActions(data.Actions); err != nil {
+		response.NewErrorResponse(response.ParamsError, "ParamsError error", "params error! "+err.Error()).FPrint(w)
 		return
 	}
 
-	for _, r := range data.Rules {
-		if !array.InArray(r.Field, []string{"From", "Subject", "To", "Cc", "Text", "Html", "Content"}) {
-			response.NewErrorResponse(response.ParamsError, "ParamsError error", "params error! Rule Field Error!").FPrint(w)
-			return
-		}
+	if err = rule.CheckRules(data.Rules); err != nil {
+		response.NewErrorResponse(response.ParamsError, "ParamsError error", "params error! "+err.Error()).FPrint(w)
+		return
 	}
 
-	err = data.Encode().Save(ctx)
+	err = ruleModel.Save(ctx)
+	if err == rule.ErrRuleNotFound {
+		response.NewErrorResponse(response.ParamsError, err.Error(), "").FPrint(w)
+		return
+	}
 	if err != nil {
 		response.NewErrorResponse(response.ServerError, "server error", err).FPrint(w)
 		return
@@ -87,3 +96,48 @@ func DelRule(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
 
 	response.NewSuccessResponse("succ").FPrint(w)
 }
+
+type applyRuleReq struct {
+	Id       int    `json:"id"`
+	Tag      string `json:"tag"`
+	Keyword  string `json:"keyword"`
+	DryRun   bool   `json:"dry_run"`
+	Outbound bool   `json:"outbound"` // 是否同时执行转发和webhook，默认不执行，避免把旧邮件发送到外部
+}
+
+// ApplyRule 在后台对已有邮件执行规则，dry_run为true时只返回匹配的邮件id
+func ApplyRule(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	requestBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("ReadError:%v", err)
+		return
+	}
+
+	var data applyRuleReq
+	err = json.Unmarshal(requestBody, &data)
+	if err != nil {
+		response.NewErrorResponse(response.ParamsError, "params error", err).FPrint(w)
+		return
+	}
+
+	if data.Id <= 0 {
+		response.NewErrorResponse(response.ParamsError, "params error", "id is empty").FPrint(w)
+		return
+	}
+
+	job, err := rule.Apply(ctx, data.Id, data.Tag, data.Keyword, data.DryRun, data.Outbound)
+	switch err {
+	case nil:
+		response.NewSuccessResponse(job).FPrint(w)
+	case rule.ErrRuleNotFound, rule.ErrJobRunning:
+		response.NewErrorResponse(response.ParamsError, err.Error(), "").FPrint(w)
+	default:
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "server error", err.Error()).FPrint(w)
+	}
+}
+
+// ApplyRuleStatus 返回最近一次批量执行规则的进度
+func ApplyRuleStatus(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	response.NewSuccessResponse(rule.GetApplyJob(ctx)).FPrint(w)
+}
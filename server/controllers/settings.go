@@ -8,8 +8,11 @@ import (
 	"pmail/db"
 	"pmail/dto/response"
 	"pmail/i18n"
+	"pmail/models"
+	"pmail/services/auth"
 	"pmail/utils/context"
 	"pmail/utils/password"
+	"unicode/utf8"
 )
 
 type modifyPasswordRequest struct {
@@ -28,9 +31,13 @@ func ModifyPassword(ctx *context.Context, w http.ResponseWriter, req *http.Reque
 	}
 
 	if retData.Password != "" {
-		encodePwd := password.Encode(retData.Password)
+		encodePwd, err := password.Hash(retData.Password)
+		if err != nil {
+			response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), "").FPrint(w)
+			return
+		}
 
-		_, err := db.Instance.Exec(db.WithContext(ctx, "update user set password = ? where id =?"), encodePwd, ctx.UserID)
+		_, err = db.Instance.Exec(db.WithContext(ctx, "update user set password = ? where id =?"), encodePwd, ctx.UserID)
 		if err != nil {
 			response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), "").FPrint(w)
 			return
@@ -40,3 +47,201 @@ func ModifyPassword(ctx *context.Context, w http.ResponseWriter, req *http.Reque
 
 	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
 }
+
+type totpStatusResponse struct {
+	Enabled       bool  `json:"enabled"`
+	RecoveryCodes int64 `json:"recovery_codes"` // 剩余可用的恢复码数量
+}
+
+// TotpStatus 两步验证的开启状态
+func TotpStatus(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	var user models.User
+	_, err := db.Instance.ID(ctx.UserID).Get(&user)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), "").FPrint(w)
+		return
+	}
+	num, err := db.Instance.Where("user_id=?", ctx.UserID).Count(&models.RecoveryCode{})
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), "").FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(totpStatusResponse{
+		Enabled:       user.TotpEnabled == 1,
+		RecoveryCodes: num,
+	}).FPrint(w)
+}
+
+type totpSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth://地址，前端生成二维码
+}
+
+// TotpSetup 生成新的TOTP密钥，需要调用TotpEnable验证后才会生效
+func TotpSetup(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	secret, uri, err := auth.TotpSetup(ctx)
+	if err == auth.ErrTotpEnabled {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "totp_enabled"), "").FPrint(w)
+		return
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), "").FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(totpSetupResponse{
+		Secret: secret,
+		URI:    uri,
+	}).FPrint(w)
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func readTotpCode(ctx *context.Context, req *http.Request) string {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData totpCodeRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	return reqData.Code
+}
+
+func totpError(ctx *context.Context, w http.ResponseWriter, err error) {
+	switch err {
+	case auth.ErrTotpEnabled:
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "totp_enabled"), "").FPrint(w)
+	case auth.ErrTotpNotSetup:
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "totp_not_setup"), "").FPrint(w)
+	case auth.ErrCodeWrong:
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "code_error"), "").FPrint(w)
+	default:
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), "").FPrint(w)
+	}
+}
+
+// TotpEnable 校验验证码并开启两步验证，返回恢复码
+func TotpEnable(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	codes, err := auth.TotpEnable(ctx, readTotpCode(ctx, req))
+	if err != nil {
+		totpError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(codes).FPrint(w)
+}
+
+// TotpDisable 关闭两步验证，需要验证码或者恢复码
+func TotpDisable(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	err := auth.TotpDisable(ctx, readTotpCode(ctx, req))
+	if err != nil {
+		totpError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+// RecoveryCodes 重新生成恢复码，需要验证码
+func RecoveryCodes(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	var user models.User
+	_, err := db.Instance.ID(ctx.UserID).Get(&user)
+	if err != nil {
+		totpError(ctx, w, err)
+		return
+	}
+	if user.TotpEnabled == 0 {
+		totpError(ctx, w, auth.ErrTotpNotSetup)
+		return
+	}
+	if !auth.CheckSecondFactor(ctx, &user, readTotpCode(ctx, req)) {
+		totpError(ctx, w, auth.ErrCodeWrong)
+		return
+	}
+	codes, err := auth.GenRecoveryCodes(ctx)
+	if err != nil {
+		totpError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(codes).FPrint(w)
+}
+
+// AppPasswordList 应用专用密码列表
+func AppPasswordList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	list, err := auth.GetAppPasswords(ctx)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(list).FPrint(w)
+}
+
+type appPasswordCreateRequest struct {
+	Name string `json:"name"`
+}
+
+type appPasswordCreateResponse struct {
+	Name     string `json:"name"`
+	Password string `json:"password"` // 只在创建时返回一次
+}
+
+// AppPasswordCreate 生成应用专用密码，用于SMTP、POP3、IMAP客户端
+func AppPasswordCreate(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData appPasswordCreateRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	if reqData.Name == "" || utf8.RuneCountInString(reqData.Name) > 50 {
+		response.NewErrorResponse(response.ParamsError, "name error", "").FPrint(w)
+		return
+	}
+
+	pwd, err := auth.CreateAppPassword(ctx, reqData.Name)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(appPasswordCreateResponse{
+		Name:     reqData.Name,
+		Password: pwd,
+	}).FPrint(w)
+}
+
+type appPasswordDeleteRequest struct {
+	Id int `json:"id"`
+}
+
+// AppPasswordDelete 撤销应用专用密码
+func AppPasswordDelete(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData appPasswordDeleteRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	err = auth.DeleteAppPassword(ctx, reqData.Id)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
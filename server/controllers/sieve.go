@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"pmail/dto/response"
+	"pmail/i18n"
+	"pmail/services/sieve"
+	"pmail/utils/context"
+)
+
+type sieveRequest struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+func readSieveRequest(ctx *context.Context, req *http.Request) *sieveRequest {
+	var reqData sieveRequest
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	return &reqData
+}
+
+// sieveError 脚本不存在、语法错误等返回参数错误，其他为数据库错误
+func sieveError(ctx *context.Context, w http.ResponseWriter, err error) {
+	switch err {
+	case sieve.ErrNotFound, sieve.ErrExists, sieve.ErrActive, sieve.ErrNameError, sieve.ErrTooLarge:
+		response.NewErrorResponse(response.ParamsError, err.Error(), "").FPrint(w)
+	default:
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+	}
+}
+
+// SieveList 当前用户的Sieve脚本列表
+func SieveList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	list, err := sieve.List(ctx)
+	if err != nil {
+		sieveError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(list).FPrint(w)
+}
+
+// SieveGet 获取脚本内容
+func SieveGet(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readSieveRequest(ctx, req)
+	script, err := sieve.Get(ctx, reqData.Name)
+	if err != nil {
+		sieveError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(script).FPrint(w)
+}
+
+// SieveSave 新建或者修改脚本，保存前会检查语法
+func SieveSave(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readSieveRequest(ctx, req)
+	if err := sieve.CheckName(reqData.Name); err != nil {
+		sieveError(ctx, w, err)
+		return
+	}
+	if err := sieve.Check(reqData.Content); err != nil {
+		response.NewErrorResponse(response.ParamsError, err.Error(), "").FPrint(w)
+		return
+	}
+	if err := sieve.Save(ctx, reqData.Name, reqData.Content); err != nil {
+		sieveError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+// SieveDelete 删除脚本
+func SieveDelete(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readSieveRequest(ctx, req)
+	if err := sieve.Delete(ctx, reqData.Name); err != nil {
+		sieveError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+// SieveActivate 启用脚本，name为空时停用全部脚本
+func SieveActivate(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readSieveRequest(ctx, req)
+	if err := sieve.SetActive(ctx, reqData.Name); err != nil {
+		sieveError(ctx, w, err)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+// SieveCheck 只检查脚本语法，不保存
+func SieveCheck(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqData := readSieveRequest(ctx, req)
+	if err := sieve.Check(reqData.Content); err != nil {
+		response.NewErrorResponse(response.ParamsError, err.Error(), "").FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"pmail/dto/response"
+	"pmail/i18n"
+	"pmail/services/user"
+	"pmail/utils/context"
+	"unicode/utf8"
+)
+
+func UserList(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	users, err := user.GetUserList(ctx)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+		response.NewErrorResponse(response.ServerError, i18n.GetText(ctx.Lang, "unknowError"), err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(users).FPrint(w)
+}
+
+type userCreateRequest struct {
+	Account  string   `json:"account"`
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	IsAdmin  bool     `json:"is_admin"`
+	Auths    []string `json:"auths"`
+}
+
+func UserCreate(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData userCreateRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	if !user.CheckAccount(reqData.Account) {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "account_error"), "").FPrint(w)
+		return
+	}
+	if reqData.Password == "" {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "password_empty"), "").FPrint(w)
+		return
+	}
+	if reqData.Name == "" {
+		reqData.Name = reqData.Account
+	}
+	if utf8.RuneCountInString(reqData.Name) > 10 {
+		response.NewErrorResponse(response.ParamsError, "name too long", "").FPrint(w)
+		return
+	}
+
+	exist, err := user.AccountExist(ctx, reqData.Account)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	if exist {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "user_exist"), "").FPrint(w)
+		return
+	}
+
+	id, err := user.CreateUser(ctx, reqData.Account, reqData.Name, reqData.Password, reqData.IsAdmin)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+
+	if len(reqData.Auths) > 0 {
+		err = user.SetAuths(ctx, id, reqData.Auths)
+		if err != nil {
+			response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "account_error"), err.Error()).FPrint(w)
+			return
+		}
+	}
+
+	response.NewSuccessResponse(id).FPrint(w)
+}
+
+type userUpdateRequest struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	IsAdmin  bool   `json:"is_admin"`
+	Disabled bool   `json:"disabled"`
+}
+
+func UserUpdate(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData userUpdateRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	info, err := user.GetUser(ctx, reqData.Id)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	if info == nil {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "user_not_exist"), "").FPrint(w)
+		return
+	}
+
+	// 防止管理员把自己锁在外面
+	if reqData.Id == ctx.UserID && (!reqData.IsAdmin || reqData.Disabled) {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "cannot_modify_self"), "").FPrint(w)
+		return
+	}
+
+	if reqData.Name == "" {
+		reqData.Name = info.Name
+	}
+	if utf8.RuneCountInString(reqData.Name) > 10 {
+		response.NewErrorResponse(response.ParamsError, "name too long", "").FPrint(w)
+		return
+	}
+
+	err = user.UpdateUser(ctx, reqData.Id, reqData.Name, reqData.IsAdmin, reqData.Disabled)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+type userIdRequest struct {
+	Id int `json:"id"`
+}
+
+func UserDelete(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData userIdRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	if reqData.Id <= 0 {
+		response.NewErrorResponse(response.ParamsError, "ID错误", "").FPrint(w)
+		return
+	}
+	if reqData.Id == ctx.UserID {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "cannot_modify_self"), "").FPrint(w)
+		return
+	}
+
+	err = user.DeleteUser(ctx, reqData.Id)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+type userPasswordRequest struct {
+	Id       int    `json:"id"`
+	Password string `json:"password"`
+}
+
+func UserResetPassword(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData userPasswordRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	if reqData.Password == "" {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "password_empty"), "").FPrint(w)
+		return
+	}
+
+	info, err := user.GetUser(ctx, reqData.Id)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	if info == nil {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "user_not_exist"), "").FPrint(w)
+		return
+	}
+
+	err = user.ResetPassword(ctx, reqData.Id, reqData.Password)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
+
+type userAuthRequest struct {
+	Id    int      `json:"id"`
+	Auths []string `json:"auths"`
+}
+
+func UserSetAuth(ctx *context.Context, w http.ResponseWriter, req *http.Request) {
+	reqBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+	var reqData userAuthRequest
+	err = json.Unmarshal(reqBytes, &reqData)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%+v", err)
+	}
+
+	info, err := user.GetUser(ctx, reqData.Id)
+	if err != nil {
+		response.NewErrorResponse(response.ServerError, "DBError", err.Error()).FPrint(w)
+		return
+	}
+	if info == nil {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "user_not_exist"), "").FPrint(w)
+		return
+	}
+
+	err = user.SetAuths(ctx, reqData.Id, reqData.Auths)
+	if err != nil {
+		response.NewErrorResponse(response.ParamsError, i18n.GetText(ctx.Lang, "account_error"), err.Error()).FPrint(w)
+		return
+	}
+	response.NewSuccessResponse(i18n.GetText(ctx.Lang, "succ")).FPrint(w)
+}
@@ -79,19 +79,36 @@ func (p *Dkim) Sign(msgData string) []byte {
 }
 
 func Check(mail io.Reader) bool {
+	for _, v := range Verify(mail) {
+		if v.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// DkimResult 单个DKIM签名的校验结果
+type DkimResult struct {
+	Domain string
+	Err    error
+}
+
+// Verify 校验邮件中全部的DKIM签名
+func Verify(mail io.Reader) []*DkimResult {
 
 	verifications, err := dkim.Verify(mail)
 	if err != nil {
 		log.Println(err)
 	}
 
+	var ret []*DkimResult
 	for _, v := range verifications {
 		if v.Err == nil {
 			log.Println("Valid signature for:", v.Domain)
 		} else {
 			log.Println("Invalid signature for:", v.Domain, v.Err)
-			return false
 		}
+		ret = append(ret, &DkimResult{Domain: v.Domain, Err: v.Err})
 	}
-	return true
+	return ret
 }
@@ -53,18 +53,48 @@ type Email struct {
 	ReadReceipt []string
 	Date        string
 	IsRead      int
+	IsStar      int
+	Tags        []string
 	Status      int // 0未发送，1已发送，2发送失败，3删除
 	GroupId     int // 分组id
 	MessageId   int64
+	Size        int64  // 原文大小
+	SPF         string // 收信时的SPF校验结果，例如pass、fail、softfail、none
+	DKIM        string // 收信时的DKIM校验结果，pass、fail或者none
+	MailFrom    string // 收信时的信封发件人，退信等情况为空
+}
+
+// countReader 统计读取的字节数
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func NewEmailFromReader(to []string, r io.Reader) *Email {
 	ret := &Email{}
-	m, err := message.Read(r)
+	cr := &countReader{r: r}
+	m, err := message.Read(cr)
 	if err != nil {
 		log.Errorf("email解析错误！ Error %+v", err)
 	}
 
+	// 解码后的全部邮件头，规则匹配等场景使用
+	ret.Headers = textproto.MIMEHeader{}
+	fields := m.Header.Fields()
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		ret.Headers.Add(fields.Key(), value)
+	}
+
 	ret.From = buildUser(m.Header.Get("From"))
 
 	if len(to) > 0 {
@@ -90,6 +120,8 @@ func NewEmailFromReader(to []string, r io.Reader) *Email {
 	m.Walk(func(path []int, entity *message.Entity, err error) error {
 		return formatContent(entity, ret)
 	})
+	io.Copy(io.Discard, cr)
+	ret.Size = cr.n
 	return ret
 }
 
@@ -104,6 +136,7 @@ func formatContent(entity *message.Entity, ret *Email) error {
 	switch contentType {
 	case "multipart/alternative":
 	case "multipart/mixed":
+	case "multipart/report":
 	case "text/plain":
 		ret.Text, _ = io.ReadAll(entity.Body)
 	case "text/html":
@@ -270,6 +303,9 @@ func (e *Email) ForwardBuildBytes(ctx *context.Context, forwardAddress string) [
 	return instance.Sign(b.String())
 }
 
+// extraHeaders BuildBytes时从Headers中带上的邮件头，用于自动回复
+var extraHeaders = []string{"Auto-Submitted", "In-Reply-To", "References"}
+
 func (e *Email) BuildBytes(ctx *context.Context, dkim bool) []byte {
 	var b bytes.Buffer
 
@@ -309,6 +345,11 @@ func (e *Email) BuildBytes(ctx *context.Context, dkim bool) []byte {
 		}
 		h.SetAddressList("Cc", cc)
 	}
+	for _, key := range extraHeaders {
+		if v := e.Headers.Get(key); v != "" {
+			h.Set(key, v)
+		}
+	}
 
 	// Create a new mail writer
 	mw, err := mail.CreateWriter(&b, h)
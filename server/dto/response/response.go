@@ -6,10 +6,12 @@ import (
 )
 
 const (
-	NeedSetup   = 402
-	NeedLogin   = 403
-	ParamsError = 100
-	ServerError = 500
+	NeedSetup     = 402
+	NeedLogin     = 403
+	NoAuth        = 405
+	NeedTwoFactor = 406 // 密码正确，需要提供两步验证的验证码
+	ParamsError   = 100
+	ServerError   = 500
 )
 
 type Response struct {
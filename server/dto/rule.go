@@ -13,21 +13,46 @@ var (
 	FORWARD RuleType = 2
 	DELETE  RuleType = 3
 	MOVE    RuleType = 4
+	TAG     RuleType = 5  // 添加标签，参数为标签名称
+	STAR    RuleType = 6  // 星标
+	REPLY   RuleType = 7  // 自动回复，参数为回复内容模板
+	WEBHOOK RuleType = 8  // 调用webhook，参数为URL
+	SPAM    RuleType = 9  // 标记为垃圾邮件
+	STOP    RuleType = 10 // 不再执行后面的规则
 )
 
-type Rule struct {
-	Id     int      `json:"id"`
-	Name   string   `json:"name"`
-	Rules  []*Value `json:"rules"`
+// Action 规则的一个执行动作
+type Action struct {
 	Action RuleType `json:"action"`
 	Params string   `json:"params"`
-	Sort   int      `json:"sort"`
 }
 
+// Rule 规则，Action和Params是老版本的单个动作，和Actions中的第一个动作保持一致
+type Rule struct {
+	Id      int       `json:"id"`
+	Name    string    `json:"name"`
+	Rules   []*Value  `json:"rules"`
+	Action  RuleType  `json:"action"`
+	Params  string    `json:"params"`
+	Actions []*Action `json:"actions"`
+	Sort    int       `json:"sort"`
+}
+
+// 条件组的逻辑
+const (
+	LogicAll = "all" // 全部满足，默认
+	LogicAny = "any" // 任意一个满足
+)
+
+// Value 一个匹配条件，Rules不为空时是一个条件组
 type Value struct {
-	Field string `json:"field"`
-	Type  string `json:"type"`
-	Rule  string `json:"rule"`
+	Field  string   `json:"field"`
+	Type   string   `json:"type"`
+	Rule   string   `json:"rule"`
+	Header string   `json:"header,omitempty"` // Field为Header时的邮件头名称
+	Not    bool     `json:"not,omitempty"`    // 结果取反
+	Logic  string   `json:"logic,omitempty"`  // 条件组的逻辑，all或者any
+	Rules  []*Value `json:"rules,omitempty"`  // 条件组的子条件
 }
 
 func (p *Rule) Decode(data *models.Rule) *Rule {
@@ -37,18 +62,36 @@ func (p *Rule) Decode(data *models.Rule) *Rule {
 	p.Action = RuleType(data.Action)
 	p.Sort = data.Sort
 	p.Params = data.Params
+	if data.Actions != "" {
+		json.Unmarshal([]byte(data.Actions), &p.Actions)
+	}
+	p.normalize()
 	return p
 }
 
+// normalize 没有Actions时使用老版本的Action和Params
+func (p *Rule) normalize() {
+	if len(p.Actions) == 0 && p.Action > 0 {
+		p.Actions = []*Action{{Action: p.Action, Params: p.Params}}
+	}
+	if len(p.Actions) > 0 && p.Actions[0] != nil {
+		p.Action = p.Actions[0].Action
+		p.Params = p.Actions[0].Params
+	}
+}
+
 func (p *Rule) Encode() *models.Rule {
+	p.normalize()
 	v, _ := json.Marshal(p.Rules)
+	actions, _ := json.Marshal(p.Actions)
 	ret := &models.Rule{
-		Id:     p.Id,
-		Name:   p.Name,
-		Value:  string(v),
-		Action: int(p.Action),
-		Sort:   p.Sort,
-		Params: p.Params,
+		Id:      p.Id,
+		Name:    p.Name,
+		Value:   string(v),
+		Action:  int(p.Action),
+		Sort:    p.Sort,
+		Params:  p.Params,
+		Actions: string(actions),
 	}
 	return ret
 }
@@ -55,13 +55,45 @@ func HttpStart() {
 		mux.HandleFunc("/api/email/del", contextIterceptor(email.EmailDelete))
 		mux.HandleFunc("/api/email/read", contextIterceptor(email.MarkRead))
 		mux.HandleFunc("/api/email/detail", contextIterceptor(email.EmailDetail))
+		mux.HandleFunc("/api/email/source", contextIterceptor(email.EmailSource))
+		mux.HandleFunc("/api/email/download/", contextIterceptor(email.Download))
 		mux.HandleFunc("/api/email/move", contextIterceptor(email.Move))
 		mux.HandleFunc("/api/email/send", contextIterceptor(email.Send))
 		mux.HandleFunc("/api/settings/modify_password", contextIterceptor(controllers.ModifyPassword))
+		mux.HandleFunc("/api/settings/totp/status", contextIterceptor(controllers.TotpStatus))
+		mux.HandleFunc("/api/settings/totp/setup", contextIterceptor(controllers.TotpSetup))
+		mux.HandleFunc("/api/settings/totp/enable", contextIterceptor(controllers.TotpEnable))
+		mux.HandleFunc("/api/settings/totp/disable", contextIterceptor(controllers.TotpDisable))
+		mux.HandleFunc("/api/settings/totp/recovery_codes", contextIterceptor(controllers.RecoveryCodes))
+		mux.HandleFunc("/api/settings/app_password/list", contextIterceptor(controllers.AppPasswordList))
+		mux.HandleFunc("/api/settings/app_password/create", contextIterceptor(controllers.AppPasswordCreate))
+		mux.HandleFunc("/api/settings/app_password/del", contextIterceptor(controllers.AppPasswordDelete))
 		mux.HandleFunc("/api/rule/get", contextIterceptor(controllers.GetRule))
 		mux.HandleFunc("/api/rule/add", contextIterceptor(controllers.UpsertRule))
 		mux.HandleFunc("/api/rule/update", contextIterceptor(controllers.UpsertRule))
 		mux.HandleFunc("/api/rule/del", contextIterceptor(controllers.DelRule))
+		mux.HandleFunc("/api/rule/apply", contextIterceptor(controllers.ApplyRule))
+		mux.HandleFunc("/api/rule/apply/status", contextIterceptor(controllers.ApplyRuleStatus))
+		mux.HandleFunc("/api/user/list", contextIterceptor(controllers.UserList))
+		mux.HandleFunc("/api/user/create", contextIterceptor(controllers.UserCreate))
+		mux.HandleFunc("/api/user/update", contextIterceptor(controllers.UserUpdate))
+		mux.HandleFunc("/api/user/del", contextIterceptor(controllers.UserDelete))
+		mux.HandleFunc("/api/user/reset_password", contextIterceptor(controllers.UserResetPassword))
+		mux.HandleFunc("/api/user/auth", contextIterceptor(controllers.UserSetAuth))
+		mux.HandleFunc("/api/user/lockout/list", contextIterceptor(controllers.LockoutList))
+		mux.HandleFunc("/api/user/lockout/unlock", contextIterceptor(controllers.LockoutUnlock))
+		mux.HandleFunc("/api/dmarc/summary", contextIterceptor(controllers.DmarcSummary))
+		mux.HandleFunc("/api/dmarc/reports", contextIterceptor(controllers.DmarcReports))
+		mux.HandleFunc("/api/dmarc/detail", contextIterceptor(controllers.DmarcDetail))
+		mux.HandleFunc("/api/alias/list", contextIterceptor(controllers.AliasList))
+		mux.HandleFunc("/api/alias/set", contextIterceptor(controllers.AliasSet))
+		mux.HandleFunc("/api/alias/del", contextIterceptor(controllers.AliasDelete))
+		mux.HandleFunc("/api/sieve/list", contextIterceptor(controllers.SieveList))
+		mux.HandleFunc("/api/sieve/get", contextIterceptor(controllers.SieveGet))
+		mux.HandleFunc("/api/sieve/save", contextIterceptor(controllers.SieveSave))
+		mux.HandleFunc("/api/sieve/del", contextIterceptor(controllers.SieveDelete))
+		mux.HandleFunc("/api/sieve/activate", contextIterceptor(controllers.SieveActivate))
+		mux.HandleFunc("/api/sieve/check", contextIterceptor(controllers.SieveCheck))
 		mux.HandleFunc("/attachments/", contextIterceptor(controllers.GetAttachments))
 		mux.HandleFunc("/attachments/download/", contextIterceptor(controllers.Download))
 		log.Infof("HttpServer Start On Port :%d", HttpPort)
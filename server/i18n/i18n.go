@@ -15,6 +15,18 @@ var (
 		"ip_taps":               "这是你服务器IP，确保这个IP正确",
 		"invalid_email_address": "无效的邮箱地址！",
 		"deleted":               "垃圾箱",
+		"no_auth":               "没有权限",
+		"user_exist":            "账号已存在",
+		"user_not_exist":        "用户不存在",
+		"account_error":         "账号格式错误",
+		"password_empty":        "密码不能为空",
+		"cannot_modify_self":    "不能禁用、删除自己或者取消自己的管理员权限",
+		"from_not_allowed":      "没有使用该地址发信的权限",
+		"login_locked":          "登陆失败次数过多，请稍后再试",
+		"need_two_factor":       "请输入两步验证的验证码",
+		"code_error":            "验证码错误",
+		"totp_enabled":          "已经开启两步验证",
+		"totp_not_setup":        "没有开启两步验证",
 	}
 	en = map[string]string{
 		"all_email":             "All Email",
@@ -30,6 +42,18 @@ var (
 		"ip_taps":               "This is your server's IP, make sure it is correct.",
 		"invalid_email_address": "Invalid e-mail address!",
 		"deleted":               "Deleted",
+		"no_auth":               "Permission denied.",
+		"user_exist":            "Account already exists.",
+		"user_not_exist":        "User does not exist.",
+		"account_error":         "Invalid account.",
+		"password_empty":        "Password can not be empty.",
+		"cannot_modify_self":    "You can not disable, delete or demote yourself.",
+		"from_not_allowed":      "You are not allowed to send as this address.",
+		"login_locked":          "Too many failed login attempts, please try again later.",
+		"need_two_factor":       "Please enter your two-factor authentication code.",
+		"code_error":            "Incorrect verification code.",
+		"totp_enabled":          "Two-factor authentication is already enabled.",
+		"totp_not_setup":        "Two-factor authentication is not enabled.",
 	}
 )
 
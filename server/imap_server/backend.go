@@ -0,0 +1,88 @@
+package imap_server
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	log "github.com/sirupsen/logrus"
+	"pmail/services/auth"
+	"pmail/services/throttle"
+	"pmail/utils/context"
+	"pmail/utils/id"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 143与993两个端口各有一个backend，更新需要同时推送给两个端口上的连接
+var backends sync.Map
+
+type serverBackend struct {
+	updates chan backend.Update
+	done    chan struct{}
+}
+
+func newBackend() *serverBackend {
+	b := &serverBackend{
+		updates: make(chan backend.Update),
+		done:    make(chan struct{}),
+	}
+	backends.Store(b, true)
+	return b
+}
+
+func (b *serverBackend) stop() {
+	backends.Delete(b)
+	close(b.done)
+}
+
+// Login 登陆，账号可以带上@域名
+func (b *serverBackend) Login(connInfo *imap.ConnInfo, username, pwd string) (backend.User, error) {
+	ctx := &context.Context{}
+	ctx.SetValue(context.LogID, id.GenLogID())
+
+	infos := strings.Split(username, "@")
+	if len(infos) > 1 {
+		username = infos[0]
+	}
+	log.WithContext(ctx).Debugf("IMAP LOGIN, User:%s", username)
+
+	user, err := auth.Login(ctx, "imap", throttle.IP(connInfo.RemoteAddr.String()), username, pwd)
+	if err == auth.ErrLocked {
+		return nil, err
+	}
+	if err != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	ctx.UserID = user.ID
+	ctx.UserName = user.Name
+	ctx.UserAccount = user.Account
+
+	return &mailUser{ctx: ctx}, nil
+}
+
+func (b *serverBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+// notify 把更新推送给所有端口上的连接，并等待推送完成
+func notify(newUpdate func() backend.Update) {
+	var updates []backend.Update
+	backends.Range(func(key, value any) bool {
+		b := key.(*serverBackend)
+		u := newUpdate()
+		select {
+		case b.updates <- u:
+			updates = append(updates, u)
+		case <-b.done:
+		case <-time.After(5 * time.Second):
+		}
+		return true
+	})
+	for _, u := range updates {
+		select {
+		case <-u.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
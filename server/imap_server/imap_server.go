@@ -0,0 +1,98 @@
+package imap_server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"github.com/emersion/go-imap/server"
+	log "github.com/sirupsen/logrus"
+	"pmail/config"
+	"time"
+)
+
+var instance *server.Server
+var instanceTls *server.Server
+
+// 轮询新邮件的间隔，IDLE状态下的客户端依赖这个轮询收到新邮件通知
+const pollInterval = 10 * time.Second
+
+func newServer(addr string) *server.Server {
+	crt, err := tls.LoadX509KeyPair(config.Instance.SSLPublicKeyPath, config.Instance.SSLPrivateKeyPath)
+	if err != nil {
+		panic(err)
+	}
+	tlsConfig := &tls.Config{}
+	tlsConfig.Certificates = []tls.Certificate{crt}
+	tlsConfig.Time = time.Now
+	tlsConfig.Rand = rand.Reader
+
+	s := server.New(newBackend())
+	s.Addr = addr
+	s.TLSConfig = tlsConfig
+	s.AutoLogout = 30 * time.Minute
+	s.ErrorLog = log.StandardLogger()
+	return s
+}
+
+func StartWithTLS() {
+	instanceTls = newServer(":993")
+	// 993端口本身就是TLS连接
+	instanceTls.AllowInsecureAuth = true
+
+	go pollLoop(instanceTls)
+	log.Infof("IMAP With TLS Server Start On Port :993")
+	err := instanceTls.ListenAndServeTLS()
+	if err != nil {
+		log.Errorf("IMAP With TLS Server Error: %v", err)
+	}
+}
+
+func Start() {
+	instance = newServer(":143")
+	// 143端口必须先STARTTLS才允许登陆
+	instance.AllowInsecureAuth = false
+
+	go pollLoop(instance)
+	log.Infof("IMAP Server Start On Port :143")
+	err := instance.ListenAndServe()
+	if err != nil {
+		log.Errorf("IMAP Server Error: %v", err)
+	}
+}
+
+func Stop() {
+	if instance != nil {
+		instance.Backend.(*serverBackend).stop()
+		instance.Close()
+	}
+	if instanceTls != nil {
+		instanceTls.Backend.(*serverBackend).stop()
+		instanceTls.Close()
+	}
+}
+
+// pollLoop 定时检查每个连接当前选中的邮箱，把新邮件和被其他端删除的邮件推送给客户端
+func pollLoop(s *server.Server) {
+	bkd := s.Backend.(*serverBackend)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bkd.done:
+			return
+		case <-ticker.C:
+		}
+
+		var selected []*mailbox
+		// ForEachConn持有server的锁，推送更新时也需要这个锁，因此先收集再轮询
+		s.ForEachConn(func(conn server.Conn) {
+			if mbox, ok := conn.Context().Mailbox.(*mailbox); ok {
+				selected = append(selected, mbox)
+			}
+		})
+		for _, mbox := range selected {
+			if err := mbox.Poll(); err != nil {
+				log.WithContext(mbox.user.ctx).Errorf("IMAP Poll Error: %v", err)
+			}
+		}
+	}
+}
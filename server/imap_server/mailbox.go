@@ -0,0 +1,812 @@
+package imap_server
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"pmail/db"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"pmail/services/attachments"
+	"pmail/services/detail"
+	"pmail/services/search"
+	"pmail/utils/array"
+	"pmail/utils/errors"
+	"sync"
+	"time"
+)
+
+const (
+	sentName   = "Sent"
+	draftsName = "Drafts"
+	trashName  = "Trash"
+)
+
+const (
+	kindInbox = iota
+	kindSent
+	kindDrafts
+	kindTrash
+	kindGroup
+)
+
+// mailbox 一个IMAP邮箱对应web端的一个分组或者系统分组（收件箱、发件箱、草稿箱、垃圾箱）
+// 每个邮箱单独分配递增的UID，见uid.go，\Seen对应is_read，\Flagged对应is_star，status=3的邮件统一放在Trash中
+type mailbox struct {
+	user    *mailUser
+	name    string
+	kind    int
+	groupId int
+
+	lock sync.Mutex
+	// 当前会话中被标记为\Deleted的邮件，EXPUNGE时才真正删除
+	deleted map[uint32]bool
+	// 最近一次告知客户端的邮件列表，用于推送新邮件与删除通知
+	known []uint32
+
+	uidValidity uint32
+	uidNext     uint32
+}
+
+func newMailbox(u *mailUser, name string, kind int, groupId int) *mailbox {
+	return &mailbox{
+		user:    u,
+		name:    name,
+		kind:    kind,
+		groupId: groupId,
+		deleted: map[uint32]bool{},
+	}
+}
+
+type mailItem struct {
+	Id         uint32 // email表的id
+	Uid        uint32 `xorm:"-"`
+	IsRead     int8
+	IsStar     int8
+	Type       int8
+	CreateTime time.Time
+}
+
+func (m *mailbox) where() (string, []any) {
+	params := []any{m.user.ctx.UserID}
+	switch m.kind {
+	case kindInbox:
+		return "user_id=? and type=0 and status!=3 and group_id=0", params
+	case kindSent:
+		return "user_id=? and type=1 and status=1 and group_id=0", params
+	case kindDrafts:
+		return "user_id=? and type=1 and status=0 and group_id=0", params
+	case kindTrash:
+		return "user_id=? and status=3", params
+	default:
+		return "user_id=? and status!=3 and group_id=?", append(params, m.groupId)
+	}
+}
+
+func (m *mailbox) items() ([]*mailItem, error) {
+	var ret []*mailItem
+	where, params := m.where()
+	err := db.Instance.Table("email").Select("id,is_read,is_star,type,create_time").Where(where, params...).Asc("id").Find(&ret)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrap(err)
+	}
+	if err = m.assign(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: delimiter,
+		Name:      m.name,
+	}
+	switch m.kind {
+	case kindSent:
+		info.Attributes = []string{imap.SentAttr}
+	case kindDrafts:
+		info.Attributes = []string{imap.DraftsAttr}
+	case kindTrash:
+		info.Attributes = []string{imap.TrashAttr}
+	}
+	return info, nil
+}
+
+func (m *mailbox) flags(item *mailItem) []string {
+	var ret []string
+	if item.IsRead == 1 {
+		ret = append(ret, imap.SeenFlag)
+	}
+	if item.IsStar == 1 {
+		ret = append(ret, imap.FlaggedFlag)
+	}
+	if m.deleted[item.Id] {
+		ret = append(ret, imap.DeletedFlag)
+	}
+	return ret
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list, err := m.items()
+	if err != nil {
+		return nil, err
+	}
+	m.remember(list)
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+
+	var unseen uint32
+	for i, item := range list {
+		if item.IsRead == 0 {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(list))
+		case imap.StatusUidNext:
+			status.UidNext = m.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = m.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+
+	return status, nil
+}
+
+func (m *mailbox) remember(list []*mailItem) {
+	m.known = []uint32{}
+	for _, item := range list {
+		m.known = append(m.known, item.Id)
+	}
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+// selected 按照序号或者UID筛选邮件，返回的序号从1开始
+func selected(list []*mailItem, uid bool, seqSet *imap.SeqSet) map[uint32]*mailItem {
+	ret := map[uint32]*mailItem{}
+	for i, item := range list {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = item.Uid
+		}
+		if seqSet.Contains(id) {
+			ret[seqNum] = item
+		}
+	}
+	return ret
+}
+
+// body 生成邮件原文
+func (m *mailbox) body(id uint32) ([]byte, error) {
+	var email models.Email
+	exist, err := db.Instance.ID(id).Get(&email)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if !exist {
+		return nil, errors.New("email not found")
+	}
+	return detail.Source(m.user.ctx, &email), nil
+}
+
+func (m *mailbox) fetch(seqNum uint32, item *mailItem, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+
+	var content []byte
+	getContent := func() ([]byte, error) {
+		if content == nil {
+			var err error
+			content, err = m.body(item.Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return content, nil
+	}
+
+	for _, fetchItem := range items {
+		switch fetchItem {
+		case imap.FetchFlags:
+			fetched.Flags = m.flags(item)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = item.CreateTime
+		case imap.FetchUid:
+			fetched.Uid = item.Uid
+		case imap.FetchRFC822Size:
+			c, err := getContent()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Size = uint32(len(c))
+		case imap.FetchEnvelope:
+			c, err := getContent()
+			if err != nil {
+				return nil, err
+			}
+			hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(c)))
+			if err != nil {
+				return nil, errors.Wrap(err)
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			c, err := getContent()
+			if err != nil {
+				return nil, err
+			}
+			body := bufio.NewReader(bytes.NewReader(c))
+			hdr, err := textproto.ReadHeader(body)
+			if err != nil {
+				return nil, errors.Wrap(err)
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, fetchItem == imap.FetchBodyStructure)
+		default:
+			section, err := imap.ParseBodySectionName(fetchItem)
+			if err != nil {
+				break
+			}
+			c, err := getContent()
+			if err != nil {
+				return nil, err
+			}
+			body := bufio.NewReader(bytes.NewReader(c))
+			hdr, err := textproto.ReadHeader(body)
+			if err != nil {
+				return nil, errors.Wrap(err)
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+
+			// 读取正文视为已读，BODY.PEEK除外
+			if !section.Peek && item.IsRead == 0 {
+				item.IsRead = 1
+				_, err = db.Instance.Exec(db.WithContext(m.user.ctx, "update email set is_read=1 where id =?"), item.Id)
+				if err != nil {
+					log.WithContext(m.user.ctx).Errorf("SQL Error: %+v", err)
+				}
+				fetched.Flags = m.flags(item)
+			}
+		}
+	}
+
+	return fetched, nil
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list, err := m.items()
+	if err != nil {
+		return err
+	}
+
+	for i, item := range list {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = item.Uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		msg, err := m.fetch(seqNum, item, items)
+		if err != nil {
+			log.WithContext(m.user.ctx).Errorf("IMAP Fetch Error: %+v", err)
+			continue
+		}
+		ch <- msg
+	}
+	return nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list, err := m.items()
+	if err != nil {
+		return nil, err
+	}
+
+	// 只按照标记、日期、序号搜索时不需要读取邮件原文
+	withBody := needBody(criteria)
+	empty, _ := message.New(message.Header{}, bytes.NewReader(nil))
+
+	var ret []uint32
+	for i, item := range list {
+		seqNum := uint32(i + 1)
+		e := empty
+		if withBody {
+			c, err := m.body(item.Id)
+			if err != nil {
+				log.WithContext(m.user.ctx).Errorf("IMAP Search Error: %+v", err)
+				continue
+			}
+			e, err = message.Read(bytes.NewReader(c))
+			if err != nil && !message.IsUnknownCharset(err) {
+				continue
+			}
+		}
+		ok, err := backendutil.Match(e, seqNum, item.Uid, item.CreateTime, m.flags(item), criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ret = append(ret, item.Uid)
+		} else {
+			ret = append(ret, seqNum)
+		}
+	}
+	return ret, nil
+}
+
+// needBody 搜索条件是否需要邮件头或者正文
+func needBody(c *imap.SearchCriteria) bool {
+	if !c.SentBefore.IsZero() || !c.SentSince.IsZero() || len(c.Header) > 0 || len(c.Body) > 0 ||
+		len(c.Text) > 0 || c.Larger > 0 || c.Smaller > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if needBody(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if needBody(or[0]) || needBody(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateMessage APPEND命令
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	email := parsemail.NewEmailFromReader(nil, bytes.NewReader(content))
+
+	// 通过SMTP发出的邮件在投递时已经入库，客户端再APPEND到发件箱时不重复保存
+	if m.kind == kindSent && m.sentExists(email.Headers.Get("Message-Id")) {
+		return nil
+	}
+	if email.From == nil {
+		email.From = &parsemail.User{}
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	modelEmail := models.Email{
+		Subject:     email.Subject,
+		ReplyTo:     json2string(email.ReplyTo),
+		FromName:    email.From.Name,
+		FromAddress: email.From.EmailAddress,
+		To:          json2string(email.To),
+		Bcc:         json2string(email.Bcc),
+		Cc:          json2string(email.Cc),
+		Text:        sql.NullString{String: string(email.Text), Valid: true},
+		Html:        sql.NullString{String: string(email.HTML), Valid: true},
+		Sender:      json2string(email.Sender),
+		Attachments: attachments.Meta(email.Attachments),
+		SendDate:    date,
+		UserId:      m.user.ctx.UserID,
+		CreateTime:  time.Now(),
+	}
+	if array.InArray(imap.SeenFlag, flags) {
+		modelEmail.IsRead = 1
+	}
+	if array.InArray(imap.FlaggedFlag, flags) {
+		modelEmail.IsStar = 1
+	}
+	switch m.kind {
+	case kindSent:
+		modelEmail.Type = 1
+		modelEmail.Status = 1
+		modelEmail.SendUserID = m.user.ctx.UserID
+	case kindDrafts:
+		modelEmail.Type = 1
+		modelEmail.SendUserID = m.user.ctx.UserID
+	case kindTrash:
+		modelEmail.Status = 3
+	case kindGroup:
+		modelEmail.GroupId = m.groupId
+	}
+
+	_, err = db.Instance.Insert(&modelEmail)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	err = attachments.Save(m.user.ctx, modelEmail.Id, email.Attachments)
+	if err != nil {
+		return err
+	}
+	detail.SaveSource(m.user.ctx, modelEmail.Id, content)
+	search.Index(m.user.ctx, modelEmail.Id)
+	return nil
+}
+
+// 检查APPEND到发件箱的邮件是否已经发送过时，最多检查的最近发送邮件数量
+const sentCheckLimit = 50
+
+// sentExists 最近一天发出的邮件中是否有相同Message-Id的邮件
+func (m *mailbox) sentExists(messageId string) bool {
+	if messageId == "" {
+		return false
+	}
+	var ids []int
+	err := db.Instance.Table("email").Cols("id").Where("user_id=? and type=1 and create_time>?", m.user.ctx.UserID, time.Now().Add(-24*time.Hour)).
+		Desc("id").Limit(sentCheckLimit).Find(&ids)
+	if err != nil || len(ids) == 0 {
+		return false
+	}
+	for _, id := range ids {
+		source := detail.Stored(m.user.ctx, id)
+		if source == nil {
+			continue
+		}
+		hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(source)))
+		if err == nil && hdr.Get("Message-Id") == messageId {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.lock.Lock()
+	list, err := m.items()
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+
+	var changed []*imap.Message
+	for seqNum, item := range selected(list, uid, seqSet) {
+		newFlags := backendutil.UpdateFlags(m.flags(item), op, flags)
+
+		isRead := int8(0)
+		if array.InArray(imap.SeenFlag, newFlags) {
+			isRead = 1
+		}
+		if isRead != item.IsRead {
+			_, err = db.Instance.Exec(db.WithContext(m.user.ctx, "update email set is_read=? where id =?"), isRead, item.Id)
+			if err != nil {
+				m.lock.Unlock()
+				return errors.Wrap(err)
+			}
+			item.IsRead = isRead
+		}
+
+		isStar := int8(0)
+		if array.InArray(imap.FlaggedFlag, newFlags) {
+			isStar = 1
+		}
+		if isStar != item.IsStar {
+			_, err = db.Instance.Exec(db.WithContext(m.user.ctx, "update email set is_star=? where id =?"), isStar, item.Id)
+			if err != nil {
+				m.lock.Unlock()
+				return errors.Wrap(err)
+			}
+			item.IsStar = isStar
+		}
+
+		if array.InArray(imap.DeletedFlag, newFlags) {
+			m.deleted[item.Id] = true
+		} else {
+			delete(m.deleted, item.Id)
+		}
+
+		msg := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+		msg.Flags = m.flags(item)
+		msg.Uid = item.Uid
+		changed = append(changed, msg)
+	}
+	m.lock.Unlock()
+
+	for _, msg := range changed {
+		msg := msg
+		notify(func() backend.Update {
+			return &backend.MessageUpdate{
+				Update:  backend.NewUpdate(m.user.Username(), m.name),
+				Message: msg,
+			}
+		})
+	}
+	return nil
+}
+
+// target 把邮件放入目标邮箱时需要修改的字段
+func (m *mailbox) target(email *models.Email) error {
+	restoreStatus := func() {
+		if email.Status == 3 {
+			email.Status = 0
+			if email.Type == 1 {
+				email.Status = 1
+			}
+		}
+	}
+
+	switch m.kind {
+	case kindInbox:
+		if email.Type != 0 {
+			return errors.New("only received mail can be put into INBOX")
+		}
+		email.GroupId = 0
+		restoreStatus()
+	case kindSent, kindDrafts:
+		if email.Type != 1 {
+			return errors.New("only sent mail can be put into this mailbox")
+		}
+		email.GroupId = 0
+		email.Status = 1
+		if m.kind == kindDrafts {
+			email.Status = 0
+		}
+	case kindTrash:
+		email.Status = 3
+	case kindGroup:
+		email.GroupId = m.groupId
+		restoreStatus()
+	}
+	return nil
+}
+
+func (m *mailbox) destination(name string) (*mailbox, error) {
+	dest, err := m.user.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return dest.(*mailbox), nil
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	dest, err := m.destination(destName)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list, err := m.items()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range selected(list, uid, seqSet) {
+		var email models.Email
+		exist, err := db.Instance.ID(item.Id).Get(&email)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		if !exist {
+			continue
+		}
+		if err = dest.target(&email); err != nil {
+			return err
+		}
+		email.Id = 0
+		email.CreateTime = time.Now()
+		_, err = db.Instance.Insert(&email)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		attachments.Copy(m.user.ctx, int(item.Id), email.Id)
+		detail.CopySource(m.user.ctx, int(item.Id), email.Id)
+		search.Index(m.user.ctx, email.Id)
+	}
+	return nil
+}
+
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	dest, err := m.destination(destName)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	list, err := m.items()
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+
+	var moved []uint32
+	for seqNum, item := range selected(list, uid, seqSet) {
+		var email models.Email
+		exist, err := db.Instance.ID(item.Id).Get(&email)
+		if err != nil {
+			m.lock.Unlock()
+			return errors.Wrap(err)
+		}
+		if !exist {
+			continue
+		}
+		if err = dest.target(&email); err != nil {
+			m.lock.Unlock()
+			return err
+		}
+		_, err = db.Instance.Exec(db.WithContext(m.user.ctx, "update email set group_id=?, status=? where id=?"), email.GroupId, email.Status, email.Id)
+		if err != nil {
+			m.lock.Unlock()
+			return errors.Wrap(err)
+		}
+		delete(m.deleted, item.Id)
+		moved = append(moved, seqNum)
+	}
+	m.lock.Unlock()
+
+	return m.expunged(moved)
+}
+
+// Expunge 普通邮箱中标记删除的邮件移入垃圾箱，垃圾箱中标记删除的邮件彻底删除
+func (m *mailbox) Expunge() error {
+	m.lock.Lock()
+	list, err := m.items()
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+
+	var ids []uint32
+	var seqNums []uint32
+	for i, item := range list {
+		if m.deleted[item.Id] {
+			ids = append(ids, item.Id)
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+	m.deleted = map[uint32]bool{}
+
+	if len(ids) > 0 {
+		var sqlStr string
+		if m.kind == kindTrash {
+			sqlStr = fmt.Sprintf("delete from email where id in (%s)", array.Join(ids, ","))
+		} else {
+			sqlStr = fmt.Sprintf("update email set status=3 where id in (%s)", array.Join(ids, ","))
+		}
+		_, err = db.Instance.Exec(db.WithContext(m.user.ctx, sqlStr))
+		if err != nil {
+			m.lock.Unlock()
+			return errors.Wrap(err)
+		}
+		if m.kind == kindTrash {
+			var removed []int
+			for _, id := range ids {
+				removed = append(removed, int(id))
+			}
+			search.Remove(m.user.ctx, removed...)
+			detail.RemoveSource(m.user.ctx, removed...)
+			attachments.Remove(m.user.ctx, removed...)
+		}
+	}
+	m.lock.Unlock()
+
+	return m.expunged(seqNums)
+}
+
+// expunged 通知客户端邮件已被移除，序号从大到小推送，避免序号错位
+func (m *mailbox) expunged(seqNums []uint32) error {
+	seqNums = array.Unique(seqNums)
+	for i := 0; i < len(seqNums); i++ {
+		for j := i + 1; j < len(seqNums); j++ {
+			if seqNums[j] > seqNums[i] {
+				seqNums[i], seqNums[j] = seqNums[j], seqNums[i]
+			}
+		}
+	}
+
+	for _, seqNum := range seqNums {
+		seqNum := seqNum
+		notify(func() backend.Update {
+			return &backend.ExpungeUpdate{
+				Update: backend.NewUpdate(m.user.Username(), m.name),
+				SeqNum: seqNum,
+			}
+		})
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	list, err := m.items()
+	if err != nil {
+		return err
+	}
+	m.remember(list)
+	return nil
+}
+
+// Poll 检查邮箱变化，推送被删除的邮件和新邮件数量
+func (m *mailbox) Poll() error {
+	m.lock.Lock()
+	list, err := m.items()
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+
+	current := map[uint32]bool{}
+	for _, item := range list {
+		current[item.Id] = true
+	}
+
+	var seqNums []uint32
+	for i, id := range m.known {
+		if !current[id] {
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+	existsChanged := len(list) != len(m.known)-len(seqNums)
+	m.lock.Unlock()
+
+	if len(seqNums) > 0 {
+		if err := m.expunged(seqNums); err != nil {
+			return err
+		}
+	}
+
+	if !existsChanged {
+		return nil
+	}
+
+	m.lock.Lock()
+	m.remember(list)
+	m.lock.Unlock()
+
+	status := imap.NewMailboxStatus(m.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(list))
+	notify(func() backend.Update {
+		return &backend.MailboxUpdate{
+			Update:        backend.NewUpdate(m.user.Username(), m.name),
+			MailboxStatus: status,
+		}
+	})
+	return nil
+}
+
+func json2string(d any) string {
+	by, _ := json.Marshal(d)
+	return string(by)
+}
@@ -0,0 +1,125 @@
+package imap_server
+
+import (
+	"github.com/emersion/go-imap"
+	"pmail/models"
+	"pmail/utils/context"
+	"testing"
+)
+
+func TestMailbox_flags(t *testing.T) {
+	m := newMailbox(&mailUser{ctx: &context.Context{}}, imap.InboxName, kindInbox, 0)
+	m.deleted[2] = true
+
+	flags := m.flags(&mailItem{Id: 1, IsRead: 1})
+	if len(flags) != 1 || flags[0] != imap.SeenFlag {
+		t.Errorf("flags() = %v, want [\\Seen]", flags)
+	}
+
+	flags = m.flags(&mailItem{Id: 2})
+	if len(flags) != 1 || flags[0] != imap.DeletedFlag {
+		t.Errorf("flags() = %v, want [\\Deleted]", flags)
+	}
+
+	flags = m.flags(&mailItem{Id: 3, IsRead: 1, IsStar: 1})
+	if len(flags) != 2 || flags[1] != imap.FlaggedFlag {
+		t.Errorf("flags() = %v, want [\\Seen \\Flagged]", flags)
+	}
+}
+
+func TestMailbox_target(t *testing.T) {
+	u := &mailUser{ctx: &context.Context{}}
+	tests := []struct {
+		name       string
+		mbox       *mailbox
+		email      models.Email
+		wantErr    bool
+		wantStatus int8
+		wantGroup  int
+	}{
+		{"trash", newMailbox(u, trashName, kindTrash, 0), models.Email{Type: 0, Status: 0}, false, 3, 0},
+		{"restore inbox", newMailbox(u, imap.InboxName, kindInbox, 0), models.Email{Type: 0, Status: 3, GroupId: 5}, false, 0, 0},
+		{"sent to inbox", newMailbox(u, imap.InboxName, kindInbox, 0), models.Email{Type: 1, Status: 1}, true, 1, 0},
+		{"restore group", newMailbox(u, "work", kindGroup, 7), models.Email{Type: 1, Status: 3}, false, 1, 7},
+		{"drafts", newMailbox(u, draftsName, kindDrafts, 0), models.Email{Type: 1, Status: 1}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.mbox.target(&tt.email)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("target() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.email.Status != tt.wantStatus || tt.email.GroupId != tt.wantGroup {
+				t.Errorf("target() status = %d group = %d, want %d %d", tt.email.Status, tt.email.GroupId, tt.wantStatus, tt.wantGroup)
+			}
+		})
+	}
+}
+
+func TestSelected(t *testing.T) {
+	list := []*mailItem{{Id: 1, Uid: 10}, {Id: 2, Uid: 20}, {Id: 3, Uid: 30}}
+
+	seqSet, _ := imap.ParseSeqSet("2:*")
+	ret := selected(list, false, seqSet)
+	if len(ret) != 2 || ret[2].Uid != 20 || ret[3].Uid != 30 {
+		t.Errorf("selected() by seq = %v", ret)
+	}
+
+	seqSet, _ = imap.ParseSeqSet("10,30")
+	ret = selected(list, true, seqSet)
+	if len(ret) != 2 || ret[1].Uid != 10 || ret[3].Uid != 30 {
+		t.Errorf("selected() by uid = %v", ret)
+	}
+}
+
+func TestAssignUids(t *testing.T) {
+	// 邮件5被移出，邮件3移入，邮件3的id比已有邮件小，也要分配比UIDNEXT大的UID
+	exists := []*models.ImapUid{{Id: 1, EmailId: 4, Uid: 1}, {Id: 2, EmailId: 5, Uid: 2}, {Id: 3, EmailId: 6, Uid: 3}}
+	list := []*mailItem{{Id: 3}, {Id: 4}, {Id: 6}, {Id: 7}}
+	added, removed, next := assignUids(list, exists, 9, 4)
+
+	if next != 6 || len(added) != 2 || added[0].EmailId != 3 || added[0].Uid != 4 || added[1].MailboxId != 9 {
+		t.Errorf("assignUids() added = %+v next = %d", added, next)
+	}
+	if len(removed) != 1 || removed[0] != 2 {
+		t.Errorf("assignUids() removed = %v", removed)
+	}
+	var got []uint32
+	for _, item := range list {
+		got = append(got, item.Id, item.Uid)
+	}
+	want := []uint32{4, 1, 6, 3, 3, 4, 7, 5}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("assignUids() list = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestNeedBody(t *testing.T) {
+	c := &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}
+	if needBody(c) {
+		t.Errorf("needBody(flags) = true")
+	}
+	c.Not = []*imap.SearchCriteria{{Body: []string{"x"}}}
+	if !needBody(c) {
+		t.Errorf("needBody(not body) = false")
+	}
+}
+
+func TestInSubtree(t *testing.T) {
+	for _, tt := range []struct {
+		path, root string
+		want       bool
+	}{
+		{"A", "A", true},
+		{"A/B", "A", true},
+		{"A/B/C", "A", true},
+		{"AB", "A", false},
+		{"B/A", "A", false},
+	} {
+		if got := inSubtree(tt.path, tt.root); got != tt.want {
+			t.Errorf("inSubtree(%s, %s) = %v", tt.path, tt.root, got)
+		}
+	}
+}
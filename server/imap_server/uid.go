@@ -0,0 +1,130 @@
+package imap_server
+
+import (
+	"fmt"
+	"github.com/emersion/go-imap"
+	"pmail/db"
+	"pmail/models"
+	"pmail/utils/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 分配UID时的全局锁，同一个邮箱可能同时被多个会话打开
+var uidLock sync.Mutex
+
+// 每次批量写入的UID记录数量
+const uidBatch = 100
+
+// key 邮箱在imap_mailbox表中的标识，分组删除后重建id会变化，对应一个新的邮箱
+func (m *mailbox) key() string {
+	switch m.kind {
+	case kindInbox:
+		return imap.InboxName
+	case kindSent:
+		return sentName
+	case kindDrafts:
+		return draftsName
+	case kindTrash:
+		return trashName
+	default:
+		return fmt.Sprintf("group:%d", m.groupId)
+	}
+}
+
+// state 获取邮箱的UID状态，第一次打开时创建，UIDVALIDITY使用创建时间
+func (m *mailbox) state() (*models.ImapMailbox, error) {
+	var ret models.ImapMailbox
+	exist, err := db.Instance.Where("user_id=? and name=?", m.user.ctx.UserID, m.key()).Get(&ret)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if exist {
+		return &ret, nil
+	}
+	ret = models.ImapMailbox{
+		UserId:      m.user.ctx.UserID,
+		Name:        m.key(),
+		UidValidity: uint32(time.Now().Unix()),
+		UidNext:     1,
+	}
+	_, err = db.Instance.Insert(&ret)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return &ret, nil
+}
+
+// assign 给邮箱中的邮件分配UID，UID在邮箱内递增，移入的邮件总是分配新的UID
+// 完成后list按照UID排序
+func (m *mailbox) assign(list []*mailItem) error {
+	uidLock.Lock()
+	defer uidLock.Unlock()
+
+	state, err := m.state()
+	if err != nil {
+		return err
+	}
+	var exists []*models.ImapUid
+	err = db.Instance.Where("mailbox_id=?", state.Id).Find(&exists)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	added, removed, next := assignUids(list, exists, state.Id, state.UidNext)
+	for i := 0; i < len(added); i += uidBatch {
+		end := min(i+uidBatch, len(added))
+		if _, err = db.Instance.Insert(added[i:end]); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	for i := 0; i < len(removed); i += uidBatch {
+		end := min(i+uidBatch, len(removed))
+		if _, err = db.Instance.In("id", removed[i:end]).Delete(&models.ImapUid{}); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	if next != state.UidNext {
+		_, err = db.Instance.Exec(db.WithContext(m.user.ctx, "update imap_mailbox set uid_next=? where id=?"), next, state.Id)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	m.uidValidity = state.UidValidity
+	m.uidNext = next
+	return nil
+}
+
+// assignUids 返回需要新增的UID记录、已经不在邮箱中的记录id以及新的UIDNEXT
+func assignUids(list []*mailItem, exists []*models.ImapUid, mailboxId int, next uint32) ([]*models.ImapUid, []int, uint32) {
+	uids := map[int]*models.ImapUid{}
+	for _, u := range exists {
+		uids[u.EmailId] = u
+	}
+
+	var added []*models.ImapUid
+	current := map[int]bool{}
+	for _, item := range list {
+		current[int(item.Id)] = true
+		if u, ok := uids[int(item.Id)]; ok {
+			item.Uid = u.Uid
+			continue
+		}
+		item.Uid = next
+		next++
+		added = append(added, &models.ImapUid{MailboxId: mailboxId, EmailId: int(item.Id), Uid: item.Uid})
+	}
+
+	var removed []int
+	for _, u := range exists {
+		if !current[u.EmailId] {
+			removed = append(removed, u.Id)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Uid < list[j].Uid
+	})
+	return added, removed, next
+}
@@ -0,0 +1,196 @@
+package imap_server
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"pmail/db"
+	"pmail/models"
+	"pmail/services/group"
+	"pmail/utils/context"
+	"pmail/utils/errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const delimiter = "/"
+
+type mailUser struct {
+	ctx *context.Context
+}
+
+func (u *mailUser) Username() string {
+	return u.ctx.UserAccount
+}
+
+// groupPaths 返回当前用户的全部分组，key是分组的完整路径，比如 "工作/项目"
+func (u *mailUser) groupPaths() map[string]*models.Group {
+	groups := group.GetGroupList(u.ctx)
+	byId := map[int]*models.Group{}
+	for _, g := range groups {
+		byId[g.ID] = g
+	}
+
+	ret := map[string]*models.Group{}
+	for _, g := range groups {
+		path := g.Name
+		parent, exist := byId[g.ParentId]
+		// 防止脏数据导致的死循环
+		for depth := 0; exist && depth < len(groups); depth++ {
+			path = parent.Name + delimiter + path
+			parent, exist = byId[parent.ParentId]
+		}
+		ret[path] = g
+	}
+	return ret
+}
+
+func (u *mailUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	ret := []backend.Mailbox{
+		newMailbox(u, imap.InboxName, kindInbox, 0),
+		newMailbox(u, sentName, kindSent, 0),
+		newMailbox(u, draftsName, kindDrafts, 0),
+		newMailbox(u, trashName, kindTrash, 0),
+	}
+	for path, g := range u.groupPaths() {
+		ret = append(ret, newMailbox(u, path, kindGroup, g.ID))
+	}
+	return ret, nil
+}
+
+func (u *mailUser) GetMailbox(name string) (backend.Mailbox, error) {
+	switch {
+	case strings.EqualFold(name, imap.InboxName):
+		return newMailbox(u, imap.InboxName, kindInbox, 0), nil
+	case name == sentName:
+		return newMailbox(u, sentName, kindSent, 0), nil
+	case name == draftsName:
+		return newMailbox(u, draftsName, kindDrafts, 0), nil
+	case name == trashName:
+		return newMailbox(u, trashName, kindTrash, 0), nil
+	}
+
+	g, exist := u.groupPaths()[name]
+	if !exist {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return newMailbox(u, name, kindGroup, g.ID), nil
+}
+
+func isReservedName(name string) bool {
+	return strings.EqualFold(name, imap.InboxName) || name == sentName || name == draftsName || name == trashName
+}
+
+// ensureGroup 按路径逐级查找分组，不存在的上级分组会自动创建
+func (u *mailUser) ensureGroup(path string) (int, bool, error) {
+	paths := u.groupPaths()
+	if g, exist := paths[path]; exist {
+		return g.ID, false, nil
+	}
+
+	parentId := 0
+	current := ""
+	for _, name := range strings.Split(path, delimiter) {
+		if name == "" {
+			return 0, false, errors.New("mailbox name error")
+		}
+		// 分组名称字段长度为10
+		if utf8.RuneCountInString(name) > 10 {
+			return 0, false, errors.New("mailbox name too long")
+		}
+		if current == "" {
+			current = name
+		} else {
+			current = current + delimiter + name
+		}
+
+		if g, exist := paths[current]; exist {
+			parentId = g.ID
+			continue
+		}
+
+		res, err := db.Instance.Exec(db.WithContext(u.ctx, "insert into `group` (name,parent_id,user_id) values (?,?,?)"), name, parentId, u.ctx.UserID)
+		if err != nil {
+			return 0, false, errors.Wrap(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, false, errors.Wrap(err)
+		}
+		parentId = int(id)
+	}
+	return parentId, true, nil
+}
+
+func (u *mailUser) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, delimiter)
+	if isReservedName(name) {
+		return backend.ErrMailboxAlreadyExists
+	}
+	_, created, err := u.ensureGroup(name)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return backend.ErrMailboxAlreadyExists
+	}
+	return nil
+}
+
+func (u *mailUser) DeleteMailbox(name string) error {
+	if isReservedName(name) {
+		return errors.New("can not delete system mailbox")
+	}
+	g, exist := u.groupPaths()[name]
+	if !exist {
+		return backend.ErrNoSuchMailbox
+	}
+	_, err := group.DelGroup(u.ctx, g.ID)
+	return err
+}
+
+func (u *mailUser) RenameMailbox(existingName, newName string) error {
+	if isReservedName(existingName) || isReservedName(newName) {
+		return errors.New("can not rename system mailbox")
+	}
+	paths := u.groupPaths()
+	g, exist := paths[existingName]
+	if !exist {
+		return backend.ErrNoSuchMailbox
+	}
+	if _, exist := paths[newName]; exist {
+		return backend.ErrMailboxAlreadyExists
+	}
+	// 不能移动到自己或者自己的子文件夹下，否则parent_id会形成循环
+	if inSubtree(newName, existingName) {
+		return errors.New("can not move mailbox into itself")
+	}
+
+	parentId := 0
+	name := newName
+	if idx := strings.LastIndex(newName, delimiter); idx >= 0 {
+		var err error
+		parentId, _, err = u.ensureGroup(newName[:idx])
+		if err != nil {
+			return err
+		}
+		name = newName[idx+1:]
+	}
+	if name == "" || utf8.RuneCountInString(name) > 10 {
+		return errors.New("mailbox name error")
+	}
+
+	_, err := db.Instance.Exec(db.WithContext(u.ctx, "update `group` set name=?, parent_id=? where id=? and user_id=?"), name, parentId, g.ID, u.ctx.UserID)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// inSubtree path是否是root或者root下的子文件夹
+func inSubtree(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+delimiter)
+}
+
+func (u *mailUser) Logout() error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package managesieve_server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"pmail/config"
+	"sync"
+	"time"
+)
+
+// ManageSieve端口，RFC 5804
+const port = 4190
+
+// 连接空闲超时时间
+const idleTimeout = 5 * time.Minute
+
+var instance *server
+
+type server struct {
+	tlsConfig *tls.Config
+	listener  net.Listener
+	lock      sync.Mutex
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+func Start() {
+	crt, err := tls.LoadX509KeyPair(config.Instance.SSLPublicKeyPath, config.Instance.SSLPrivateKeyPath)
+	if err != nil {
+		panic(err)
+	}
+	tlsConfig := &tls.Config{}
+	tlsConfig.Certificates = []tls.Certificate{crt}
+	tlsConfig.Time = time.Now
+	tlsConfig.Rand = rand.Reader
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		panic(err)
+	}
+	instance = newServer(ln, tlsConfig)
+	log.Infof("ManageSieve Server Start On Port :%d", port)
+	instance.serve()
+}
+
+func Stop() {
+	if instance != nil {
+		instance.close()
+	}
+}
+
+func newServer(ln net.Listener, tlsConfig *tls.Config) *server {
+	return &server{
+		tlsConfig: tlsConfig,
+		listener:  ln,
+		conns:     map[net.Conn]bool{},
+	}
+}
+
+func (s *server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return
+			}
+			log.Errorf("ManageSieve Accept Error:%v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !s.track(conn, true) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.track(conn, false)
+			newSession(conn, s.tlsConfig).serve()
+		}()
+	}
+}
+
+// track 记录当前的连接，停止服务时一起关闭
+func (s *server) track(conn net.Conn, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *server) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
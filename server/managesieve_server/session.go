@@ -0,0 +1,537 @@
+package managesieve_server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"pmail/models"
+	"pmail/services/auth"
+	"pmail/services/sieve"
+	"pmail/services/throttle"
+	"pmail/utils/context"
+	"pmail/utils/id"
+	lang "pmail/utils/sieve"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 引号字符串和命令名称的最大长度
+const maxLine = 8192
+
+// 字面量字符串的最大长度，超过脚本大小限制的部分由PUTSCRIPT返回QUOTA/MAXSIZE
+const maxLiteral = 1 << 20
+
+// 一条命令最多的参数数量，包括命令名称
+const maxArgs = 8
+
+// 一条命令全部参数的最大长度，超过时断开连接
+const maxCommand = maxLiteral + maxLine
+
+// 一个连接最多允许的认证失败次数
+const maxAuthFails = 3
+
+var errSyntax = errors.New("syntax error")
+
+var errTooLarge = errors.New("command too large")
+
+// login 校验账号密码，测试时可以替换
+var login = func(ctx *context.Context, ip, account, pwd string) (*models.User, error) {
+	return auth.Login(ctx, "managesieve", ip, account, pwd)
+}
+
+type session struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	tlsConfig *tls.Config
+	ctx       *context.Context
+	ip        string
+	tls       bool
+	authed    bool
+	fails     int
+}
+
+func newSession(conn net.Conn, tlsConfig *tls.Config) *session {
+	ctx := &context.Context{}
+	ctx.SetValue(context.LogID, id.GenLogID())
+	s := &session{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		w:         bufio.NewWriter(conn),
+		tlsConfig: tlsConfig,
+		ctx:       ctx,
+		ip:        throttle.IP(conn.RemoteAddr().String()),
+	}
+	_, s.tls = conn.(*tls.Conn)
+	return s
+}
+
+func (s *session) serve() {
+	defer s.conn.Close()
+	if throttle.IsBanned(s.ip) {
+		log.WithContext(s.ctx).Infof("ManageSieve Connection Banned %s", s.ip)
+		return
+	}
+
+	s.capability()
+	for {
+		if s.w.Flush() != nil {
+			return
+		}
+		s.conn.SetDeadline(time.Now().Add(idleTimeout))
+		args, err := s.readCommand()
+		if err == errSyntax {
+			s.no("", "Syntax error")
+			continue
+		}
+		if err == errTooLarge {
+			// 剩余的内容无法可靠地跳过，直接断开连接
+			s.w.WriteString("BYE \"Command too large\"\r\n")
+			s.w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.WithContext(s.ctx).Debugf("ManageSieve Read Error:%v", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			s.no("", "Empty command")
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		log.WithContext(s.ctx).Debugf("ManageSieve CMD: %s", cmd)
+		if !s.handle(cmd, args[1:]) {
+			s.w.Flush()
+			return
+		}
+	}
+}
+
+// handle 执行命令，返回false时关闭连接
+func (s *session) handle(cmd string, args []string) bool {
+	switch cmd {
+	case "CAPABILITY":
+		s.capability()
+		return true
+	case "LOGOUT":
+		s.ok("", "Logout Complete")
+		return false
+	case "NOOP":
+		if len(args) > 0 {
+			s.ok("TAG "+quote(args[0]), "Done")
+		} else {
+			s.ok("", "Done")
+		}
+		return true
+	case "STARTTLS":
+		return s.startTLS()
+	case "AUTHENTICATE":
+		return s.authenticate(args)
+	}
+
+	if !s.authed {
+		s.no("", "Authenticate first")
+		return true
+	}
+	switch cmd {
+	case "HAVESPACE":
+		if !s.argc(args, 2) {
+			return true
+		}
+		size, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			s.no("", "Syntax error")
+		} else if err = sieve.CheckName(args[0]); err != nil {
+			s.result(err)
+		} else if size > sieve.MaxScriptSize {
+			s.result(sieve.ErrTooLarge)
+		} else {
+			s.ok("", "Putscript would succeed")
+		}
+	case "PUTSCRIPT":
+		if s.argc(args, 2) {
+			s.result(sieve.Save(s.ctx, args[0], args[1]))
+		}
+	case "CHECKSCRIPT":
+		if s.argc(args, 1) {
+			s.result(sieve.Check(args[0]))
+		}
+	case "LISTSCRIPTS":
+		if !s.argc(args, 0) {
+			return true
+		}
+		list, err := sieve.List(s.ctx)
+		if err != nil {
+			s.result(err)
+			return true
+		}
+		for _, script := range list {
+			s.w.WriteString(quote(script.Name))
+			if script.Active == 1 {
+				s.w.WriteString(" ACTIVE")
+			}
+			s.w.WriteString("\r\n")
+		}
+		s.ok("", "Listscripts completed")
+	case "GETSCRIPT":
+		if !s.argc(args, 1) {
+			return true
+		}
+		script, err := sieve.Get(s.ctx, args[0])
+		if err != nil {
+			s.result(err)
+			return true
+		}
+		s.w.WriteString(literal(script.Content) + "\r\n")
+		s.ok("", "Getscript completed")
+	case "SETACTIVE":
+		if s.argc(args, 1) {
+			s.result(sieve.SetActive(s.ctx, args[0]))
+		}
+	case "DELETESCRIPT":
+		if s.argc(args, 1) {
+			s.result(sieve.Delete(s.ctx, args[0]))
+		}
+	case "RENAMESCRIPT":
+		if s.argc(args, 2) {
+			s.result(sieve.Rename(s.ctx, args[0], args[1]))
+		}
+	default:
+		s.no("", "Unknown command "+cmd)
+	}
+	return true
+}
+
+func (s *session) capability() {
+	s.w.WriteString("\"IMPLEMENTATION\" \"PMail\"\r\n")
+	s.w.WriteString("\"SIEVE\" " + quote(strings.Join(lang.Capabilities, " ")) + "\r\n")
+	if s.canAuth() {
+		s.w.WriteString("\"SASL\" \"PLAIN\"\r\n")
+	} else {
+		s.w.WriteString("\"SASL\" \"\"\r\n")
+	}
+	if !s.tls && s.tlsConfig != nil {
+		s.w.WriteString("\"STARTTLS\"\r\n")
+	}
+	if s.authed {
+		s.w.WriteString("\"OWNER\" " + quote(s.ctx.UserAccount) + "\r\n")
+	}
+	s.w.WriteString("\"MAXREDIRECTS\" \"" + strconv.Itoa(lang.MaxRedirects) + "\"\r\n")
+	s.w.WriteString("\"VERSION\" \"1.0\"\r\n")
+	s.ok("", "ManageSieve ready")
+}
+
+// canAuth 明文连接只允许本机登陆，其他情况需要先STARTTLS
+func (s *session) canAuth() bool {
+	if s.tls {
+		return true
+	}
+	ip := net.ParseIP(s.ip)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *session) startTLS() bool {
+	if s.tls || s.tlsConfig == nil || s.authed {
+		s.no("", "STARTTLS not available")
+		return true
+	}
+	s.ok("", "Begin TLS negotiation now")
+	if s.w.Flush() != nil {
+		return false
+	}
+	conn := tls.Server(s.conn, s.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		log.WithContext(s.ctx).Infof("ManageSieve TLS Handshake Error:%v", err)
+		return false
+	}
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	s.w = bufio.NewWriter(conn)
+	s.tls = true
+	// RFC 5804要求STARTTLS之后重新发送capability
+	s.capability()
+	return true
+}
+
+// authenticate 只支持PLAIN，没有初始响应时发送空的质询
+func (s *session) authenticate(args []string) bool {
+	if s.authed {
+		s.no("", "Already authenticated")
+		return true
+	}
+	if len(args) == 0 || len(args) > 2 {
+		s.no("", "Syntax error")
+		return true
+	}
+	if !strings.EqualFold(args[0], "PLAIN") {
+		s.no("", "Unsupported mechanism")
+		return true
+	}
+	if !s.canAuth() {
+		s.no("ENCRYPT-NEEDED", "STARTTLS first")
+		return true
+	}
+
+	var response string
+	if len(args) == 2 {
+		response = args[1]
+	} else {
+		s.w.WriteString("\"\"\r\n")
+		if s.w.Flush() != nil {
+			return false
+		}
+		reply, err := s.readCommand()
+		if err != nil && err != errSyntax {
+			return false
+		}
+		if err == errSyntax || len(reply) != 1 {
+			s.no("", "Syntax error")
+			return true
+		}
+		response = reply[0]
+	}
+	if response == "*" {
+		s.no("", "Authentication aborted")
+		return true
+	}
+
+	data, err := base64.StdEncoding.DecodeString(response)
+	parts := strings.Split(string(data), "\x00")
+	if err != nil || len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+		s.no("", "Invalid response")
+		return true
+	}
+	account := parts[1]
+	if idx := strings.Index(account, "@"); idx >= 0 {
+		account = account[:idx]
+	}
+	log.WithContext(s.ctx).Debugf("ManageSieve AUTHENTICATE, User:%s", account)
+
+	user, err := login(s.ctx, s.ip, account, parts[2])
+	if err != nil {
+		s.fails++
+		if s.fails >= maxAuthFails {
+			s.w.WriteString("BYE \"Too many authentication failures\"\r\n")
+			return false
+		}
+		if err == auth.ErrLocked {
+			s.no("", err.Error())
+		} else {
+			s.no("", "Authentication failed")
+		}
+		return true
+	}
+
+	s.authed = true
+	s.ctx.UserID = user.ID
+	s.ctx.UserName = user.Name
+	s.ctx.UserAccount = user.Account
+	s.ok("", "Logged in")
+	return true
+}
+
+func (s *session) argc(args []string, n int) bool {
+	if len(args) != n {
+		s.no("", "Syntax error")
+		return false
+	}
+	return true
+}
+
+// result 根据存储层返回的错误输出对应的响应码
+func (s *session) result(err error) {
+	var scriptErr *lang.Error
+	switch {
+	case err == nil:
+		s.ok("", "Completed")
+	case err == sieve.ErrNotFound:
+		s.no("NONEXISTENT", "There is no script by that name")
+	case err == sieve.ErrExists:
+		s.no("ALREADYEXISTS", "A script with that name already exists")
+	case err == sieve.ErrActive:
+		s.no("ACTIVE", "You may not delete an active script")
+	case err == sieve.ErrTooLarge:
+		s.no("QUOTA/MAXSIZE", "Script is too large")
+	case err == sieve.ErrNameError:
+		s.no("", err.Error())
+	case errors.As(err, &scriptErr):
+		s.no("", err.Error())
+	default:
+		log.WithContext(s.ctx).Errorf("ManageSieve Error:%+v", err)
+		s.no("TRYLATER", "Server error")
+	}
+}
+
+func (s *session) ok(code string, msg string) {
+	s.response("OK", code, msg)
+}
+
+func (s *session) no(code string, msg string) {
+	s.response("NO", code, msg)
+}
+
+func (s *session) response(status string, code string, msg string) {
+	s.w.WriteString(status)
+	if code != "" {
+		s.w.WriteString(" (" + code + ")")
+	}
+	s.w.WriteString(" " + quote(msg) + "\r\n")
+}
+
+// quote 输出字符串，包含换行或者太长时使用字面量
+func quote(str string) string {
+	if len(str) > 1024 || strings.ContainsAny(str, "\r\n\x00") {
+		return literal(str)
+	}
+	return "\"" + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(str) + "\""
+}
+
+func literal(str string) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(str), str)
+}
+
+// readCommand 读取一行命令，返回原子、数字和字符串参数，字面量可以跨行
+// 参数数量或者总长度超过限制时返回errTooLarge
+func (s *session) readCommand() ([]string, error) {
+	var args []string
+	total := 0
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		var arg string
+		switch {
+		case c == ' ' || c == '\r':
+			continue
+		case c == '\n':
+			return args, nil
+		case c == '"':
+			arg, err = s.readQuoted()
+		case c == '{':
+			arg, err = s.readLiteral(maxCommand - total)
+		default:
+			s.r.UnreadByte()
+			arg, err = s.readAtom()
+		}
+		if err != nil {
+			return nil, s.discard(err)
+		}
+		args = append(args, arg)
+		total += len(arg)
+		if len(args) > maxArgs || total > maxCommand {
+			return nil, errTooLarge
+		}
+	}
+}
+
+// discard 语法错误时丢弃这一行剩余的内容
+func (s *session) discard(err error) error {
+	if err != errSyntax {
+		return err
+	}
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c == '\n' {
+			return errSyntax
+		}
+	}
+}
+
+func (s *session) readAtom() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' || c == '\r' || c == '\n' {
+			s.r.UnreadByte()
+			return b.String(), nil
+		}
+		if c == '"' || c == '{' || c < 0x20 || b.Len() >= maxLine {
+			return "", errSyntax
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (s *session) readQuoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			c, err = s.r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			if c != '"' && c != '\\' {
+				return "", errSyntax
+			}
+		case '\r', '\n':
+			if c == '\n' {
+				s.r.UnreadByte()
+			}
+			return "", errSyntax
+		}
+		if b.Len() >= maxLine {
+			return "", errSyntax
+		}
+		b.WriteByte(c)
+	}
+}
+
+// readLiteral 读取{N+}或者{N}格式的字面量，客户端不需要等待服务端确认
+// 字面量的内容已经发出，超过limit或者maxLiteral时无法跳过，返回errTooLarge
+func (s *session) readLiteral(limit int) (string, error) {
+	var head []byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == '}' {
+			break
+		}
+		if c == '\n' || len(head) > 10 {
+			s.r.UnreadByte()
+			return "", errSyntax
+		}
+		head = append(head, c)
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(string(head), "+"))
+	if err != nil || size < 0 {
+		return "", errSyntax
+	}
+	if size > maxLiteral || size > limit {
+		return "", errTooLarge
+	}
+	if c, err := s.r.ReadByte(); err != nil || c != '\r' {
+		return "", errSyntax
+	}
+	if c, err := s.r.ReadByte(); err != nil || c != '\n' {
+		return "", errSyntax
+	}
+	buf := make([]byte, size)
+	if _, err = io.ReadFull(s.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,155 @@
+package managesieve_server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"pmail/models"
+	"pmail/services/auth"
+	"pmail/utils/context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startTest 在本机端口启动服务，本机连接不需要STARTTLS就可以登陆
+func startTest(t *testing.T) *testClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ln, nil)
+	go srv.serve()
+	t.Cleanup(srv.close)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect("OK")
+	return c
+}
+
+// expect 读取到OK、NO或者BYE开头的行为止，返回全部内容
+func (c *testClient) expect(status string) string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read error %v, lines %q", err, lines)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			if !strings.HasPrefix(line, status) {
+				c.t.Fatalf("want %s, got %q", status, lines)
+			}
+			return strings.Join(lines, "")
+		}
+	}
+}
+
+func (c *testClient) send(cmd string) {
+	c.conn.Write([]byte(cmd + "\r\n"))
+}
+
+func TestSession(t *testing.T) {
+	login = func(ctx *context.Context, ip, account, pwd string) (*models.User, error) {
+		if account == "me" && pwd == "secret" {
+			return &models.User{ID: 1, Account: "me"}, nil
+		}
+		return nil, auth.ErrPasswordWrong
+	}
+
+	c := startTest(t)
+	c.send("CAPABILITY")
+	ret := c.expect("OK")
+	for _, want := range []string{`"SASL" "PLAIN"`, `"SIEVE" "fileinto envelope vacation`, `"VERSION" "1.0"`} {
+		if !strings.Contains(ret, want) {
+			t.Errorf("capability %q missing %s", ret, want)
+		}
+	}
+	if strings.Contains(ret, "STARTTLS") {
+		t.Errorf("STARTTLS without tls config")
+	}
+
+	c.send(`LISTSCRIPTS`)
+	c.expect("NO")
+	c.send(`NOOP "x\"y"`)
+	if ret = c.expect("OK"); !strings.Contains(ret, `(TAG "x\"y")`) {
+		t.Errorf("noop %q", ret)
+	}
+	c.send(`FOO "unterminated`)
+	c.expect("NO")
+
+	c.send(`AUTHENTICATE "PLAIN" "` + base64.StdEncoding.EncodeToString([]byte("\x00me\x00wrong")) + `"`)
+	c.expect("NO")
+	c.send(`AUTHENTICATE "PLAIN"`)
+	if line, _ := c.r.ReadString('\n'); line != "\"\"\r\n" {
+		t.Fatalf("challenge %q", line)
+	}
+	resp := base64.StdEncoding.EncodeToString([]byte("\x00me@example.com\x00secret"))
+	c.send("{" + strconv.Itoa(len(resp)) + "+}\r\n" + resp)
+	c.expect("OK")
+
+	c.send(`HAVESPACE "main" 100`)
+	c.expect("OK")
+	c.send(`HAVESPACE "main" 1000000`)
+	if ret = c.expect("NO"); !strings.Contains(ret, "QUOTA/MAXSIZE") {
+		t.Errorf("havespace %q", ret)
+	}
+	script := "require \"fileinto\";\r\nfileinto \"a\";\r\n"
+	c.send("CHECKSCRIPT {" + strconv.Itoa(len(script)) + "+}\r\n" + script)
+	c.expect("OK")
+	c.send(`CHECKSCRIPT "fileinto \"a\";"`)
+	if ret = c.expect("NO"); !strings.Contains(ret, "requires") {
+		t.Errorf("checkscript %q", ret)
+	}
+	c.send("LOGOUT")
+	c.expect("OK")
+}
+
+func TestAuthFailures(t *testing.T) {
+	login = func(ctx *context.Context, ip, account, pwd string) (*models.User, error) {
+		return nil, auth.ErrPasswordWrong
+	}
+	c := startTest(t)
+	resp := base64.StdEncoding.EncodeToString([]byte("\x00me\x00x"))
+	for i := 1; i < maxAuthFails; i++ {
+		c.send(`AUTHENTICATE "PLAIN" "` + resp + `"`)
+		c.expect("NO")
+	}
+	c.send(`AUTHENTICATE "PLAIN" "` + resp + `"`)
+	c.expect("BYE")
+}
+
+func TestCommandLimits(t *testing.T) {
+	c := startTest(t)
+	c.send("NOOP" + strings.Repeat(" a", maxArgs))
+	c.expect("BYE")
+
+	// 字面量超过限制时内容无法跳过，直接断开
+	c = startTest(t)
+	c.send("CHECKSCRIPT {" + strconv.Itoa(maxLiteral+1) + "+}")
+	c.expect("BYE")
+
+	c = startTest(t)
+	c.send("NOOP" + strings.Repeat(" a", maxArgs-1))
+	c.expect("OK")
+}
+
+func TestQuote(t *testing.T) {
+	if got := quote(`a"b\c`); got != `"a\"b\\c"` {
+		t.Errorf("quote = %s", got)
+	}
+	if got := quote("a\r\nb"); got != "{4}\r\na\r\nb" {
+		t.Errorf("quote = %q", got)
+	}
+}
@@ -4,7 +4,13 @@ type User struct {
 	ID       int    `xorm:"id unsigned int not null pk autoincr"`
 	Account  string `xorm:"varchar(20) notnull unique comment('账号登陆名')"`
 	Name     string `xorm:"varchar(10) notnull comment('用户名')"`
-	Password string `xorm:"char(32) notnull comment('登陆密码，两次md5加盐，md5(md5(password+pmail) +pmail2023)')"`
+	Password string `xorm:"varchar(100) notnull comment('登陆密码，bcrypt，老版本为两次md5加盐，登陆后自动升级')"`
+	IsAdmin  int8   `xorm:"is_admin tinyint(1) notnull default(0) comment('是否是管理员')"`
+	Disabled int8   `xorm:"disabled tinyint(1) notnull default(0) comment('是否禁用，禁用后无法登陆')"`
+	// 两步验证
+	TotpSecret  string `xorm:"totp_secret varchar(64) notnull default('') comment('TOTP密钥，base32')" json:"-"`
+	TotpEnabled int8   `xorm:"totp_enabled tinyint(1) notnull default(0) comment('是否开启两步验证')"`
+	TotpStep    int64  `xorm:"totp_step bigint notnull default(0) comment('最近一次使用的TOTP时间步，同一个验证码不能重复使用')" json:"-"`
 }
 
 func (p User) TableName() string {
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Alias 邮件别名，同一个地址的多条记录组成邮件列表
+type Alias struct {
+	Id         int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	Address    string    `xorm:"address varchar(255) notnull unique('address_target') index comment('别名地址，*@example.com表示该域名的catch-all')" json:"address"`
+	Target     string    `xorm:"target varchar(255) notnull unique('address_target') comment('投递目标，没有@时为本地账号，否则为邮箱地址，本地地址会继续展开')" json:"target"`
+	CreateTime time.Time `xorm:"create_time created" json:"create_time"`
+}
+
+func (p *Alias) TableName() string {
+	return "alias"
+}
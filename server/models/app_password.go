@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// AppPassword 应用专用密码，用于不支持两步验证的SMTP、POP3、IMAP客户端
+type AppPassword struct {
+	Id          int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	UserId      int       `xorm:"user_id int unsigned notnull default(0) index comment('所属用户id')" json:"-"`
+	Name        string    `xorm:"name varchar(50) notnull default('') comment('设备名称')" json:"name"`
+	Password    string    `xorm:"password varchar(64) notnull default('') unique comment('密码的sha256')" json:"-"`
+	LastUseTime time.Time `xorm:"last_use_time comment('最后使用时间')" json:"last_use_time"`
+	CreateTime  time.Time `xorm:"create_time created" json:"create_time"`
+}
+
+func (p *AppPassword) TableName() string {
+	return "app_password"
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Attachment 附件元数据，附件内容按sha256保存在附件存储目录中，内容相同的附件只保存一份
+type Attachment struct {
+	Id          int       `xorm:"id int unsigned not null pk autoincr"`
+	EmailId     int       `xorm:"email_id int unsigned notnull default(0) index comment('邮件id')"`
+	Idx         int       `xorm:"idx int notnull default(0) comment('在邮件附件中的序号')"`
+	Filename    string    `xorm:"filename varchar(255) notnull default('') comment('文件名')"`
+	ContentType string    `xorm:"content_type varchar(255) notnull default('') comment('文件类型')"`
+	ContentId   string    `xorm:"content_id varchar(255) notnull default('') comment('正文中引用的cid')"`
+	Size        int64     `xorm:"size bigint notnull default(0) comment('文件大小')"`
+	Hash        string    `xorm:"hash varchar(64) notnull default('') index comment('文件内容的sha256')"`
+	CreateTime  time.Time `xorm:"create_time created"`
+}
+
+func (p *Attachment) TableName() string {
+	return "attachment"
+}
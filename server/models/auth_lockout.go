@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// AuthLockout 登陆失败次数过多导致的锁定记录
+type AuthLockout struct {
+	Id         int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	Type       string    `xorm:"type varchar(10) notnull default('') comment('account账号锁定，ip封禁')" json:"type"`
+	Target     string    `xorm:"target varchar(100) notnull default('') index comment('被锁定的账号或IP')" json:"target"`
+	Protocol   string    `xorm:"protocol varchar(10) notnull default('') comment('触发锁定的协议，http、smtp、pop3、imap')" json:"protocol"`
+	Ip         string    `xorm:"ip varchar(50) notnull default('') comment('最后一次失败的IP')" json:"ip"`
+	Failures   int       `xorm:"failures int notnull default(0) comment('失败次数')" json:"failures"`
+	LockUntil  time.Time `xorm:"lock_until comment('锁定截止时间')" json:"lock_until"`
+	CreateTime time.Time `xorm:"create_time created" json:"create_time"`
+}
+
+func (p *AuthLockout) TableName() string {
+	return "auth_lockout"
+}
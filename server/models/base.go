@@ -1,12 +1,16 @@
 package models
 
-import "pmail/db"
+import (
+	"pmail/db"
+	"xorm.io/xorm/schemas"
+)
 
 func SyncTables() {
 	err := db.Instance.Sync2(&User{})
 	if err != nil {
 		panic(err)
 	}
+	fixPasswordColumn()
 	err = db.Instance.Sync2(&Email{})
 	if err != nil {
 		panic(err)
@@ -27,4 +31,119 @@ func SyncTables() {
 	if err != nil {
 		panic(err)
 	}
+	err = db.Instance.Sync2(&SendQueue{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&AuthLockout{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&AppPassword{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&RecoveryCode{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&EmailSource{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&Attachment{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&Alias{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&DmarcReport{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&DmarcRecord{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&SieveScript{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&SieveVacation{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&ImapMailbox{})
+	if err != nil {
+		panic(err)
+	}
+	err = db.Instance.Sync2(&ImapUid{})
+	if err != nil {
+		panic(err)
+	}
+	fixEmailOwner()
+	fixAdmin()
+}
+
+// fixAdmin 老版本没有管理员标记，拥有全部邮箱权限的用户设为管理员
+func fixAdmin() {
+	exist, err := db.Instance.Where("is_admin=1").Exist(&User{})
+	if err != nil {
+		panic(err)
+	}
+	if exist {
+		return
+	}
+	_, err = db.Instance.Exec("update user set is_admin=1 where id in (select user_id from user_auth where email_account='*')")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// fixEmailOwner 老版本的邮件没有所属用户，发出的邮件归属发件人，其他邮件归属管理员
+func fixEmailOwner() {
+	_, err := db.Instance.Exec("update email set user_id=send_user_id where user_id=0 and type=1 and send_user_id>0")
+	if err != nil {
+		panic(err)
+	}
+
+	var auth UserAuth
+	exist, err := db.Instance.Where("email_account='*'").Asc("user_id").Get(&auth)
+	if err != nil {
+		panic(err)
+	}
+	if !exist {
+		return
+	}
+	_, err = db.Instance.Exec("update email set user_id=? where user_id=0", auth.UserID)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// fixPasswordColumn 老版本密码字段是char(32)，Sync2不会修改字段长度，需要手动加长
+func fixPasswordColumn() {
+	tables, err := db.Instance.DBMetas()
+	if err != nil {
+		panic(err)
+	}
+	for _, table := range tables {
+		if table.Name != (User{}).TableName() {
+			continue
+		}
+		col := table.GetColumn("password")
+		if col == nil || col.Length == 0 || col.Length >= 100 {
+			return
+		}
+		// sqlite不限制字段长度，只有mysql需要修改
+		if db.Instance.Dialect().URI().DBType == schemas.MYSQL {
+			_, err = db.Instance.Exec("alter table user modify password varchar(100) not null comment '登陆密码，bcrypt，老版本为两次md5加盐，登陆后自动升级'")
+			if err != nil {
+				panic(err)
+			}
+		}
+		return
+	}
 }
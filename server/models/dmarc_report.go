@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// DmarcReport 收到的DMARC聚合报告
+type DmarcReport struct {
+	Id         int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	OrgName    string    `xorm:"org_name varchar(100) notnull default('') index comment('发送报告的机构')" json:"org_name"`
+	Email      string    `xorm:"email varchar(100) notnull default('') comment('发送报告的邮箱')" json:"email"`
+	ReportId   string    `xorm:"report_id varchar(200) notnull default('') comment('报告id')" json:"report_id"`
+	Domain     string    `xorm:"domain varchar(100) notnull default('') index comment('报告对应的域名')" json:"domain"`
+	Policy     string    `xorm:"policy varchar(20) notnull default('') comment('发布的DMARC策略')" json:"policy"`
+	DateBegin  time.Time `xorm:"date_begin comment('统计开始时间')" json:"date_begin"`
+	DateEnd    time.Time `xorm:"date_end comment('统计结束时间')" json:"date_end"`
+	EmailId    int       `xorm:"email_id int unsigned notnull default(0) comment('报告所在的邮件id')" json:"email_id"`
+	CreateTime time.Time `xorm:"create_time created" json:"create_time"`
+}
+
+func (p *DmarcReport) TableName() string {
+	return "dmarc_report"
+}
+
+// DmarcRecord 聚合报告中每个来源IP的统计
+type DmarcRecord struct {
+	Id            int    `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	DmarcReportId int    `xorm:"dmarc_report_id int unsigned notnull default(0) index comment('dmarc_report表id')" json:"dmarc_report_id"`
+	SourceIp      string `xorm:"source_ip varchar(50) notnull default('') index comment('来源IP')" json:"source_ip"`
+	Count         int    `xorm:"count int notnull default(0) comment('邮件数量')" json:"count"`
+	Disposition   string `xorm:"disposition varchar(20) notnull default('') comment('收件方的处理方式，none、quarantine、reject')" json:"disposition"`
+	DkimResult    string `xorm:"dkim_result varchar(20) notnull default('') comment('对齐后的DKIM结果')" json:"dkim_result"`
+	SpfResult     string `xorm:"spf_result varchar(20) notnull default('') comment('对齐后的SPF结果')" json:"spf_result"`
+	HeaderFrom    string `xorm:"header_from varchar(100) notnull default('') comment('邮件头From的域名')" json:"header_from"`
+	EnvelopeFrom  string `xorm:"envelope_from varchar(100) notnull default('') comment('信封发件人域名')" json:"envelope_from"`
+	DkimDomain    string `xorm:"dkim_domain varchar(100) notnull default('') comment('DKIM签名域名')" json:"dkim_domain"`
+	DkimAuth      string `xorm:"dkim_auth varchar(20) notnull default('') comment('DKIM签名校验结果')" json:"dkim_auth"`
+	SpfDomain     string `xorm:"spf_domain varchar(100) notnull default('') comment('SPF校验域名')" json:"spf_domain"`
+	SpfAuth       string `xorm:"spf_auth varchar(20) notnull default('') comment('SPF校验结果')" json:"spf_auth"`
+}
+
+func (p *DmarcRecord) TableName() string {
+	return "dmarc_record"
+}
@@ -21,14 +21,18 @@ type Email struct {
 	Text         sql.NullString `xorm:"text text comment('文本内容')" json:"text"`
 	Html         sql.NullString `xorm:"html mediumtext comment('html内容')" json:"html"`
 	Sender       string         `xorm:"sender text comment('发送人')" json:"sender"`
-	Attachments  string         `xorm:"attachments longtext comment('附件')" json:"attachments"`
+	Attachments  string         `xorm:"attachments longtext comment('附件')" json:"attachments"` // 附件元数据，内容保存在attachment表和附件存储中
 	SPFCheck     int8           `xorm:"spf_check tinyint(1) comment('spf校验是否通过')" json:"spf_check"`
 	DKIMCheck    int8           `xorm:"dkim_check tinyint(1) comment('dkim校验是否通过')" json:"dkim_check"`
-	Status       int8           `xorm:"status tinyint(4) notnull default(0) comment('0未发送，1已发送，2发送失败，3删除')" json:"status"` // 0未发送，1已发送，2发送失败，3删除
+	DMARCCheck   int8           `xorm:"dmarc_check tinyint(1) notnull default(0) comment('dmarc校验结果，0:没有策略，1:通过，2:失败')" json:"dmarc_check"`
+	Status       int8           `xorm:"status tinyint(4) notnull default(0) comment('0未发送，1已发送，2发送失败，3删除，4等待重试')" json:"status"` // 0未发送，1已发送，2发送失败，3删除，4等待重试
 	CronSendTime time.Time      `xorm:"cron_send_time comment('定时发送时间')" json:"cron_send_time"`
 	UpdateTime   time.Time      `xorm:"update_time updated comment('更新时间')" json:"update_time"`
 	SendUserID   int            `xorm:"send_user_id unsigned int  notnull default(0) comment('发件人用户id')" json:"send_user_id"`
+	UserId       int            `xorm:"user_id unsigned int notnull default(0) index comment('所属用户id')" json:"-"`
 	IsRead       int8           `xorm:"is_read tinyint(1) comment('是否已读')" json:"is_read"`
+	IsStar       int8           `xorm:"is_star tinyint(1) notnull default(0) comment('是否星标')" json:"is_star"`
+	Tags         string         `xorm:"tags text comment('标签，JSON数组')" json:"tags"`
 	Error        sql.NullString `xorm:"error text comment('投递错误信息')" json:"error"`
 	SendDate     time.Time      `xorm:"send_date comment('投递时间')" json:"send_date"`
 	CreateTime   time.Time      `xorm:"create_time created" json:"create_time"`
@@ -75,6 +79,7 @@ func (d Email) GetCc() []*parsemail.User {
 	return ret
 }
 
+// GetAttachments 附件元数据，附件内容使用attachments.Load读取
 func (d Email) GetAttachments() []*parsemail.Attachment {
 	var ret []*parsemail.Attachment
 	json.Unmarshal([]byte(d.Attachments), &ret)
@@ -137,6 +142,7 @@ func (d Email) ToTransObj() *parsemail.Email {
 		Cc:          d.GetCc(),
 		Attachments: d.GetAttachments(),
 		Date:        d.SendDate.Format("2006-01-02 15:04:05"),
+		MessageId:   int64(d.Id),
 	}
 
 }
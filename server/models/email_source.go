@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// EmailSource 邮件原文，保存收到的原始RFC 5322内容，POP3、IMAP和查看原文时原样返回
+// 原文内容和附件一样保存在附件存储中，老版本的原文保存在content字段，启动后在后台迁移
+type EmailSource struct {
+	EmailId    int       `xorm:"email_id int unsigned not null pk comment('邮件id')"`
+	Content    []byte    `xorm:"content longblob comment('邮件原文，老版本使用')"`
+	Hash       string    `xorm:"hash varchar(64) notnull default('') index comment('原文在附件存储中的sha256')"`
+	Size       int64     `xorm:"size bigint notnull default(0) comment('原文大小，POP3统计邮件大小时使用')"`
+	CreateTime time.Time `xorm:"create_time created"`
+}
+
+func (p *EmailSource) TableName() string {
+	return "email_source"
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// ImapMailbox IMAP邮箱的UID状态，每个用户的每个邮箱一条记录
+type ImapMailbox struct {
+	Id          int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	UserId      int       `xorm:"user_id int unsigned notnull default(0) unique('user_name') comment('用户id')" json:"user_id"`
+	Name        string    `xorm:"name varchar(100) notnull default('') unique('user_name') comment('邮箱标识，系统邮箱为名称，分组为group:分组id')" json:"name"`
+	UidValidity uint32    `xorm:"uid_validity int unsigned notnull default(0) comment('UIDVALIDITY')" json:"uid_validity"`
+	UidNext     uint32    `xorm:"uid_next int unsigned notnull default(1) comment('下一个分配的UID')" json:"uid_next"`
+	CreateTime  time.Time `xorm:"create_time created" json:"create_time"`
+}
+
+func (p *ImapMailbox) TableName() string {
+	return "imap_mailbox"
+}
+
+// ImapUid 邮件在IMAP邮箱中的UID，邮件移动到其他邮箱后重新分配
+type ImapUid struct {
+	Id        int    `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	MailboxId int    `xorm:"mailbox_id int unsigned notnull default(0) unique('mailbox_email') comment('imap_mailbox表id')" json:"mailbox_id"`
+	EmailId   int    `xorm:"email_id int unsigned notnull default(0) unique('mailbox_email') index comment('邮件id')" json:"email_id"`
+	Uid       uint32 `xorm:"uid int unsigned notnull default(0) comment('UID')" json:"uid"`
+}
+
+func (p *ImapUid) TableName() string {
+	return "imap_uid"
+}
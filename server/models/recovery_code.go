@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// RecoveryCode 两步验证的恢复码，每个只能使用一次，使用后删除
+type RecoveryCode struct {
+	Id         int       `xorm:"id int unsigned not null pk autoincr"`
+	UserId     int       `xorm:"user_id int unsigned notnull default(0) index comment('所属用户id')"`
+	Code       string    `xorm:"code varchar(64) notnull default('') comment('恢复码的sha256')"`
+	CreateTime time.Time `xorm:"create_time created"`
+}
+
+func (p *RecoveryCode) TableName() string {
+	return "recovery_code"
+}
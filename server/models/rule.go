@@ -6,14 +6,18 @@ import (
 	"pmail/utils/errors"
 )
 
+// ErrRuleNotFound 规则不存在或者不属于当前用户
+var ErrRuleNotFound = errors.New("rule not found")
+
 type Rule struct {
-	Id     int    `xorm:"id int unsigned not null pk autoincr" json:"id"`
-	UserId int    `xorm:"user_id notnull default(0) comment('用户id')" json:"user_id"`
-	Name   string `xorm:"name notnull default('') comment('规则名称')" json:"name"`
-	Value  string `xorm:"value text comment('规则内容')" json:"value"`
-	Action int    `xorm:"action notnull default(0) comment('执行动作,1已读，2转发，3删除')" json:"action"`
-	Params string `xorm:"params notnull default('') comment('执行参数')" json:"params"`
-	Sort   int    `xorm:"sort notnull default(0) comment('排序，越大约优先')" json:"sort"`
+	Id      int    `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	UserId  int    `xorm:"user_id notnull default(0) comment('用户id')" json:"user_id"`
+	Name    string `xorm:"name notnull default('') comment('规则名称')" json:"name"`
+	Value   string `xorm:"value text comment('规则内容')" json:"value"`
+	Action  int    `xorm:"action notnull default(0) comment('执行动作,1已读，2转发，3删除，4移动，5标签，6星标，7自动回复，8webhook，9垃圾邮件，10停止')" json:"action"`
+	Params  string `xorm:"params notnull default('') comment('执行参数')" json:"params"`
+	Actions string `xorm:"actions text comment('执行动作列表，JSON数组，为空时使用action和params')" json:"actions"`
+	Sort    int    `xorm:"sort notnull default(0) comment('排序，越大约优先')" json:"sort"`
 }
 
 func (p *Rule) TableName() string {
@@ -23,13 +27,21 @@ func (p *Rule) TableName() string {
 func (p *Rule) Save(ctx *context.Context) error {
 
 	if p.Id > 0 {
-		_, err := db.Instance.Exec(db.WithContext(ctx, "update rule set name=? ,value = ? ,action = ?,params = ?,sort = ? where id = ?"), p.Name, p.Value, p.Action, p.Params, p.Sort, p.Id)
+		// 只能修改自己的规则，内容没有变化时mysql的影响行数为0，所以先检查规则是否存在
+		exist, err := db.Instance.Where("id = ? and user_id = ?", p.Id, ctx.UserID).Exist(&Rule{})
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		if !exist {
+			return ErrRuleNotFound
+		}
+		_, err = db.Instance.Exec(db.WithContext(ctx, "update rule set name=? ,value = ? ,action = ?,params = ?,actions = ?,sort = ? where id = ? and user_id = ?"), p.Name, p.Value, p.Action, p.Params, p.Actions, p.Sort, p.Id, ctx.UserID)
 		if err != nil {
 			return errors.Wrap(err)
 		}
 		return nil
 	} else {
-		_, err := db.Instance.Exec(db.WithContext(ctx, "insert into rule (name,value,user_id,action,params,sort) values (?,?,?,?,?,?)"), p.Name, p.Value, ctx.UserID, p.Action, p.Params, p.Sort)
+		_, err := db.Instance.Exec(db.WithContext(ctx, "insert into rule (name,value,user_id,action,params,actions,sort) values (?,?,?,?,?,?,?)"), p.Name, p.Value, ctx.UserID, p.Action, p.Params, p.Actions, p.Sort)
 		if err != nil {
 			return errors.Wrap(err)
 		}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// SendQueue 待投递的外发邮件，每个收件域名一行
+// 别名转发到外部地址的邮件没有邮件记录，投递附件存储中保存的原文
+type SendQueue struct {
+	Id            int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	EmailId       int       `xorm:"email_id int unsigned notnull default(0) index comment('邮件id')" json:"email_id"`
+	Domain        string    `xorm:"domain varchar(255) notnull default('') comment('收件域名')" json:"domain"`
+	Recipients    string    `xorm:"recipients text comment('该域名下的收件人')" json:"recipients"`
+	Sender        string    `xorm:"sender varchar(255) notnull default('') comment('信封发件人，原样转发的邮件使用')" json:"sender"`
+	SourceHash    string    `xorm:"source_hash varchar(64) notnull default('') index comment('原样转发的邮件原文在附件存储中的sha256，email_id为0')" json:"source_hash"`
+	Status        int8      `xorm:"status tinyint(4) notnull default(0) index comment('0待投递，1投递成功，2投递失败')" json:"status"`
+	Attempts      int       `xorm:"attempts int notnull default(0) comment('已尝试次数')" json:"attempts"`
+	NextRetryTime time.Time `xorm:"next_retry_time index comment('下次投递时间')" json:"next_retry_time"`
+	ExpireTime    time.Time `xorm:"expire_time comment('超过这个时间不再重试')" json:"expire_time"`
+	Error         string    `xorm:"error text comment('最近一次投递错误')" json:"error"`
+	TlsPolicy     string    `xorm:"tls_policy varchar(20) notnull default('') comment('最近一次投递使用的TLS策略，dane、mta-sts、opportunistic、relay')" json:"tls_policy"`
+	TlsStatus     string    `xorm:"tls_status varchar(100) notnull default('') comment('最近一次投递的加密情况')" json:"tls_status"`
+	MxHost        string    `xorm:"mx_host varchar(255) notnull default('') comment('最近一次投递的MX主机或中继地址，投递成功时为接收邮件的主机')" json:"mx_host"`
+	CreateTime    time.Time `xorm:"create_time created" json:"create_time"`
+	UpdateTime    time.Time `xorm:"update_time updated" json:"update_time"`
+}
+
+func (p *SendQueue) TableName() string {
+	return "send_queue"
+}
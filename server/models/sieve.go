@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// SieveScript 用户的Sieve过滤脚本，每个用户最多只有一个启用的脚本
+type SieveScript struct {
+	Id         int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	UserId     int       `xorm:"user_id int unsigned notnull default(0) unique('user_name') comment('用户id')" json:"-"`
+	Name       string    `xorm:"name varchar(100) notnull default('') unique('user_name') comment('脚本名称')" json:"name"`
+	Content    string    `xorm:"content text comment('脚本内容')" json:"content,omitempty"`
+	Active     int8      `xorm:"active tinyint(1) notnull default(0) comment('是否启用')" json:"active"`
+	CreateTime time.Time `xorm:"create_time created" json:"create_time"`
+	UpdateTime time.Time `xorm:"update_time updated" json:"update_time"`
+}
+
+func (p *SieveScript) TableName() string {
+	return "sieve_script"
+}
+
+// SieveVacation 自动回复记录，同一个发件人在指定天数内只回复一次
+type SieveVacation struct {
+	Id         int       `xorm:"id int unsigned not null pk autoincr" json:"id"`
+	UserId     int       `xorm:"user_id int unsigned notnull default(0) unique('user_handle_sender') comment('用户id')" json:"user_id"`
+	Handle     string    `xorm:"handle varchar(64) notnull default('') unique('user_handle_sender') comment('自动回复标识')" json:"handle"`
+	Sender     string    `xorm:"sender varchar(255) notnull default('') unique('user_handle_sender') comment('回复的地址')" json:"sender"`
+	ExpireTime time.Time `xorm:"expire_time comment('在这个时间之前不再回复')" json:"expire_time"`
+}
+
+func (p *SieveVacation) TableName() string {
+	return "sieve_vacation"
+}
@@ -6,19 +6,33 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
 	"pmail/db"
-	"pmail/models"
+	"pmail/services/auth"
 	"pmail/services/detail"
+	"pmail/services/throttle"
 	"pmail/utils/array"
 	"pmail/utils/context"
 	"pmail/utils/errors"
 	"pmail/utils/id"
-	"pmail/utils/password"
 	"strings"
 )
 
 type action struct {
 }
 
+// banned 被封禁的IP直接断开连接
+func banned(session *gopop.Session) bool {
+	if session.Conn == nil || session.Status == gopop.TRANSACTION {
+		return false
+	}
+	ip := throttle.IP(session.Conn.RemoteAddr().String())
+	if !throttle.IsBanned(ip) {
+		return false
+	}
+	log.WithContext(session.Ctx).Infof("POP3 Connection Banned %s", ip)
+	session.Conn.Close()
+	return true
+}
+
 // Custom 非标准命令
 func (a action) Custom(session *gopop.Session, cmd string, args []string) ([]string, error) {
 	if session.Ctx == nil {
@@ -38,6 +52,9 @@ func (a action) Capa(session *gopop.Session) ([]string, error) {
 		tc.SetValue(context.LogID, id.GenLogID())
 		session.Ctx = tc
 	}
+	if banned(session) {
+		return nil, errors.New("banned")
+	}
 
 	if session.InTls {
 		log.WithContext(session.Ctx).Debugf("POP3 CMD: CAPA With Tls")
@@ -49,7 +66,6 @@ func (a action) Capa(session *gopop.Session) ([]string, error) {
 		"USER",
 		"PASS",
 		"TOP",
-		"APOP",
 		"STAT",
 		"UIDL",
 		"LIST",
@@ -73,6 +89,9 @@ func (a action) User(session *gopop.Session, username string) error {
 		tc.SetValue(context.LogID, id.GenLogID())
 		session.Ctx = tc
 	}
+	if banned(session) {
+		return errors.New("banned")
+	}
 	log.WithContext(session.Ctx).Debugf("POP3 CMD: USER, Args:%s", username)
 
 	infos := strings.Split(username, "@")
@@ -93,69 +112,48 @@ func (a action) Pass(session *gopop.Session, pwd string) error {
 		tc.SetValue(context.LogID, id.GenLogID())
 		session.Ctx = tc
 	}
+	if banned(session) {
+		return errors.New("banned")
+	}
 
-	log.WithContext(session.Ctx).Debugf("POP3 PASS %s , User:%s", pwd, session.User)
-
-	var user models.User
-
-	encodePwd := password.Encode(pwd)
+	log.WithContext(session.Ctx).Debugf("POP3 PASS, User:%s", session.User)
 
-	_, err := db.Instance.Where("account =? and password =?", session.User, encodePwd).Get(&user)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		log.WithContext(session.Ctx.(*context.Context)).Errorf("%+v", err)
+	var ip string
+	if session.Conn != nil {
+		ip = throttle.IP(session.Conn.RemoteAddr().String())
+	}
+	user, err := auth.Login(session.Ctx.(*context.Context), "pop3", ip, session.User, pwd)
+	if err != nil {
+		return err
 	}
 
-	if user.ID > 0 {
-		session.Status = gopop.TRANSACTION
-
-		session.Ctx.(*context.Context).UserID = user.ID
-		session.Ctx.(*context.Context).UserName = user.Name
-		session.Ctx.(*context.Context).UserAccount = user.Account
+	session.Status = gopop.TRANSACTION
 
-		return nil
-	}
+	session.Ctx.(*context.Context).UserID = user.ID
+	session.Ctx.(*context.Context).UserName = user.Name
+	session.Ctx.(*context.Context).UserAccount = user.Account
 
-	return errors.New("password error")
+	return nil
 }
 
-// Apop APOP登陆命令
+// Apop APOP登陆命令。APOP需要服务端保存明文密码，密码使用bcrypt存储后无法支持，请使用USER/PASS登陆
 func (a action) Apop(session *gopop.Session, username, digest string) error {
 	if session.Ctx == nil {
 		tc := &context.Context{}
 		tc.SetValue(context.LogID, id.GenLogID())
 		session.Ctx = tc
 	}
-	log.WithContext(session.Ctx).Debugf("POP3 CMD: APOP, Args:%s,%s", username, digest)
-
-	infos := strings.Split(username, "@")
-	if len(infos) > 1 {
-		username = infos[0]
-	}
-
-	log.WithContext(session.Ctx).Debugf("POP3 APOP %s %s", username, digest)
-
-	var user models.User
-
-	_, err := db.Instance.Where("account =? ", username).Get(&user)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		log.WithContext(session.Ctx.(*context.Context)).Errorf("%+v", err)
-	}
-
-	if user.ID > 0 && digest == password.Md5Encode(user.Password) {
-		session.User = username
-		session.Status = gopop.TRANSACTION
-
-		session.Ctx.(*context.Context).UserID = user.ID
-		session.Ctx.(*context.Context).UserName = user.Name
-		session.Ctx.(*context.Context).UserAccount = user.Account
-
-		return nil
+	if banned(session) {
+		return errors.New("banned")
 	}
+	log.WithContext(session.Ctx).Debugf("POP3 CMD: APOP, Args:%s", username)
 
-	return errors.New("password error")
-
+	return errors.New("APOP not supported, please use USER/PASS")
 }
 
+// 邮件大小，有原文的使用原文大小，原文在附件存储中时使用email_source.size，还没迁移的使用content的长度
+const sizeField = "ifnull(nullif(email_source.size, 0), ifnull(LENGTH(email_source.content), ifnull(LENGTH(text) , 0) + ifnull(LENGTH(html) , 0)))"
+
 type statInfo struct {
 	Num  int64 `json:"num"`
 	Size int64 `json:"size"`
@@ -166,7 +164,7 @@ func (a action) Stat(session *gopop.Session) (msgNum, msgSize int64, err error)
 	log.WithContext(session.Ctx).Debugf("POP3 CMD: STAT")
 
 	var si statInfo
-	_, err = db.Instance.Select("count(1) as `num`, sum(length(text)+length(html)) as `size`").Table("email").Where("type=0 and status=0").Get(&si)
+	_, err = db.Instance.SQL("select count(1) as `num`, sum("+sizeField+") as `size` from email left join email_source on email_source.email_id = email.id where type=0 and status=0 and user_id=?", session.Ctx.(*context.Context).UserID).Get(&si)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		log.WithContext(session.Ctx.(*context.Context)).Errorf("%+v", err)
 		err = nil
@@ -197,7 +195,7 @@ func (a action) Uidl(session *gopop.Session, msg string) ([]gopop.UidlItem, erro
 	var err error
 	var ssql string
 
-	err = db.Instance.Where("type=0 and status=0").Select("id").Table("email").Find(&res)
+	err = db.Instance.Where("type=0 and status=0 and user_id=?", session.Ctx.(*context.Context).UserID).Select("id").Table("email").Find(&res)
 
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		log.WithContext(session.Ctx.(*context.Context)).Errorf("SQL:%s  Error: %+v", ssql, err)
@@ -234,9 +232,9 @@ func (a action) List(session *gopop.Session, msg string) ([]gopop.MailInfo, erro
 	var ssql string
 
 	if listId != 0 {
-		err = db.Instance.Select("id, ifnull(LENGTH(TEXT) , 0) + ifnull(LENGTH(html) , 0) AS `size`").Table("email").Where("id=?", listId).Find(&res)
+		err = db.Instance.SQL("select id, "+sizeField+" AS `size` from email left join email_source on email_source.email_id = email.id where id=? and user_id=?", listId, session.Ctx.(*context.Context).UserID).Find(&res)
 	} else {
-		err = db.Instance.Select("id, ifnull(LENGTH(TEXT) , 0) + ifnull(LENGTH(html) , 0) AS `size`").Table("email").Where("type=0 and status=0").Find(&res)
+		err = db.Instance.SQL("select id, "+sizeField+" AS `size` from email left join email_source on email_source.email_id = email.id where type=0 and status=0 and user_id=?", session.Ctx.(*context.Context).UserID).Find(&res)
 	}
 
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
@@ -257,13 +255,12 @@ func (a action) List(session *gopop.Session, msg string) ([]gopop.MailInfo, erro
 // Retr 获取邮件详情
 func (a action) Retr(session *gopop.Session, id int64) (string, int64, error) {
 	log.WithContext(session.Ctx).Debugf("POP3 CMD: RETR ,Args:%d", id)
-	email, err := detail.GetEmailDetail(session.Ctx.(*context.Context), cast.ToInt(id), false)
+	_, ret, err := detail.GetEmailSource(session.Ctx.(*context.Context), cast.ToInt(id))
 	if err != nil {
 		log.WithContext(session.Ctx.(*context.Context)).Errorf("%+v", err)
 		return "", 0, errors.New("server error")
 	}
 
-	ret := email.ToTransObj().BuildBytes(session.Ctx.(*context.Context), false)
 	return string(ret), cast.ToInt64(len(ret)), nil
 
 }
@@ -285,17 +282,16 @@ func (a action) Rest(session *gopop.Session) error {
 
 func (a action) Top(session *gopop.Session, id int64, n int) (string, error) {
 	log.WithContext(session.Ctx).Debugf("POP3 CMD: TOP %d %d", id, n)
-	email, err := detail.GetEmailDetail(session.Ctx.(*context.Context), cast.ToInt(id), false)
+	_, ret, err := detail.GetEmailSource(session.Ctx.(*context.Context), cast.ToInt(id))
 	if err != nil {
 		log.WithContext(session.Ctx.(*context.Context)).Errorf("%+v", err)
 		return "", errors.New("server error")
 	}
 
-	ret := email.ToTransObj().BuildBytes(session.Ctx.(*context.Context), false)
 	res := strings.Split(string(ret), "\n")
 	headerEndLine := len(res) - 1
 	for i, re := range res {
-		if re == "\r" {
+		if strings.TrimSuffix(re, "\r") == "" {
 			headerEndLine = i
 			break
 		}
@@ -317,7 +313,7 @@ func (a action) Quit(session *gopop.Session) error {
 	log.WithContext(session.Ctx).Debugf("POP3 CMD: QUIT ")
 	if len(session.DeleteIds) > 0 {
 
-		_, err := db.Instance.Exec(db.WithContext(session.Ctx.(*context.Context), "UPDATE email SET status=3 WHERE id in ?"), session.DeleteIds)
+		_, err := db.Instance.Exec(db.WithContext(session.Ctx.(*context.Context), "UPDATE email SET status=3 WHERE id in ? and user_id=?"), session.DeleteIds, session.Ctx.(*context.Context).UserID)
 		if err != nil {
 			log.WithContext(session.Ctx.(*context.Context)).Errorf("%+v", err)
 		}
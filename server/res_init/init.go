@@ -9,8 +9,14 @@ import (
 	"pmail/dto/parsemail"
 	"pmail/hooks"
 	"pmail/http_server"
+	"pmail/imap_server"
+	"pmail/managesieve_server"
 	"pmail/models"
 	"pmail/pop3_server"
+	"pmail/services/attachments"
+	"pmail/services/detail"
+	"pmail/services/queue"
+	"pmail/services/search"
 	"pmail/services/setup/ssl"
 	"pmail/session"
 	"pmail/signal"
@@ -39,6 +45,9 @@ func Init(serverVersion string) {
 			panic(err)
 		}
 		models.SyncTables()
+		search.Init()
+		attachments.Init()
+		detail.Init()
 		session.Init()
 		hooks.Init(serverVersion)
 		// smtp server start
@@ -50,6 +59,13 @@ func Init(serverVersion string) {
 		// pop3 server start
 		go pop3_server.Start()
 		go pop3_server.StartWithTls()
+		// imap server start
+		go imap_server.Start()
+		go imap_server.StartWithTLS()
+		// managesieve server start
+		go managesieve_server.Start()
+		// 发信队列
+		go queue.Start()
 
 		configStr, _ := json.Marshal(config.Instance)
 		log.Warnf("Config File Info:  %s", configStr)
@@ -60,6 +76,9 @@ func Init(serverVersion string) {
 		http_server.HttpsStop()
 		http_server.HttpStop()
 		pop3_server.Stop()
+		imap_server.Stop()
+		managesieve_server.Stop()
+		queue.Stop()
 	}
 
 }
@@ -0,0 +1,275 @@
+package alias
+
+import (
+	log "github.com/sirupsen/logrus"
+	"pmail/config"
+	"pmail/db"
+	"pmail/models"
+	"pmail/services/user"
+	"pmail/utils/array"
+	"pmail/utils/context"
+	"pmail/utils/errors"
+	"strings"
+	"xorm.io/builder"
+)
+
+// 别名最多嵌套的层数
+const maxDepth = 10
+
+// 一封邮件最多展开的地址数量
+const maxSteps = 1000
+
+type Item struct {
+	Address string   `json:"address"`
+	Targets []string `json:"targets"`
+}
+
+// Expansion 收件地址展开后的结果
+type Expansion struct {
+	Users    []*models.User   // 本地用户
+	External []string         // 外部地址，需要转发
+	Rcpt     map[int][]string // 每个本地用户由哪些信封收件地址展开得到
+}
+
+// Empty 没有任何投递目标
+func (e *Expansion) Empty() bool {
+	return len(e.Users) == 0 && len(e.External) == 0
+}
+
+// lookupTargets 查询地址的别名目标，测试时可以替换
+var lookupTargets = func(ctx *context.Context, address string) ([]string, error) {
+	var targets []string
+	err := db.Instance.Table("alias").Where("address=?", address).Asc("id").Cols("target").Find(&targets)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return targets, nil
+}
+
+// lookupUser 根据账号或者用户设置的收信地址前缀查询用户，测试时可以替换
+var lookupUser = func(ctx *context.Context, account string) (*models.User, error) {
+	var userIds []int
+	err := db.Instance.Table("user_auth").Where("email_account=?", account).Cols("user_id").Find(&userIds)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	var users []*models.User
+	err = db.Instance.Where(builder.Eq{"account": account}.Or(builder.In("id", userIds))).Asc("id").Limit(1).Find(&users)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return users[0], nil
+}
+
+// IsLocalDomain 是否是本机收信的域名
+func IsLocalDomain(domain string) bool {
+	for _, d := range config.Instance.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand 展开收件地址
+// 本地地址优先使用别名，其次是账号和收信地址前缀，都没有时使用该域名的catch-all，外部地址直接返回
+func Expand(ctx *context.Context, addresses []string) (*Expansion, error) {
+	e := &expander{
+		ctx:      ctx,
+		ret:      &Expansion{Rcpt: map[int][]string{}},
+		path:     map[string]bool{},
+		users:    map[int]bool{},
+		external: map[string]bool{},
+	}
+	for _, address := range addresses {
+		e.rcpt = address
+		if err := e.expand(address, 0); err != nil {
+			return nil, err
+		}
+	}
+	return e.ret, nil
+}
+
+type expander struct {
+	ctx      *context.Context
+	ret      *Expansion
+	path     map[string]bool // 当前展开路径上的地址，用于检测循环
+	users    map[int]bool
+	external map[string]bool
+	steps    int
+	rcpt     string // 当前展开的信封收件地址
+}
+
+func (e *expander) expand(address string, depth int) error {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if address == "" {
+		return nil
+	}
+	if e.path[address] {
+		log.WithContext(e.ctx).Warnf("Alias Loop Detected: %s", address)
+		return nil
+	}
+	if depth > maxDepth {
+		log.WithContext(e.ctx).Warnf("Alias Too Deep: %s", address)
+		return nil
+	}
+	e.steps++
+	if e.steps > maxSteps {
+		log.WithContext(e.ctx).Warnf("Alias Too Many Targets: %s", address)
+		return nil
+	}
+
+	idx := strings.LastIndex(address, "@")
+	// 没有@的是本地账号
+	if idx < 0 {
+		_, err := e.addUser(address)
+		return err
+	}
+	local, domain := address[:idx], address[idx+1:]
+	if !IsLocalDomain(domain) {
+		if !e.external[address] {
+			e.external[address] = true
+			e.ret.External = append(e.ret.External, address)
+		}
+		return nil
+	}
+
+	targets, err := lookupTargets(e.ctx, address)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		found, err := e.addUser(local)
+		if err != nil || found {
+			return err
+		}
+		targets, err = lookupTargets(e.ctx, "*@"+domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.path[address] = true
+	defer delete(e.path, address)
+	for _, target := range targets {
+		if err = e.expand(target, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *expander) addUser(account string) (bool, error) {
+	u, err := lookupUser(e.ctx, account)
+	if err != nil || u == nil {
+		return false, err
+	}
+	if !e.users[u.ID] {
+		e.users[u.ID] = true
+		e.ret.Users = append(e.ret.Users, u)
+	}
+	if !array.InArray(e.rcpt, e.ret.Rcpt[u.ID]) {
+		e.ret.Rcpt[u.ID] = append(e.ret.Rcpt[u.ID], e.rcpt)
+	}
+	return true, nil
+}
+
+// GetList 获取全部别名，同一个地址的目标合并在一起
+func GetList(ctx *context.Context) ([]*Item, error) {
+	var rows []*models.Alias
+	err := db.Instance.Asc("address", "id").Find(&rows)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	ret := []*Item{}
+	for _, row := range rows {
+		if len(ret) == 0 || ret[len(ret)-1].Address != row.Address {
+			ret = append(ret, &Item{Address: row.Address})
+		}
+		item := ret[len(ret)-1]
+		item.Targets = append(item.Targets, row.Target)
+	}
+	return ret, nil
+}
+
+// CheckAddress 别名地址必须是本机域名下的地址，*@domain表示catch-all
+func CheckAddress(address string) (string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	idx := strings.LastIndex(address, "@")
+	if idx <= 0 || !IsLocalDomain(address[idx+1:]) {
+		return "", errors.New("alias address must be in local domains")
+	}
+	local := address[:idx]
+	if local != "*" && !user.CheckAccount(local) {
+		return "", errors.New("alias address error")
+	}
+	return address, nil
+}
+
+// CheckTargets 检查并整理别名目标，目标可以是本地账号或者邮箱地址，不能指向自己
+func CheckTargets(address string, targets []string) ([]string, error) {
+	var list []string
+	for _, target := range targets {
+		target = strings.ToLower(strings.TrimSpace(target))
+		if target == "" {
+			continue
+		}
+		if target == address {
+			return nil, errors.New("alias can not point to itself")
+		}
+		idx := strings.LastIndex(target, "@")
+		if (idx < 0 && !user.CheckAccount(target)) || idx == 0 || idx == len(target)-1 {
+			return nil, errors.New("alias target error: " + target)
+		}
+		list = append(list, target)
+	}
+	return array.Unique(list), nil
+}
+
+// Set 设置别名的全部目标，会覆盖原有设置
+func Set(ctx *context.Context, address string, targets []string) error {
+	address, err := CheckAddress(address)
+	if err != nil {
+		return err
+	}
+	list, err := CheckTargets(address, targets)
+	if err != nil {
+		return err
+	}
+
+	trans := db.Instance.NewSession()
+	defer trans.Close()
+	if err := trans.Begin(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	_, err = trans.Exec(db.WithContext(ctx, "delete from alias where address=?"), address)
+	if err != nil {
+		trans.Rollback()
+		return errors.Wrap(err)
+	}
+	for _, target := range list {
+		_, err = trans.Insert(&models.Alias{Address: address, Target: target})
+		if err != nil {
+			trans.Rollback()
+			return errors.Wrap(err)
+		}
+	}
+
+	if err = trans.Commit(); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// Delete 删除别名
+func Delete(ctx *context.Context, address string) error {
+	_, err := db.Instance.Exec(db.WithContext(ctx, "delete from alias where address=?"), strings.ToLower(strings.TrimSpace(address)))
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
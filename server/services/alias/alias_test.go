@@ -0,0 +1,111 @@
+package alias
+
+import (
+	"pmail/config"
+	"pmail/models"
+	"pmail/utils/context"
+	"sort"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	config.Instance = &config.Config{Domains: []string{"example.com"}}
+	aliases := map[string][]string{
+		"team@example.com":     {"alice", "bob@example.com", "partner@other.com"},
+		"bob@example.com":      {"bob", "bob@gmail.com"},
+		"loop1@example.com":    {"loop2@example.com"},
+		"loop2@example.com":    {"loop1@example.com", "alice"},
+		"all@example.com":      {"team@example.com", "bob@example.com"},
+		"*@example.com":        {"catchall@example.com"},
+		"catchall@example.com": {"missing@example.com"},
+	}
+	users := map[string]*models.User{
+		"alice": {ID: 1, Account: "alice"},
+		"bob":   {ID: 2, Account: "bob"},
+		"admin": {ID: 3, Account: "admin"},
+	}
+	lookupTargets = func(ctx *context.Context, address string) ([]string, error) {
+		return aliases[address], nil
+	}
+	lookupUser = func(ctx *context.Context, account string) (*models.User, error) {
+		return users[account], nil
+	}
+
+	tests := []struct {
+		to       []string
+		users    []int
+		external []string
+	}{
+		{[]string{"Alice@Example.com"}, []int{1}, nil},
+		{[]string{"team@example.com"}, []int{1, 2}, []string{"bob@gmail.com", "partner@other.com"}},
+		// 列表嵌套时同一个用户只投递一次
+		{[]string{"all@example.com", "alice@example.com"}, []int{1, 2}, []string{"bob@gmail.com", "partner@other.com"}},
+		// 循环的别名只展开一次
+		{[]string{"loop1@example.com"}, []int{1}, nil},
+		// catch-all指向不存在的地址时不会无限展开
+		{[]string{"nobody@example.com"}, nil, nil},
+		{[]string{"someone@other.com"}, nil, []string{"someone@other.com"}},
+	}
+	for _, tt := range tests {
+		ret, err := Expand(&context.Context{}, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, u := range ret.Users {
+			ids = append(ids, u.ID)
+		}
+		sort.Ints(ids)
+		sort.Strings(ret.External)
+		if len(ids) != len(tt.users) || len(ret.External) != len(tt.external) {
+			t.Errorf("Expand(%v) = %v %v", tt.to, ids, ret.External)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.users[i] {
+				t.Errorf("Expand(%v) users = %v", tt.to, ids)
+			}
+		}
+		for i := range ret.External {
+			if ret.External[i] != tt.external[i] {
+				t.Errorf("Expand(%v) external = %v", tt.to, ret.External)
+			}
+		}
+	}
+
+	// 每个用户只对应展开到自己的信封收件地址
+	ret, _ := Expand(&context.Context{}, []string{"team@example.com", "Alice@Example.com", "bob@gmail.com"})
+	if len(ret.Rcpt[1]) != 2 || ret.Rcpt[1][0] != "team@example.com" || ret.Rcpt[1][1] != "Alice@Example.com" {
+		t.Errorf("alice rcpt = %v", ret.Rcpt[1])
+	}
+	if len(ret.Rcpt[2]) != 1 || ret.Rcpt[2][0] != "team@example.com" {
+		t.Errorf("bob rcpt = %v", ret.Rcpt[2])
+	}
+
+	// catch-all指向本地账号
+	aliases["*@example.com"] = []string{"admin"}
+	ret, _ = Expand(&context.Context{}, []string{"nobody@example.com"})
+	if len(ret.Users) != 1 || ret.Users[0].ID != 3 {
+		t.Errorf("catch-all = %+v", ret.Users)
+	}
+}
+
+func TestCheckTargets(t *testing.T) {
+	config.Instance = &config.Config{Domains: []string{"example.com"}}
+	if _, err := CheckAddress("list@other.com"); err == nil {
+		t.Error("alias in other domain should fail")
+	}
+	if a, err := CheckAddress(" *@Example.com "); err != nil || a != "*@example.com" {
+		t.Errorf("catch-all address = %s, %v", a, err)
+	}
+	if _, err := CheckTargets("list@example.com", []string{"list@example.com"}); err == nil {
+		t.Error("self target should fail")
+	}
+	if _, err := CheckTargets("list@example.com", []string{"bad account"}); err == nil {
+		t.Error("bad account should fail")
+	}
+	list, err := CheckTargets("list@example.com", []string{"alice", " Bob@Gmail.com", "", "alice"})
+	if err != nil || len(list) != 2 {
+		t.Errorf("targets = %v, %v", list, err)
+	}
+}
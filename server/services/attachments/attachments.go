@@ -1,60 +1,253 @@
 package attachments
 
 import (
+	"bytes"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"pmail/db"
 	"pmail/dto/parsemail"
 	"pmail/models"
 	"pmail/services/auth"
+	"pmail/utils/blob"
 	"pmail/utils/context"
+	"pmail/utils/errors"
 )
 
-func GetAttachments(ctx *context.Context, emailId int, cid string) (string, []byte) {
+// Meta 附件元数据，保存到email表的attachments字段，不包含附件内容
+func Meta(atts []*parsemail.Attachment) string {
+	meta := []*parsemail.Attachment{}
+	for _, att := range atts {
+		meta = append(meta, &parsemail.Attachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			ContentID:   att.ContentID,
+		})
+	}
+	by, _ := json.Marshal(meta)
+	return string(by)
+}
 
-	// 获取邮件内容
-	var email models.Email
-	_, err := db.Instance.ID(emailId).Get(&email)
+// Save 保存邮件的附件，附件内容写入附件存储，元数据写入attachment表
+func Save(ctx *context.Context, emailId int, atts []*parsemail.Attachment) error {
+	for i, att := range atts {
+		if err := save(emailId, i, att); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func save(emailId, idx int, att *parsemail.Attachment) error {
+	hash := blob.Hash(att.Content)
+	unlock := blob.Lock(hash)
+	defer unlock()
+	if err := blob.PutHash(hash, att.Content); err != nil {
+		return err
+	}
+	_, err := db.Instance.Insert(&models.Attachment{
+		EmailId:     emailId,
+		Idx:         idx,
+		Filename:    att.Filename,
+		ContentType: att.ContentType,
+		ContentId:   att.ContentID,
+		Size:        int64(len(att.Content)),
+		Hash:        hash,
+	})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// Load 读取邮件的全部附件内容，用于重新生成邮件原文
+func Load(ctx *context.Context, email *models.Email) []*parsemail.Attachment {
+	ret := email.GetAttachments()
+	if len(ret) == 0 || email.Id == 0 {
+		return ret
+	}
+
+	var rows []*models.Attachment
+	err := db.Instance.Where("email_id = ?", email.Id).Find(&rows)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return ret
+	}
+	for _, row := range rows {
+		if row.Idx < 0 || row.Idx >= len(ret) || ret[row.Idx].Content != nil {
+			continue
+		}
+		content, err := blob.Read(row.Hash)
+		if err != nil {
+			log.WithContext(ctx).Errorf("Attachment Read Error:%+v", err)
+			continue
+		}
+		ret[row.Idx].Content = content
+	}
+	return ret
+}
+
+// Copy 复制邮件时复制附件记录，附件文件不需要复制
+func Copy(ctx *context.Context, fromId, toId int) {
+	var rows []*models.Attachment
+	err := db.Instance.Where("email_id = ?", fromId).Find(&rows)
 	if err != nil {
 		log.WithContext(ctx).Errorf("SQL error:%+v", err)
-		return "", nil
+		return
+	}
+	for _, row := range rows {
+		row.Id = 0
+		row.EmailId = toId
+		copyRow(ctx, row)
 	}
+}
 
-	// 检查权限
-	if !auth.HasAuth(ctx, &email) {
-		return "", nil
+// copyRow 检查文件和增加引用在锁内完成，避免原邮件同时被删除时引用已经删除的文件
+func copyRow(ctx *context.Context, row *models.Attachment) {
+	unlock := blob.Lock(row.Hash)
+	defer unlock()
+	if !blob.Exist(row.Hash) {
+		log.WithContext(ctx).Errorf("Attachment Copy Error: %s not exist", row.Hash)
+		return
+	}
+	_, err := db.Instance.Insert(row)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+	}
+}
+
+// Hashes 获取邮件引用的全部附件文件
+func Hashes(ctx *context.Context, emailIds ...int) []string {
+	if len(emailIds) == 0 {
+		return nil
+	}
+	var hashes []string
+	err := db.Instance.Table("attachment").In("email_id", emailIds).Distinct("hash").Find(&hashes)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+	}
+	return hashes
+}
+
+// Remove 邮件彻底删除后删除附件记录，没有其他邮件引用的文件一并删除
+func Remove(ctx *context.Context, emailIds ...int) {
+	if len(emailIds) == 0 {
+		return
+	}
+	hashes := Hashes(ctx, emailIds...)
+	_, err := db.Instance.In("email_id", emailIds).Delete(&models.Attachment{})
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return
+	}
+	Clean(ctx, hashes)
+}
+
+// Clean 删除没有被附件、邮件原文或者待转发邮件引用的文件
+func Clean(ctx *context.Context, hashes []string) {
+	for _, hash := range hashes {
+		clean(ctx, hash)
+	}
+}
+
+func clean(ctx *context.Context, hash string) {
+	if hash == "" {
+		return
+	}
+	// 检查引用和删除文件在锁内完成，避免同时保存的相同文件被删除
+	unlock := blob.Lock(hash)
+	defer unlock()
+	exist, err := db.Instance.Where("hash = ?", hash).Exist(&models.Attachment{})
+	if err == nil && !exist {
+		exist, err = db.Instance.Where("hash = ?", hash).Exist(&models.EmailSource{})
+	}
+	if err == nil && !exist {
+		// 等待转发的邮件原文
+		exist, err = db.Instance.Where("source_hash = ? and status = 0", hash).Exist(&models.SendQueue{})
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return
+	}
+	if exist {
+		return
+	}
+	if err = blob.Remove(hash); err != nil {
+		log.WithContext(ctx).Errorf("Attachment Remove Error:%+v", err)
+	}
+}
+
+// open 读取附件，老版本的附件内容保存在email表中，迁移完成前从email表读取
+func open(ctx *context.Context, email *models.Email, match func(idx int, contentId string) bool) (*models.Attachment, io.ReadCloser) {
+	var rows []*models.Attachment
+	err := db.Instance.Where("email_id = ?", email.Id).Asc("idx").Find(&rows)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return nil, nil
+	}
+	for _, row := range rows {
+		if !match(row.Idx, row.ContentId) {
+			continue
+		}
+		f, err := blob.Open(row.Hash)
+		if err != nil {
+			log.WithContext(ctx).Errorf("Attachment Open Error:%+v", err)
+			return nil, nil
+		}
+		return row, f
+	}
+	if len(rows) > 0 {
+		return nil, nil
 	}
 
 	var atts []parsemail.Attachment
 	_ = json.Unmarshal([]byte(email.Attachments), &atts)
-	for _, att := range atts {
-		if att.ContentID == cid {
-			return att.ContentType, att.Content
+	for i, att := range atts {
+		if match(i, att.ContentID) && att.Content != nil {
+			return &models.Attachment{
+				Filename:    att.Filename,
+				ContentType: att.ContentType,
+				Size:        int64(len(att.Content)),
+			}, io.NopCloser(bytes.NewReader(att.Content))
 		}
 	}
-	return "", nil
+	return nil, nil
 }
 
-func GetAttachmentsByIndex(ctx *context.Context, emailId int, index int) (string, []byte) {
-
+func getEmail(ctx *context.Context, emailId int) *models.Email {
 	// 获取邮件内容
 	var email models.Email
-	_, err := db.Instance.ID(emailId).Get(&email)
+	exist, err := db.Instance.ID(emailId).Get(&email)
 	if err != nil {
 		log.WithContext(ctx).Errorf("SQL error:%+v", err)
-		return "", nil
+		return nil
 	}
 
 	// 检查权限
-	if !auth.HasAuth(ctx, &email) {
-		return "", nil
+	if !exist || !auth.HasAuth(ctx, &email) {
+		return nil
 	}
+	return &email
+}
 
-	var atts []parsemail.Attachment
-	_ = json.Unmarshal([]byte(email.Attachments), &atts)
+// GetAttachments 根据cid获取正文中引用的附件，返回的reader需要调用方关闭
+func GetAttachments(ctx *context.Context, emailId int, cid string) (*models.Attachment, io.ReadCloser) {
+	email := getEmail(ctx, emailId)
+	if email == nil {
+		return nil, nil
+	}
+	return open(ctx, email, func(idx int, contentId string) bool {
+		return contentId == cid
+	})
+}
 
-	if len(atts) > index {
-		return atts[index].Filename, atts[index].Content
+// GetAttachmentsByIndex 根据序号获取附件，返回的reader需要调用方关闭
+func GetAttachmentsByIndex(ctx *context.Context, emailId int, index int) (*models.Attachment, io.ReadCloser) {
+	email := getEmail(ctx, emailId)
+	if email == nil {
+		return nil, nil
 	}
-	return "", nil
+	return open(ctx, email, func(idx int, contentId string) bool {
+		return idx == index
+	})
 }
@@ -0,0 +1,74 @@
+package attachments
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"pmail/db"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"pmail/utils/context"
+	"sync/atomic"
+)
+
+// 每批迁移的邮件数量
+const migrateBatch = 50
+
+var migrating atomic.Bool
+
+// Init 老版本的附件内容以base64保存在email表中，启动后在后台迁移到附件存储
+func Init() {
+	go Migrate()
+}
+
+// Migrate 把email表中的附件内容迁移到附件存储，可以重复执行
+func Migrate() {
+	if !migrating.CompareAndSwap(false, true) {
+		return
+	}
+	defer migrating.Store(false)
+
+	ctx := &context.Context{}
+	lastId := 0
+	num := 0
+	for {
+		var emails []*models.Email
+		err := db.Instance.Where("id > ? and attachments like ?", lastId, `%"Content":"%`).Asc("id").Limit(migrateBatch).Find(&emails)
+		if err != nil {
+			log.Errorf("Attachment Migrate SQL Error: %+v", err)
+			return
+		}
+		for _, email := range emails {
+			lastId = email.Id
+			if err = migrate(ctx, email); err != nil {
+				log.Errorf("Attachment Migrate Error, email %d: %+v", email.Id, err)
+				continue
+			}
+			num++
+		}
+		if len(emails) < migrateBatch {
+			break
+		}
+	}
+	if num > 0 {
+		log.Infof("Attachment Migrate End, %d emails", num)
+	}
+}
+
+func migrate(ctx *context.Context, email *models.Email) error {
+	var atts []*parsemail.Attachment
+	err := json.Unmarshal([]byte(email.Attachments), &atts)
+	if err != nil {
+		return err
+	}
+
+	// 上次迁移中断时可能已经写入了部分记录
+	_, err = db.Instance.Where("email_id = ?", email.Id).Delete(&models.Attachment{})
+	if err != nil {
+		return err
+	}
+	if err = Save(ctx, email.Id, atts); err != nil {
+		return err
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "update email set attachments=? where id=?"), Meta(atts), email.Id)
+	return err
+}
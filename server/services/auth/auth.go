@@ -7,36 +7,147 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"pmail/config"
 	"pmail/db"
 	"pmail/models"
+	"pmail/services/throttle"
 	"pmail/utils/context"
+	"pmail/utils/password"
 	"strings"
 )
 
-// HasAuth 检查当前用户是否有某个邮件的auth
+// HasAuth 检查当前用户是否有某个邮件的auth，邮件只有所属用户可以访问
 func HasAuth(ctx *context.Context, email *models.Email) bool {
-	// 获取当前用户的auth
-	var auth []models.UserAuth
-	err := db.Instance.Where("user_id = ?", ctx.UserID).Find(&auth)
+	if ctx == nil || email == nil || ctx.UserID == 0 {
+		return false
+	}
+	return email.UserId == ctx.UserID
+}
+
+// CheckPassword 校验账号密码，成功返回用户信息。老版本的md5密码校验通过后自动升级为bcrypt
+func CheckPassword(ctx *context.Context, account, pwd string) *models.User {
+	var user models.User
+	exist, err := db.Instance.Where("account =? and disabled = 0", account).Get(&user)
 	if err != nil {
 		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return nil
+	}
+	if !exist {
+		return nil
+	}
+
+	ok, needRehash := password.Verify(pwd, user.Password)
+	if !ok {
+		return nil
+	}
+
+	if needRehash {
+		hash, err := password.Hash(pwd)
+		if err == nil {
+			_, err = db.Instance.Exec(db.WithContext(ctx, "update user set password=? where id=?"), hash, user.ID)
+		}
+		if err != nil {
+			log.WithContext(ctx).Errorf("Password Rehash Error:%+v", err)
+		} else {
+			log.WithContext(ctx).Infof("Password Rehash, User:%s", user.Account)
+			user.Password = hash
+		}
+	}
+
+	return &user
+}
+
+var (
+	ErrLocked        = errors.New("too many failed attempts, try again later")
+	ErrPasswordWrong = errors.New("account or password error")
+)
+
+const ProtocolHTTP = "http"
+
+// checkMailPassword 邮件客户端可以使用应用专用密码登陆，开启两步验证后只能使用应用专用密码
+func checkMailPassword(ctx *context.Context, account, pwd string) *models.User {
+	user := CheckPassword(ctx, account, pwd)
+	if user != nil && user.TotpEnabled == 0 {
+		return user
+	}
+	if user != nil {
+		log.WithContext(ctx).Infof("Two-factor authentication enabled, app password required. Account:%s", account)
+	}
+	return CheckAppPassword(ctx, account, pwd)
+}
+
+// Login 各协议统一的登陆入口，失败次数过多时锁定账号或封禁IP
+func Login(ctx *context.Context, protocol, ip, account, pwd string) (*models.User, error) {
+	user, err := CheckLogin(ctx, protocol, ip, account, pwd)
+	if err != nil {
+		return nil, err
+	}
+	throttle.Success(ip, account)
+	return user, nil
+}
+
+// CheckLogin 只校验密码，成功时不清空失败次数
+// 需要两步验证时，第二步也通过后才能调用throttle.Success，否则可以不受限制的尝试验证码
+func CheckLogin(ctx *context.Context, protocol, ip, account, pwd string) (*models.User, error) {
+	if !throttle.Allow(ip, account) {
+		log.WithContext(ctx).Warnf("Login Locked! Protocol:%s IP:%s Account:%s", protocol, ip, account)
+		return nil, ErrLocked
+	}
+	var user *models.User
+	if protocol == ProtocolHTTP {
+		user = CheckPassword(ctx, account, pwd)
+	} else {
+		user = checkMailPassword(ctx, account, pwd)
+	}
+	if user == nil {
+		log.WithContext(ctx).Infof("Login Failed! Protocol:%s IP:%s Account:%s", protocol, ip, account)
+		throttle.Failed(ctx, protocol, ip, account)
+		return nil, ErrPasswordWrong
+	}
+	return user, nil
+}
+
+// HasSendAuth 检查当前用户是否可以使用某个地址发信，账号本身以及user_auth中设置的地址前缀可以发信，*表示任意地址
+func HasSendAuth(ctx *context.Context, address string) bool {
+	if ctx == nil || ctx.UserID == 0 {
+		return false
+	}
+	idx := strings.LastIndex(address, "@")
+	if idx <= 0 {
 		return false
 	}
+	account, domain := address[:idx], address[idx+1:]
 
-	var hasAuth bool
-	for _, userAuth := range auth {
-		if userAuth.EmailAccount == "*" {
-			hasAuth = true
-			break
-		} else if strings.Contains(email.Bcc, ctx.UserAccount) || strings.Contains(email.Cc, ctx.UserAccount) || strings.Contains(email.To, ctx.UserAccount) {
-			hasAuth = true
+	isLocal := false
+	for _, d := range config.Instance.Domains {
+		if strings.EqualFold(d, domain) {
+			isLocal = true
 			break
 		}
 	}
+	if !isLocal {
+		return false
+	}
 
-	return hasAuth
+	if strings.EqualFold(account, ctx.UserAccount) {
+		return true
+	}
+
+	var auths []models.UserAuth
+	err := db.Instance.Where("user_id = ?", ctx.UserID).Find(&auths)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return false
+	}
+	for _, auth := range auths {
+		if auth.EmailAccount == "*" || strings.EqualFold(auth.EmailAccount, account) {
+			return true
+		}
+	}
+	return false
 }
 
 func DkimGen() string {
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"pmail/config"
+	"pmail/db"
+	"pmail/models"
+	"pmail/utils/context"
+	"pmail/utils/totp"
+	"strings"
+	"time"
+)
+
+const totpIssuer = "PMail"
+
+// 恢复码数量
+const recoveryCodeNum = 10
+
+var (
+	ErrTotpEnabled  = errors.New("two-factor authentication already enabled")
+	ErrTotpNotSetup = errors.New("two-factor authentication not set up")
+	ErrCodeWrong    = errors.New("verification code error")
+)
+
+// 去掉容易混淆的字符
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+const appPasswordAlphabet = "abcdefghijklmnopqrstuvwxyz"
+
+func randomString(n int, alphabet string) (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(alphabet)))
+	for i := 0; i < n; i++ {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(alphabet[idx.Int64()])
+	}
+	return b.String(), nil
+}
+
+// hashSecret 恢复码和应用专用密码都是高强度的随机字符串，使用sha256存储，方便直接查询
+func hashSecret(s string) string {
+	s = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(s))
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func getUser(ctx *context.Context) (*models.User, error) {
+	var user models.User
+	exist, err := db.Instance.ID(ctx.UserID).Get(&user)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, errors.New("user not found")
+	}
+	return &user, nil
+}
+
+// TotpSetup 生成新的TOTP密钥，验证通过前不会生效
+func TotpSetup(ctx *context.Context) (secret, uri string, err error) {
+	user, err := getUser(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TotpEnabled == 1 {
+		return "", "", ErrTotpEnabled
+	}
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "update user set totp_secret=? where id=?"), secret, user.ID)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(totpIssuer, user.Account+"@"+config.Instance.Domain, secret), nil
+}
+
+// TotpEnable 验证客户端生成的验证码，通过后开启两步验证并返回恢复码
+func TotpEnable(ctx *context.Context, code string) ([]string, error) {
+	user, err := getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user.TotpEnabled == 1 {
+		return nil, ErrTotpEnabled
+	}
+	if user.TotpSecret == "" {
+		return nil, ErrTotpNotSetup
+	}
+	step, ok := totp.ValidateStep(user.TotpSecret, code, time.Now())
+	if !ok {
+		return nil, ErrCodeWrong
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "update user set totp_enabled=1, totp_step=? where id=?"), step, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	log.WithContext(ctx).Infof("TOTP Enabled, User:%s", user.Account)
+	return GenRecoveryCodes(ctx)
+}
+
+// TotpDisable 关闭两步验证，需要提供验证码或者恢复码
+func TotpDisable(ctx *context.Context, code string) error {
+	user, err := getUser(ctx)
+	if err != nil {
+		return err
+	}
+	if user.TotpEnabled == 0 {
+		return ErrTotpNotSetup
+	}
+	if !CheckSecondFactor(ctx, user, code) {
+		return ErrCodeWrong
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "update user set totp_secret='', totp_enabled=0 where id=?"), user.ID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "delete from recovery_code where user_id=?"), user.ID)
+	if err != nil {
+		return err
+	}
+	log.WithContext(ctx).Infof("TOTP Disabled, User:%s", user.Account)
+	return nil
+}
+
+// GenRecoveryCodes 重新生成恢复码，旧的恢复码全部失效
+func GenRecoveryCodes(ctx *context.Context) ([]string, error) {
+	var codes []string
+	for i := 0; i < recoveryCodeNum; i++ {
+		code, err := randomString(10, recoveryAlphabet)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	trans := db.Instance.NewSession()
+	defer trans.Close()
+	if err := trans.Begin(); err != nil {
+		return nil, err
+	}
+	_, err := trans.Exec(db.WithContext(ctx, "delete from recovery_code where user_id=?"), ctx.UserID)
+	if err != nil {
+		trans.Rollback()
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err = trans.Insert(&models.RecoveryCode{UserId: ctx.UserID, Code: hashSecret(code)})
+		if err != nil {
+			trans.Rollback()
+			return nil, err
+		}
+	}
+	if err = trans.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CheckSecondFactor 校验TOTP验证码，或者使用一个恢复码
+// 验证码的时间步必须比上一次使用的大，同一个验证码在有效期内不能重复使用
+func CheckSecondFactor(ctx *context.Context, user *models.User, code string) bool {
+	if user.TotpEnabled == 0 || code == "" {
+		return false
+	}
+	if step, ok := totp.ValidateStep(user.TotpSecret, code, time.Now()); ok {
+		res, err := db.Instance.Exec(db.WithContext(ctx, "update user set totp_step=? where id=? and totp_step<?"), step, user.ID, step)
+		if err != nil {
+			log.WithContext(ctx).Errorf("SQL error:%+v", err)
+			return false
+		}
+		if num, _ := res.RowsAffected(); num > 0 {
+			return true
+		}
+		log.WithContext(ctx).Infof("TOTP Code Reused, User:%s", user.Account)
+		return false
+	}
+	res, err := db.Instance.Exec(db.WithContext(ctx, "delete from recovery_code where user_id=? and code=?"), user.ID, hashSecret(code))
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return false
+	}
+	if num, _ := res.RowsAffected(); num > 0 {
+		log.WithContext(ctx).Infof("Recovery Code Used, User:%s", user.Account)
+		return true
+	}
+	return false
+}
+
+// CreateAppPassword 生成应用专用密码，明文只在创建时返回一次
+func CreateAppPassword(ctx *context.Context, name string) (string, error) {
+	pwd, err := randomString(16, appPasswordAlphabet)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Instance.Insert(&models.AppPassword{
+		UserId:   ctx.UserID,
+		Name:     name,
+		Password: hashSecret(pwd),
+	})
+	if err != nil {
+		return "", err
+	}
+	return pwd, nil
+}
+
+// GetAppPasswords 当前用户的全部应用专用密码
+func GetAppPasswords(ctx *context.Context) ([]*models.AppPassword, error) {
+	ret := []*models.AppPassword{}
+	err := db.Instance.Where("user_id=?", ctx.UserID).Desc("id").Find(&ret)
+	return ret, err
+}
+
+// DeleteAppPassword 撤销应用专用密码
+func DeleteAppPassword(ctx *context.Context, id int) error {
+	_, err := db.Instance.Exec(db.WithContext(ctx, "delete from app_password where id=? and user_id=?"), id, ctx.UserID)
+	return err
+}
+
+// CheckAppPassword 使用应用专用密码登陆
+func CheckAppPassword(ctx *context.Context, account, pwd string) *models.User {
+	var user models.User
+	exist, err := db.Instance.Where("account =? and disabled = 0", account).Get(&user)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return nil
+	}
+	if !exist {
+		return nil
+	}
+
+	var appPwd models.AppPassword
+	exist, err = db.Instance.Where("user_id=? and password=?", user.ID, hashSecret(pwd)).Get(&appPwd)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return nil
+	}
+	if !exist {
+		return nil
+	}
+
+	_, err = db.Instance.Exec(db.WithContext(ctx, "update app_password set last_use_time=? where id=?"), time.Now(), appPwd.Id)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+	}
+	return &user
+}
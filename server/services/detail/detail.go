@@ -8,7 +8,9 @@ import (
 	"pmail/db"
 	"pmail/dto/parsemail"
 	"pmail/models"
+	"pmail/services/auth"
 	"pmail/utils/context"
+	"pmail/utils/errors"
 	"strings"
 )
 
@@ -21,6 +23,11 @@ func GetEmailDetail(ctx *context.Context, id int, markRead bool) (*models.Email,
 		return nil, err
 	}
 
+	// 检查是否有权限
+	if !auth.HasAuth(ctx, &email) {
+		return nil, errors.New("No Auth!")
+	}
+
 	if markRead && email.IsRead == 0 {
 		_, err = db.Instance.Exec(db.WithContext(ctx, "update email set is_read =1 where id =?"), email.Id)
 		if err != nil {
@@ -0,0 +1,240 @@
+package detail
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"pmail/db"
+	"pmail/models"
+	"pmail/services/attachments"
+	"pmail/services/auth"
+	"pmail/utils/blob"
+	"pmail/utils/context"
+	"pmail/utils/errors"
+	"sync/atomic"
+)
+
+// 每批迁移的原文数量
+const migrateBatch = 50
+
+var migrating atomic.Bool
+
+// SaveSource 保存邮件原文，原文保存在附件存储中，多个收件人的相同原文只保存一份
+func SaveSource(ctx *context.Context, emailId int, content []byte) {
+	if len(content) == 0 {
+		return
+	}
+	SaveSourceReader(ctx, emailId, bytes.NewReader(content))
+}
+
+// SaveSourceReader 从reader中流式读取并保存邮件原文
+func SaveSourceReader(ctx *context.Context, emailId int, r io.Reader) {
+	if emailId <= 0 {
+		return
+	}
+	cr := &countReader{r: r}
+	hash, unlock, err := blob.PutReader(cr)
+	if err == nil {
+		_, err = db.Instance.Insert(&models.EmailSource{
+			EmailId: emailId,
+			Hash:    hash,
+			Size:    cr.n,
+		})
+		unlock()
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("Save Source Error:%+v", err)
+	}
+}
+
+// countReader 读取的同时统计原文大小
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CopySource 复制邮件时一起复制原文，原文文件不需要复制
+func CopySource(ctx *context.Context, fromId, toId int) {
+	var source models.EmailSource
+	exist, err := db.Instance.ID(fromId).Get(&source)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return
+	}
+	if !exist {
+		return
+	}
+	if source.Hash == "" {
+		SaveSource(ctx, toId, source.Content)
+		return
+	}
+	unlock := blob.Lock(source.Hash)
+	defer unlock()
+	if !blob.Exist(source.Hash) {
+		log.WithContext(ctx).Errorf("Source Copy Error: %s not exist", source.Hash)
+		return
+	}
+	_, err = db.Instance.Insert(&models.EmailSource{
+		EmailId: toId,
+		Hash:    source.Hash,
+		Size:    source.Size,
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+	}
+}
+
+// RemoveSource 邮件彻底删除后删除原文，没有其他邮件引用的文件一并删除
+func RemoveSource(ctx *context.Context, ids ...int) {
+	if len(ids) == 0 {
+		return
+	}
+	var hashes []string
+	err := db.Instance.Table("email_source").In("email_id", ids).Where("hash != ''").Distinct("hash").Find(&hashes)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+	}
+	_, err = db.Instance.In("email_id", ids).Delete(&models.EmailSource{})
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+		return
+	}
+	attachments.Clean(ctx, hashes)
+}
+
+// Stored 读取保存的邮件原文，没有保存原文时返回nil
+func Stored(ctx *context.Context, emailId int) []byte {
+	var source models.EmailSource
+	exist, err := db.Instance.ID(emailId).Get(&source)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL error:%+v", err)
+	}
+	if !exist {
+		return nil
+	}
+	if source.Hash == "" {
+		return source.Content
+	}
+	content, err := blob.Read(source.Hash)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Source Read Error:%+v", err)
+		return nil
+	}
+	return content
+}
+
+// Source 获取邮件原文，有保存原文的直接返回原文，网页发出的邮件没有原文，根据数据库内容重新生成
+func Source(ctx *context.Context, email *models.Email) []byte {
+	if content := Stored(ctx, email.Id); content != nil {
+		return content
+	}
+	return Rebuild(ctx, email)
+}
+
+// Rebuild 根据数据库内容重新生成邮件原文，原始邮件头中除了地址和主题以外的内容都没有保存
+func Rebuild(ctx *context.Context, email *models.Email) []byte {
+	e := email.ToTransObj()
+	e.Attachments = attachments.Load(ctx, email)
+	return e.BuildBytes(ctx, false)
+}
+
+// GetEmailSource 获取邮件原文，会检查权限
+func GetEmailSource(ctx *context.Context, id int) (*models.Email, []byte, error) {
+	var email models.Email
+	exist, err := db.Instance.ID(id).Get(&email)
+	if err != nil {
+		return nil, nil, errors.Wrap(err)
+	}
+	if !exist || !auth.HasAuth(ctx, &email) {
+		return nil, nil, errors.New("No Auth!")
+	}
+	return &email, Source(ctx, &email), nil
+}
+
+// Init 老版本的原文保存在email_source表中，启动后在后台迁移到附件存储
+func Init() {
+	go Migrate()
+}
+
+// Migrate 把email_source表中的原文迁移到附件存储，可以重复执行
+func Migrate() {
+	if !migrating.CompareAndSwap(false, true) {
+		return
+	}
+	defer migrating.Store(false)
+
+	lastId := 0
+	num := 0
+	for {
+		var rows []*models.EmailSource
+		err := db.Instance.Where("email_id > ? and hash = ''", lastId).Asc("email_id").Limit(migrateBatch).Find(&rows)
+		if err != nil {
+			log.Errorf("Source Migrate SQL Error: %+v", err)
+			return
+		}
+		for _, row := range rows {
+			lastId = row.EmailId
+			if err = migrate(row); err != nil {
+				log.Errorf("Source Migrate Error, email %d: %+v", row.EmailId, err)
+				continue
+			}
+			num++
+		}
+		if len(rows) < migrateBatch {
+			break
+		}
+	}
+	if num > 0 {
+		log.Infof("Source Migrate End, %d emails", num)
+	}
+	migrateSize()
+}
+
+// migrateSize 早期迁移的原文没有记录大小，从附件存储中补上
+func migrateSize() {
+	lastId := 0
+	for {
+		var rows []*models.EmailSource
+		err := db.Instance.Cols("email_id", "hash").Where("email_id > ? and hash != '' and size = 0", lastId).Asc("email_id").Limit(migrateBatch).Find(&rows)
+		if err != nil {
+			log.Errorf("Source Size Migrate SQL Error: %+v", err)
+			return
+		}
+		for _, row := range rows {
+			lastId = row.EmailId
+			info, err := os.Stat(blob.Path(row.Hash))
+			if err != nil {
+				log.Errorf("Source Size Migrate Error, email %d: %+v", row.EmailId, err)
+				continue
+			}
+			_, err = db.Instance.Exec("update email_source set size=? where email_id=?", info.Size(), row.EmailId)
+			if err != nil {
+				log.Errorf("Source Size Migrate SQL Error, email %d: %+v", row.EmailId, err)
+			}
+		}
+		if len(rows) < migrateBatch {
+			break
+		}
+	}
+}
+
+func migrate(row *models.EmailSource) error {
+	hash := blob.Hash(row.Content)
+	unlock := blob.Lock(hash)
+	defer unlock()
+	if err := blob.PutHash(hash, row.Content); err != nil {
+		return err
+	}
+	_, err := db.Instance.Exec("update email_source set hash=?, size=?, content=null where email_id=?", hash, len(row.Content), row.EmailId)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package dmarc_report
+
+import (
+	log "github.com/sirupsen/logrus"
+	"pmail/config"
+	"pmail/db"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"pmail/utils/context"
+	"pmail/utils/dmarc"
+	"pmail/utils/errors"
+	"strings"
+	"time"
+	"xorm.io/builder"
+)
+
+// Ingest 收到的邮件中如果有本站域名的DMARC聚合报告，解析后入库
+func Ingest(ctx *context.Context, email *parsemail.Email, emailId int) {
+	for _, att := range email.Attachments {
+		if !dmarc.IsReport(att) {
+			continue
+		}
+		feedback, err := dmarc.ParseReport(att)
+		if err != nil {
+			if err != dmarc.ErrNotReport {
+				log.WithContext(ctx).Warnf("DMARC Report Parse Error %s: %v", att.Filename, err)
+			}
+			continue
+		}
+		if !isOwnDomain(feedback.PolicyPublished.Domain) {
+			log.WithContext(ctx).Infof("DMARC Report Ignored, domain %s", feedback.PolicyPublished.Domain)
+			continue
+		}
+		if err = save(ctx, feedback, emailId); err != nil {
+			log.WithContext(ctx).Errorf("DMARC Report Save Error: %+v", err)
+		}
+	}
+}
+
+func isOwnDomain(domain string) bool {
+	org := dmarc.OrgDomain(domain)
+	for _, d := range append([]string{config.Instance.Domain}, config.Instance.Domains...) {
+		if d != "" && dmarc.OrgDomain(d) == org {
+			return true
+		}
+	}
+	return false
+}
+
+func save(ctx *context.Context, feedback *dmarc.Feedback, emailId int) error {
+	meta := feedback.ReportMetadata
+	// 同一份报告可能会重复发送
+	exist, err := db.Instance.Where("org_name = ? and report_id = ?", meta.OrgName, meta.ReportId).Exist(&models.DmarcReport{})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if exist {
+		log.WithContext(ctx).Infof("DMARC Report Exist %s %s", meta.OrgName, meta.ReportId)
+		return nil
+	}
+
+	report := &models.DmarcReport{
+		OrgName:   meta.OrgName,
+		Email:     meta.Email,
+		ReportId:  meta.ReportId,
+		Domain:    strings.ToLower(feedback.PolicyPublished.Domain),
+		Policy:    feedback.PolicyPublished.P,
+		DateBegin: time.Unix(meta.DateRange.Begin, 0),
+		DateEnd:   time.Unix(meta.DateRange.End, 0),
+		EmailId:   emailId,
+	}
+
+	trans := db.Instance.NewSession()
+	defer trans.Close()
+	if err = trans.Begin(); err != nil {
+		return errors.Wrap(err)
+	}
+	if _, err = trans.Insert(report); err != nil {
+		trans.Rollback()
+		return errors.Wrap(err)
+	}
+	for _, r := range feedback.Records {
+		record := &models.DmarcRecord{
+			DmarcReportId: report.Id,
+			SourceIp:      r.Row.SourceIp,
+			Count:         r.Row.Count,
+			Disposition:   r.Row.PolicyEvaluated.Disposition,
+			DkimResult:    r.Row.PolicyEvaluated.DKIM,
+			SpfResult:     r.Row.PolicyEvaluated.SPF,
+			HeaderFrom:    strings.ToLower(r.Identifiers.HeaderFrom),
+			EnvelopeFrom:  strings.ToLower(r.Identifiers.EnvelopeFrom),
+		}
+		if len(r.AuthResults.DKIM) > 0 {
+			record.DkimDomain = r.AuthResults.DKIM[0].Domain
+			record.DkimAuth = r.AuthResults.DKIM[0].Result
+		}
+		if len(r.AuthResults.SPF) > 0 {
+			record.SpfDomain = r.AuthResults.SPF[0].Domain
+			record.SpfAuth = r.AuthResults.SPF[0].Result
+		}
+		if _, err = trans.Insert(record); err != nil {
+			trans.Rollback()
+			return errors.Wrap(err)
+		}
+	}
+	if err = trans.Commit(); err != nil {
+		return errors.Wrap(err)
+	}
+	log.WithContext(ctx).Infof("DMARC Report Saved %s %s, %d records", meta.OrgName, meta.ReportId, len(feedback.Records))
+	return nil
+}
+
+// Filter 报告的查询条件
+type Filter struct {
+	Domain string
+	Start  time.Time
+	End    time.Time
+}
+
+func (f *Filter) cond() builder.Cond {
+	cond := builder.NewCond()
+	if f.Domain != "" {
+		cond = cond.And(builder.Eq{"rep.domain": strings.ToLower(f.Domain)})
+	}
+	if !f.Start.IsZero() {
+		cond = cond.And(builder.Gte{"rep.date_end": f.Start})
+	}
+	if !f.End.IsZero() {
+		cond = cond.And(builder.Lt{"rep.date_begin": f.End})
+	}
+	return cond
+}
+
+// 对齐后的DKIM或者SPF任意一个通过，DMARC即为通过
+const (
+	sumTotal    = "sum(rec.count)"
+	sumPass     = "sum(case when rec.dkim_result = 'pass' or rec.spf_result = 'pass' then rec.count else 0 end)"
+	sumDkimPass = "sum(case when rec.dkim_result = 'pass' then rec.count else 0 end)"
+	sumSpfPass  = "sum(case when rec.spf_result = 'pass' then rec.count else 0 end)"
+)
+
+// SourceItem 按来源IP汇总的结果
+type SourceItem struct {
+	SourceIp   string `xorm:"source_ip" json:"source_ip"`
+	HeaderFrom string `xorm:"header_from" json:"header_from"`
+	Reporters  int    `xorm:"reporters" json:"reporters"`
+	Total      int    `xorm:"total" json:"total"`
+	Pass       int    `xorm:"pass" json:"pass"`
+	Fail       int    `xorm:"fail" json:"fail"`
+	DkimPass   int    `xorm:"dkim_pass" json:"dkim_pass"`
+	SpfPass    int    `xorm:"spf_pass" json:"spf_pass"`
+}
+
+// Summary 按来源IP和From域名汇总通过和失败的邮件数量，失败多的排在前面
+func Summary(ctx *context.Context, filter *Filter) ([]*SourceItem, error) {
+	sql, args, err := builder.Select("rec.source_ip", "rec.header_from",
+		"count(distinct rep.org_name) as reporters",
+		sumTotal+" as total",
+		sumPass+" as pass",
+		sumDkimPass+" as dkim_pass",
+		sumSpfPass+" as spf_pass").
+		From("dmarc_record", "rec").
+		InnerJoin("dmarc_report rep", "rep.id = rec.dmarc_report_id").
+		Where(filter.cond()).
+		GroupBy("rec.source_ip, rec.header_from").
+		ToSQL()
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	var ret []*SourceItem
+	err = db.Instance.SQL(db.WithContext(ctx, sql+" order by "+sumTotal+" - "+sumPass+" desc, "+sumTotal+" desc"), args...).Find(&ret)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	for _, item := range ret {
+		item.Fail = item.Total - item.Pass
+	}
+	return ret, nil
+}
+
+// ReportItem 报告列表
+type ReportItem struct {
+	models.DmarcReport `xorm:"extends"`
+	Total              int `xorm:"total" json:"total"`
+	Pass               int `xorm:"pass" json:"pass"`
+	Fail               int `xorm:"fail" json:"fail"`
+}
+
+// GetReports 分页获取报告列表，最新的排在前面
+func GetReports(ctx *context.Context, filter *Filter, offset, limit int) ([]*ReportItem, int64, error) {
+	total, err := db.Instance.Table("dmarc_report").Alias("rep").Where(filter.cond()).Count()
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+
+	sql, args, err := builder.Select("rep.*",
+		"coalesce("+sumTotal+", 0) as total",
+		"coalesce("+sumPass+", 0) as pass").
+		From("dmarc_report", "rep").
+		LeftJoin("dmarc_record rec", "rep.id = rec.dmarc_report_id").
+		Where(filter.cond()).
+		GroupBy("rep.id").
+		ToSQL()
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+
+	var ret []*ReportItem
+	err = db.Instance.SQL(db.WithContext(ctx, sql+" order by rep.date_begin desc, rep.id desc limit ? offset ?"), append(args, limit, offset)...).Find(&ret)
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	for _, item := range ret {
+		item.Fail = item.Total - item.Pass
+	}
+	return ret, total, nil
+}
+
+// GetReport 获取报告详情
+func GetReport(ctx *context.Context, id int) (*models.DmarcReport, []*models.DmarcRecord, error) {
+	var report models.DmarcReport
+	exist, err := db.Instance.ID(id).Get(&report)
+	if err != nil {
+		return nil, nil, errors.Wrap(err)
+	}
+	if !exist {
+		return nil, nil, nil
+	}
+	var records []*models.DmarcRecord
+	err = db.Instance.Where("dmarc_report_id = ?", id).Desc("count").Find(&records)
+	if err != nil {
+		return nil, nil, errors.Wrap(err)
+	}
+	return &report, records, nil
+}
@@ -36,7 +36,7 @@ func DelGroup(ctx *context.Context, groupId int) (bool, error) {
 		return false, errors.Wrap(err)
 	}
 
-	_, err = trans.Exec(db.WithContext(ctx, fmt.Sprintf("update email set group_id=0 where group_id in (%s)", array.Join(allGroupIds, ","))))
+	_, err = trans.Exec(db.WithContext(ctx, fmt.Sprintf("update email set group_id=0 where group_id in (%s) and user_id =?", array.Join(allGroupIds, ","))), ctx.UserID)
 	if err != nil {
 		trans.Rollback()
 		return false, errors.Wrap(err)
@@ -72,7 +72,19 @@ func GetGroupInfoList(ctx *context.Context) []*GroupItem {
 
 // MoveMailToGroup 将某封邮件移动到某个分组中
 func MoveMailToGroup(ctx *context.Context, mailId []int, groupId int) bool {
-	res, err := db.Instance.Exec(db.WithContext(ctx, fmt.Sprintf("update email set group_id=? where id in (%s)", array.Join(mailId, ","))), groupId)
+	// 只能移动到自己的分组
+	if groupId > 0 {
+		exist, err := db.Instance.Table("group").Where("id=? and user_id=?", groupId, ctx.UserID).Exist()
+		if err != nil {
+			log.WithContext(ctx).Errorf("SQL Error:%+v", err)
+			return false
+		}
+		if !exist {
+			return false
+		}
+	}
+
+	res, err := db.Instance.Exec(db.WithContext(ctx, fmt.Sprintf("update email set group_id=? where id in (%s) and user_id =?", array.Join(mailId, ","))), groupId, ctx.UserID)
 	if err != nil {
 		log.WithContext(ctx).Errorf("SQL Error:%+v", err)
 		return false
@@ -113,3 +125,32 @@ func GetGroupList(ctx *context.Context) []*models.Group {
 	db.Instance.Table("group").Where("user_id=?", ctx.UserID).Find(&ret)
 	return ret
 }
+
+// SpamGroupName 垃圾邮件分组，DMARC校验失败需要隔离的邮件放到这个分组
+const SpamGroupName = "Spam"
+
+// GetSpamGroupId 获取用户的垃圾邮件分组，没有的话自动创建
+func GetSpamGroupId(ctx *context.Context) int {
+	return GetGroupIdByName(ctx, SpamGroupName)
+}
+
+// GetGroupIdByName 根据名称获取用户的一级分组，没有的话自动创建
+func GetGroupIdByName(ctx *context.Context, name string) int {
+	var group models.Group
+	exist, err := db.Instance.Where("name=? and parent_id=0 and user_id=?", name, ctx.UserID).Get(&group)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL Error:%+v", err)
+		return 0
+	}
+	if exist {
+		return group.ID
+	}
+
+	group = models.Group{Name: name, UserId: ctx.UserID}
+	_, err = db.Instance.Insert(&group)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL Error:%+v", err)
+		return 0
+	}
+	return group.ID
+}
@@ -6,6 +6,7 @@ import (
 	"pmail/db"
 	"pmail/dto"
 	"pmail/models"
+	"pmail/services/search"
 	"pmail/utils/context"
 )
 
@@ -21,11 +22,16 @@ func GetEmailList(ctx *context.Context, tag string, keyword string, offset, limi
 	return
 }
 
+// Where 邮件列表的查询条件，批量执行规则等场景复用列表的筛选
+func Where(ctx *context.Context, tag, keyword string) (string, []any) {
+	return genSQL(ctx, tag, keyword)
+}
+
 func genSQL(ctx *context.Context, tag, keyword string) (string, []any) {
 
-	sql := "1=1 "
+	sql := "user_id = ? "
 
-	sqlParams := []any{}
+	sqlParams := []any{ctx.UserID}
 
 	var tagInfo dto.SearchTag
 	_ = json.Unmarshal([]byte(tag), &tagInfo)
@@ -48,8 +54,13 @@ func genSQL(ctx *context.Context, tag, keyword string) (string, []any) {
 	}
 
 	if keyword != "" {
-		sql += " and (subject like ? or text like ? )"
-		sqlParams = append(sqlParams, "%"+keyword+"%", "%"+keyword+"%")
+		// 支持 from: to: subject: has:attachment is:unread before: after: 等搜索语法
+		query := search.Parse(keyword)
+		if !query.IsEmpty() {
+			searchSQL, searchParams := search.Where(ctx, query)
+			sql += " and " + searchSQL
+			sqlParams = append(sqlParams, searchParams...)
+		}
 	}
 
 	return sql, sqlParams
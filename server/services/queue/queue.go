@@ -0,0 +1,358 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"pmail/config"
+	"pmail/db"
+	"pmail/dto/parsemail"
+	"pmail/hooks"
+	"pmail/hooks/framework"
+	"pmail/models"
+	"pmail/services/attachments"
+	"pmail/utils/async"
+	"pmail/utils/blob"
+	"pmail/utils/context"
+	"pmail/utils/errors"
+	"pmail/utils/id"
+	"pmail/utils/send"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusWaiting = 0
+	StatusSuccess = 1
+	StatusFailed  = 2
+)
+
+// 每次最多取出的待投递数量
+const batchSize = 50
+
+// 第一次重试的等待时间，之后每次翻倍，最长不超过maxBackoff
+const baseBackoff = 5 * time.Minute
+const maxBackoff = 4 * time.Hour
+
+// DeliveryError 某个域名最终投递失败的原因，内容是对方服务器的返回或者网络错误
+type DeliveryError string
+
+func (e DeliveryError) Error() string {
+	return string(e)
+}
+
+// Bounce 投递最终失败后生成退信，由smtp_server注册，避免循环引用
+var Bounce func(ctx *context.Context, e *parsemail.Email, errMap map[string]error)
+
+var wakeup = make(chan bool, 1)
+
+var lock sync.Mutex
+var stop chan bool
+
+func lifetime() time.Duration {
+	hours := 120
+	if config.Instance != nil && config.Instance.SendQueueLifetime > 0 {
+		hours = config.Instance.SendQueueLifetime
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// backoff 第attempts次投递失败后需要等待的时间
+func backoff(attempts int) time.Duration {
+	wait := baseBackoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return wait
+}
+
+// Enqueue 邮件落库后加入投递队列，每个收件域名一条记录
+func Enqueue(ctx *context.Context, e *parsemail.Email) error {
+	if e.MessageId <= 0 {
+		return errors.New("email not saved")
+	}
+
+	var to []*parsemail.User
+	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
+
+	now := time.Now()
+	for domain, tos := range send.GroupByDomain(ctx, to) {
+		recipients, _ := json.Marshal(tos)
+		_, err := db.Instance.Exec(db.WithContext(ctx, "insert into send_queue (email_id,domain,recipients,status,attempts,next_retry_time,expire_time,error,create_time,update_time) values (?,?,?,?,?,?,?,?,?,?)"),
+			e.MessageId, domain, string(recipients), StatusWaiting, 0, now, now.Add(lifetime()), "", now, now)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	select {
+	case wakeup <- true:
+	default:
+	}
+	return nil
+}
+
+// Forward 别名指向外部地址时原样转发收到的原文，保留Received邮件头和DKIM签名
+// 原文写入附件存储后按收件域名加入投递队列，sender为本服务器的信封发件人
+func Forward(ctx *context.Context, sender string, to []string, source io.Reader) error {
+	var tos []*parsemail.User
+	for _, address := range to {
+		tos = append(tos, &parsemail.User{EmailAddress: address})
+	}
+
+	hash, unlock, err := blob.PutReader(source)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := time.Now()
+	for domain, list := range send.GroupByDomain(ctx, tos) {
+		recipients, _ := json.Marshal(list)
+		_, err = db.Instance.Exec(db.WithContext(ctx, "insert into send_queue (email_id,domain,recipients,sender,source_hash,status,attempts,next_retry_time,expire_time,error,create_time,update_time) values (?,?,?,?,?,?,?,?,?,?,?,?)"),
+			0, domain, string(recipients), sender, hash, StatusWaiting, 0, now, now.Add(lifetime()), "", now, now)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	select {
+	case wakeup <- true:
+	default:
+	}
+	return nil
+}
+
+// Start 启动投递worker，有新邮件入队或者每分钟检查一次到期的重试
+func Start() {
+	lock.Lock()
+	stop = make(chan bool)
+	stopChan := stop
+	lock.Unlock()
+
+	log.Infof("Send Queue Worker Start")
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		drain()
+		select {
+		case <-stopChan:
+			return
+		case <-wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+func Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+// drain 投递所有已经到期的记录
+func drain() {
+	for {
+		var rows []*models.SendQueue
+		err := db.Instance.Where("status=? and next_retry_time<=?", StatusWaiting, time.Now()).Asc("next_retry_time").Limit(batchSize).Find(&rows)
+		if err != nil {
+			log.Errorf("Send Queue SQL Error: %+v", err)
+			return
+		}
+
+		as := async.New(nil)
+		for _, row := range rows {
+			as.WaitProcess(func(p any) {
+				process(p.(*models.SendQueue))
+			}, row)
+		}
+		as.Wait()
+
+		if len(rows) < batchSize {
+			return
+		}
+	}
+}
+
+func process(row *models.SendQueue) {
+	ctx := &context.Context{}
+	ctx.SetValue(context.LogID, id.GenLogID())
+
+	if row.SourceHash != "" {
+		processForward(ctx, row)
+		return
+	}
+
+	var email models.Email
+	exist, err := db.Instance.ID(row.EmailId).Get(&email)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Send Queue SQL Error: %+v", err)
+		return
+	}
+	if !exist {
+		finish(ctx, row, StatusFailed, "email not found")
+		return
+	}
+	ctx.UserID = email.SendUserID
+
+	e := email.ToTransObj()
+	e.Attachments = attachments.Load(ctx, &email)
+	if email.SendDate.IsZero() {
+		e.Date = email.CreateTime.Format(time.DateTime)
+	}
+
+	var tos []*parsemail.User
+	_ = json.Unmarshal([]byte(row.Recipients), &tos)
+
+	log.WithContext(ctx).Infof("Send Queue: email %d to %s, attempt %d", row.EmailId, row.Domain, row.Attempts+1)
+
+	b := e.BuildBytes(ctx, true)
+	ret, err := send.SendToDomain(ctx, row.Domain, e.From.EmailAddress, tos, b)
+	retry(ctx, row, ret, err)
+
+	refreshEmail(ctx, e)
+}
+
+// processForward 投递原样转发的邮件，投递结束后删除没有引用的原文
+func processForward(ctx *context.Context, row *models.SendQueue) {
+	var tos []*parsemail.User
+	_ = json.Unmarshal([]byte(row.Recipients), &tos)
+
+	log.WithContext(ctx).Infof("Send Queue: forward %s to %s, attempt %d", row.SourceHash, row.Domain, row.Attempts+1)
+
+	b, err := blob.Read(row.SourceHash)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Send Queue Source Read Error: %+v", err)
+		finish(ctx, row, StatusFailed, "source not found")
+		return
+	}
+	ret, err := send.SendToDomain(ctx, row.Domain, row.Sender, tos, b)
+	if retry(ctx, row, ret, err) {
+		return
+	}
+	attachments.Clean(ctx, []string{row.SourceHash})
+}
+
+// retry 记录投递结果，临时错误并且没有过期时等待下次重试，返回是否需要重试
+func retry(ctx *context.Context, row *models.SendQueue, ret *send.Result, err error) bool {
+	row.Attempts++
+	row.MxHost = ret.Host
+	row.TlsPolicy = ret.Policy
+	row.TlsStatus = ret.Status
+
+	switch {
+	case err == nil:
+		finish(ctx, row, StatusSuccess, "")
+	case !send.IsTemporaryError(err):
+		finish(ctx, row, StatusFailed, err.Error())
+	default:
+		next := time.Now().Add(backoff(row.Attempts))
+		if next.After(row.ExpireTime) {
+			finish(ctx, row, StatusFailed, err.Error())
+		} else {
+			_, err2 := db.Instance.Exec(db.WithContext(ctx, "update send_queue set attempts=?,next_retry_time=?,error=?,mx_host=?,tls_policy=?,tls_status=?,update_time=? where id=?"), row.Attempts, next, err.Error(), row.MxHost, row.TlsPolicy, row.TlsStatus, time.Now(), row.Id)
+			if err2 != nil {
+				log.WithContext(ctx).Errorf("Send Queue SQL Error: %+v", err2)
+			}
+			log.WithContext(ctx).Warnf("Send Queue: email %d to %s deferred until %s", row.EmailId, row.Domain, next.Format(time.DateTime))
+			return true
+		}
+	}
+	return false
+}
+
+func finish(ctx *context.Context, row *models.SendQueue, status int8, errMsg string) {
+	_, err := db.Instance.Exec(db.WithContext(ctx, "update send_queue set status=?,attempts=?,error=?,mx_host=?,tls_policy=?,tls_status=?,update_time=? where id=?"), status, row.Attempts, errMsg, row.MxHost, row.TlsPolicy, row.TlsStatus, time.Now(), row.Id)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Send Queue SQL Error: %+v", err)
+	}
+}
+
+// refreshEmail 根据每个域名的投递结果更新邮件状态，全部投递结束后执行SendAfter插件
+func refreshEmail(ctx *context.Context, e *parsemail.Email) {
+	var rows []*models.SendQueue
+	err := db.Instance.Where("email_id=?", e.MessageId).Asc("id").Find(&rows)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Send Queue SQL Error: %+v", err)
+		return
+	}
+
+	var pending, failed bool
+	var errMsgs []string
+	errMap := map[string]error{}
+	for _, row := range rows {
+		switch row.Status {
+		case StatusWaiting:
+			pending = true
+		case StatusFailed:
+			failed = true
+		}
+		if row.Status != StatusSuccess && row.Error != "" {
+			var tos []*parsemail.User
+			_ = json.Unmarshal([]byte(row.Recipients), &tos)
+			var addresses []string
+			for _, to := range tos {
+				addresses = append(addresses, to.EmailAddress)
+			}
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s", strings.Join(addresses, ","), row.Error))
+		}
+		if row.Status == StatusFailed {
+			errMap[row.Domain] = DeliveryError(row.Error)
+		} else {
+			errMap[row.Domain] = nil
+		}
+	}
+
+	errMsg := strings.Join(errMsgs, "\n")
+	if pending {
+		if errMsg == "" {
+			return
+		}
+		_, err = db.Instance.Exec(db.WithContext(ctx, "update email set status =4 ,error=? where id = ? and status in (0,4)"), errMsg, e.MessageId)
+		if err != nil {
+			log.WithContext(ctx).Errorf("sql Error :%+v", err)
+		}
+		return
+	}
+
+	// 同一封邮件不同域名的记录并发投递，可能同时看到全部投递结束
+	// 只有把状态从投递中改为结束的那一次执行退信和SendAfter插件
+	status := 1
+	if failed {
+		status = 2
+	}
+	res, err := db.Instance.Exec(db.WithContext(ctx, "update email set status =? ,error=? where id = ? and status in (0,4)"), status, errMsg, e.MessageId)
+	if err != nil {
+		log.WithContext(ctx).Errorf("sql Error :%+v", err)
+		return
+	}
+	if num, _ := res.RowsAffected(); num != 1 {
+		return
+	}
+
+	if failed && Bounce != nil {
+		Bounce(ctx, e, errMap)
+	}
+
+	log.WithContext(ctx).Debugf("插件执行--SendAfter")
+	as := async.New(ctx)
+	for _, hook := range hooks.HookList {
+		if hook == nil {
+			continue
+		}
+		as.WaitProcess(func(hk any) {
+			hk.(framework.EmailHook).SendAfter(ctx, e, errMap)
+		}, hook)
+	}
+	as.Wait()
+	log.WithContext(ctx).Debugf("插件执行--SendAfter End")
+}
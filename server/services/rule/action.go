@@ -0,0 +1,308 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"pmail/config"
+	"pmail/db"
+	"pmail/dto"
+	"pmail/dto/parsemail"
+	"pmail/services/group"
+	"pmail/services/sieve"
+	"pmail/utils/address"
+	"pmail/utils/async"
+	"pmail/utils/context"
+	"pmail/utils/send"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// 标签最大长度
+const maxTagLength = 50
+
+// 同一个规则对同一个发件人自动回复的间隔天数
+const replyDays = 1
+
+// webhook请求超时时间
+const webhookTimeout = 10 * time.Second
+
+var errWebhookAddress = errors.New("webhook address not allowed")
+
+// webhookClient 连接时检查对方地址，重定向和DNS解析后的地址同样会检查
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: webhookControl}).DialContext,
+	},
+}
+
+// webhookControl 不允许webhook访问本机、内网和链路本地地址，防止通过规则访问内部服务(SSRF)
+func webhookControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !webhookAllowed(ip) {
+		return fmt.Errorf("%w: %s", errWebhookAddress, ip)
+	}
+	return nil
+}
+
+// webhookBlocked 标准库没有判断的其他内部地址段
+var webhookBlocked = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // 本网络
+	netip.MustParsePrefix("100.64.0.0/10"),  // 运营商级NAT
+	netip.MustParsePrefix("64:ff9b:1::/48"), // 本地使用的NAT64，见RFC 8215
+}
+
+// 嵌入了IPv4地址的IPv6地址段
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	prefix6to4  = netip.MustParsePrefix("2002::/16")
+)
+
+func webhookAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	// NAT64和6to4地址按照其中嵌入的IPv4地址检查
+	b := ip.As16()
+	if nat64Prefix.Contains(ip) {
+		ip = netip.AddrFrom4([4]byte(b[12:16]))
+	} else if prefix6to4.Contains(ip) {
+		ip = netip.AddrFrom4([4]byte(b[2:6]))
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, p := range webhookBlocked {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckActions 检查规则的执行动作是否合法
+func CheckActions(actions []*dto.Action) error {
+	if len(actions) == 0 {
+		return errors.New("rule actions is empty")
+	}
+	for _, a := range actions {
+		if a == nil {
+			return errors.New("rule action is empty")
+		}
+		switch a.Action {
+		case dto.READ, dto.DELETE, dto.STAR, dto.SPAM, dto.STOP:
+		case dto.FORWARD:
+			if !address.IsValidEmailAddress(a.Params) {
+				return errors.New("invalid email address: " + a.Params)
+			}
+		case dto.MOVE:
+			if cast.ToInt(a.Params) <= 0 {
+				return errors.New("group id error: " + a.Params)
+			}
+		case dto.TAG:
+			tag := strings.TrimSpace(a.Params)
+			if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+				return errors.New("tag error: " + a.Params)
+			}
+		case dto.REPLY:
+			if strings.TrimSpace(a.Params) == "" {
+				return errors.New("reply content is empty")
+			}
+			if _, err := template.New("reply").Parse(a.Params); err != nil {
+				return errors.New("reply template error: " + err.Error())
+			}
+		case dto.WEBHOOK:
+			u, err := url.Parse(a.Params)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errors.New("webhook url error: " + a.Params)
+			}
+		default:
+			return fmt.Errorf("rule action error: %d", a.Action)
+		}
+	}
+	return nil
+}
+
+func addTag(ctx *context.Context, email *parsemail.Email, tag string) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return
+	}
+	for _, t := range email.Tags {
+		if t == tag {
+			return
+		}
+	}
+	email.Tags = append(email.Tags, tag)
+	if email.MessageId > 0 {
+		tags, _ := json.Marshal(email.Tags)
+		db.Instance.Exec(db.WithContext(ctx, "update email set tags=? where id =?"), string(tags), email.MessageId)
+	}
+}
+
+// replyData 自动回复模板中可以使用的变量，例如{{.Subject}}
+type replyData struct {
+	Subject  string
+	From     string
+	FromName string
+	To       string
+	Date     string
+}
+
+// autoReply 使用模板自动回复信封发件人，不回复退信和自动发送的邮件，同一个发件人每天只回复一次
+// 邮件头中的From可以随意伪造，回复信封发件人，信封发件人为空时不回复，见RFC 3834
+func autoReply(ctx *context.Context, rule *dto.Rule, email *parsemail.Email, content string) {
+	if email.From == nil || email.MailFrom == "" || ctx == nil || ctx.UserAccount == "" {
+		return
+	}
+	sender := strings.ToLower(email.MailFrom)
+	if !sieve.AutoReplyAllowed(email.Headers, sender) {
+		return
+	}
+	from := ctx.UserAccount + "@" + config.Instance.Domain
+	if strings.EqualFold(sender, from) {
+		return
+	}
+
+	tpl, err := template.New("reply").Parse(content)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Rule Reply Template Error:%v", err)
+		return
+	}
+	var text bytes.Buffer
+	err = tpl.Execute(&text, &replyData{
+		Subject:  email.Subject,
+		From:     email.From.EmailAddress,
+		FromName: email.From.Name,
+		To:       from,
+		Date:     email.Date,
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorf("Rule Reply Template Error:%v", err)
+		return
+	}
+
+	if !sieve.MarkReplied(ctx, fmt.Sprintf("rule-%d", rule.Id), sender, replyDays) {
+		return
+	}
+
+	reply := &parsemail.Email{
+		From:    &parsemail.User{EmailAddress: from, Name: ctx.UserName},
+		To:      []*parsemail.User{{EmailAddress: email.MailFrom}},
+		Subject: "Re: " + email.Subject,
+		Text:    text.Bytes(),
+		Headers: textproto.MIMEHeader{},
+	}
+	reply.Headers.Set("Auto-Submitted", "auto-replied")
+	if messageId := email.Headers.Get("Message-Id"); messageId != "" {
+		reply.Headers.Set("In-Reply-To", messageId)
+		reply.Headers.Set("References", messageId)
+	}
+	err, _ = send.Send(ctx, reply)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Rule Reply Error:%v", err)
+	}
+}
+
+type webhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// webhookData webhook请求的内容
+type webhookData struct {
+	RuleId      int                  `json:"rule_id"`
+	RuleName    string               `json:"rule_name"`
+	Id          int64                `json:"id"`
+	From        *parsemail.User      `json:"from"`
+	To          []*parsemail.User    `json:"to"`
+	Cc          []*parsemail.User    `json:"cc"`
+	Subject     string               `json:"subject"`
+	Text        string               `json:"text"`
+	Html        string               `json:"html"`
+	Date        string               `json:"date"`
+	Size        int64                `json:"size"`
+	SPF         string               `json:"spf"`
+	DKIM        string               `json:"dkim"`
+	Headers     textproto.MIMEHeader `json:"headers"`
+	Attachments []*webhookAttachment `json:"attachments"`
+}
+
+// webhook 把解析后的邮件以JSON格式POST到指定的URL，请求在后台发送，不阻塞收信
+func webhook(ctx *context.Context, rule *dto.Rule, email *parsemail.Email, webhookURL string) {
+	data := &webhookData{
+		RuleId:      rule.Id,
+		RuleName:    rule.Name,
+		Id:          email.MessageId,
+		From:        email.From,
+		To:          email.To,
+		Cc:          email.Cc,
+		Subject:     email.Subject,
+		Text:        string(email.Text),
+		Html:        string(email.HTML),
+		Date:        email.Date,
+		Size:        email.Size,
+		SPF:         email.SPF,
+		DKIM:        email.DKIM,
+		Headers:     email.Headers,
+		Attachments: []*webhookAttachment{},
+	}
+	for _, a := range email.Attachments {
+		data.Attachments = append(data.Attachments, &webhookAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        len(a.Content),
+		})
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Rule Webhook Error:%v", err)
+		return
+	}
+
+	async.New(ctx).Process(func(p any) {
+		postWebhook(ctx, webhookURL, body)
+	}, nil)
+}
+
+func postWebhook(ctx *context.Context, webhookURL string, body []byte) {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithContext(ctx).Errorf("Rule Webhook Error:%v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.WithContext(ctx).Errorf("Rule Webhook Error: %s status %d", webhookURL, resp.StatusCode)
+	}
+}
+
+func markSpam(ctx *context.Context, email *parsemail.Email) {
+	groupId := group.GetSpamGroupId(ctx)
+	if groupId == 0 {
+		return
+	}
+	email.GroupId = groupId
+	if email.MessageId > 0 {
+		db.Instance.Exec(db.WithContext(ctx, "update email set group_id=? where id =?"), email.GroupId, email.MessageId)
+	}
+}
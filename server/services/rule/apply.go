@@ -0,0 +1,240 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"pmail/db"
+	"pmail/dto"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"pmail/services/detail"
+	"pmail/services/group"
+	"pmail/services/list"
+	"pmail/utils/async"
+	"pmail/utils/context"
+	"sync"
+	"time"
+)
+
+// 批量执行规则时每次读取的邮件数量
+const applyBatch = 100
+
+// dry-run最多返回的邮件id数量，超过时只统计数量
+const maxDryRunIds = 10000
+
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+var ErrRuleNotFound = models.ErrRuleNotFound
+var ErrJobRunning = errors.New("a rule apply job is running")
+
+// ApplyJob 对已有邮件执行规则的后台任务，每个用户同时只能有一个任务
+type ApplyJob struct {
+	RuleId    int        `json:"rule_id"`
+	DryRun    bool       `json:"dry_run"`
+	Status    string     `json:"status"`
+	Total     int64      `json:"total"`     // 筛选出的邮件数量
+	Processed int64      `json:"processed"` // 已经检查的邮件数量
+	Matched   int64      `json:"matched"`   // 匹配规则的邮件数量
+	Ids       []int      `json:"ids"`       // dry-run时匹配的邮件id
+	Truncated bool       `json:"truncated"` // Ids超过maxDryRunIds被截断
+	NoSource  int64      `json:"no_source"` // 没有保存原文的邮件数量，这些邮件根据数据库内容重新生成，邮件头条件可能无法匹配
+	Error     string     `json:"error"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time"`
+}
+
+var jobLock sync.Mutex
+var jobs = map[int]*ApplyJob{}
+
+// Apply 在后台对筛选出的已有邮件执行规则，tag和keyword与邮件列表的筛选条件相同，tag为空时为垃圾邮件以外的全部收件
+// 转发和webhook会把旧邮件发送到外部，outbound为true时才执行
+func Apply(ctx *context.Context, ruleId int, tag, keyword string, dryRun bool, outbound bool) (*ApplyJob, error) {
+	var ruleModel models.Rule
+	exist, err := db.Instance.Where("id=? and user_id=?", ruleId, ctx.UserID).Get(&ruleModel)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrRuleNotFound
+	}
+	r := (&dto.Rule{}).Decode(&ruleModel)
+	r.Actions = retroactiveActions(r.Actions, outbound)
+
+	jobLock.Lock()
+	if job, ok := jobs[ctx.UserID]; ok && job.Status == JobRunning {
+		jobLock.Unlock()
+		return nil, ErrJobRunning
+	}
+	job := &ApplyJob{
+		RuleId:    ruleId,
+		DryRun:    dryRun,
+		Status:    JobRunning,
+		Ids:       []int{},
+		StartTime: time.Now(),
+	}
+	jobs[ctx.UserID] = job
+	jobLock.Unlock()
+
+	// 请求结束后任务还在执行，使用新的context
+	jobCtx := &context.Context{
+		UserID:      ctx.UserID,
+		UserAccount: ctx.UserAccount,
+		UserName:    ctx.UserName,
+		IsAdmin:     ctx.IsAdmin,
+		Lang:        ctx.Lang,
+	}
+	jobCtx.SetValue(context.LogID, ctx.GetValue(context.LogID))
+	// 没有筛选条件时处理垃圾邮件以外全部未删除的收件
+	defaultTag := tag == ""
+	if defaultTag {
+		tag = dto.SearchTag{Type: 0, Status: -1, GroupId: -1}.ToString()
+	}
+	where, params := list.Where(jobCtx, tag, keyword)
+	if defaultTag {
+		where += " and group_id not in (select id from `group` where name=? and parent_id=0 and user_id=?)"
+		params = append(params, group.SpamGroupName, jobCtx.UserID)
+	}
+
+	as := async.New(jobCtx)
+	as.Process(func(p any) {
+		defer func() {
+			if e := recover(); e != nil {
+				finishJob(job, as.HandleErrRecover(e))
+			}
+		}()
+		finishJob(job, runJob(jobCtx, job, r, where, params))
+	}, nil)
+
+	return GetApplyJob(ctx), nil
+}
+
+// GetApplyJob 返回当前用户最近一次任务的进度，没有任务时返回nil
+func GetApplyJob(ctx *context.Context) *ApplyJob {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	job, ok := jobs[ctx.UserID]
+	if !ok {
+		return nil
+	}
+	ret := *job
+	ret.Ids = append([]int{}, job.Ids...)
+	return &ret
+}
+
+// retroactiveActions 对已有邮件执行规则时不自动回复，旧邮件的自动回复没有意义
+// 转发和webhook需要outbound为true时才执行
+func retroactiveActions(actions []*dto.Action, outbound bool) []*dto.Action {
+	var ret []*dto.Action
+	for _, a := range actions {
+		if a == nil || a.Action == dto.REPLY {
+			continue
+		}
+		if !outbound && (a.Action == dto.FORWARD || a.Action == dto.WEBHOOK) {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+func finishJob(job *ApplyJob, err error) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	if job.Status != JobRunning {
+		return
+	}
+	now := time.Now()
+	job.EndTime = &now
+	job.Status = JobDone
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+}
+
+func runJob(ctx *context.Context, job *ApplyJob, r *dto.Rule, where string, params []any) error {
+	total, err := db.Instance.Table("email").Where(where, params...).Count()
+	if err != nil {
+		return err
+	}
+	jobLock.Lock()
+	job.Total = total
+	jobLock.Unlock()
+
+	log.WithContext(ctx).Infof("Rule Apply Start, rule %d, %d emails, dry-run %v", r.Id, total, job.DryRun)
+	lastId := 0
+	var matchedNum int64
+	for {
+		var emails []*models.Email
+		err = db.Instance.Where(where+" and id > ?", append(params, lastId)...).Asc("id").Limit(applyBatch).Find(&emails)
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			lastId = email.Id
+			e, stored := toParsemail(ctx, email)
+			matched := MatchRule(ctx, r, e)
+			if matched {
+				matchedNum++
+				if !job.DryRun {
+					DoRule(ctx, r, e)
+				}
+			}
+
+			jobLock.Lock()
+			job.Processed++
+			if !stored {
+				job.NoSource++
+			}
+			if matched {
+				job.Matched++
+				if job.DryRun {
+					if len(job.Ids) < maxDryRunIds {
+						job.Ids = append(job.Ids, email.Id)
+					} else {
+						job.Truncated = true
+					}
+				}
+			}
+			jobLock.Unlock()
+		}
+		if len(emails) < applyBatch {
+			break
+		}
+	}
+	log.WithContext(ctx).Infof("Rule Apply End, rule %d, %d matched", r.Id, matchedNum)
+	return nil
+}
+
+// toParsemail 从邮件原文解析出规则匹配需要的内容，状态字段使用数据库中的值，返回是否有保存的原文
+func toParsemail(ctx *context.Context, email *models.Email) (*parsemail.Email, bool) {
+	source := detail.Stored(ctx, email.Id)
+	stored := source != nil
+	if !stored {
+		source = detail.Rebuild(ctx, email)
+	}
+	ret := parsemail.NewEmailFromReader(nil, bytes.NewReader(source))
+	ret.MessageId = int64(email.Id)
+	ret.IsRead = int(email.IsRead)
+	ret.IsStar = int(email.IsStar)
+	ret.Status = int(email.Status)
+	ret.GroupId = email.GroupId
+	if email.Tags != "" {
+		_ = json.Unmarshal([]byte(email.Tags), &ret.Tags)
+	}
+	// 数据库只保存了是否通过校验，没有具体的结果
+	ret.SPF, ret.DKIM = "fail", "fail"
+	if email.SPFCheck == 1 {
+		ret.SPF = "pass"
+	}
+	if email.DKIMCheck == 1 {
+		ret.DKIM = "pass"
+	}
+	return ret, stored
+}
@@ -1,51 +1,161 @@
 package match
 
 import (
-	"encoding/json"
+	"net/textproto"
 	"pmail/dto/parsemail"
 	"pmail/utils/context"
+	"strconv"
+	"strings"
 )
 
 const (
 	RuleTypeRegex    = "regex"
 	RuleTypeContains = "contains"
 	RuleTypeEq       = "equal"
+	RuleTypeExists   = "exists" // 字段存在且不为空
+	RuleTypeGt       = "gt"     // 数值大于
+	RuleTypeLt       = "lt"     // 数值小于
 )
 
+const (
+	FieldHeader          = "Header" // 任意邮件头，名称在Value.Header中
+	FieldSize            = "Size"
+	FieldAttachmentName  = "AttachmentName"
+	FieldAttachmentType  = "AttachmentType"
+	FieldSPF             = "SPF"
+	FieldDKIM            = "DKIM"
+	FieldRecipientDomain = "RecipientDomain"
+)
+
+// Fields 规则可以使用的全部字段
+var Fields = []string{"From", "Subject", "To", "Cc", "Text", "Html", "Content", "ReplyTo", "Bcc", "Sender",
+	FieldHeader, FieldSize, FieldAttachmentName, FieldAttachmentType, FieldSPF, FieldDKIM, FieldRecipientDomain}
+
+// Types 规则可以使用的全部匹配方式
+var Types = []string{RuleTypeRegex, RuleTypeContains, RuleTypeEq, RuleTypeExists, RuleTypeGt, RuleTypeLt}
+
 type Match interface {
 	Match(ctx *context.Context, email *parsemail.Email) bool
 }
 
-func getFieldContent(field string, email *parsemail.Email) string {
+// New 根据匹配方式创建Match，不支持的方式返回nil
+func New(ruleType, field, header, rule string) Match {
+	switch ruleType {
+	case RuleTypeRegex:
+		m := NewRegexMatch(field, rule)
+		m.Header = header
+		return m
+	case RuleTypeContains:
+		m := NewContainsMatch(field, rule)
+		m.Header = header
+		return m
+	case RuleTypeEq:
+		m := NewEqualMatch(field, rule)
+		m.Header = header
+		return m
+	case RuleTypeExists:
+		return &ExistsMatch{Field: field, Header: header}
+	case RuleTypeGt, RuleTypeLt:
+		return &CompareMatch{Field: field, Header: header, Rule: rule, Type: ruleType}
+	}
+	return nil
+}
+
+// getFieldValues 获取字段的全部值，任意一个值匹配即为匹配
+// 地址字段返回每个地址以及地址的名称
+func getFieldValues(field, header string, email *parsemail.Email) []string {
 	switch field {
 	case "ReplyTo":
-		b, _ := json.Marshal(email.ReplyTo)
-		return string(b)
+		return userValues(email.ReplyTo...)
 	case "From":
-		b, _ := json.Marshal(email.From)
-		return string(b)
+		return userValues(email.From)
 	case "Subject":
-		return email.Subject
+		return []string{email.Subject}
 	case "To":
-		b, _ := json.Marshal(email.To)
-		return string(b)
+		return userValues(email.To...)
 	case "Bcc":
-		b, _ := json.Marshal(email.Bcc)
-		return string(b)
+		return userValues(email.Bcc...)
 	case "Cc":
-		b, _ := json.Marshal(email.Cc)
-		return string(b)
+		return userValues(email.Cc...)
 	case "Text":
-		return string(email.Text)
+		return []string{string(email.Text)}
 	case "Html":
-		return string(email.HTML)
+		return []string{string(email.HTML)}
 	case "Sender":
-		b, _ := json.Marshal(email.Sender)
-		return string(b)
+		return userValues(email.Sender)
 	case "Content":
 		b := string(email.HTML)
 		b2 := string(email.Text)
-		return b + b2
+		return []string{b + b2}
+	case FieldHeader:
+		return email.Headers.Values(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(header)))
+	case FieldSize:
+		return []string{strconv.FormatInt(email.Size, 10)}
+	case FieldAttachmentName, FieldAttachmentType:
+		var ret []string
+		for _, a := range email.Attachments {
+			if field == FieldAttachmentName {
+				ret = append(ret, a.Filename)
+			} else {
+				ret = append(ret, a.ContentType)
+			}
+		}
+		return ret
+	case FieldSPF:
+		return []string{email.SPF}
+	case FieldDKIM:
+		return []string{email.DKIM}
+	case FieldRecipientDomain:
+		var ret []string
+		exist := map[string]bool{}
+		for _, u := range append(append([]*parsemail.User{}, email.To...), email.Cc...) {
+			if u == nil {
+				continue
+			}
+			_, domain := u.GetDomainAccount()
+			domain = strings.ToLower(domain)
+			if domain != "" && !exist[domain] {
+				exist[domain] = true
+				ret = append(ret, domain)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+func userValues(users ...*parsemail.User) []string {
+	var ret []string
+	for _, u := range users {
+		if u == nil {
+			continue
+		}
+		ret = append(ret, u.EmailAddress)
+		if u.Name != "" {
+			ret = append(ret, u.Name)
+		}
+	}
+	return ret
+}
+
+// ParseNumber 解析数值，支持K、M、G后缀，用于邮件大小
+func ParseNumber(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	var unit int64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
 	}
-	return ""
+	return n * unit, nil
 }
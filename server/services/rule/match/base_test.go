@@ -0,0 +1,58 @@
+package match
+
+import (
+	"net/textproto"
+	"pmail/dto/parsemail"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	email := &parsemail.Email{
+		From:    &parsemail.User{Name: "Boss", EmailAddress: "boss@example.com"},
+		To:      []*parsemail.User{{EmailAddress: "me@Example.org"}},
+		Cc:      []*parsemail.User{{EmailAddress: "a@example.net"}, {EmailAddress: "b@example.org"}},
+		Subject: "report",
+		Headers: textproto.MIMEHeader{"List-Id": {"<dev.lists.example.com>"}, "X-Spam-Flag": {"YES"}},
+		Size:    20 * 1024,
+		Attachments: []*parsemail.Attachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf"},
+		},
+		SPF:  "softfail",
+		DKIM: "pass",
+	}
+
+	tests := []struct {
+		ruleType, field, header, rule string
+		want                          bool
+	}{
+		{RuleTypeEq, "From", "", "boss@example.com", true},
+		{RuleTypeEq, "From", "", "Boss", true},
+		{RuleTypeContains, "From", "", "EmailAddress", false},
+		{RuleTypeContains, FieldHeader, "list-id", "dev.lists", true},
+		{RuleTypeEq, FieldHeader, "X-Spam-Flag", "YES", true},
+		{RuleTypeExists, FieldHeader, "X-Spam-Status", "", false},
+		{RuleTypeExists, FieldAttachmentName, "", "", true},
+		{RuleTypeRegex, FieldAttachmentName, "", `\.pdf$`, true},
+		{RuleTypeEq, FieldAttachmentType, "", "image/png", false},
+		{RuleTypeGt, FieldSize, "", "10K", true},
+		{RuleTypeLt, FieldSize, "", "10K", false},
+		{RuleTypeGt, FieldSize, "", "abc", false},
+		{RuleTypeEq, FieldSPF, "", "softfail", true},
+		{RuleTypeEq, FieldDKIM, "", "fail", false},
+		{RuleTypeEq, FieldRecipientDomain, "", "example.net", true},
+		{RuleTypeEq, FieldRecipientDomain, "", "example.org", true},
+	}
+	for _, tt := range tests {
+		m := New(tt.ruleType, tt.field, tt.header, tt.rule)
+		if got := m.Match(nil, email); got != tt.want {
+			t.Errorf("%s %s %s %s = %v, want %v", tt.field, tt.header, tt.ruleType, tt.rule, got, tt.want)
+		}
+	}
+
+	if New("unknown", "From", "", "") != nil {
+		t.Errorf("unknown type should return nil")
+	}
+	if got := getFieldValues(FieldRecipientDomain, "", email); len(got) != 2 {
+		t.Errorf("recipient domains = %v", got)
+	}
+}
@@ -0,0 +1,33 @@
+package match
+
+import (
+	log "github.com/sirupsen/logrus"
+	"pmail/dto/parsemail"
+	"pmail/utils/context"
+)
+
+// CompareMatch 数值比较，例如邮件大小
+type CompareMatch struct {
+	Field  string
+	Header string
+	Rule   string
+	Type   string // gt或者lt
+}
+
+func (r *CompareMatch) Match(ctx *context.Context, email *parsemail.Email) bool {
+	rule, err := ParseNumber(r.Rule)
+	if err != nil {
+		log.WithContext(ctx).Errorf("rule number error %v", err)
+		return false
+	}
+	for _, content := range getFieldValues(r.Field, r.Header, email) {
+		n, err := ParseNumber(content)
+		if err != nil {
+			continue
+		}
+		if (r.Type == RuleTypeGt && n > rule) || (r.Type == RuleTypeLt && n < rule) {
+			return true
+		}
+	}
+	return false
+}
@@ -7,8 +7,9 @@ import (
 )
 
 type ContainsMatch struct {
-	Rule  string
-	Field string
+	Rule   string
+	Field  string
+	Header string
 }
 
 func NewContainsMatch(field, rule string) *ContainsMatch {
@@ -19,6 +20,10 @@ func NewContainsMatch(field, rule string) *ContainsMatch {
 }
 
 func (r *ContainsMatch) Match(ctx *context.Context, email *parsemail.Email) bool {
-	content := getFieldContent(r.Field, email)
-	return strings.Contains(content, r.Rule)
+	for _, content := range getFieldValues(r.Field, r.Header, email) {
+		if strings.Contains(content, r.Rule) {
+			return true
+		}
+	}
+	return false
 }
@@ -6,8 +6,9 @@ import (
 )
 
 type EqualMatch struct {
-	Rule  string
-	Field string
+	Rule   string
+	Field  string
+	Header string
 }
 
 func NewEqualMatch(field, rule string) *EqualMatch {
@@ -18,6 +19,10 @@ func NewEqualMatch(field, rule string) *EqualMatch {
 }
 
 func (r *EqualMatch) Match(ctx *context.Context, email *parsemail.Email) bool {
-	content := getFieldContent(r.Field, email)
-	return content == r.Rule
+	for _, content := range getFieldValues(r.Field, r.Header, email) {
+		if content == r.Rule {
+			return true
+		}
+	}
+	return false
 }
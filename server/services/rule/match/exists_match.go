@@ -0,0 +1,21 @@
+package match
+
+import (
+	"pmail/dto/parsemail"
+	"pmail/utils/context"
+)
+
+// ExistsMatch 字段存在且不为空，例如邮件头存在、有附件
+type ExistsMatch struct {
+	Field  string
+	Header string
+}
+
+func (r *ExistsMatch) Match(ctx *context.Context, email *parsemail.Email) bool {
+	for _, content := range getFieldValues(r.Field, r.Header, email) {
+		if content != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -8,8 +8,9 @@ import (
 )
 
 type RegexMatch struct {
-	Rule  string
-	Field string
+	Rule   string
+	Field  string
+	Header string
 }
 
 func NewRegexMatch(field, rule string) *RegexMatch {
@@ -20,13 +21,16 @@ func NewRegexMatch(field, rule string) *RegexMatch {
 }
 
 func (r *RegexMatch) Match(ctx *context.Context, email *parsemail.Email) bool {
-	content := getFieldContent(r.Field, email)
-
-	match, err := regexp.MatchString(r.Rule, content)
-
+	re, err := regexp.Compile(r.Rule)
 	if err != nil {
 		log.WithContext(ctx).Errorf("rule regex error %v", err)
+		return false
 	}
 
-	return match
+	for _, content := range getFieldValues(r.Field, r.Header, email) {
+		if re.MatchString(content) {
+			return true
+		}
+	}
+	return false
 }
@@ -1,14 +1,14 @@
 package match
 
 import (
-	"pmail/models"
+	"pmail/dto/parsemail"
 	"testing"
 )
 
 func TestRegexMatch_Match(t *testing.T) {
 	r := NewRegexMatch("Subject", "\\d+")
 
-	ret := r.Match(nil, &models.Email{
+	ret := r.Match(nil, &parsemail.Email{
 		Subject: "111",
 	})
 
@@ -1,6 +1,7 @@
 package rule
 
 import (
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
 	"pmail/config"
@@ -9,8 +10,10 @@ import (
 	"pmail/dto/parsemail"
 	"pmail/models"
 	"pmail/services/rule/match"
+	"pmail/utils/array"
 	"pmail/utils/context"
 	"pmail/utils/send"
+	"regexp"
 	"strings"
 )
 
@@ -34,59 +37,141 @@ func GetAllRules(ctx *context.Context) []*dto.Rule {
 	return ret
 }
 
-func MatchRule(ctx *context.Context, rule *dto.Rule, email *parsemail.Email) bool {
+// 条件组最多嵌套的层数
+const maxDepth = 5
 
-	for _, r := range rule.Rules {
-		var m match.Match
+// MatchRule 顶层的条件全部满足时匹配，条件组可以使用any和not组合出或、非逻辑
+func MatchRule(ctx *context.Context, rule *dto.Rule, email *parsemail.Email) bool {
+	matched, _ := matchGroup(ctx, dto.LogicAll, rule.Rules, email)
+	return matched
+}
 
-		switch r.Type {
-		case match.RuleTypeRegex:
-			m = match.NewRegexMatch(r.Field, r.Rule)
-		case match.RuleTypeContains:
-			m = match.NewContainsMatch(r.Field, r.Rule)
-		case match.RuleTypeEq:
-			m = match.NewEqualMatch(r.Field, r.Rule)
-		}
-		if m == nil {
+// matchGroup 返回是否匹配以及是否有有效的条件，不支持的条件会被忽略
+func matchGroup(ctx *context.Context, logic string, values []*dto.Value, email *parsemail.Email) (bool, bool) {
+	valid := false
+	for _, v := range values {
+		matched, ok := matchValue(ctx, v, email)
+		if !ok {
 			continue
 		}
-
-		if !m.Match(ctx, email) {
-			return false
+		valid = true
+		if logic == dto.LogicAny && matched {
+			return true, true
+		}
+		if logic != dto.LogicAny && !matched {
+			return false, true
 		}
 	}
+	return logic != dto.LogicAny, valid
+}
 
-	return true
+func matchValue(ctx *context.Context, v *dto.Value, email *parsemail.Email) (bool, bool) {
+	var matched, ok bool
+	if len(v.Rules) > 0 {
+		matched, ok = matchGroup(ctx, v.Logic, v.Rules, email)
+	} else if m := match.New(v.Type, v.Field, v.Header, v.Rule); m != nil {
+		matched, ok = m.Match(ctx, email), true
+	}
+	if !ok {
+		return false, false
+	}
+	return matched != v.Not, true
 }
 
-func DoRule(ctx *context.Context, rule *dto.Rule, email *parsemail.Email) {
-	log.WithContext(ctx).Debugf("执行规则:%s", rule.Name)
+// CheckRules 检查规则条件是否合法
+func CheckRules(values []*dto.Value) error {
+	return checkRules(values, 1)
+}
 
-	switch rule.Action {
-	case dto.READ:
-		email.IsRead = 1
-		if email.MessageId > 0 {
-			db.Instance.Exec(db.WithContext(ctx, "update email set is_read=1 where id =?"), email.MessageId)
+func checkRules(values []*dto.Value, depth int) error {
+	if depth > maxDepth {
+		return errors.New("rule groups too deep")
+	}
+	for _, v := range values {
+		if v == nil {
+			return errors.New("rule is empty")
+		}
+		if v.Logic != "" && v.Logic != dto.LogicAll && v.Logic != dto.LogicAny {
+			return errors.New("rule logic error: " + v.Logic)
+		}
+		if len(v.Rules) > 0 {
+			if err := checkRules(v.Rules, depth+1); err != nil {
+				return err
+			}
+			continue
 		}
-	case dto.DELETE:
-		email.Status = 3
-		if email.MessageId > 0 {
-			db.Instance.Exec(db.WithContext(ctx, "update email set status=3 where id =?"), email.MessageId)
+		if !array.InArray(v.Field, match.Fields) {
+			return errors.New("rule field error: " + v.Field)
 		}
-	case dto.FORWARD:
-		if strings.Contains(rule.Params, config.Instance.Domain) {
-			log.WithContext(ctx).Errorf("Forward Error! loop forwarding!")
-			return
+		if !array.InArray(v.Type, match.Types) {
+			return errors.New("rule type error: " + v.Type)
 		}
-		err := send.Forward(ctx, email, rule.Params)
-		if err != nil {
-			log.WithContext(ctx).Errorf("Forward Error:%v", err)
+		if v.Field == match.FieldHeader && strings.TrimSpace(v.Header) == "" {
+			return errors.New("rule header is empty")
 		}
-	case dto.MOVE:
-		email.GroupId = cast.ToInt(rule.Params)
-		if email.MessageId > 0 {
-			db.Instance.Exec(db.WithContext(ctx, "update email set group_id=? where id =?"), email.GroupId, email.MessageId)
+		switch v.Type {
+		case match.RuleTypeRegex:
+			if _, err := regexp.Compile(v.Rule); err != nil {
+				return errors.New("rule regex error: " + err.Error())
+			}
+		case match.RuleTypeGt, match.RuleTypeLt:
+			if _, err := match.ParseNumber(v.Rule); err != nil {
+				return errors.New("rule number error: " + v.Rule)
+			}
 		}
 	}
+	return nil
+}
 
+// DoRule 依次执行规则的全部动作，返回true时不再执行后面的规则
+func DoRule(ctx *context.Context, rule *dto.Rule, email *parsemail.Email) bool {
+	log.WithContext(ctx).Debugf("执行规则:%s", rule.Name)
+
+	for _, action := range rule.Actions {
+		if action == nil {
+			continue
+		}
+		switch action.Action {
+		case dto.READ:
+			email.IsRead = 1
+			if email.MessageId > 0 {
+				db.Instance.Exec(db.WithContext(ctx, "update email set is_read=1 where id =?"), email.MessageId)
+			}
+		case dto.DELETE:
+			email.Status = 3
+			if email.MessageId > 0 {
+				db.Instance.Exec(db.WithContext(ctx, "update email set status=3 where id =?"), email.MessageId)
+			}
+		case dto.FORWARD:
+			if strings.Contains(action.Params, config.Instance.Domain) {
+				log.WithContext(ctx).Errorf("Forward Error! loop forwarding!")
+				continue
+			}
+			err := send.Forward(ctx, email, action.Params)
+			if err != nil {
+				log.WithContext(ctx).Errorf("Forward Error:%v", err)
+			}
+		case dto.MOVE:
+			email.GroupId = cast.ToInt(action.Params)
+			if email.MessageId > 0 {
+				db.Instance.Exec(db.WithContext(ctx, "update email set group_id=? where id =?"), email.GroupId, email.MessageId)
+			}
+		case dto.TAG:
+			addTag(ctx, email, action.Params)
+		case dto.STAR:
+			email.IsStar = 1
+			if email.MessageId > 0 {
+				db.Instance.Exec(db.WithContext(ctx, "update email set is_star=1 where id =?"), email.MessageId)
+			}
+		case dto.REPLY:
+			autoReply(ctx, rule, email, action.Params)
+		case dto.WEBHOOK:
+			webhook(ctx, rule, email, action.Params)
+		case dto.SPAM:
+			markSpam(ctx, email)
+		case dto.STOP:
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,166 @@
+package rule
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"pmail/dto"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"strings"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	email := &parsemail.Email{
+		From:    &parsemail.User{EmailAddress: "news@example.com"},
+		Subject: "weekly",
+		Headers: textproto.MIMEHeader{"List-Id": {"<news.example.com>"}},
+		Size:    1024,
+	}
+
+	tests := []struct {
+		rules string
+		want  bool
+	}{
+		{`[]`, true},
+		{`[{"field":"Subject","type":"equal","rule":"weekly"},{"field":"Size","type":"gt","rule":"2K"}]`, false},
+		{`[{"logic":"any","rules":[{"field":"Subject","type":"equal","rule":"daily"},{"field":"Header","header":"List-Id","type":"exists"}]}]`, true},
+		{`[{"logic":"any","rules":[{"field":"Subject","type":"equal","rule":"daily"},{"field":"Size","type":"gt","rule":"2K"}]}]`, false},
+		{`[{"field":"From","type":"contains","rule":"example.com","not":true}]`, false},
+		{`[{"not":true,"logic":"any","rules":[{"field":"Subject","type":"equal","rule":"daily"}]}]`, true},
+		// 不支持的条件被忽略
+		{`[{"field":"Subject","type":"unknown","rule":"x"},{"logic":"any","rules":[{"field":"Subject","type":"unknown"}]}]`, true},
+	}
+	for _, tt := range tests {
+		r := &dto.Rule{}
+		if err := json.Unmarshal([]byte(tt.rules), &r.Rules); err != nil {
+			t.Fatal(err)
+		}
+		if got := MatchRule(nil, r, email); got != tt.want {
+			t.Errorf("MatchRule(%s) = %v, want %v", tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	tests := map[string]bool{
+		`[{"field":"Subject","type":"regex","rule":"\\d+"}]`:                                           true,
+		`[{"field":"Subject","type":"regex","rule":"("}]`:                                              false,
+		`[{"field":"Body","type":"equal","rule":"x"}]`:                                                 false,
+		`[{"field":"Header","type":"exists"}]`:                                                         false,
+		`[{"field":"Size","type":"gt","rule":"10M"}]`:                                                  true,
+		`[{"field":"Size","type":"lt","rule":"big"}]`:                                                  false,
+		`[{"logic":"or","rules":[{"field":"Subject","type":"equal","rule":"x"}]}]`:                     false,
+		`[{"rules":[{"rules":[{"rules":[{"rules":[{"rules":[{"field":"SPF","type":"equal"}]}]}]}]}]}]`: false,
+	}
+	for rules, want := range tests {
+		var values []*dto.Value
+		if err := json.Unmarshal([]byte(rules), &values); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckRules(values); (err == nil) != want {
+			t.Errorf("CheckRules(%s) = %v", rules, err)
+		}
+	}
+}
+
+func TestCheckActions(t *testing.T) {
+	tests := []struct {
+		actions string
+		wantErr bool
+	}{
+		{`[]`, true},
+		{`[{"action":1},{"action":6},{"action":10}]`, false},
+		{`[{"action":2,"params":"a@example.com"}]`, false},
+		{`[{"action":2,"params":"a"}]`, true},
+		{`[{"action":4,"params":"x"}]`, true},
+		{`[{"action":5,"params":" "}]`, true},
+		{`[{"action":7,"params":"Hi {{.FromName}}"}]`, false},
+		{`[{"action":7,"params":"Hi {{.FromName"}]`, true},
+		{`[{"action":8,"params":"https://example.com/hook"}]`, false},
+		{`[{"action":8,"params":"ftp://example.com"}]`, true},
+		{`[{"action":99}]`, true},
+	}
+	for _, tt := range tests {
+		var actions []*dto.Action
+		if err := json.Unmarshal([]byte(tt.actions), &actions); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckActions(actions); (err != nil) != tt.wantErr {
+			t.Errorf("CheckActions(%s) error = %v, wantErr %v", tt.actions, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDoRule(t *testing.T) {
+	email := &parsemail.Email{Tags: []string{"a"}}
+	r := &dto.Rule{Actions: []*dto.Action{
+		{Action: dto.READ},
+		{Action: dto.TAG, Params: "a"},
+		{Action: dto.TAG, Params: "b"},
+		{Action: dto.STOP},
+		{Action: dto.STAR},
+	}}
+	if !DoRule(nil, r, email) {
+		t.Errorf("DoRule() should stop")
+	}
+	if email.IsRead != 1 || email.IsStar != 0 || len(email.Tags) != 2 || email.Tags[1] != "b" {
+		t.Errorf("DoRule() email = %+v", email)
+	}
+}
+
+func TestDecodeLegacyAction(t *testing.T) {
+	r := (&dto.Rule{}).Decode(&models.Rule{Action: int(dto.MOVE), Params: "3"})
+	if len(r.Actions) != 1 || r.Actions[0].Action != dto.MOVE || r.Actions[0].Params != "3" {
+		t.Errorf("Decode() actions = %+v", r.Actions)
+	}
+}
+
+func TestRetroactiveActions(t *testing.T) {
+	ret := retroactiveActions([]*dto.Action{{Action: dto.REPLY, Params: "hi"}, nil, {Action: dto.MOVE, Params: "1"}}, true)
+	if len(ret) != 1 || ret[0].Action != dto.MOVE {
+		t.Errorf("retroactiveActions() = %+v", ret)
+	}
+
+	// 转发和webhook需要明确开启
+	actions := []*dto.Action{{Action: dto.FORWARD, Params: "a@b.com"}, {Action: dto.WEBHOOK, Params: "https://a.com"}, {Action: dto.STAR}}
+	if ret = retroactiveActions(actions, false); len(ret) != 1 || ret[0].Action != dto.STAR {
+		t.Errorf("retroactiveActions() = %+v", ret)
+	}
+	if ret = retroactiveActions(actions, true); len(ret) != 3 {
+		t.Errorf("retroactiveActions() outbound = %+v", ret)
+	}
+}
+
+func TestWebhookControl(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, err := webhookClient.Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if !errors.Is(err, errWebhookAddress) {
+		t.Errorf("loopback err = %v", err)
+	}
+
+	for address, allowed := range map[string]bool{
+		"10.1.2.3:80":              false,
+		"169.254.169.254:80":       false,
+		"[::1]:443":                false,
+		"[::ffff:127.0.0.1]:80":    false,
+		"[fe80::1]:80":             false,
+		"0.1.2.3:80":               false,
+		"100.64.0.1:80":            false,
+		"[64:ff9b::a00:1]:80":      false,
+		"[64:ff9b::7f00:1]:80":     false,
+		"[64:ff9b:1::1]:80":        false,
+		"[2002:a9fe:a9fe::]:80":    false,
+		"93.184.216.34:443":        true,
+		"[64:ff9b::5db8:d822]:443": true,
+		"[2002:5db8:d822::]:443":   true,
+	} {
+		if err := webhookControl("tcp", address, nil); (err == nil) != allowed {
+			t.Errorf("webhookControl(%s) = %v", address, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package search
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Query 解析后的搜索条件
+//
+// 支持的语法：
+//
+//	from:xxx  to:xxx  subject:xxx  has:attachment  is:unread  is:read
+//	before:2024-01-02  after:2024-01-02  "带空格的短语"
+//
+// 其他内容作为关键字，在发件人、收件人、标题、正文和附件名中搜索，多个条件之间是并且的关系
+type Query struct {
+	Text          []string
+	From          []string
+	To            []string
+	Subject       []string
+	HasAttachment bool
+	Unread        bool
+	Read          bool
+	Before        time.Time
+	After         time.Time
+}
+
+var dateLayouts = []string{"2006-01-02", "2006/01/02", "2006-1-2", "2006/1/2"}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Parse 解析搜索语句
+func Parse(q string) *Query {
+	ret := &Query{}
+	for _, token := range tokenize(q) {
+		key, value, found := strings.Cut(token, ":")
+		if !found || value == "" {
+			ret.addText(token)
+			continue
+		}
+		value = unquote(value)
+		switch strings.ToLower(key) {
+		case "from":
+			ret.From = append(ret.From, value)
+		case "to":
+			ret.To = append(ret.To, value)
+		case "subject":
+			ret.Subject = append(ret.Subject, value)
+		case "has":
+			if strings.HasPrefix(strings.ToLower(value), "attachment") {
+				ret.HasAttachment = true
+			} else {
+				ret.addText(token)
+			}
+		case "is":
+			switch strings.ToLower(value) {
+			case "unread":
+				ret.Unread = true
+			case "read":
+				ret.Read = true
+			default:
+				ret.addText(token)
+			}
+		case "before":
+			if t, ok := parseDate(value); ok {
+				ret.Before = t
+			} else {
+				ret.addText(token)
+			}
+		case "after":
+			if t, ok := parseDate(value); ok {
+				ret.After = t
+			} else {
+				ret.addText(token)
+			}
+		default:
+			// 不认识的前缀当作普通关键字，例如 http://xxx
+			ret.addText(token)
+		}
+	}
+	return ret
+}
+
+func (q *Query) addText(s string) {
+	s = unquote(s)
+	if s != "" {
+		q.Text = append(q.Text, s)
+	}
+}
+
+// IsEmpty 没有任何搜索条件
+func (q *Query) IsEmpty() bool {
+	return len(q.Text) == 0 && len(q.From) == 0 && len(q.To) == 0 && len(q.Subject) == 0 &&
+		!q.HasAttachment && !q.Unread && !q.Read && q.Before.IsZero() && q.After.IsZero()
+}
+
+// tokenize 按空格切分，双引号中的空格不切分
+func tokenize(q string) []string {
+	var ret []string
+	var cur strings.Builder
+	inQuote := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			cur.WriteRune(r)
+		case !inQuote && (r == ' ' || r == '\t' || r == '\n' || r == '　'):
+			if cur.Len() > 0 {
+				ret = append(ret, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		ret = append(ret, cur.String())
+	}
+	return ret
+}
+
+func unquote(s string) string {
+	return strings.TrimSpace(strings.ReplaceAll(s, `"`, ""))
+}
+
+func runeLen(s string) int {
+	return utf8.RuneCountInString(s)
+}
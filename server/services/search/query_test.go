@@ -0,0 +1,89 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	q := Parse(`from:alice@example.com to:"Bob Smith" subject:invoice has:attachment is:unread after:2024-01-02 before:2024/02/01 "quarterly report" 报表 http://x.com`)
+
+	if !reflect.DeepEqual(q.From, []string{"alice@example.com"}) {
+		t.Errorf("From = %v", q.From)
+	}
+	if !reflect.DeepEqual(q.To, []string{"Bob Smith"}) {
+		t.Errorf("To = %v", q.To)
+	}
+	if !reflect.DeepEqual(q.Subject, []string{"invoice"}) {
+		t.Errorf("Subject = %v", q.Subject)
+	}
+	if !reflect.DeepEqual(q.Text, []string{"quarterly report", "报表", "http://x.com"}) {
+		t.Errorf("Text = %v", q.Text)
+	}
+	if !q.HasAttachment || !q.Unread || q.Read {
+		t.Errorf("flags = %+v", q)
+	}
+	if !q.After.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("After = %v", q.After)
+	}
+	if !q.Before.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Before = %v", q.Before)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	q := Parse(`before:yesterday is:starred from:`)
+	if !q.Before.IsZero() {
+		t.Errorf("Before = %v", q.Before)
+	}
+	if !reflect.DeepEqual(q.Text, []string{"before:yesterday", "is:starred", "from:"}) {
+		t.Errorf("Text = %v", q.Text)
+	}
+	if Parse("  ").IsEmpty() != true {
+		t.Error("blank query should be empty")
+	}
+}
+
+func TestWhere(t *testing.T) {
+	q := Parse(`from:alice 报表 is:unread`)
+
+	sql, params := where("sqlite", 7, q)
+	wantSQL := "is_read = 0 and id in (select rowid from email_search where email_search match ? and user_id = ? and (from_text like ? escape '\\' or to_text like ? escape '\\' or subject like ? escape '\\' or body like ? escape '\\' or attachments like ? escape '\\'))"
+	if sql != wantSQL {
+		t.Errorf("sqlite sql = %s", sql)
+	}
+	if len(params) != 7 || params[0] != `from_text : "alice"` || params[1] != 7 || params[2] != "%报表%" {
+		t.Errorf("sqlite params = %v", params)
+	}
+
+	sql, params = where("mysql", 7, q)
+	wantSQL = "is_read = 0 and id in (select email_id from email_search where user_id = ? and match(from_text,to_text,subject,body,attachments) against(? in boolean mode) and match(from_text) against(? in boolean mode))"
+	if sql != wantSQL {
+		t.Errorf("mysql sql = %s", sql)
+	}
+	if !reflect.DeepEqual(params, []any{7, `"报表"`, `"alice"`}) {
+		t.Errorf("mysql params = %v", params)
+	}
+
+	_, params = where("sqlite", 7, Parse(`subject:1%`))
+	if len(params) != 2 || params[1] != `%1\%%` {
+		t.Errorf("like params = %v", params)
+	}
+	_, params = where("mysql", 7, Parse(`_`))
+	if len(params) != 6 || params[1] != `%\_%` {
+		t.Errorf("like params = %v", params)
+	}
+
+	sql, params = where("sqlite", 7, Parse("is:read"))
+	if sql != "is_read = 1" || len(params) != 0 {
+		t.Errorf("sql = %s, params = %v", sql, params)
+	}
+}
+
+func TestHtmlToText(t *testing.T) {
+	got := htmlToText(`<html><style>p{color:red}</style><p>Hello&nbsp;<b>world</b></p><script>alert(1)</script></html>`)
+	if got != "Hello world" {
+		t.Errorf("htmlToText = %q", got)
+	}
+}
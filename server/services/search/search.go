@@ -0,0 +1,284 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"pmail/config"
+	"pmail/db"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"pmail/utils/context"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// 全文索引表，SQLite使用FTS5虚拟表，rowid即邮件id；MySQL使用ngram分词的FULLTEXT索引
+const sqliteTable = "CREATE VIRTUAL TABLE IF NOT EXISTS email_search USING fts5(" +
+	"user_id UNINDEXED, has_attachment UNINDEXED, from_text, to_text, subject, body, attachments, tokenize='trigram')"
+
+const mysqlTable = "CREATE TABLE IF NOT EXISTS email_search (" +
+	"email_id int unsigned NOT NULL PRIMARY KEY," +
+	"user_id int unsigned NOT NULL DEFAULT 0," +
+	"has_attachment tinyint(1) NOT NULL DEFAULT 0," +
+	"from_text text," +
+	"to_text text," +
+	"subject text," +
+	"body mediumtext," +
+	"attachments text," +
+	"KEY idx_user_id (user_id)," +
+	"FULLTEXT KEY ft_all (from_text,to_text,subject,body,attachments) WITH PARSER ngram," +
+	"FULLTEXT KEY ft_from (from_text) WITH PARSER ngram," +
+	"FULLTEXT KEY ft_to (to_text) WITH PARSER ngram," +
+	"FULLTEXT KEY ft_subject (subject) WITH PARSER ngram" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// 每批重建索引的邮件数量
+const rebuildBatch = 200
+
+var rebuilding atomic.Bool
+
+var htmlTagReg = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+func dbType() string {
+	if config.Instance != nil && config.Instance.DbType == "mysql" {
+		return "mysql"
+	}
+	return "sqlite"
+}
+
+// Init 创建索引表，老版本升级上来的时候在后台为已有邮件建立索引
+func Init() {
+	createSQL := sqliteTable
+	if dbType() == "mysql" {
+		createSQL = mysqlTable
+	}
+	_, err := db.Instance.Exec(createSQL)
+	if err != nil {
+		panic(err)
+	}
+
+	indexed, err := db.Instance.SQL("select count(*) from email_search").Count()
+	if err != nil {
+		log.Errorf("Search Index SQL Error: %+v", err)
+		return
+	}
+	if indexed > 0 {
+		return
+	}
+	total, err := db.Instance.Count(&models.Email{})
+	if err != nil || total == 0 {
+		return
+	}
+	go Rebuild()
+}
+
+// Rebuild 为全部邮件重新建立索引
+func Rebuild() {
+	if !rebuilding.CompareAndSwap(false, true) {
+		return
+	}
+	defer rebuilding.Store(false)
+
+	ctx := &context.Context{}
+	log.Infof("Search Index Rebuild Start")
+	lastId := 0
+	num := 0
+	for {
+		var emails []*models.Email
+		err := db.Instance.Where("id > ?", lastId).Asc("id").Limit(rebuildBatch).Find(&emails)
+		if err != nil {
+			log.Errorf("Search Index SQL Error: %+v", err)
+			return
+		}
+		for _, email := range emails {
+			if err = save(ctx, email); err != nil {
+				log.Errorf("Search Index Error: %+v", err)
+			}
+			lastId = email.Id
+		}
+		num += len(emails)
+		if len(emails) < rebuildBatch {
+			break
+		}
+	}
+	log.Infof("Search Index Rebuild End, %d emails", num)
+}
+
+// Index 邮件入库或者修改后更新索引
+func Index(ctx *context.Context, id int) {
+	var email models.Email
+	exist, err := db.Instance.ID(id).Get(&email)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Search Index SQL Error: %+v", err)
+		return
+	}
+	if !exist {
+		Remove(ctx, id)
+		return
+	}
+	if err = save(ctx, &email); err != nil {
+		log.WithContext(ctx).Errorf("Search Index Error: %+v", err)
+	}
+}
+
+// Remove 邮件彻底删除后删除索引
+func Remove(ctx *context.Context, ids ...int) {
+	idField := "rowid"
+	if dbType() == "mysql" {
+		idField = "email_id"
+	}
+	for _, id := range ids {
+		_, err := db.Instance.Exec(db.WithContext(ctx, "delete from email_search where "+idField+" = ?"), id)
+		if err != nil {
+			log.WithContext(ctx).Errorf("Search Index SQL Error: %+v", err)
+		}
+	}
+}
+
+func save(ctx *context.Context, email *models.Email) error {
+	var hasAttachment int8
+	var attachments []string
+	// 只需要文件名，不读取附件内容
+	var atts []*parsemail.Attachment
+	_ = json.Unmarshal([]byte(email.Attachments), &atts)
+	for _, att := range atts {
+		// 正文中引用的图片不算附件
+		if att.Filename == "" || att.ContentID != "" {
+			continue
+		}
+		hasAttachment = 1
+		attachments = append(attachments, att.Filename)
+	}
+
+	var to []string
+	for _, users := range [][]*parsemail.User{email.GetTos(), email.GetCc(), email.GetBcc()} {
+		for _, u := range users {
+			to = append(to, strings.TrimSpace(u.Name+" "+u.EmailAddress))
+		}
+	}
+
+	body := email.Text.String
+	if email.Html.String != "" {
+		body += "\n" + htmlToText(email.Html.String)
+	}
+
+	params := []any{email.UserId, hasAttachment, strings.TrimSpace(email.FromName + " " + email.FromAddress),
+		strings.Join(to, " "), email.Subject, body, strings.Join(attachments, " ")}
+
+	if dbType() == "mysql" {
+		_, err := db.Instance.Exec(append([]any{db.WithContext(ctx, "replace into email_search (email_id,user_id,has_attachment,from_text,to_text,subject,body,attachments) values (?,?,?,?,?,?,?,?)"), email.Id}, params...)...)
+		return err
+	}
+
+	_, err := db.Instance.Exec(db.WithContext(ctx, "delete from email_search where rowid = ?"), email.Id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Instance.Exec(append([]any{db.WithContext(ctx, "insert into email_search (rowid,user_id,has_attachment,from_text,to_text,subject,body,attachments) values (?,?,?,?,?,?,?,?)"), email.Id}, params...)...)
+	return err
+}
+
+func htmlToText(s string) string {
+	s = htmlTagReg.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// Where 生成搜索条件，用于email表的where语句
+func Where(ctx *context.Context, q *Query) (string, []any) {
+	return where(dbType(), ctx.UserID, q)
+}
+
+type field struct {
+	sqliteFilter string   // fts5的列过滤
+	mysqlColumns string   // match()中的列，需要和FULLTEXT索引一致
+	columns      []string // 关键字太短无法使用全文索引时，使用like的列
+}
+
+var (
+	fieldText    = field{"", "from_text,to_text,subject,body,attachments", []string{"from_text", "to_text", "subject", "body", "attachments"}}
+	fieldFrom    = field{"from_text : ", "from_text", []string{"from_text"}}
+	fieldTo      = field{"to_text : ", "to_text", []string{"to_text"}}
+	fieldSubject = field{"subject : ", "subject", []string{"subject"}}
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func where(dbType string, userId int, q *Query) (string, []any) {
+	var conds []string
+	var params []any
+
+	if q.Unread {
+		conds = append(conds, "is_read = 0")
+	}
+	if q.Read {
+		conds = append(conds, "is_read = 1")
+	}
+	if !q.After.IsZero() {
+		conds = append(conds, "send_date >= ?")
+		params = append(params, q.After)
+	}
+	if !q.Before.IsZero() {
+		conds = append(conds, "send_date < ?")
+		params = append(params, q.Before)
+	}
+
+	// 各数据库分词器能匹配的最短关键字，sqlite trigram为3个字，mysql ngram默认为2个字
+	minLen := 3
+	if dbType == "mysql" {
+		minLen = 2
+	}
+
+	// like中的%和_需要转义，mysql字符串中的反斜杠本身也需要转义
+	likeSQL := ` like ? escape '\'`
+	if dbType == "mysql" {
+		likeSQL = ` like ? escape '\\'`
+	}
+
+	var matches []string
+	subConds := []string{"user_id = ?"}
+	subParams := []any{userId}
+	add := func(f field, terms []string) {
+		for _, term := range terms {
+			if runeLen(term) < minLen {
+				var likes []string
+				for _, col := range f.columns {
+					likes = append(likes, col+likeSQL)
+					subParams = append(subParams, "%"+likeEscaper.Replace(term)+"%")
+				}
+				subConds = append(subConds, "("+strings.Join(likes, " or ")+")")
+				continue
+			}
+			if dbType == "mysql" {
+				subConds = append(subConds, fmt.Sprintf("match(%s) against(? in boolean mode)", f.mysqlColumns))
+				subParams = append(subParams, `"`+term+`"`)
+			} else {
+				matches = append(matches, f.sqliteFilter+`"`+term+`"`)
+			}
+		}
+	}
+	add(fieldText, q.Text)
+	add(fieldFrom, q.From)
+	add(fieldTo, q.To)
+	add(fieldSubject, q.Subject)
+	if q.HasAttachment {
+		subConds = append(subConds, "has_attachment = 1")
+	}
+
+	if len(subConds) > 1 || len(matches) > 0 {
+		idField := "rowid"
+		if dbType == "mysql" {
+			idField = "email_id"
+		}
+		if len(matches) > 0 {
+			subConds = append([]string{"email_search match ?"}, subConds...)
+			subParams = append([]any{strings.Join(matches, " AND ")}, subParams...)
+		}
+		conds = append(conds, fmt.Sprintf("id in (select %s from email_search where %s)", idField, strings.Join(subConds, " and ")))
+		params = append(params, subParams...)
+	}
+
+	return strings.Join(conds, " and "), params
+}
@@ -42,8 +42,11 @@ func GetAdminPassword(ctx *context.Context) (string, error) {
 }
 
 func SetAdminPassword(ctx *context.Context, account, pwd string) error {
-	encodePwd := password.Encode(pwd)
-	res, err := db.Instance.Exec(db.WithContext(ctx, "INSERT INTO user (account, name, password) VALUES (?, 'admin',?)"), account, encodePwd)
+	encodePwd, err := password.Hash(pwd)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	res, err := db.Instance.Exec(db.WithContext(ctx, "INSERT INTO user (account, name, password, is_admin) VALUES (?, 'admin',?, 1)"), account, encodePwd)
 	if err != nil {
 		return errors.Wrap(err)
 	}
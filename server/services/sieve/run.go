@@ -0,0 +1,340 @@
+package sieve
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/emersion/go-message"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"pmail/config"
+	"pmail/db"
+	"pmail/dto/parsemail"
+	"pmail/models"
+	"pmail/services/alias"
+	"pmail/services/auth"
+	"pmail/services/group"
+	"pmail/utils/context"
+	"pmail/utils/send"
+	lang "pmail/utils/sieve"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 自动回复间隔天数的上限
+const maxVacationDays = 30
+
+// 分组名称最大长度，和group表保持一致
+const maxGroupNameLength = 10
+
+// Run 对已经入库的邮件执行用户启用的Sieve脚本，source为邮件原文，只读取邮件头，size为原文大小，from和to为信封地址
+// 脚本出错时按照RFC 5228保留邮件，不做任何处理
+func Run(ctx *context.Context, email *parsemail.Email, source io.Reader, size int64, from string, to []string) {
+	active, err := GetActive(ctx)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL Error:%+v", err)
+		return
+	}
+	if active == nil {
+		return
+	}
+	script, err := lang.Parse(active.Content)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Sieve Parse Error %s:%v", active.Name, err)
+		return
+	}
+
+	header := readHeader(source)
+	ret, err := script.Execute(&lang.Message{
+		Header: header,
+		Size:   size,
+		From:   from,
+		To:     to,
+	})
+	if err != nil {
+		log.WithContext(ctx).Warnf("Sieve Runtime Error %s:%v", active.Name, err)
+		return
+	}
+	log.WithContext(ctx).Debugf("Sieve执行结果:%+v", ret)
+
+	for _, address := range ret.Redirect {
+		redirect(ctx, email, address)
+	}
+	if ret.Vacation != nil {
+		vacation(ctx, header, from, ret.Vacation)
+	}
+
+	switch {
+	case ret.Keep:
+	case len(ret.FileInto) > 0:
+		// 一个用户只保存一份邮件，多个fileinto时以最后一个为准
+		fileInto(ctx, email, ret.FileInto[len(ret.FileInto)-1])
+	default:
+		email.Status = 3
+		if email.MessageId > 0 {
+			db.Instance.Exec(db.WithContext(ctx, "update email set status=3 where id =?"), email.MessageId)
+		}
+	}
+}
+
+// readHeader 读取并解码原文的邮件头
+func readHeader(source io.Reader) textproto.MIMEHeader {
+	ret := textproto.MIMEHeader{}
+	entity, err := message.Read(source)
+	if entity == nil {
+		log.Errorf("Sieve Header Read Error:%v", err)
+		return ret
+	}
+	fields := entity.Header.Fields()
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		ret.Add(fields.Key(), value)
+	}
+	return ret
+}
+
+func fileInto(ctx *context.Context, email *parsemail.Email, name string) {
+	if strings.EqualFold(name, "INBOX") {
+		return
+	}
+	if utf8.RuneCountInString(name) > maxGroupNameLength {
+		log.WithContext(ctx).Warnf("Sieve fileinto group name too long: %s", name)
+		return
+	}
+	groupId := group.GetGroupIdByName(ctx, name)
+	if groupId == 0 {
+		return
+	}
+	email.GroupId = groupId
+	if email.MessageId > 0 {
+		db.Instance.Exec(db.WithContext(ctx, "update email set group_id=? where id =?"), email.GroupId, email.MessageId)
+	}
+}
+
+func redirect(ctx *context.Context, email *parsemail.Email, address string) {
+	args := strings.Split(address, "@")
+	if len(args) != 2 || alias.IsLocalDomain(args[1]) {
+		log.WithContext(ctx).Errorf("Sieve Redirect Error! loop forwarding! %s", address)
+		return
+	}
+	err := send.Forward(ctx, email, address)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Sieve Redirect Error:%v", err)
+	}
+}
+
+// vacation 按照RFC 5230发送自动回复，不回复自动发送的邮件和邮件列表
+func vacation(ctx *context.Context, header textproto.MIMEHeader, from string, v *lang.Vacation) {
+	sender := strings.ToLower(from)
+	if !AutoReplyAllowed(header, sender) {
+		return
+	}
+	idx := strings.LastIndex(sender, "@")
+
+	replyFrom := replyAddress(ctx, header, v)
+	if replyFrom == "" {
+		return
+	}
+
+	days := v.Days
+	if days < 1 {
+		days = 1
+	}
+	if days > maxVacationDays {
+		days = maxVacationDays
+	}
+	handle := v.Handle
+	if handle == "" {
+		sum := sha1.Sum([]byte(v.Subject + "\x00" + v.From + "\x00" + v.Reason))
+		handle = hex.EncodeToString(sum[:])
+	}
+	if !MarkReplied(ctx, handle, sender, days) {
+		return
+	}
+
+	subject := v.Subject
+	if subject == "" {
+		subject = "Auto: " + header.Get("Subject")
+	}
+	reply := &parsemail.Email{
+		From:    &parsemail.User{EmailAddress: replyFrom, Name: ctx.UserName},
+		To:      []*parsemail.User{{EmailAddress: sender}},
+		Subject: subject,
+		Text:    []byte(v.Reason),
+		Headers: textproto.MIMEHeader{},
+	}
+	if v.Mime {
+		reply.Text, reply.HTML = readMime(v.Reason)
+	}
+	reply.Headers.Set("Auto-Submitted", "auto-replied")
+	if messageId := header.Get("Message-Id"); messageId != "" {
+		reply.Headers.Set("In-Reply-To", messageId)
+		reply.Headers.Set("References", messageId)
+	}
+
+	// 自动回复的信封发件人为空，防止对方再自动回复或者退信
+	_, err := send.SendToDomain(ctx, sender[idx+1:], "", reply.To, reply.BuildBytes(ctx, true))
+	if err != nil {
+		log.WithContext(ctx).Errorf("Sieve Vacation Send Error:%v", err)
+	}
+}
+
+// AutoReplyAllowed 是否可以自动回复，不回复退信、自动发送的邮件和邮件列表
+func AutoReplyAllowed(header textproto.MIMEHeader, sender string) bool {
+	sender = strings.ToLower(sender)
+	idx := strings.LastIndex(sender, "@")
+	if idx <= 0 {
+		return false
+	}
+	local := sender[:idx]
+	if local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+	if s := strings.ToLower(header.Get("Auto-Submitted")); s != "" && s != "no" {
+		return false
+	}
+	switch strings.ToLower(header.Get("Precedence")) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for key := range header {
+		if strings.HasPrefix(key, "List-") {
+			return false
+		}
+	}
+	return true
+}
+
+// userAddresses 用户在所有域名下的地址，以及脚本中:addresses指定的地址
+// replyAddress 自动回复使用的发件地址，邮件不是直接发给用户或者地址没有发信权限时返回空
+// :addresses只用于判断邮件是否发给自己，发件地址默认使用用户自己的地址，:from指定的地址需要有发信权限
+func replyAddress(ctx *context.Context, header textproto.MIMEHeader, v *lang.Vacation) string {
+	// 只回复直接发给自己的邮件，抄送给邮件列表等情况不回复
+	own := ownAddresses(ctx)
+	matched := matchAddress(header, userAddresses(own, v))
+	if matched == "" {
+		return ""
+	}
+	replyFrom := strings.ToLower(ctx.UserAccount + "@" + config.Instance.Domain)
+	for _, address := range own {
+		if address == matched {
+			replyFrom = matched
+		}
+	}
+	if v.From != "" {
+		a, err := mail.ParseAddress(v.From)
+		if err != nil {
+			log.WithContext(ctx).Warnf("Sieve Vacation From Not Allowed: %s", v.From)
+			return ""
+		}
+		replyFrom = a.Address
+	}
+	if !auth.HasSendAuth(ctx, replyFrom) {
+		log.WithContext(ctx).Warnf("Sieve Vacation From Not Allowed: %s", replyFrom)
+		return ""
+	}
+	return replyFrom
+}
+
+// ownAddresses 用户在每个域名下的地址
+func ownAddresses(ctx *context.Context) []string {
+	var ret []string
+	for _, domain := range config.Instance.Domains {
+		ret = append(ret, strings.ToLower(ctx.UserAccount+"@"+domain))
+	}
+	return ret
+}
+
+// userAddresses 判断邮件是否发给自己时使用的地址，包括:addresses和:from
+func userAddresses(own []string, v *lang.Vacation) []string {
+	ret := append([]string{}, own...)
+	for _, address := range v.Addresses {
+		ret = append(ret, strings.ToLower(address))
+	}
+	if v.From != "" {
+		if a, err := mail.ParseAddress(v.From); err == nil {
+			ret = append(ret, strings.ToLower(a.Address))
+		}
+	}
+	return ret
+}
+
+// matchAddress 返回To或者Cc中出现的用户地址
+func matchAddress(header textproto.MIMEHeader, addresses []string) string {
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range header.Values(key) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, a := range list {
+				for _, address := range addresses {
+					if strings.EqualFold(a.Address, address) {
+						return address
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// MarkReplied 记录自动回复，间隔时间内已经回复过时返回false
+func MarkReplied(ctx *context.Context, handle string, sender string, days int) bool {
+	var record models.SieveVacation
+	exist, err := db.Instance.Where("user_id=? and handle=? and sender=?", ctx.UserID, handle, sender).Get(&record)
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL Error:%+v", err)
+		return false
+	}
+	now := time.Now()
+	if exist && record.ExpireTime.After(now) {
+		return false
+	}
+	expire := now.Add(time.Duration(days) * 24 * time.Hour)
+	if exist {
+		_, err = db.Instance.Exec(db.WithContext(ctx, "update sieve_vacation set expire_time=? where id=?"), expire, record.Id)
+	} else {
+		_, err = db.Instance.Insert(&models.SieveVacation{UserId: ctx.UserID, Handle: handle, Sender: sender, ExpireTime: expire})
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("SQL Error:%+v", err)
+		return false
+	}
+	return true
+}
+
+// readMime :mime时回复内容是一个MIME实体，取出其中的正文
+func readMime(reason string) ([]byte, []byte) {
+	entity, err := message.Read(strings.NewReader(reason))
+	if entity == nil {
+		return []byte(reason), nil
+	}
+	var text, html []byte
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil || part.MultipartReader() != nil {
+			return err
+		}
+		t, _, _ := part.Header.ContentType()
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		if t == "text/html" && html == nil {
+			html = body
+		} else if text == nil {
+			text = body
+		}
+		return nil
+	})
+	if err != nil && text == nil && html == nil {
+		return []byte(reason), nil
+	}
+	return text, html
+}
@@ -0,0 +1,57 @@
+package sieve
+
+import (
+	"net/textproto"
+	"pmail/config"
+	"pmail/utils/context"
+	lang "pmail/utils/sieve"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	h := readHeader(strings.NewReader("From: a@b.com\r\nTo: me@example.org,\r\n other@example.org\r\nSubject: =?UTF-8?B?5pyI5bqmcmVwb3J0?=\r\nList-Id: <x.example.com>\r\n\r\nbody\r\n"))
+	if h.Get("Subject") != "月度report" {
+		t.Errorf("Subject = %q", h.Get("Subject"))
+	}
+	if h.Get("List-Id") == "" {
+		t.Errorf("List-Id not found")
+	}
+	if got := matchAddress(h, []string{"other@example.org"}); got != "other@example.org" {
+		t.Errorf("matchAddress = %q", got)
+	}
+	if got := matchAddress(h, []string{"nobody@example.org"}); got != "" {
+		t.Errorf("matchAddress = %q", got)
+	}
+}
+
+func TestReadMime(t *testing.T) {
+	text, html := readMime("Content-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\naway\r\n--b\r\nContent-Type: text/html\r\n\r\n<b>away</b>\r\n--b--\r\n")
+	if string(text) != "away" || string(html) != "<b>away</b>" {
+		t.Errorf("readMime = %q %q", text, html)
+	}
+}
+
+func TestReplyAddress(t *testing.T) {
+	config.Instance = &config.Config{Domain: "example.org", Domains: []string{"example.org", "example.net"}}
+	defer func() { config.Instance = nil }()
+	ctx := &context.Context{UserID: 1, UserAccount: "me"}
+	h := textproto.MIMEHeader{"To": {"list@other.com"}}
+
+	// :addresses只用于判断是否发给自己，回复使用用户自己的地址
+	if got := replyAddress(ctx, h, &lang.Vacation{Addresses: []string{"list@other.com"}}); got != "me@example.org" {
+		t.Errorf("replyAddress = %q", got)
+	}
+	h = textproto.MIMEHeader{"To": {"Me@example.net"}}
+	if got := replyAddress(ctx, h, &lang.Vacation{}); got != "me@example.net" {
+		t.Errorf("replyAddress = %q", got)
+	}
+	// 没有发给自己的邮件不回复
+	if got := replyAddress(ctx, textproto.MIMEHeader{"To": {"a@b.com"}}, &lang.Vacation{}); got != "" {
+		t.Errorf("replyAddress = %q", got)
+	}
+	// :from没有发信权限时不回复
+	if got := replyAddress(ctx, h, &lang.Vacation{From: "boss@other.com"}); got != "" {
+		t.Errorf("replyAddress = %q", got)
+	}
+}
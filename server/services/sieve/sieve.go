@@ -0,0 +1,169 @@
+package sieve
+
+import (
+	"errors"
+	"pmail/db"
+	"pmail/models"
+	"pmail/utils/context"
+	lang "pmail/utils/sieve"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 脚本名称最大长度
+const maxNameLength = 100
+
+// 脚本内容最大长度
+const MaxScriptSize = 64 * 1024
+
+var (
+	ErrNotFound  = errors.New("sieve script not found")
+	ErrExists    = errors.New("sieve script already exists")
+	ErrActive    = errors.New("active sieve script can not be deleted")
+	ErrNameError = errors.New("sieve script name error")
+	ErrTooLarge  = errors.New("sieve script too large")
+)
+
+// CheckName 名称不能为空，不能包含控制字符
+func CheckName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength || !utf8.ValidString(name) {
+		return ErrNameError
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return ErrNameError
+		}
+	}
+	return nil
+}
+
+// Check 检查脚本语法
+func Check(content string) error {
+	if len(content) > MaxScriptSize {
+		return ErrTooLarge
+	}
+	_, err := lang.Parse(content)
+	return err
+}
+
+// List 当前用户的脚本列表，不包含脚本内容
+func List(ctx *context.Context) ([]*models.SieveScript, error) {
+	ret := []*models.SieveScript{}
+	err := db.Instance.Where("user_id=?", ctx.UserID).Cols("id", "name", "active", "create_time", "update_time").Asc("name").Find(&ret)
+	return ret, err
+}
+
+// Get 获取脚本，不存在时返回ErrNotFound
+func Get(ctx *context.Context, name string) (*models.SieveScript, error) {
+	var script models.SieveScript
+	exist, err := db.Instance.Where("user_id=? and name=?", ctx.UserID, name).Get(&script)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return &script, nil
+}
+
+// GetActive 获取启用的脚本，没有启用的脚本时返回nil
+func GetActive(ctx *context.Context) (*models.SieveScript, error) {
+	var script models.SieveScript
+	exist, err := db.Instance.Where("user_id=? and active=1", ctx.UserID).Get(&script)
+	if err != nil || !exist {
+		return nil, err
+	}
+	return &script, nil
+}
+
+// Save 保存脚本，同名脚本会被覆盖
+func Save(ctx *context.Context, name string, content string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	if err := Check(content); err != nil {
+		return err
+	}
+	// 统一使用CRLF换行，方便ManageSieve原样返回
+	content = strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\n", "\r\n")
+
+	script, err := Get(ctx, name)
+	if err == ErrNotFound {
+		_, err = db.Instance.Insert(&models.SieveScript{UserId: ctx.UserID, Name: name, Content: content})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	script.Content = content
+	_, err = db.Instance.ID(script.Id).Cols("content").Update(script)
+	return err
+}
+
+// Rename 重命名脚本，新名称不能已经存在
+func Rename(ctx *context.Context, oldName string, newName string) error {
+	if err := CheckName(newName); err != nil {
+		return err
+	}
+	script, err := Get(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, err = Get(ctx, newName); err != ErrNotFound {
+		if err == nil {
+			err = ErrExists
+		}
+		return err
+	}
+	script.Name = newName
+	_, err = db.Instance.ID(script.Id).Cols("name").Update(script)
+	return err
+}
+
+// Delete 删除脚本，启用中的脚本不能删除
+func Delete(ctx *context.Context, name string) error {
+	script, err := Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	if script.Active == 1 {
+		return ErrActive
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "delete from sieve_script where id=?"), script.Id)
+	return err
+}
+
+// SetActive 启用脚本，同时停用其他脚本，name为空时停用全部脚本
+func SetActive(ctx *context.Context, name string) error {
+	var id int
+	if name != "" {
+		script, err := Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		id = script.Id
+	}
+
+	trans := db.Instance.NewSession()
+	defer trans.Close()
+	if err := trans.Begin(); err != nil {
+		return err
+	}
+	_, err := trans.Exec(db.WithContext(ctx, "update sieve_script set active=0 where user_id=? and id!=?"), ctx.UserID, id)
+	if err != nil {
+		trans.Rollback()
+		return err
+	}
+	if id > 0 {
+		_, err = trans.Exec(db.WithContext(ctx, "update sieve_script set active=1 where id=?"), id)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+	}
+	return trans.Commit()
+}
@@ -0,0 +1,242 @@
+package throttle
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"pmail/db"
+	"pmail/models"
+	"pmail/utils/context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeAccount = "account"
+	TypeIP      = "ip"
+)
+
+const (
+	// 账号连续失败多少次后锁定
+	maxAccountFailures = 5
+	// IP连续失败多少次后封禁
+	maxIPFailures = 20
+	// 超过这个时间没有失败，失败次数清零
+	failureWindow = 15 * time.Minute
+	// 第一次锁定的时间，之后每次翻倍，最长不超过maxLockout
+	baseLockout = time.Minute
+	maxLockout  = 24 * time.Hour
+	// 每种类型最多保存的记录数量，防止尝试大量不存在的账号占满内存
+	maxRecords = 100000
+	// 清理过期记录的间隔
+	pruneInterval = time.Minute
+)
+
+type record struct {
+	failures  int
+	lockouts  int // 已经被锁定的次数，用于计算下一次锁定时间
+	lastFail  time.Time
+	lockUntil time.Time
+}
+
+// LockItem 当前正在生效的锁定
+type LockItem struct {
+	Type      string `json:"type"`
+	Target    string `json:"target"`
+	Failures  int    `json:"failures"`
+	LockUntil string `json:"lock_until"`
+}
+
+var lock sync.Mutex
+var records = map[string]map[string]*record{
+	TypeAccount: {},
+	TypeIP:      {},
+}
+var lastPrune time.Time
+
+// now 方便测试替换
+var now = time.Now
+
+// IP 从连接地址中取出IP
+func IP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func lockDuration(lockouts int) time.Duration {
+	d := baseLockout
+	for i := 1; i < lockouts; i++ {
+		d *= 2
+		if d >= maxLockout {
+			return maxLockout
+		}
+	}
+	return d
+}
+
+func isLocked(kind, key string) bool {
+	r, exist := records[kind][key]
+	return exist && now().Before(r.lockUntil)
+}
+
+// IsBanned IP是否处于封禁状态
+func IsBanned(ip string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return isLocked(TypeIP, ip)
+}
+
+// Allow 登陆前检查，IP被封禁或者账号被锁定时返回false
+func Allow(ip, account string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return !isLocked(TypeIP, ip) && !isLocked(TypeAccount, strings.ToLower(account))
+}
+
+// Failed 记录一次登陆失败，失败次数达到上限后锁定账号或封禁IP
+func Failed(ctx *context.Context, protocol, ip, account string) {
+	lock.Lock()
+	var events []*models.AuthLockout
+	if e := fail(TypeAccount, strings.ToLower(account), maxAccountFailures); e != nil {
+		events = append(events, e)
+	}
+	if e := fail(TypeIP, ip, maxIPFailures); e != nil {
+		events = append(events, e)
+	}
+	lock.Unlock()
+
+	for _, e := range events {
+		e.Protocol = protocol
+		e.Ip = ip
+		log.WithContext(ctx).Warnf("Auth Lockout! %s %s locked until %s", e.Type, e.Target, e.LockUntil.Format(time.DateTime))
+		_, err := db.Instance.Insert(e)
+		if err != nil {
+			log.WithContext(ctx).Errorf("SQL Error: %+v", err)
+		}
+	}
+}
+
+// expired 失败次数已经清零并且不会影响下一次锁定时间的记录
+func (r *record) expired(t time.Time) bool {
+	return t.Sub(r.lastFail) > failureWindow && t.Sub(r.lockUntil) > maxLockout
+}
+
+// prune 清理过期的记录，记录数量仍然超过上限时丢弃没有被锁定的记录
+func prune(t time.Time) {
+	lastPrune = t
+	for _, items := range records {
+		for key, r := range items {
+			if r.expired(t) {
+				delete(items, key)
+			}
+		}
+		if len(items) < maxRecords {
+			continue
+		}
+		for key, r := range items {
+			if !t.Before(r.lockUntil) {
+				delete(items, key)
+			}
+		}
+	}
+}
+
+func fail(kind, key string, max int) *models.AuthLockout {
+	if key == "" {
+		return nil
+	}
+	t := now()
+	r, exist := records[kind][key]
+	if !exist {
+		if t.Sub(lastPrune) > pruneInterval || len(records[kind]) >= maxRecords {
+			prune(t)
+		}
+		r = &record{}
+		records[kind][key] = r
+	}
+	if t.Sub(r.lastFail) > failureWindow {
+		r.failures = 0
+	}
+	// 长时间没有再被锁定，锁定时间重新计算
+	if t.Sub(r.lockUntil) > maxLockout {
+		r.lockouts = 0
+	}
+	r.failures++
+	r.lastFail = t
+
+	if r.failures < max {
+		return nil
+	}
+	r.lockouts++
+	r.failures = 0
+	r.lockUntil = t.Add(lockDuration(r.lockouts))
+	return &models.AuthLockout{
+		Type:      kind,
+		Target:    key,
+		Failures:  max,
+		LockUntil: r.lockUntil,
+	}
+}
+
+// Success 登陆成功后清空账号的失败次数
+func Success(ip, account string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if r, exist := records[TypeAccount][strings.ToLower(account)]; exist {
+		r.failures = 0
+	}
+}
+
+// Unlock 管理员手动解除锁定
+func Unlock(kind, target string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if kind == TypeAccount {
+		target = strings.ToLower(target)
+	}
+	r, exist := records[kind][target]
+	if !exist {
+		return false
+	}
+	delete(records[kind], target)
+	return now().Before(r.lockUntil)
+}
+
+// GetLocks 获取当前正在生效的锁定
+func GetLocks() []*LockItem {
+	lock.Lock()
+	defer lock.Unlock()
+
+	ret := []*LockItem{}
+	t := now()
+	for kind, items := range records {
+		for key, r := range items {
+			if t.Before(r.lockUntil) {
+				ret = append(ret, &LockItem{
+					Type:      kind,
+					Target:    key,
+					Failures:  r.failures,
+					LockUntil: r.lockUntil.Format(time.DateTime),
+				})
+			} else if r.expired(t) {
+				// 顺便清理过期的记录
+				delete(items, key)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LockUntil > ret[j].LockUntil
+	})
+	return ret
+}
+
+// GetEvents 获取最近的锁定记录
+func GetEvents(ctx *context.Context, limit int) ([]*models.AuthLockout, error) {
+	ret := []*models.AuthLockout{}
+	err := db.Instance.Desc("id").Limit(limit).Find(&ret)
+	return ret, err
+}
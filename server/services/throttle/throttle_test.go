@@ -0,0 +1,133 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func reset(t time.Time) {
+	records = map[string]map[string]*record{
+		TypeAccount: {},
+		TypeIP:      {},
+	}
+	now = func() time.Time { return t }
+}
+
+func TestLockDuration(t *testing.T) {
+	tests := []struct {
+		lockouts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{11, 1024 * time.Minute},
+		{12, 24 * time.Hour},
+		{100, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := lockDuration(tt.lockouts); got != tt.want {
+			t.Errorf("lockDuration(%d) = %v, want %v", tt.lockouts, got, tt.want)
+		}
+	}
+}
+
+func TestAccountLock(t *testing.T) {
+	start := time.Now()
+	reset(start)
+	defer func() { now = time.Now }()
+
+	for i := 0; i < maxAccountFailures-1; i++ {
+		fail(TypeAccount, "admin", maxAccountFailures)
+	}
+	if !Allow("1.1.1.1", "Admin") {
+		t.Fatal("locked before reaching the limit")
+	}
+	if e := fail(TypeAccount, "admin", maxAccountFailures); e == nil {
+		t.Fatal("lock event expected")
+	}
+	if Allow("2.2.2.2", "Admin") {
+		t.Fatal("account should be locked")
+	}
+
+	// 锁定过期后再次失败，锁定时间翻倍
+	later := start.Add(2 * time.Minute)
+	now = func() time.Time { return later }
+	if !Allow("1.1.1.1", "admin") {
+		t.Fatal("lock should expire")
+	}
+	for i := 0; i < maxAccountFailures-1; i++ {
+		fail(TypeAccount, "admin", maxAccountFailures)
+	}
+	e := fail(TypeAccount, "admin", maxAccountFailures)
+	if e == nil {
+		t.Fatal("second lock event expected")
+	}
+	if got := e.LockUntil.Sub(later); got != 2*time.Minute {
+		t.Errorf("second lockout = %v, want 2m", got)
+	}
+
+	if !Unlock(TypeAccount, "ADMIN") {
+		t.Error("Unlock should report an active lock")
+	}
+	if !Allow("1.1.1.1", "admin") {
+		t.Error("account should be unlocked")
+	}
+}
+
+func TestIPBan(t *testing.T) {
+	reset(time.Now())
+	defer func() { now = time.Now }()
+
+	for i := 0; i < maxIPFailures; i++ {
+		fail(TypeIP, "10.0.0.1", maxIPFailures)
+	}
+	if !IsBanned("10.0.0.1") || IsBanned("10.0.0.2") {
+		t.Fatal("only 10.0.0.1 should be banned")
+	}
+	if len(GetLocks()) != 1 {
+		t.Errorf("GetLocks() = %d items, want 1", len(GetLocks()))
+	}
+}
+
+func TestFailureWindow(t *testing.T) {
+	start := time.Now()
+	reset(start)
+	defer func() { now = time.Now }()
+
+	for i := 0; i < maxAccountFailures-1; i++ {
+		fail(TypeAccount, "admin", maxAccountFailures)
+	}
+	later := start.Add(failureWindow + time.Second)
+	now = func() time.Time { return later }
+	if e := fail(TypeAccount, "admin", maxAccountFailures); e != nil {
+		t.Error("failures outside the window should not count")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	start := time.Now()
+	reset(start)
+	defer func() { now = time.Now }()
+
+	fail(TypeAccount, "a", maxAccountFailures)
+	fail(TypeAccount, "b", maxAccountFailures)
+	later := start.Add(maxLockout + failureWindow + time.Second)
+	now = func() time.Time { return later }
+	fail(TypeAccount, "c", maxAccountFailures)
+	if len(records[TypeAccount]) != 1 {
+		t.Errorf("expired records not pruned: %d", len(records[TypeAccount]))
+	}
+}
+
+func TestIP(t *testing.T) {
+	if got := IP("127.0.0.1:25"); got != "127.0.0.1" {
+		t.Errorf("IP() = %s", got)
+	}
+	if got := IP("[::1]:993"); got != "::1" {
+		t.Errorf("IP() = %s", got)
+	}
+	if got := IP("127.0.0.1"); got != "127.0.0.1" {
+		t.Errorf("IP() = %s", got)
+	}
+}
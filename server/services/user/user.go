@@ -0,0 +1,261 @@
+package user
+
+import (
+	"pmail/config"
+	"pmail/db"
+	"pmail/models"
+	"pmail/services/attachments"
+	"pmail/utils/array"
+	"pmail/utils/context"
+	"pmail/utils/errors"
+	"pmail/utils/password"
+	"regexp"
+	"strings"
+)
+
+var accountReg = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,20}$`)
+
+type UserItem struct {
+	Id       int      `json:"id"`
+	Account  string   `json:"account"`
+	Name     string   `json:"name"`
+	IsAdmin  bool     `json:"is_admin"`
+	Disabled bool     `json:"disabled"`
+	Auths    []string `json:"auths"` // 可以收信和发信的地址前缀，*表示可以使用任意地址发信
+}
+
+// CheckAccount 账号只能包含字母、数字和._-
+func CheckAccount(account string) bool {
+	return accountReg.MatchString(account)
+}
+
+// GetUserList 获取全部用户
+func GetUserList(ctx *context.Context) ([]*UserItem, error) {
+	var users []*models.User
+	err := db.Instance.Asc("id").Find(&users)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	var auths []*models.UserAuth
+	err = db.Instance.Asc("id").Find(&auths)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	authMap := map[int][]string{}
+	for _, auth := range auths {
+		authMap[auth.UserID] = append(authMap[auth.UserID], auth.EmailAccount)
+	}
+
+	ret := []*UserItem{}
+	for _, user := range users {
+		item := &UserItem{
+			Id:       user.ID,
+			Account:  user.Account,
+			Name:     user.Name,
+			IsAdmin:  user.IsAdmin == 1,
+			Disabled: user.Disabled == 1,
+			Auths:    authMap[user.ID],
+		}
+		if item.Auths == nil {
+			item.Auths = []string{}
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// GetUser 根据id获取用户
+func GetUser(ctx *context.Context, id int) (*models.User, error) {
+	var user models.User
+	exist, err := db.Instance.ID(id).Get(&user)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if !exist {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+// AccountExist 账号是否已经存在
+func AccountExist(ctx *context.Context, account string) (bool, error) {
+	exist, err := db.Instance.Where("account = ?", account).Exist(&models.User{})
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	return exist, nil
+}
+
+// CreateUser 新建用户
+func CreateUser(ctx *context.Context, account, name, pwd string, isAdmin bool) (int, error) {
+	hash, err := password.Hash(pwd)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	user := models.User{
+		Account:  account,
+		Name:     name,
+		Password: hash,
+	}
+	if isAdmin {
+		user.IsAdmin = 1
+	}
+	_, err = db.Instance.Insert(&user)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	return user.ID, nil
+}
+
+// UpdateUser 修改用户名称、管理员权限以及禁用状态
+func UpdateUser(ctx *context.Context, id int, name string, isAdmin, disabled bool) error {
+	var adminV, disabledV int8
+	if isAdmin {
+		adminV = 1
+	}
+	if disabled {
+		disabledV = 1
+	}
+	_, err := db.Instance.Exec(db.WithContext(ctx, "update user set name=?, is_admin=?, disabled=? where id=?"), name, adminV, disabledV, id)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// ResetPassword 重置用户密码
+func ResetPassword(ctx *context.Context, id int, pwd string) error {
+	hash, err := password.Hash(pwd)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	_, err = db.Instance.Exec(db.WithContext(ctx, "update user set password=? where id=?"), hash, id)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// SetAuths 设置用户可以收信和发信的地址前缀，会覆盖原有设置
+func SetAuths(ctx *context.Context, id int, accounts []string) error {
+	var auths []string
+	for _, account := range accounts {
+		account = strings.TrimSpace(account)
+		// 只保留@前面的部分
+		if idx := strings.LastIndex(account, "@"); idx >= 0 {
+			account = account[:idx]
+		}
+		if account == "" {
+			continue
+		}
+		if account != "*" && !CheckAccount(account) {
+			return errors.New("account error")
+		}
+		auths = append(auths, account)
+	}
+	auths = array.Unique(auths)
+
+	trans := db.Instance.NewSession()
+	defer trans.Close()
+	if err := trans.Begin(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	_, err := trans.Exec(db.WithContext(ctx, "delete from user_auth where user_id=?"), id)
+	if err != nil {
+		trans.Rollback()
+		return errors.Wrap(err)
+	}
+	for _, account := range auths {
+		_, err = trans.Exec(db.WithContext(ctx, "insert into user_auth (user_id, email_account) values (?,?)"), id, account)
+		if err != nil {
+			trans.Rollback()
+			return errors.Wrap(err)
+		}
+	}
+
+	if err = trans.Commit(); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// DeleteUser 删除用户以及用户的全部数据
+func DeleteUser(ctx *context.Context, id int) error {
+	var user models.User
+	_, err := db.Instance.ID(id).Get(&user)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	// 附件和邮件原文使用的文件，删除记录后清理
+	var hashes, sourceHashes []string
+	err = db.Instance.Table("attachment").Where("email_id in (select id from email where user_id=?)", id).Distinct("hash").Find(&hashes)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	err = db.Instance.Table("email_source").Where("hash != '' and email_id in (select id from email where user_id=?)", id).Distinct("hash").Find(&sourceHashes)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	hashes = append(hashes, sourceHashes...)
+
+	trans := db.Instance.NewSession()
+	defer trans.Close()
+	if err := trans.Begin(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	// 指向该用户的别名，目标可能是账号本身或者账号在各个域名下的完整地址
+	if user.Account != "" {
+		account := strings.ToLower(user.Account)
+		targets := []any{account}
+		for _, domain := range config.Instance.Domains {
+			targets = append(targets, account+"@"+strings.ToLower(domain))
+		}
+		_, err = trans.In("target", targets...).Delete(&models.Alias{})
+		if err != nil {
+			trans.Rollback()
+			return errors.Wrap(err)
+		}
+		_, err = trans.Exec(db.WithContext(ctx, "delete from auth_lockout where type='account' and target=?"), user.Account)
+		if err != nil {
+			trans.Rollback()
+			return errors.Wrap(err)
+		}
+	}
+
+	sqls := []string{
+		"delete from user where id=?",
+		"delete from user_auth where user_id=?",
+		"delete from `group` where user_id=?",
+		"delete from rule where user_id=?",
+		"delete from sieve_script where user_id=?",
+		"delete from sieve_vacation where user_id=?",
+		"delete from imap_uid where mailbox_id in (select id from imap_mailbox where user_id=?)",
+		"delete from imap_mailbox where user_id=?",
+		"delete from send_queue where email_id in (select id from email where user_id=?)",
+		"delete from email_source where email_id in (select id from email where user_id=?)",
+		"delete from attachment where email_id in (select id from email where user_id=?)",
+		"delete from email where user_id=?",
+		"delete from email_search where user_id=?",
+		"delete from app_password where user_id=?",
+		"delete from recovery_code where user_id=?",
+	}
+	for _, sql := range sqls {
+		_, err := trans.Exec(db.WithContext(ctx, sql), id)
+		if err != nil {
+			trans.Rollback()
+			return errors.Wrap(err)
+		}
+	}
+
+	if err := trans.Commit(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	// 删除没有其他邮件引用的附件和原文文件
+	attachments.Clean(ctx, hashes)
+	return nil
+}
@@ -0,0 +1,22 @@
+package user
+
+import "testing"
+
+func TestCheckAccount(t *testing.T) {
+	tests := []struct {
+		account string
+		want    bool
+	}{
+		{"admin", true},
+		{"first.last-1_a", true},
+		{"", false},
+		{"a@b", false},
+		{"has space", false},
+		{"abcdefghijklmnopqrstu", false},
+	}
+	for _, tt := range tests {
+		if got := CheckAccount(tt.account); got != tt.want {
+			t.Errorf("CheckAccount(%q) = %v, want %v", tt.account, got, tt.want)
+		}
+	}
+}
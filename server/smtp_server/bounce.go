@@ -0,0 +1,194 @@
+package smtp_server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-message"
+	log "github.com/sirupsen/logrus"
+	"pmail/config"
+	"pmail/dto/parsemail"
+	"pmail/hooks"
+	"pmail/hooks/framework"
+	"pmail/services/queue"
+	"pmail/utils/async"
+	"pmail/utils/context"
+	"pmail/utils/dmarc"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const mailerDaemon = "mailer-daemon"
+
+// 对方服务器的返回，例如 "550 5.1.1 user unknown"
+var smtpReplyReg = regexp.MustCompile(`^([245])\d{2}[ -](?:([245]\.\d{1,3}\.\d{1,3})\s)?`)
+
+func init() {
+	queue.Bounce = bounce
+}
+
+type failedRecipient struct {
+	address    string
+	diagnostic string
+}
+
+// status 按RFC 3463返回最终的状态码，以及是否拿到了对方服务器的SMTP返回
+func (r *failedRecipient) status() (string, bool) {
+	matches := smtpReplyReg.FindStringSubmatch(r.diagnostic)
+	if matches == nil {
+		// 网络错误，一直重试到过期
+		return "4.4.7", false
+	}
+	if matches[1] != "5" {
+		// 临时错误，一直重试到过期
+		return "4.4.7", true
+	}
+	if matches[2] != "" {
+		return matches[2], true
+	}
+	return "5.0.0", true
+}
+
+// bounce 投递最终失败后生成RFC 3464格式的退信，存入发件人的收件箱
+func bounce(ctx *context.Context, e *parsemail.Email, errMap map[string]error) {
+	if e.From == nil || e.From.EmailAddress == "" {
+		return
+	}
+	// 退信投递失败不再生成退信，避免循环
+	if account, _ := e.From.GetDomainAccount(); strings.EqualFold(account, mailerDaemon) {
+		return
+	}
+
+	failed := failedRecipients(e, errMap)
+	if len(failed) == 0 {
+		return
+	}
+
+	data, err := buildDSN(ctx, e, failed)
+	if err != nil {
+		log.WithContext(ctx).Errorf("DSN Build Error %+v", err)
+		return
+	}
+
+	dsn := parsemail.NewEmailFromReader(nil, bytes.NewReader(data))
+	err = saveEmail(ctx, dsn, 0, 0, true, true, dmarc.ResultNone)
+	if err != nil {
+		log.WithContext(ctx).Errorf("DSN Save Error %+v", err)
+		return
+	}
+	log.WithContext(ctx).Infof("DSN: email %d bounced to %s", e.MessageId, e.From.EmailAddress)
+
+	as := async.New(ctx)
+	for _, hook := range hooks.HookList {
+		if hook == nil {
+			continue
+		}
+		as.WaitProcess(func(hk any) {
+			hk.(framework.EmailHook).ReceiveSaveAfter(ctx, dsn)
+		}, hook)
+	}
+	as.Wait()
+}
+
+// failedRecipients 根据每个域名的投递结果找出投递失败的收件人
+func failedRecipients(e *parsemail.Email, errMap map[string]error) []*failedRecipient {
+	var to []*parsemail.User
+	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
+
+	var ret []*failedRecipient
+	for _, user := range to {
+		_, domain := user.GetDomainAccount()
+		if err := errMap[domain]; err != nil {
+			ret = append(ret, &failedRecipient{
+				address:    user.EmailAddress,
+				diagnostic: strings.TrimSpace(err.Error()),
+			})
+		}
+	}
+	return ret
+}
+
+// buildDSN 生成multipart/report退信，包含说明文字、投递状态以及原邮件的邮件头
+func buildDSN(ctx *context.Context, e *parsemail.Email, failed []*failedRecipient) ([]byte, error) {
+	var b bytes.Buffer
+
+	var h message.Header
+	h.Set("From", fmt.Sprintf("Mail Delivery System <%s@%s>", mailerDaemon, config.Instance.Domain))
+	h.Set("To", e.From.EmailAddress)
+	h.Set("Subject", "Undelivered Mail Returned to Sender")
+	h.Set("Date", time.Now().Format(time.RFC1123Z))
+	h.Set("Message-Id", fmt.Sprintf("<bounce.%d.%d@%s>", e.MessageId, time.Now().Unix(), config.Instance.Domain))
+	h.Set("Auto-Submitted", "auto-replied")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/report", map[string]string{"report-type": "delivery-status"})
+
+	mw, err := message.CreateWriter(&b, h)
+	if err != nil {
+		return nil, err
+	}
+
+	// 说明文字
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("This is the mail system at host smtp.%s.\r\n\r\n", config.Instance.Domain))
+	text.WriteString("I'm sorry to have to inform you that your message could not\r\nbe delivered to one or more recipients.\r\n\r\n")
+	for _, r := range failed {
+		text.WriteString(fmt.Sprintf("<%s>: %s\r\n", r.address, r.diagnostic))
+	}
+	var th message.Header
+	th.SetContentType("text/plain", map[string]string{"charset": "UTF-8"})
+	if err = writePart(mw, th, text.String()); err != nil {
+		return nil, err
+	}
+
+	// 投递状态
+	var status strings.Builder
+	status.WriteString(fmt.Sprintf("Reporting-MTA: dns; smtp.%s\r\n", config.Instance.Domain))
+	if t, err := time.ParseInLocation(time.DateTime, e.Date, time.Local); err == nil {
+		status.WriteString(fmt.Sprintf("Arrival-Date: %s\r\n", t.Format(time.RFC1123Z)))
+	}
+	for _, r := range failed {
+		code, isSMTP := r.status()
+		status.WriteString("\r\n")
+		status.WriteString(fmt.Sprintf("Final-Recipient: rfc822; %s\r\n", r.address))
+		status.WriteString("Action: failed\r\n")
+		status.WriteString(fmt.Sprintf("Status: %s\r\n", code))
+		if isSMTP {
+			status.WriteString(fmt.Sprintf("Diagnostic-Code: smtp; %s\r\n", strings.ReplaceAll(r.diagnostic, "\n", " ")))
+		}
+	}
+	var sh message.Header
+	sh.SetContentType("message/delivery-status", nil)
+	sh.SetContentDisposition("attachment", map[string]string{"filename": "delivery-status.txt"})
+	if err = writePart(mw, sh, status.String()); err != nil {
+		return nil, err
+	}
+
+	// 原邮件的邮件头
+	original := e.BuildBytes(ctx, false)
+	if idx := bytes.Index(original, []byte("\r\n\r\n")); idx >= 0 {
+		original = original[:idx+2]
+	}
+	var oh message.Header
+	oh.SetContentType("text/rfc822-headers", nil)
+	oh.SetContentDisposition("attachment", map[string]string{"filename": "original-headers.txt"})
+	if err = writePart(mw, oh, string(original)); err != nil {
+		return nil, err
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writePart(mw *message.Writer, h message.Header, content string) error {
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(content))
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,79 @@
+package smtp_server
+
+import (
+	"bytes"
+	"pmail/config"
+	"pmail/dto/parsemail"
+	"pmail/services/queue"
+	"pmail/utils/context"
+	"strings"
+	"testing"
+)
+
+func TestFailedRecipientStatus(t *testing.T) {
+	tests := []struct {
+		diagnostic string
+		status     string
+		isSMTP     bool
+	}{
+		{"550 5.1.1 <a@b.com>: Recipient address rejected", "5.1.1", true},
+		{"554 rejected", "5.0.0", true},
+		{"451 4.7.1 try again later", "4.4.7", true},
+		{"dial tcp: i/o timeout", "4.4.7", false},
+	}
+	for _, tt := range tests {
+		r := &failedRecipient{diagnostic: tt.diagnostic}
+		status, isSMTP := r.status()
+		if status != tt.status || isSMTP != tt.isSMTP {
+			t.Errorf("status(%q) = %s,%v, want %s,%v", tt.diagnostic, status, isSMTP, tt.status, tt.isSMTP)
+		}
+	}
+}
+
+func TestBuildDSN(t *testing.T) {
+	config.Instance = &config.Config{Domain: "example.com"}
+	e := &parsemail.Email{
+		From:      &parsemail.User{EmailAddress: "me@example.com"},
+		To:        []*parsemail.User{{EmailAddress: "a@fail.com"}, {EmailAddress: "b@ok.com"}},
+		Subject:   "hello",
+		Text:      []byte("body"),
+		Date:      "2024-01-02 03:04:05",
+		MessageId: 1,
+	}
+	errMap := map[string]error{
+		"fail.com": queue.DeliveryError("550 5.1.1 no such user"),
+		"ok.com":   nil,
+	}
+	failed := failedRecipients(e, errMap)
+	if len(failed) != 1 || failed[0].address != "a@fail.com" {
+		t.Fatalf("failedRecipients = %+v", failed)
+	}
+
+	data, err := buildDSN(&context.Context{}, e, failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("multipart/report")) || !bytes.Contains(data, []byte("report-type=delivery-status")) {
+		t.Errorf("content type error: %s", data)
+	}
+
+	dsn := parsemail.NewEmailFromReader(nil, bytes.NewReader(data))
+	if dsn.To[0].EmailAddress != "me@example.com" {
+		t.Errorf("to = %s", dsn.To[0].EmailAddress)
+	}
+	if !strings.Contains(string(dsn.Text), "<a@fail.com>: 550 5.1.1 no such user") {
+		t.Errorf("text = %s", dsn.Text)
+	}
+	if len(dsn.Attachments) != 2 {
+		t.Fatalf("attachments = %d", len(dsn.Attachments))
+	}
+	status := string(dsn.Attachments[0].Content)
+	for _, want := range []string{"Final-Recipient: rfc822; a@fail.com", "Action: failed", "Status: 5.1.1", "Diagnostic-Code: smtp; 550 5.1.1 no such user"} {
+		if !strings.Contains(status, want) {
+			t.Errorf("delivery-status missing %q: %s", want, status)
+		}
+	}
+	if !strings.Contains(string(dsn.Attachments[1].Content), "Subject: hello") {
+		t.Errorf("headers = %s", dsn.Attachments[1].Content)
+	}
+}
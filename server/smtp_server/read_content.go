@@ -2,6 +2,7 @@ package smtp_server
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"github.com/mileusna/spf"
@@ -16,10 +17,18 @@ import (
 	"pmail/hooks"
 	"pmail/hooks/framework"
 	"pmail/models"
+	"pmail/services/alias"
+	"pmail/services/attachments"
+	"pmail/services/detail"
+	"pmail/services/dmarc_report"
+	"pmail/services/group"
+	"pmail/services/queue"
 	"pmail/services/rule"
+	"pmail/services/search"
+	"pmail/services/sieve"
 	"pmail/utils/async"
 	"pmail/utils/context"
-	"pmail/utils/send"
+	"pmail/utils/dmarc"
 	"strings"
 	"time"
 )
@@ -30,23 +39,50 @@ func (s *Session) Data(r io.Reader) error {
 
 	log.WithContext(ctx).Debugf("收到邮件")
 
-	emailData, err := io.ReadAll(r)
+	// 邮件内容先写入临时文件，避免大邮件占用内存
+	spool, err := spoolData(r)
+	if spool != nil {
+		defer removeSpool(spool)
+	}
 	if err != nil {
-		log.WithContext(ctx).Error("邮件内容无法读取", err)
+		log.WithContext(ctx).Errorf("邮件内容无法读取 %v", err)
 		return err
 	}
-	log.WithContext(ctx).Debugf("开始执行插件ReceiveParseBefore！")
-	for _, hook := range hooks.HookList {
-		if hook == nil {
-			continue
+	log.WithContext(ctx).Infof("邮件大小: %d", spoolSize(spool))
+
+	// 原文原样保存，插件修改后的内容写入新的临时文件用于解析
+	// 插件接口需要完整的邮件内容，只有注册了插件时才读入内存，通过hash判断是否被修改
+	parsed := spool
+	if len(hooks.HookList) > 0 {
+		emailData, err := readSpool(spool)
+		if err != nil {
+			log.WithContext(ctx).Errorf("邮件内容无法读取 %v", err)
+			return err
 		}
-		hook.ReceiveParseBefore(ctx, &emailData)
-	}
-	log.WithContext(ctx).Debugf("开始执行插件ReceiveParseBefore End！")
+		origin := sha256.Sum256(emailData)
 
-	log.WithContext(ctx).Infof("邮件原始内容: %s", emailData)
+		log.WithContext(ctx).Debugf("开始执行插件ReceiveParseBefore！")
+		for _, hook := range hooks.HookList {
+			if hook == nil {
+				continue
+			}
+			hook.ReceiveParseBefore(ctx, &emailData)
+		}
+		log.WithContext(ctx).Debugf("开始执行插件ReceiveParseBefore End！")
+
+		if sha256.Sum256(emailData) != origin {
+			parsed, err = spoolData(bytes.NewReader(emailData))
+			if parsed != nil {
+				defer removeSpool(parsed)
+			}
+			if err != nil {
+				log.WithContext(ctx).Errorf("邮件内容无法写入 %v", err)
+				return err
+			}
+		}
+	}
 
-	email := parsemail.NewEmailFromReader(s.To, bytes.NewReader(emailData))
+	email := parsemail.NewEmailFromReader(s.To, openSpool(parsed))
 
 	if s.From != "" {
 		from := parsemail.BuilderUser(s.From)
@@ -77,36 +113,17 @@ func (s *Session) Data(r io.Reader) error {
 		}
 
 		// 转发
-		err := saveEmail(ctx, email, s.Ctx.UserID, 1, true, true)
+		err := saveEmail(ctx, email, s.Ctx.UserID, 1, true, true, dmarc.ResultNone)
 		if err != nil {
 			log.WithContext(ctx).Errorf("Email Save Error %v", err)
 		}
+		saveSource(ctx, int(email.MessageId), spool)
 
-		errMsg := ""
-		err, sendErr := send.Send(ctx, email)
-
-		log.WithContext(ctx).Debugf("插件执行--SendAfter")
-
-		as3 := async.New(ctx)
-		for _, hook := range hooks.HookList {
-			if hook == nil {
-				continue
-			}
-			as3.WaitProcess(func(hk any) {
-				hk.(framework.EmailHook).SendAfter(ctx, email, sendErr)
-			}, hook)
-		}
-		as3.Wait()
-		log.WithContext(ctx).Debugf("插件执行--SendAfter")
-
+		// 加入投递队列，失败后由队列自动重试
+		err = queue.Enqueue(ctx, email)
 		if err != nil {
-			errMsg = err.Error()
-			_, err := db.Instance.Exec(db.WithContext(ctx, "update email set status =2 ,error=? where id = ? "), errMsg, email.MessageId)
-			if err != nil {
-				log.WithContext(ctx).Errorf("sql Error :%+v", err)
-			}
-		} else {
-			_, err := db.Instance.Exec(db.WithContext(ctx, "update email set status =1  where id = ? "), email.MessageId)
+			log.WithContext(ctx).Errorf("Enqueue Error :%+v", err)
+			_, err := db.Instance.Exec(db.WithContext(ctx, "update email set status =2 ,error=? where id = ? "), err.Error(), email.MessageId)
 			if err != nil {
 				log.WithContext(ctx).Errorf("sql Error :%+v", err)
 			}
@@ -115,16 +132,28 @@ func (s *Session) Data(r io.Reader) error {
 	} else {
 		// 收件
 
-		var dkimStatus, SPFStatus bool
-
 		// DKIM校验
-		dkimStatus = parsemail.Check(bytes.NewReader(emailData))
+		dkimResults := parsemail.Verify(openSpool(parsed))
+		dkimStatus, dkimDomains := dkimCheck(dkimResults)
 
-		if err != nil {
-			log.WithContext(ctx).Errorf("邮件内容解析失败！ Error : %v \n", err)
+		// SPF校验使用信封发件人，没有时使用邮件头中的发件人
+		spfSender := s.From
+		if spfSender == "" && email.Sender != nil {
+			spfSender = email.Sender.EmailAddress
 		}
-
-		SPFStatus = spfCheck(s.RemoteAddress.String(), email.Sender, email.Sender.EmailAddress)
+		spfResult, spfDomain := spfCheck(s.RemoteAddress.String(), spfSender)
+		// 没有设置SPF的域名也当作通过
+		SPFStatus := spfResult == spf.Pass || spfResult == spf.None
+		email.SPF, email.DKIM = authResultText(spfResult, dkimResults, dkimStatus)
+		email.MailFrom = s.From
+
+		// DMARC校验，检查SPF和DKIM通过的域名是否和邮件头From的域名对齐
+		var fromDomain string
+		if email.From != nil {
+			_, fromDomain = email.From.GetDomainAccount()
+		}
+		dmarcResult := dmarc.Evaluate(fromDomain, spfDomain, dkimDomains)
+		log.WithContext(ctx).Infof("SPF:%v DKIM:%v DMARC:%d Policy:%s", SPFStatus, dkimStatus, dmarcResult.Result, dmarcResult.Policy)
 
 		log.WithContext(ctx).Debugf("开始执行插件ReceiveParseAfter！")
 		for _, hook := range hooks.HookList {
@@ -150,38 +179,116 @@ func (s *Session) Data(r io.Reader) error {
 			return nil
 		}
 
-		saveEmail(ctx, email, 0, 0, SPFStatus, dkimStatus)
+		if dmarcResult.Reject() {
+			log.WithContext(ctx).Infof("DMARC校验失败，拒信 %s", dmarcResult.Domain)
+			return errDMARCReject
+		}
+
+		// 转发次数过多，可能是别名或者外部转发形成了循环
+		if hops := countReceived(openSpool(spool)); hops > maxHops {
+			log.WithContext(ctx).Warnf("邮件转发次数过多，拒信 %d", hops)
+			return errLoopDetected
+		}
 
-		if email.MessageId > 0 {
-			log.WithContext(ctx).Debugf("开始执行邮件规则！")
-			// 执行邮件规则
-			rs := rule.GetAllRules(ctx)
-			for _, r := range rs {
-				if rule.MatchRule(ctx, r, email) {
-					rule.DoRule(ctx, r, email)
+		// 展开别名、邮件列表和catch-all
+		rcpt, err := alias.Expand(ctx, s.To)
+		if err != nil {
+			log.WithContext(ctx).Errorf("Alias Expand Error %+v", err)
+			return errTemporary
+		}
+		if rcpt.Empty() {
+			log.WithContext(ctx).Warnf("没有本地收件人，邮件丢弃 %v", s.To)
+			return nil
+		}
+		users := rcpt.Users
+
+		// 保存的原文加上Received和Authentication-Results邮件头，POP3下载或者转发时可以看到校验结果
+		trace := s.traceHeader(&authResults{
+			spf:       spfResult,
+			spfSender: spfSender,
+			dkim:      dkimResults,
+			dmarc:     dmarcResult,
+		})
+
+		// 每个本地收件人各保存一份，邮件归属对应的用户
+		var firstEmailId int
+		for _, user := range users {
+			userCtx := &context.Context{
+				UserID:      user.ID,
+				UserAccount: user.Account,
+				UserName:    user.Name,
+				Values:      ctx.Values,
+			}
+			userEmail := *email
+
+			// DMARC要求隔离的邮件放到垃圾邮件分组
+			if dmarcResult.Quarantine() {
+				userEmail.GroupId = group.GetSpamGroupId(userCtx)
+			}
+
+			saveEmail(userCtx, &userEmail, 0, 0, SPFStatus, dkimStatus, dmarcResult.Result)
+
+			if userEmail.MessageId > 0 {
+				// 原文从临时文件流式保存一次，其他收件人复制原文记录
+				if firstEmailId == 0 {
+					firstEmailId = int(userEmail.MessageId)
+					detail.SaveSourceReader(userCtx, firstEmailId, traceSource(trace, openSpool(spool)))
+				} else {
+					detail.CopySource(userCtx, firstEmailId, int(userEmail.MessageId))
 				}
+
+				// 执行邮件规则，隔离的邮件不执行，防止被转发、自动回复或者发送到webhook
+				if !dmarcResult.Quarantine() {
+					log.WithContext(ctx).Debugf("开始执行邮件规则！")
+					rs := rule.GetAllRules(userCtx)
+					for _, r := range rs {
+						if rule.MatchRule(userCtx, r, &userEmail) && rule.DoRule(userCtx, r, &userEmail) {
+							break
+						}
+					}
+				}
+
+				// 执行用户的Sieve脚本，隔离的邮件不执行，防止被转发或者自动回复
+				// 信封收件人只包含展开到该用户的地址，不暴露其他收件人
+				if !dmarcResult.Quarantine() {
+					sieve.Run(userCtx, &userEmail, traceSource(trace, openSpool(spool)), spoolSize(spool), s.From, rcpt.Rcpt[user.ID])
+				}
+			}
+
+			log.WithContext(ctx).Debugf("开始执行插件ReceiveSaveAfter！")
+			as3 := async.New(userCtx)
+			for _, hook := range hooks.HookList {
+				if hook == nil {
+					continue
+				}
+				as3.WaitProcess(func(hk any) {
+					hk.(framework.EmailHook).ReceiveSaveAfter(userCtx, &userEmail)
+				}, hook)
 			}
+			as3.Wait()
+			log.WithContext(ctx).Debugf("开始执行插件ReceiveSaveAfter！End")
 		}
 
-		log.WithContext(ctx).Debugf("开始执行插件ReceiveSaveAfter！")
-		as3 := async.New(ctx)
-		for _, hook := range hooks.HookList {
-			if hook == nil {
-				continue
+		// 别名指向的外部地址，原文连同trace邮件头加入投递队列原样转发，隔离的邮件不转发
+		// 信封发件人使用本服务器的地址，原发件人的SPF不会因为转发失败
+		if !dmarcResult.Quarantine() && len(rcpt.External) > 0 {
+			sender := mailerDaemon + "@" + config.Instance.Domain
+			if err := queue.Forward(ctx, sender, rcpt.External, traceSource(trace, openSpool(spool))); err != nil {
+				log.WithContext(ctx).Errorf("Alias Forward Error %v: %+v", rcpt.External, err)
 			}
-			as3.WaitProcess(func(hk any) {
-				hk.(framework.EmailHook).ReceiveSaveAfter(ctx, email)
-			}, hook)
 		}
-		as3.Wait()
-		log.WithContext(ctx).Debugf("开始执行插件ReceiveSaveAfter！End")
 
+		// DMARC聚合报告，只接收通过了SPF或者DKIM认证的邮件，防止伪造报告
+		if firstEmailId > 0 && (spfDomain != "" || len(dkimDomains) > 0) {
+			dmarc_report.Ingest(ctx, email, firstEmailId)
+		}
 	}
 
 	return nil
 }
 
-func saveEmail(ctx *context.Context, email *parsemail.Email, sendUserID int, emailType int, SPFStatus, dkimStatus bool) error {
+// saveEmail 邮件入库，邮件归属ctx中的用户
+func saveEmail(ctx *context.Context, email *parsemail.Email, sendUserID int, emailType int, SPFStatus, dkimStatus bool, dmarcStatus int8) error {
 	var dkimV, spfV int8
 	if dkimStatus {
 		dkimV = 1
@@ -209,10 +316,12 @@ func saveEmail(ctx *context.Context, email *parsemail.Email, sendUserID int, ema
 		Text:        sql.NullString{String: string(email.Text), Valid: true},
 		Html:        sql.NullString{String: string(email.HTML), Valid: true},
 		Sender:      json2string(email.Sender),
-		Attachments: json2string(email.Attachments),
+		Attachments: attachments.Meta(email.Attachments),
 		SPFCheck:    spfV,
 		DKIMCheck:   dkimV,
+		DMARCCheck:  dmarcStatus,
 		SendUserID:  sendUserID,
+		UserId:      ctx.UserID,
 		SendDate:    time.Now(),
 		Status:      cast.ToInt8(email.Status),
 		CreateTime:  time.Now(),
@@ -226,6 +335,11 @@ func saveEmail(ctx *context.Context, email *parsemail.Email, sendUserID int, ema
 
 	if modelEmail.Id > 0 {
 		email.MessageId = cast.ToInt64(modelEmail.Id)
+		err = attachments.Save(ctx, modelEmail.Id, email.Attachments)
+		if err != nil {
+			log.WithContext(ctx).Errorf("attachment save error:%+v", err)
+		}
+		search.Index(ctx, modelEmail.Id)
 	}
 
 	return nil
@@ -236,25 +350,32 @@ func json2string(d any) string {
 	return string(by)
 }
 
-func spfCheck(remoteAddress string, sender *parsemail.User, senderString string) bool {
+// spfCheck 返回SPF校验结果，以及校验通过(Pass)的域名，用于DMARC对齐检查
+func spfCheck(remoteAddress string, sender string) (spf.Result, string) {
 	//spf校验
 	ipAddress, _ := netip.ParseAddrPort(remoteAddress)
 
 	ip := net.ParseIP(ipAddress.Addr().String())
-	if ip.IsPrivate() {
-		return true
+
+	tmp := strings.Split(sender, "@")
+	var domain string
+	if len(tmp) >= 2 {
+		domain = tmp[len(tmp)-1]
 	}
 
-	tmp := strings.Split(sender.EmailAddress, "@")
-	if len(tmp) < 2 {
-		return false
+	// 内网投递不校验
+	if ip.IsPrivate() {
+		return spf.Pass, domain
 	}
 
-	res := spf.CheckHost(ip, tmp[1], senderString, "")
+	// 发件人地址不合法
+	if domain == "" {
+		return spf.PermError, ""
+	}
 
-	if res == spf.None || res == spf.Pass {
-		// spf校验通过
-		return true
+	res := spf.CheckHost(ip, domain, sender, "")
+	if res == spf.Pass {
+		return res, domain
 	}
-	return false
+	return res, ""
 }
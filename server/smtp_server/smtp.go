@@ -2,18 +2,17 @@ package smtp_server
 
 import (
 	"crypto/tls"
-	"database/sql"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"pmail/config"
-	"pmail/db"
-	"pmail/models"
+	"pmail/services/alias"
+	"pmail/services/auth"
+	"pmail/services/throttle"
 	"pmail/utils/context"
 	"pmail/utils/errors"
 	"pmail/utils/id"
-	"pmail/utils/password"
 	"strings"
 	"time"
 )
@@ -28,15 +27,32 @@ func (bkd *Backend) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 	ctx.SetValue(context.LogID, id.GenLogID())
 	log.WithContext(ctx).Debugf("新SMTP连接")
 
-	return &Session{
+	// 被封禁的IP直接断开
+	if throttle.IsBanned(throttle.IP(remoteAddress.String())) {
+		log.WithContext(ctx).Infof("SMTP Connection Banned %s", remoteAddress.String())
+		return nil, &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many failed login attempts, try again later",
+		}
+	}
+
+	sess := &Session{
 		RemoteAddress: remoteAddress,
+		Helo:          conn.Hostname(),
 		Ctx:           ctx,
-	}, nil
+	}
+	if state, ok := conn.TLSConnectionState(); ok {
+		sess.TLS = &state
+	}
+	return sess, nil
 }
 
 // A Session is returned after EHLO.
 type Session struct {
 	RemoteAddress net.Addr
+	Helo          string               // EHLO/HELO中的主机名
+	TLS           *tls.ConnectionState // 没有使用TLS时为nil
 	User          string
 	From          string
 	To            []string
@@ -68,51 +84,125 @@ func (s *Session) Auth(mech string) (sasl.Server, error) {
 }
 
 func (s *Session) AuthPlain(username, pwd string) error {
-	log.WithContext(s.Ctx).Debugf("Auth %s %s", username, pwd)
+	log.WithContext(s.Ctx).Debugf("Auth %s", username)
 
 	s.User = username
 
-	var user models.User
-
-	encodePwd := password.Encode(pwd)
-
 	infos := strings.Split(username, "@")
 	if len(infos) > 1 {
 		username = infos[0]
 	}
 
-	_, err := db.Instance.Where("account =? and password =?", username, encodePwd).Get(&user)
-	if err != nil && err != sql.ErrNoRows {
-		log.Errorf("%+v", err)
+	user, err := auth.Login(s.Ctx, "smtp", throttle.IP(s.RemoteAddress.String()), username, pwd)
+	if err == auth.ErrLocked {
+		return &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many failed login attempts, try again later",
+		}
 	}
-
-	if user.ID > 0 {
-		s.Ctx.UserAccount = user.Account
-		s.Ctx.UserID = user.ID
-		s.Ctx.UserName = user.Name
-
-		log.WithContext(s.Ctx).Debugf("Auth Success %+v", user)
-		return nil
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         535,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Authentication credentials invalid",
+		}
 	}
 
-	log.WithContext(s.Ctx).Debugf("登陆错误%s %s", username, pwd)
-	return errors.New("password error")
+	s.Ctx.UserAccount = user.Account
+	s.Ctx.UserID = user.ID
+	s.Ctx.UserName = user.Name
+
+	log.WithContext(s.Ctx).Debugf("Auth Success %s", user.Account)
+	return nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	// 登陆后只能使用有权限的地址发信
+	if s.Ctx.UserID > 0 && !auth.HasSendAuth(s.Ctx, from) {
+		log.WithContext(s.Ctx).Infof("Mail From Denied %s", from)
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Sender address rejected: not owned by user",
+		}
+	}
 	log.WithContext(s.Ctx).Debugf("Mail Success %+v %+v", from, opts)
 	s.From = from
 	return nil
 }
 
+var errDMARCReject = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected due to DMARC policy",
+}
+
+var errUserUnknown = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient address rejected: User unknown",
+}
+
+var errTemporary = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Temporary local problem",
+}
+
+var errLoopDetected = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+	Message:      "Routing loop detected",
+}
+
+var errRelayDenied = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Relay access denied",
+}
+
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	idx := strings.LastIndex(to, "@")
+	if idx <= 0 {
+		return errUserUnknown
+	}
+	domain := to[idx+1:]
+
+	if !isLocalDomain(domain) {
+		// 只有登陆后才允许投递到外部域名，防止成为开放中继
+		if s.Ctx.UserID == 0 {
+			log.WithContext(s.Ctx).Infof("Rcpt Relay Denied %s", to)
+			return errRelayDenied
+		}
+	} else {
+		ret, err := alias.Expand(s.Ctx, []string{to})
+		if err != nil {
+			log.WithContext(s.Ctx).Errorf("%+v", err)
+			return errTemporary
+		}
+		if ret.Empty() {
+			log.WithContext(s.Ctx).Infof("Rcpt User Unknown %s", to)
+			return errUserUnknown
+		}
+	}
+
 	log.WithContext(s.Ctx).Debugf("Rcpt Success %+v", to)
 
 	s.To = append(s.To, to)
 	return nil
 }
 
-func (s *Session) Reset() {}
+// isLocalDomain 是否是本机收信的域名
+func isLocalDomain(domain string) bool {
+	return alias.IsLocalDomain(domain)
+}
+
+// Reset 每封邮件结束或者RSET后清空信封，同一个连接中的下一封邮件不能投递给上一封的收件人
+func (s *Session) Reset() {
+	s.From = ""
+	s.To = nil
+}
 
 func (s *Session) Logout() error {
 	return nil
@@ -121,17 +211,30 @@ func (s *Session) Logout() error {
 var instance *smtp.Server
 var instanceTls *smtp.Server
 
-func StartWithTLS() {
-	be := &Backend{}
+// 默认的最大邮件大小
+const defaultMaxMessageBytes = 25 * 1024 * 1024
 
-	instanceTls = smtp.NewServer(be)
+func maxMessageBytes() int64 {
+	if config.Instance != nil && config.Instance.SmtpMaxMessageBytes > 0 {
+		return config.Instance.SmtpMaxMessageBytes
+	}
+	return defaultMaxMessageBytes
+}
 
-	instanceTls.Addr = ":465"
-	instanceTls.Domain = config.Instance.Domain
-	instanceTls.ReadTimeout = 10 * time.Second
-	instanceTls.WriteTimeout = 10 * time.Second
-	instanceTls.MaxMessageBytes = 1024 * 1024
-	instanceTls.MaxRecipients = 50
+// newServer 邮件大小通过EHLO的SIZE扩展告知客户端，MAIL FROM中SIZE参数超过限制时直接拒绝
+func newServer(addr string) *smtp.Server {
+	s := smtp.NewServer(&Backend{})
+	s.Addr = addr
+	s.Domain = config.Instance.Domain
+	s.ReadTimeout = 10 * time.Second
+	s.WriteTimeout = 10 * time.Second
+	s.MaxMessageBytes = maxMessageBytes()
+	s.MaxRecipients = 50
+	return s
+}
+
+func StartWithTLS() {
+	instanceTls = newServer(":465")
 	// force TLS for auth
 	instanceTls.AllowInsecureAuth = true
 	// Load the certificate and key
@@ -150,16 +253,7 @@ func StartWithTLS() {
 }
 
 func Start() {
-	be := &Backend{}
-
-	instance = smtp.NewServer(be)
-
-	instance.Addr = ":25"
-	instance.Domain = config.Instance.Domain
-	instance.ReadTimeout = 10 * time.Second
-	instance.WriteTimeout = 10 * time.Second
-	instance.MaxMessageBytes = 1024 * 1024
-	instance.MaxRecipients = 50
+	instance = newServer(":25")
 	// force TLS for auth
 	instance.AllowInsecureAuth = false
 	// Load the certificate and key
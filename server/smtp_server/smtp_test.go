@@ -0,0 +1,148 @@
+package smtp_server
+
+import (
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"pmail/config"
+	"pmail/db"
+	"pmail/models"
+	"pmail/utils/context"
+	"strings"
+	"testing"
+)
+
+func TestRcptRelay(t *testing.T) {
+	config.Instance = &config.Config{Domain: "example.com", Domains: []string{"example.com"}}
+
+	s := &Session{Ctx: &context.Context{}}
+	if err := s.Rcpt("someone@other.com", nil); err != errRelayDenied {
+		t.Errorf("unauthenticated relay error = %v", err)
+	}
+	if err := s.Rcpt("no-domain", nil); err != errUserUnknown {
+		t.Errorf("bad address error = %v", err)
+	}
+
+	s.Ctx.UserID = 1
+	if err := s.Rcpt("someone@other.com", nil); err != nil {
+		t.Errorf("authenticated relay error = %v", err)
+	}
+	if len(s.To) != 1 {
+		t.Errorf("to = %v", s.To)
+	}
+}
+
+func TestIsLocalDomain(t *testing.T) {
+	config.Instance = &config.Config{Domains: []string{"example.com", "example.org"}}
+	if !isLocalDomain("Example.ORG") {
+		t.Error("example.org should be local")
+	}
+	if isLocalDomain("example.net") {
+		t.Error("example.net should not be local")
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	config.Instance = &config.Config{Domain: "example.com", SmtpMaxMessageBytes: 1000}
+
+	s := newServer("127.0.0.1:0")
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.PrintfLine("EHLO client.example.org")
+	_, msg, err := conn.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "SIZE 1000") {
+		t.Errorf("EHLO = %s", msg)
+	}
+
+	conn.PrintfLine("MAIL FROM:<a@example.org> SIZE=2000")
+	if code, _, _ := conn.ReadResponse(250); code != 552 {
+		t.Errorf("oversize MAIL FROM code = %d", code)
+	}
+	conn.PrintfLine("MAIL FROM:<a@example.org> SIZE=500")
+	if code, _, _ := conn.ReadResponse(250); code != 250 {
+		t.Errorf("MAIL FROM code = %d", code)
+	}
+}
+
+func TestResetBetweenTransactions(t *testing.T) {
+	dir := t.TempDir()
+	config.Instance = &config.Config{DbType: "sqlite", DbDSN: filepath.Join(dir, "pmail.db"), Domain: "example.com", Domains: []string{"example.com"}, AttachmentPath: filepath.Join(dir, "attachments")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	models.SyncTables()
+	for _, account := range []string{"alice", "bob"} {
+		if _, err := db.Instance.Insert(&models.User{Account: account, Name: account, Password: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newServer("127.0.0.1:0")
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	conn.PrintfLine("EHLO client.example.org")
+	if _, _, err = conn.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个连接中的两封邮件，第二封只能投递给自己的收件人
+	for _, to := range []string{"alice", "bob"} {
+		conn.PrintfLine("MAIL FROM:<a@example.org>")
+		if _, _, err = conn.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+		conn.PrintfLine("RCPT TO:<%s@example.com>", to)
+		if _, _, err = conn.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+		conn.PrintfLine("DATA")
+		if _, _, err = conn.ReadResponse(354); err != nil {
+			t.Fatal(err)
+		}
+		conn.PrintfLine("From: a@example.org\r\nTo: %s@example.com\r\nSubject: to %s\r\n\r\nhello\r\n.", to, to)
+		if _, _, err = conn.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var emails []*models.Email
+	if err = db.Instance.Asc("id").Find(&emails); err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 || emails[0].Subject != "to alice" || emails[1].Subject != "to bob" || emails[0].UserId == emails[1].UserId {
+		for _, e := range emails {
+			t.Logf("email %d user %d subject %s", e.Id, e.UserId, e.Subject)
+		}
+		t.Errorf("emails = %d", len(emails))
+	}
+}
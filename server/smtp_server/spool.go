@@ -0,0 +1,52 @@
+package smtp_server
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"pmail/services/detail"
+	"pmail/utils/context"
+)
+
+// spoolData 把DATA内容写入临时文件，超过大小限制时返回smtp.ErrDataTooLarge
+func spoolData(r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "pmail-spool-*.eml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func spoolSize(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// openSpool 从头读取临时文件
+func openSpool(f *os.File) io.Reader {
+	_, _ = f.Seek(0, io.SeekStart)
+	return bufio.NewReader(f)
+}
+
+func readSpool(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+// saveSource 保存邮件原文
+func saveSource(ctx *context.Context, emailId int, f *os.File) {
+	detail.SaveSourceReader(ctx, emailId, openSpool(f))
+}
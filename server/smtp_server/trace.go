@@ -0,0 +1,203 @@
+package smtp_server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/mileusna/spf"
+	"io"
+	"net"
+	"pmail/config"
+	"pmail/dto/parsemail"
+	"pmail/utils/context"
+	"pmail/utils/dmarc"
+	"strings"
+	"time"
+)
+
+// authResults 收信时的SPF、DKIM、DMARC校验结果
+type authResults struct {
+	spf       spf.Result
+	spfSender string
+	dkim      []*parsemail.DkimResult
+	dmarc     *dmarc.Result
+}
+
+// dkimCheck 返回DKIM签名是否全部有效，以及签名有效的域名
+func dkimCheck(results []*parsemail.DkimResult) (bool, []string) {
+	pass := true
+	var domains []string
+	for _, r := range results {
+		if r.Err != nil {
+			pass = false
+			continue
+		}
+		domains = append(domains, r.Domain)
+	}
+	return pass, domains
+}
+
+// authResultText SPF和DKIM的校验结果，用于邮件规则匹配
+func authResultText(spfResult spf.Result, dkimResults []*parsemail.DkimResult, dkimStatus bool) (string, string) {
+	spfText := strings.ToLower(string(spfResult))
+	if spfText == "" {
+		spfText = "none"
+	}
+	dkimText := "pass"
+	if len(dkimResults) == 0 {
+		dkimText = "none"
+	} else if !dkimStatus {
+		dkimText = "fail"
+	}
+	return spfText, dkimText
+}
+
+// authServId 本服务器的标识，即MX记录指向的主机名
+func authServId() string {
+	return "smtp." + config.Instance.Domain
+}
+
+// authenticationResults 生成RFC 8601 Authentication-Results邮件头
+func (a *authResults) authenticationResults() string {
+	var b strings.Builder
+	b.WriteString("Authentication-Results: " + authServId())
+
+	spfRes := strings.ToLower(string(a.spf))
+	if spfRes == "" {
+		spfRes = "none"
+	}
+	b.WriteString(";\r\n\tspf=" + spfRes)
+	if a.spfSender != "" {
+		b.WriteString(" smtp.mailfrom=" + a.spfSender)
+	}
+
+	if len(a.dkim) == 0 {
+		b.WriteString(";\r\n\tdkim=none")
+	}
+	for _, r := range a.dkim {
+		res := "pass"
+		if dkim.IsTempFail(r.Err) {
+			res = "temperror"
+		} else if r.Err != nil {
+			res = "fail"
+		}
+		b.WriteString(";\r\n\tdkim=" + res + " header.d=" + r.Domain)
+	}
+
+	if a.dmarc != nil {
+		res := "none"
+		switch a.dmarc.Result {
+		case dmarc.ResultPass:
+			res = "pass"
+		case dmarc.ResultFail:
+			res = fmt.Sprintf("fail (p=%s)", a.dmarc.Policy)
+		}
+		b.WriteString(";\r\n\tdmarc=" + res)
+		if a.dmarc.Domain != "" {
+			b.WriteString(" header.from=" + a.dmarc.Domain)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// received 生成Received邮件头，记录对端IP、HELO名称、TLS信息和日志id
+func (s *Session) received(now time.Time) string {
+	ip := s.RemoteAddress.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	helo := s.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	protocol := "ESMTP"
+	if s.TLS != nil {
+		protocol = "ESMTPS"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: from %s ([%s])\r\n\tby %s (PMail) with %s id %s", helo, ip, authServId(), protocol, s.Ctx.GetValue(context.LogID))
+	if s.TLS != nil {
+		fmt.Fprintf(&b, "\r\n\t(version=%s cipher=%s)", tls.VersionName(s.TLS.Version), tls.CipherSuiteName(s.TLS.CipherSuite))
+	}
+	// 多个收件人时不写for，避免泄露其他收件人
+	if len(s.To) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", s.To[0])
+	}
+	fmt.Fprintf(&b, ";\r\n\t%s\r\n", now.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// traceHeader 生成保存原文时加在最前面的Received和Authentication-Results邮件头
+func (s *Session) traceHeader(a *authResults) string {
+	return s.received(time.Now()) + a.authenticationResults()
+}
+
+// traceSource 在邮件原文最前面加上trace邮件头，原文中冒充本服务器的Authentication-Results邮件头需要删除
+// 返回的reader从原文流式读取，只有邮件头会读入内存
+func traceSource(header string, r io.Reader) io.Reader {
+	return io.MultiReader(strings.NewReader(header), stripAuthResults(r, authServId()))
+}
+
+// stripAuthResults 删除邮件头中authserv-id和本服务器相同的Authentication-Results，正文原样返回
+func stripAuthResults(r io.Reader, servId string) io.Reader {
+	var out bytes.Buffer
+	br := bufio.NewReader(r)
+	skipping := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			trimmed := bytes.TrimRight(line, "\r\n")
+			if len(trimmed) == 0 {
+				// 邮件头结束，正文原样读取
+				out.Write(line)
+				break
+			} else if trimmed[0] == ' ' || trimmed[0] == '\t' {
+				// 折行属于上一个邮件头
+			} else {
+				skipping = isOwnAuthResults(string(trimmed), servId)
+			}
+			if !skipping {
+				out.Write(line)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return io.MultiReader(&out, br)
+}
+
+func isOwnAuthResults(line string, servId string) bool {
+	name, value, found := strings.Cut(line, ":")
+	if !found || !strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") {
+		return false
+	}
+	id, _, _ := strings.Cut(strings.TrimSpace(value), ";")
+	id, _, _ = strings.Cut(strings.TrimSpace(id), " ")
+	return strings.EqualFold(id, servId)
+}
+
+// 邮件最多经过的转发次数，超过时认为出现了转发循环，见RFC 5321 6.3
+const maxHops = 30
+
+// countReceived 统计邮件头中Received的数量
+func countReceived(r io.Reader) int {
+	var count int
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if len(line) >= 9 && strings.EqualFold(line[:9], "Received:") {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,76 @@
+package smtp_server
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/mileusna/spf"
+	"io"
+	"net"
+	"net/netip"
+	"pmail/config"
+	"pmail/dto/parsemail"
+	"pmail/utils/context"
+	"pmail/utils/dmarc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceSource(t *testing.T) {
+	config.Instance = &config.Config{Domain: "example.com"}
+
+	ctx := &context.Context{}
+	ctx.SetValue(context.LogID, "abc123")
+	s := &Session{
+		RemoteAddress: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("203.0.113.5:41234")),
+		Helo:          "mail.sender.org",
+		TLS:           &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+		To:            []string{"bob@example.com"},
+		Ctx:           ctx,
+	}
+
+	received := s.received(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	want := "Received: from mail.sender.org ([203.0.113.5])\r\n" +
+		"\tby smtp.example.com (PMail) with ESMTPS id abc123\r\n" +
+		"\t(version=TLS 1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n" +
+		"\tfor <bob@example.com>;\r\n" +
+		"\tTue, 02 Jan 2024 03:04:05 +0000\r\n"
+	if received != want {
+		t.Errorf("received = %q", received)
+	}
+
+	a := &authResults{
+		spf:       spf.Pass,
+		spfSender: "a@sender.org",
+		dkim:      []*parsemail.DkimResult{{Domain: "sender.org"}, {Domain: "other.org", Err: errors.New("bad signature")}},
+		dmarc:     &dmarc.Result{Result: dmarc.ResultPass, Domain: "sender.org", Policy: "none"},
+	}
+	want = "Authentication-Results: smtp.example.com;\r\n" +
+		"\tspf=pass smtp.mailfrom=a@sender.org;\r\n" +
+		"\tdkim=pass header.d=sender.org;\r\n" +
+		"\tdkim=fail header.d=other.org;\r\n" +
+		"\tdmarc=pass header.from=sender.org\r\n"
+	if got := a.authenticationResults(); got != want {
+		t.Errorf("authenticationResults = %q", got)
+	}
+
+	// 伪造的本服务器校验结果需要删除，其他服务器的保留
+	source := "Authentication-Results: smtp.example.com;\r\n\tspf=pass\r\n" +
+		"Authentication-Results: mx.other.net; spf=fail\r\n" +
+		"Subject: hi\r\n\r\nAuthentication-Results: smtp.example.com; body\r\n"
+	b, _ := io.ReadAll(traceSource(s.traceHeader(a), strings.NewReader(source)))
+	got := string(b)
+	if strings.Count(got, "Authentication-Results: smtp.example.com;") != 2 {
+		t.Errorf("forged header not removed: %q", got)
+	}
+	if !strings.HasPrefix(got, "Received: ") || !strings.Contains(got, "Authentication-Results: mx.other.net; spf=fail\r\nSubject: hi\r\n\r\nAuthentication-Results: smtp.example.com; body\r\n") {
+		t.Errorf("traceSource = %q", got)
+	}
+}
+
+func TestCountReceived(t *testing.T) {
+	source := "Received: from a\r\n\tby b\r\nreceived: from c\r\nSubject: hi\r\n\r\nReceived: in body\r\n"
+	if got := countReceived(strings.NewReader(source)); got != 2 {
+		t.Errorf("countReceived = %d", got)
+	}
+}
@@ -0,0 +1,149 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"pmail/config"
+	"pmail/utils/errors"
+	"sync"
+)
+
+// 默认的附件存储目录
+const defaultPath = "./data/attachments"
+
+func root() string {
+	if config.Instance != nil && config.Instance.AttachmentPath != "" {
+		return config.Instance.AttachmentPath
+	}
+	return defaultPath
+}
+
+// 按照hash分段加锁，保存文件和删除没有引用的文件不能同时进行
+var locks [256]sync.Mutex
+
+// Lock 锁定hash对应的文件，返回解锁函数
+// 保存文件并写入引用记录、检查引用并删除文件这两个过程都需要在锁内完成
+func Lock(hash string) func() {
+	var idx byte
+	if len(hash) > 0 {
+		idx = hash[len(hash)-1]
+	}
+	l := &locks[idx]
+	l.Lock()
+	return l.Unlock
+}
+
+// Hash 内容的sha256
+func Hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Path 文件按hash前两级目录分散存放，例如 ab/cd/abcd...
+func Path(hash string) string {
+	if len(hash) < 4 {
+		return filepath.Join(root(), hash)
+	}
+	return filepath.Join(root(), hash[0:2], hash[2:4], hash)
+}
+
+// Put 保存内容，返回内容的hash。内容相同的文件只保存一份
+func Put(content []byte) (string, error) {
+	hash := Hash(content)
+	return hash, PutHash(hash, content)
+}
+
+// PutHash 使用已经计算好的hash保存内容
+func PutHash(hash string, content []byte) error {
+	path := Path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err)
+	}
+	// 先写临时文件再重命名，避免读到写了一半的文件
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp")
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// PutReader 流式保存内容，返回内容的hash
+// 返回时已经持有hash对应的锁，调用方写入引用记录后调用unlock解锁
+func PutReader(r io.Reader) (string, func(), error) {
+	if err := os.MkdirAll(root(), 0700); err != nil {
+		return "", nil, errors.Wrap(err)
+	}
+	// 内容写入临时文件的同时计算hash，不需要把全部内容读入内存
+	tmp, err := os.CreateTemp(root(), "put-*.tmp")
+	if err != nil {
+		return "", nil, errors.Wrap(err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err)
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	unlock := Lock(hash)
+	path := Path(hash)
+	if _, err = os.Stat(path); err == nil {
+		return hash, unlock, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		unlock()
+		return "", nil, errors.Wrap(err)
+	}
+	return hash, unlock, nil
+}
+
+// Open 打开文件用于流式读取
+func Open(hash string) (*os.File, error) {
+	return os.Open(Path(hash))
+}
+
+// Read 读取全部内容
+func Read(hash string) ([]byte, error) {
+	return os.ReadFile(Path(hash))
+}
+
+// Exist 文件是否存在，增加引用前需要在锁内检查，避免引用已经被删除的文件
+func Exist(hash string) bool {
+	_, err := os.Stat(Path(hash))
+	return err == nil
+}
+
+// Remove 删除文件，调用前需要确认没有邮件引用
+func Remove(hash string) error {
+	err := os.Remove(Path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package blob
+
+import (
+	"os"
+	"pmail/config"
+	"testing"
+)
+
+func TestPut(t *testing.T) {
+	config.Instance = &config.Config{AttachmentPath: t.TempDir()}
+	defer func() { config.Instance = nil }()
+
+	h1, err := Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("hash = %s", h1)
+	}
+	h2, err := Put([]byte("hello"))
+	if err != nil || h2 != h1 {
+		t.Fatalf("Put again = %s, %v", h2, err)
+	}
+
+	content, err := Read(h1)
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("Read = %s, %v", content, err)
+	}
+	if !Exist(h1) {
+		t.Error("file should exist")
+	}
+
+	if err = Remove(h1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(Path(h1)); !os.IsNotExist(err) || Exist(h1) {
+		t.Error("file should be removed")
+	}
+	if err = Remove(h1); err != nil {
+		t.Error("removing a missing file should not fail")
+	}
+}
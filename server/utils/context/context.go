@@ -13,6 +13,7 @@ type Context struct {
 	UserID      int
 	UserAccount string
 	UserName    string
+	IsAdmin     bool
 	Values      map[string]any
 	Lang        string
 }
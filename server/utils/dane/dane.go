@@ -0,0 +1,195 @@
+package dane
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TLSA证书用途，SMTP只使用DANE-TA和DANE-EE，见RFC 7672
+const (
+	UsageDANETA = 2
+	UsageDANEEE = 3
+)
+
+var ErrNoMatch = errors.New("dane: no matching TLSA record")
+
+// ErrLookup 主机所在的区域有DNSSEC签名，但是TLSA记录查询失败，可能是校验失败，不能当作没有DANE策略
+var ErrLookup = errors.New("dane: TLSA lookup failed in signed zone")
+
+// Record TLSA记录
+type Record struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// Resolver 查询TLSA记录，secure表示结果经过了DNSSEC校验，测试时可以替换
+// LookupSigned 查询主机的地址记录是否经过DNSSEC校验，用于判断TLSA查询失败时主机所在的区域是否有签名
+type Resolver interface {
+	LookupTLSA(ctx context.Context, name string) (records []*Record, secure bool, err error)
+	LookupSigned(ctx context.Context, host string) (secure bool, err error)
+}
+
+var DefaultResolver Resolver = &dnsResolver{}
+
+// dnsResolver 使用系统配置的DNS服务器查询，依赖递归服务器完成DNSSEC校验并返回AD标记
+type dnsResolver struct{}
+
+func (r *dnsResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, true)
+	m.AuthenticatedData = true
+
+	c := &dns.Client{Timeout: 5 * time.Second}
+	for _, server := range conf.Servers {
+		addr := net.JoinHostPort(server, conf.Port)
+		resp, _, err := c.ExchangeContext(ctx, m, addr)
+		if err == nil && resp.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+			resp, _, err = tcp.ExchangeContext(ctx, m, addr)
+		}
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("dane: lookup %s rcode %s", name, dns.RcodeToString[resp.Rcode])
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("dane: lookup %s failed", name)
+}
+
+func (r *dnsResolver) LookupTLSA(ctx context.Context, name string) ([]*Record, bool, error) {
+	resp, err := r.exchange(ctx, name, dns.TypeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+	var ret []*Record
+	for _, rr := range resp.Answer {
+		tlsa, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+		data, err := hex.DecodeString(tlsa.Certificate)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, &Record{Usage: tlsa.Usage, Selector: tlsa.Selector, MatchingType: tlsa.MatchingType, Data: data})
+	}
+	return ret, resp.AuthenticatedData, nil
+}
+
+func (r *dnsResolver) LookupSigned(ctx context.Context, host string) (bool, error) {
+	resp, err := r.exchange(ctx, host, dns.TypeA)
+	if err != nil {
+		return false, err
+	}
+	return resp.AuthenticatedData, nil
+}
+
+// Lookup 查询MX主机的TLSA记录，只返回经过DNSSEC校验并且SMTP可用的记录
+// 查询失败时只有主机所在区域经过DNSSEC校验才返回ErrLookup，解析服务器故障、不支持DNSSEC等情况按照没有DANE策略处理，见RFC 7672 2.2
+func Lookup(ctx context.Context, host string, port int) ([]*Record, error) {
+	records, secure, err := DefaultResolver.LookupTLSA(ctx, "_"+strconv.Itoa(port)+"._tcp."+dns.Fqdn(host))
+	if err != nil {
+		if signed, serr := DefaultResolver.LookupSigned(ctx, host); serr == nil && signed {
+			return nil, fmt.Errorf("%w: %v", ErrLookup, err)
+		}
+		return nil, nil
+	}
+	if !secure {
+		return nil, nil
+	}
+	var ret []*Record
+	for _, r := range records {
+		if (r.Usage == UsageDANETA || r.Usage == UsageDANEEE) && r.Selector <= 1 && r.MatchingType <= 2 {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// Config 使用TLSA记录校验证书的TLS配置
+func Config(host string, records []*Record) *tls.Config {
+	return &tls.Config{
+		ServerName: host,
+		// 证书由VerifyConnection按照TLSA记录校验
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return Verify(host, records, cs.PeerCertificates)
+		},
+	}
+}
+
+// Verify 按照TLSA记录校验证书链
+// DANE-EE只比较服务器证书，不检查域名和有效期；DANE-TA需要从匹配的证书开始校验证书链和域名
+func Verify(host string, records []*Record, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return ErrNoMatch
+	}
+	for _, r := range records {
+		switch r.Usage {
+		case UsageDANEEE:
+			if match(r, certs[0]) {
+				return nil
+			}
+		case UsageDANETA:
+			for i, cert := range certs {
+				if !match(r, cert) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				intermediates := x509.NewCertPool()
+				if i > 1 {
+					for _, c := range certs[1:i] {
+						intermediates.AddCert(c)
+					}
+				}
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       host,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrNoMatch
+}
+
+func match(r *Record, cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch r.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.Data)
+}
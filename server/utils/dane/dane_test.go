@@ -0,0 +1,132 @@
+package dane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !isCA {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerify(t *testing.T) {
+	ca, caKey := newCert(t, "Test CA", true, nil, nil)
+	leaf, _ := newCert(t, "mx.example.com", false, ca, caKey)
+	other, _ := newCert(t, "mx.example.com", false, nil, nil)
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	ee := &Record{Usage: UsageDANEEE, Selector: 1, MatchingType: 1, Data: spki[:]}
+	if err := Verify("anything.example", []*Record{ee}, []*x509.Certificate{leaf, ca}); err != nil {
+		t.Errorf("DANE-EE: %v", err)
+	}
+	if err := Verify("mx.example.com", []*Record{ee}, []*x509.Certificate{other}); err != ErrNoMatch {
+		t.Errorf("DANE-EE mismatch: %v", err)
+	}
+
+	ta := &Record{Usage: UsageDANETA, Selector: 0, MatchingType: 0, Data: ca.Raw}
+	if err := Verify("mx.example.com", []*Record{ta}, []*x509.Certificate{leaf, ca}); err != nil {
+		t.Errorf("DANE-TA: %v", err)
+	}
+	// DANE-TA需要校验域名
+	if err := Verify("mail.other.com", []*Record{ta}, []*x509.Certificate{leaf, ca}); err != ErrNoMatch {
+		t.Errorf("DANE-TA wrong name: %v", err)
+	}
+}
+
+type fakeResolver struct {
+	records []*Record
+	secure  bool
+	err     error // TLSA查询返回的错误，例如SERVFAIL
+	signed  bool  // 主机所在区域是否有DNSSEC签名
+}
+
+func (r *fakeResolver) LookupTLSA(ctx context.Context, name string) ([]*Record, bool, error) {
+	if r.err != nil {
+		return nil, false, r.err
+	}
+	if name != "_25._tcp.mx.example.com." {
+		return nil, false, nil
+	}
+	return r.records, r.secure, nil
+}
+
+func (r *fakeResolver) LookupSigned(ctx context.Context, host string) (bool, error) {
+	return r.signed, nil
+}
+
+func TestLookup(t *testing.T) {
+	records := []*Record{
+		{Usage: UsageDANEEE, Selector: 1, MatchingType: 1, Data: []byte{1}},
+		{Usage: 1, Selector: 1, MatchingType: 1, Data: []byte{2}},
+	}
+	DefaultResolver = &fakeResolver{records: records, secure: true}
+	defer func() { DefaultResolver = &dnsResolver{} }()
+
+	got, err := Lookup(context.Background(), "mx.example.com", 25)
+	if err != nil || len(got) != 1 || got[0].Usage != UsageDANEEE {
+		t.Errorf("Lookup = %v, %v", got, err)
+	}
+
+	// 没有经过DNSSEC校验的记录不能使用
+	DefaultResolver = &fakeResolver{records: records, secure: false}
+	got, err = Lookup(context.Background(), "mx.example.com", 25)
+	if err != nil || len(got) != 0 {
+		t.Errorf("insecure Lookup = %v, %v", got, err)
+	}
+}
+
+func TestLookupServFail(t *testing.T) {
+	servFail := errors.New("dane: lookup _25._tcp.mx.example.com. rcode SERVFAIL")
+	defer func() { DefaultResolver = &dnsResolver{} }()
+
+	// 没有签名的区域查询失败，例如解析服务器不支持TLSA，按照没有DANE策略处理
+	DefaultResolver = &fakeResolver{err: servFail}
+	got, err := Lookup(context.Background(), "mx.example.com", 25)
+	if err != nil || len(got) != 0 {
+		t.Errorf("unsigned SERVFAIL Lookup = %v, %v", got, err)
+	}
+
+	// 有签名的区域查询失败，可能是校验失败，不能降级
+	DefaultResolver = &fakeResolver{err: servFail, signed: true}
+	got, err = Lookup(context.Background(), "mx.example.com", 25)
+	if !errors.Is(err, ErrLookup) || len(got) != 0 {
+		t.Errorf("signed SERVFAIL Lookup = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,164 @@
+package dmarc
+
+import (
+	"context"
+	"github.com/emersion/go-msgauth/dmarc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// 校验结果，保存在email表的dmarc_check字段
+const (
+	ResultNone = 0 // 发件域名没有DMARC策略
+	ResultPass = 1
+	ResultFail = 2
+)
+
+// Resolver 查询DNS的TXT记录，测试时可以替换成离线实现
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var DefaultResolver Resolver = net.DefaultResolver
+
+// 按pct抽样时使用，测试时可以替换
+var random = rand.Intn
+
+const lookupTimeout = 5 * time.Second
+
+// Result DMARC校验结果
+type Result struct {
+	Result      int8
+	Domain      string       // 邮件头From中的域名
+	Policy      dmarc.Policy // 校验失败时需要执行的策略，已经考虑了sp和pct
+	SPFAligned  bool
+	DKIMAligned bool
+}
+
+// Evaluate 根据邮件头From的域名，校验SPF和DKIM通过的域名是否和它对齐
+// spfDomain为SPF校验通过的域名，没有通过时传空；dkimDomains为签名有效的d=域名
+func Evaluate(fromDomain, spfDomain string, dkimDomains []string) *Result {
+	fromDomain = normalize(fromDomain)
+	ret := &Result{Result: ResultNone, Domain: fromDomain, Policy: dmarc.PolicyNone}
+	if fromDomain == "" {
+		return ret
+	}
+
+	record, orgRecord := lookup(fromDomain)
+	if record == nil {
+		return ret
+	}
+
+	ret.SPFAligned = spfDomain != "" && aligned(fromDomain, normalize(spfDomain), record.SPFAlignment)
+	for _, d := range dkimDomains {
+		if aligned(fromDomain, normalize(d), record.DKIMAlignment) {
+			ret.DKIMAligned = true
+			break
+		}
+	}
+	if ret.SPFAligned || ret.DKIMAligned {
+		ret.Result = ResultPass
+		return ret
+	}
+
+	ret.Result = ResultFail
+	ret.Policy = record.Policy
+	// 子域名没有自己的记录时，使用组织域名的sp策略
+	if orgRecord && record.SubdomainPolicy != "" {
+		ret.Policy = record.SubdomainPolicy
+	}
+	// pct抽样之外的邮件降一级处理
+	if record.Percent != nil && *record.Percent < 100 && random(100) >= *record.Percent {
+		switch ret.Policy {
+		case dmarc.PolicyReject:
+			ret.Policy = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			ret.Policy = dmarc.PolicyNone
+		}
+	}
+	return ret
+}
+
+// lookup 先查询发件域名的记录，没有的话查询组织域名的记录
+func lookup(domain string) (*dmarc.Record, bool) {
+	record, err := lookupRecord(domain)
+	if err == nil {
+		return record, false
+	}
+	if err != dmarc.ErrNoPolicy {
+		log.Warnf("DMARC Lookup Error %s: %v", domain, err)
+		return nil, false
+	}
+
+	org := OrgDomain(domain)
+	if org == domain {
+		return nil, false
+	}
+	record, err = lookupRecord(org)
+	if err != nil {
+		if err != dmarc.ErrNoPolicy {
+			log.Warnf("DMARC Lookup Error %s: %v", org, err)
+		}
+		return nil, false
+	}
+	return record, true
+}
+
+func lookupRecord(domain string) (*dmarc.Record, error) {
+	return dmarc.LookupWithOptions(domain, &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+			defer cancel()
+			txts, err := DefaultResolver.LookupTXT(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			// 同一个域名下可能还有其他用途的TXT记录
+			var ret []string
+			for _, txt := range txts {
+				if strings.HasPrefix(strings.ToLower(strings.TrimSpace(txt)), "v=dmarc1") {
+					ret = append(ret, txt)
+				}
+			}
+			return ret, nil
+		},
+	})
+}
+
+func aligned(fromDomain, domain string, mode dmarc.AlignmentMode) bool {
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return fromDomain == domain
+	}
+	return OrgDomain(fromDomain) == OrgDomain(domain)
+}
+
+// OrgDomain 组织域名，例如mail.example.co.uk的组织域名是example.co.uk
+func OrgDomain(domain string) string {
+	domain = normalize(domain)
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// Reject 校验失败并且策略要求拒收
+func (r *Result) Reject() bool {
+	return r.Result == ResultFail && r.Policy == dmarc.PolicyReject
+}
+
+// Quarantine 校验失败并且策略要求隔离
+func (r *Result) Quarantine() bool {
+	return r.Result == ResultFail && r.Policy == dmarc.PolicyQuarantine
+}
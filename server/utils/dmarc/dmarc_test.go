@@ -0,0 +1,70 @@
+package dmarc
+
+import (
+	"context"
+	"github.com/emersion/go-msgauth/dmarc"
+	"net"
+	"testing"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestEvaluate(t *testing.T) {
+	DefaultResolver = fakeResolver{
+		"_dmarc.example.com": {"google-site-verification=xxx", "v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.org":  {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+		"_dmarc.none.net":    {"v=DMARC1; p=none"},
+		"_dmarc.half.io":     {"v=DMARC1; p=reject; pct=50"},
+	}
+	defer func() { DefaultResolver = net.DefaultResolver }()
+
+	tests := []struct {
+		name   string
+		from   string
+		spf    string
+		dkim   []string
+		result int8
+		policy dmarc.Policy
+	}{
+		{"no record", "nodmarc.com", "", nil, ResultNone, dmarc.PolicyNone},
+		{"spf relaxed", "example.com", "bounce.example.com", nil, ResultPass, dmarc.PolicyNone},
+		{"dkim relaxed", "example.com", "", []string{"other.com", "mail.example.com"}, ResultPass, dmarc.PolicyNone},
+		{"fail reject", "example.com", "evil.com", []string{"evil.com"}, ResultFail, dmarc.PolicyReject},
+		{"subdomain policy", "news.example.com", "", nil, ResultFail, dmarc.PolicyQuarantine},
+		{"strict misaligned", "strict.org", "mail.strict.org", []string{"mail.strict.org"}, ResultFail, dmarc.PolicyQuarantine},
+		{"strict aligned", "Strict.ORG", "", []string{"strict.org"}, ResultPass, dmarc.PolicyNone},
+		{"policy none", "none.net", "", nil, ResultFail, dmarc.PolicyNone},
+	}
+	for _, tt := range tests {
+		ret := Evaluate(tt.from, tt.spf, tt.dkim)
+		if ret.Result != tt.result || ret.Policy != tt.policy {
+			t.Errorf("%s: result = %d, policy = %s", tt.name, ret.Result, ret.Policy)
+		}
+	}
+
+	// pct抽样之外降一级处理
+	random = func(n int) int { return 80 }
+	if ret := Evaluate("half.io", "", nil); ret.Policy != dmarc.PolicyQuarantine {
+		t.Errorf("pct sampled out policy = %s", ret.Policy)
+	}
+	random = func(n int) int { return 10 }
+	if ret := Evaluate("half.io", "", nil); ret.Policy != dmarc.PolicyReject {
+		t.Errorf("pct sampled in policy = %s", ret.Policy)
+	}
+}
+
+func TestOrgDomain(t *testing.T) {
+	if got := OrgDomain("mail.example.co.uk"); got != "example.co.uk" {
+		t.Errorf("OrgDomain = %s", got)
+	}
+	if got := OrgDomain("A.B.Example.com."); got != "example.com" {
+		t.Errorf("OrgDomain = %s", got)
+	}
+}
@@ -0,0 +1,143 @@
+package dmarc
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"pmail/dto/parsemail"
+	"strings"
+)
+
+// 解压后报告的最大大小，防止压缩炸弹
+const maxReportSize = 20 * 1024 * 1024
+
+var ErrNotReport = errors.New("dmarc: not an aggregate report")
+
+// Feedback DMARC聚合报告(rua)，格式见RFC 7489 附录C
+type Feedback struct {
+	XMLName        xml.Name `xml:"feedback"`
+	ReportMetadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportId  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	PolicyPublished struct {
+		Domain string `xml:"domain"`
+		ADKIM  string `xml:"adkim"`
+		ASPF   string `xml:"aspf"`
+		P      string `xml:"p"`
+		SP     string `xml:"sp"`
+		Pct    int    `xml:"pct"`
+	} `xml:"policy_published"`
+	Records []*FeedbackRecord `xml:"record"`
+}
+
+// FeedbackRecord 报告中同一个来源IP的统计
+type FeedbackRecord struct {
+	Row struct {
+		SourceIp        string `xml:"source_ip"`
+		Count           int    `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom   string `xml:"header_from"`
+		EnvelopeFrom string `xml:"envelope_from"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		DKIM []struct {
+			Domain string `xml:"domain"`
+			Result string `xml:"result"`
+		} `xml:"dkim"`
+		SPF []struct {
+			Domain string `xml:"domain"`
+			Result string `xml:"result"`
+		} `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+// IsReport 根据文件名和类型判断附件是否可能是聚合报告
+func IsReport(att *parsemail.Attachment) bool {
+	name := strings.ToLower(att.Filename)
+	contentType := strings.ToLower(att.ContentType)
+	for _, ext := range []string{".xml", ".xml.gz", ".gz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	for _, t := range []string{"application/gzip", "application/x-gzip", "application/zip", "application/x-zip-compressed", "text/xml", "application/xml"} {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReport 解析附件中的聚合报告，支持zip、gzip压缩和未压缩的xml
+func ParseReport(att *parsemail.Attachment) (*Feedback, error) {
+	data, err := decompress(att.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret Feedback
+	if err = xml.Unmarshal(data, &ret); err != nil {
+		return nil, ErrNotReport
+	}
+	if ret.ReportMetadata.ReportId == "" || ret.PolicyPublished.Domain == "" {
+		return nil, ErrNotReport
+	}
+	return &ret, nil
+}
+
+func decompress(content []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		r, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimit(r)
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if strings.ToLower(path.Ext(f.Name)) != ".xml" {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return readLimit(r)
+		}
+		return nil, ErrNotReport
+	}
+	return content, nil
+}
+
+func readLimit(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxReportSize {
+		return nil, errors.New("dmarc: report too large")
+	}
+	return data, nil
+}
@@ -0,0 +1,88 @@
+package dmarc
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"pmail/dto/parsemail"
+	"testing"
+)
+
+const reportXML = `<?xml version="1.0" encoding="UTF-8" ?>
+<feedback>
+  <report_metadata>
+    <org_name>google.com</org_name>
+    <email>noreply-dmarc-support@google.com</email>
+    <report_id>1234567890</report_id>
+    <date_range><begin>1704067200</begin><end>1704153599</end></date_range>
+  </report_metadata>
+  <policy_published><domain>example.com</domain><adkim>r</adkim><aspf>r</aspf><p>quarantine</p><sp>quarantine</sp><pct>100</pct></policy_published>
+  <record>
+    <row>
+      <source_ip>203.0.113.5</source_ip>
+      <count>3</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>example.com</domain><selector>default</selector><result>pass</result></dkim>
+      <spf><domain>bounce.other.net</domain><result>pass</result></spf>
+    </auth_results>
+  </record>
+  <record>
+    <row>
+      <source_ip>198.51.100.7</source_ip>
+      <count>1</count>
+      <policy_evaluated><disposition>quarantine</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results><spf><domain>spoof.net</domain><result>fail</result></spf></auth_results>
+  </record>
+</feedback>`
+
+func TestParseReport(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(reportXML))
+	gw.Close()
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	f, _ := zw.Create("google.com!example.com!1704067200!1704153599.xml")
+	f.Write([]byte(reportXML))
+	zw.Close()
+
+	atts := []*parsemail.Attachment{
+		{Filename: "report.xml.gz", ContentType: "application/gzip", Content: gz.Bytes()},
+		{Filename: "report.zip", ContentType: "application/zip", Content: zipped.Bytes()},
+		{Filename: "report.xml", ContentType: "text/xml", Content: []byte(reportXML)},
+	}
+	for _, att := range atts {
+		if !IsReport(att) {
+			t.Errorf("%s: IsReport = false", att.Filename)
+		}
+		ret, err := ParseReport(att)
+		if err != nil {
+			t.Errorf("%s: %v", att.Filename, err)
+			continue
+		}
+		if ret.ReportMetadata.OrgName != "google.com" || ret.ReportMetadata.ReportId != "1234567890" || ret.ReportMetadata.DateRange.Begin != 1704067200 {
+			t.Errorf("%s: metadata = %+v", att.Filename, ret.ReportMetadata)
+		}
+		if ret.PolicyPublished.Domain != "example.com" || ret.PolicyPublished.P != "quarantine" {
+			t.Errorf("%s: policy = %+v", att.Filename, ret.PolicyPublished)
+		}
+		if len(ret.Records) != 2 || ret.Records[0].Row.Count != 3 || ret.Records[1].Row.PolicyEvaluated.Disposition != "quarantine" ||
+			ret.Records[0].AuthResults.SPF[0].Domain != "bounce.other.net" {
+			t.Errorf("%s: records = %+v", att.Filename, ret.Records)
+		}
+	}
+
+	_, err := ParseReport(&parsemail.Attachment{Filename: "a.xml", Content: []byte("<html></html>")})
+	if err != ErrNotReport {
+		t.Errorf("not report err = %v", err)
+	}
+	if IsReport(&parsemail.Attachment{Filename: "photo.png", ContentType: "image/png"}) {
+		t.Error("png should not be a report")
+	}
+}
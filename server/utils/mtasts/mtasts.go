@@ -0,0 +1,235 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 策略模式，见RFC 8461
+const (
+	ModeEnforce = "enforce"
+	ModeTesting = "testing"
+	ModeNone    = "none"
+)
+
+// 策略文件最大64KB
+const maxPolicySize = 64 * 1024
+
+// 缓存时间上限一年
+const maxAge = 365 * 24 * time.Hour
+
+var ErrNoPolicy = errors.New("mta-sts: no policy")
+
+// Policy MTA-STS策略
+type Policy struct {
+	Id      string
+	Mode    string
+	MX      []string
+	MaxAge  time.Duration
+	Expires time.Time
+}
+
+// Resolver 查询_mta-sts的TXT记录，测试时可以替换
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var DefaultResolver Resolver = net.DefaultResolver
+
+// Fetch 下载策略文件，测试时可以替换
+var Fetch = fetch
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// 策略文件不允许跳转
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var cache = map[string]*Policy{}
+var lock sync.Mutex
+
+// Get 获取域名的MTA-STS策略，没有策略时返回ErrNoPolicy
+// TXT记录中的id没有变化时使用缓存，查询失败时缓存没有过期的话继续使用缓存
+func Get(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	lock.Lock()
+	cached := cache[domain]
+	lock.Unlock()
+	if cached != nil && time.Now().After(cached.Expires) {
+		cached = nil
+	}
+
+	id, err := lookupId(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	if cached != nil && cached.Id == id {
+		return cached, nil
+	}
+
+	body, err := Fetch(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy, err := Parse(body)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.Id = id
+	policy.Expires = time.Now().Add(policy.MaxAge)
+
+	lock.Lock()
+	cache[domain] = policy
+	lock.Unlock()
+	return policy, nil
+}
+
+func lookupId(ctx context.Context, domain string) (string, error) {
+	txts, err := DefaultResolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", ErrNoPolicy
+		}
+		return "", err
+	}
+	var ids []string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(txt, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			if key == "id" && value != "" {
+				ids = append(ids, value)
+			}
+		}
+	}
+	// 多条记录视为没有策略
+	if len(ids) != 1 {
+		return "", ErrNoPolicy
+	}
+	return ids[0], nil
+}
+
+func fetch(ctx context.Context, domain string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("mta-sts: fetch policy status %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		return "", fmt.Errorf("mta-sts: bad content type %s", resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// Parse 解析策略文件
+func Parse(body string) (*Policy, error) {
+	ret := &Policy{}
+	var version string
+	for _, line := range strings.Split(body, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			ret.Mode = value
+		case "mx":
+			ret.MX = append(ret.MX, strings.ToLower(value))
+		case "max_age":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("mta-sts: bad max_age %s", value)
+			}
+			ret.MaxAge = time.Duration(seconds) * time.Second
+		}
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("mta-sts: bad version %s", version)
+	}
+	switch ret.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(ret.MX) == 0 {
+			return nil, errors.New("mta-sts: no mx in policy")
+		}
+	case ModeNone:
+	default:
+		return nil, fmt.Errorf("mta-sts: bad mode %s", ret.Mode)
+	}
+	if ret.MaxAge > maxAge {
+		ret.MaxAge = maxAge
+	}
+	return ret, nil
+}
+
+// Match MX主机名是否在策略允许的列表中，通配符只匹配最左边的一级
+func (p *Policy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			_, parent, found := strings.Cut(host, ".")
+			if found && parent == pattern[2:] {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforce 策略要求必须使用TLS
+func (p *Policy) Enforce() bool {
+	return p != nil && p.Mode == ModeEnforce
+}
+
+// Lookup 获取策略，出错时记录日志并按照没有策略处理
+func Lookup(ctx context.Context, domain string) *Policy {
+	policy, err := Get(ctx, domain)
+	if err != nil {
+		if err != ErrNoPolicy {
+			log.Warnf("MTA-STS Lookup Error %s: %v", domain, err)
+		}
+		return nil
+	}
+	return policy
+}
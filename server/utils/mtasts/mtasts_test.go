@@ -0,0 +1,91 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.Example.net\r\nmax_age: 86400\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != ModeEnforce || p.MaxAge != 24*time.Hour || len(p.MX) != 2 {
+		t.Errorf("policy = %+v", p)
+	}
+	for host, want := range map[string]bool{
+		"mail.example.com.":   true,
+		"mx1.example.net":     true,
+		"a.mx1.example.net":   false,
+		"example.net":         false,
+		"mail2.example.com":   false,
+		"MAIL.EXAMPLE.COM":    true,
+		"evil-mail.example.c": false,
+	} {
+		if p.Match(host) != want {
+			t.Errorf("Match(%s) = %v", host, !want)
+		}
+	}
+
+	for _, body := range []string{
+		"version: STSv1\nmode: enforce\nmax_age: 100\n",
+		"version: STSv2\nmode: enforce\nmx: a.com\nmax_age: 100\n",
+		"version: STSv1\nmode: strict\nmx: a.com\nmax_age: 100\n",
+	} {
+		if _, err = Parse(body); err == nil {
+			t.Errorf("Parse(%q) should fail", body)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	resolver := fakeResolver{"_mta-sts.example.com": {"v=STSv1; id=20240101"}}
+	DefaultResolver = resolver
+	fetched := 0
+	Fetch = func(ctx context.Context, domain string) (string, error) {
+		fetched++
+		return "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 604800\n", nil
+	}
+	defer func() {
+		DefaultResolver = net.DefaultResolver
+		Fetch = fetch
+	}()
+
+	for i := 0; i < 2; i++ {
+		p, err := Get(context.Background(), "example.com")
+		if err != nil || !p.Enforce() {
+			t.Fatalf("Get = %+v, %v", p, err)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("policy fetched %d times, want cached", fetched)
+	}
+
+	// id变化后重新下载
+	resolver["_mta-sts.example.com"] = []string{"v=STSv1; id=20240202"}
+	if _, err := Get(context.Background(), "example.com"); err != nil || fetched != 2 {
+		t.Errorf("refetch err = %v, fetched = %d", err, fetched)
+	}
+
+	// TXT记录被删除或者查询失败时，未过期的缓存继续有效，防止降级攻击
+	delete(resolver, "_mta-sts.example.com")
+	if p, err := Get(context.Background(), "example.com"); err != nil || !p.Enforce() {
+		t.Errorf("cached policy = %+v, %v", p, err)
+	}
+
+	if _, err := Get(context.Background(), "other.com"); !errors.Is(err, ErrNoPolicy) {
+		t.Errorf("no policy err = %v", err)
+	}
+}
@@ -2,10 +2,13 @@ package password
 
 import (
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/hex"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
 )
 
-// Encode 对密码两次md5加盐
+// Encode 对密码两次md5加盐，老版本的密码存储方式，只用于校验和升级老密码
 func Encode(password string) string {
 	encodePwd := Md5Encode(Md5Encode(password+"pmail") + "pmail2023")
 	return encodePwd
@@ -16,3 +19,31 @@ func Md5Encode(str string) string {
 	h.Write([]byte(str))
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// Hash 使用bcrypt生成密码hash，每个密码都有独立的随机盐
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsLegacy 是否是老版本的md5密码
+func IsLegacy(hash string) bool {
+	return !strings.HasPrefix(hash, "$2")
+}
+
+// Verify 校验密码，needRehash为true表示密码正确但是需要重新生成hash
+func Verify(password, hash string) (ok bool, needRehash bool) {
+	if IsLegacy(hash) {
+		ok = subtle.ConstantTimeCompare([]byte(Encode(password)), []byte(hash)) == 1
+		return ok, ok
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost < bcrypt.DefaultCost
+}
@@ -8,3 +8,34 @@ import (
 func TestEncode(t *testing.T) {
 	fmt.Println(Encode("admin"))
 }
+
+func TestVerify(t *testing.T) {
+	hash, err := Hash("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacy(hash) {
+		t.Errorf("bcrypt hash treated as legacy: %s", hash)
+	}
+
+	tests := []struct {
+		name       string
+		password   string
+		hash       string
+		ok         bool
+		needRehash bool
+	}{
+		{"bcrypt", "admin", hash, true, false},
+		{"bcrypt wrong", "admin2", hash, false, false},
+		{"legacy", "admin", Encode("admin"), true, true},
+		{"legacy wrong", "admin2", Encode("admin"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needRehash := Verify(tt.password, tt.hash)
+			if ok != tt.ok || needRehash != tt.needRehash {
+				t.Errorf("Verify() = %v,%v, want %v,%v", ok, needRehash, tt.ok, tt.needRehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package send
+
+import (
+	"crypto/tls"
+	log "github.com/sirupsen/logrus"
+	"net"
+	netsmtp "net/smtp"
+	"pmail/config"
+	"pmail/utils/context"
+	"pmail/utils/smtp"
+	"strconv"
+	"strings"
+)
+
+// Relays 返回投递到某个域名时使用的中继服务器，为空表示直接投递到对方MX
+// 指定了该域名的中继优先于默认中继，host为空的中继表示该域名直接投递
+func Relays(domainName string) []*config.Relay {
+	if config.Instance == nil {
+		return nil
+	}
+	domainName = strings.ToLower(strings.TrimSuffix(domainName, "."))
+
+	var matched, defaults []*config.Relay
+	for _, relay := range config.Instance.Relays {
+		if len(relay.Domains) == 0 {
+			defaults = append(defaults, relay)
+			continue
+		}
+		for _, d := range relay.Domains {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "*" {
+				defaults = append(defaults, relay)
+				break
+			}
+			if d == domainName || (strings.HasPrefix(d, "*.") && strings.HasSuffix(domainName, d[1:])) {
+				matched = append(matched, relay)
+				break
+			}
+		}
+	}
+	if len(matched) == 0 {
+		matched = defaults
+	}
+
+	var ret []*config.Relay
+	for _, relay := range matched {
+		if relay.Host == "" {
+			return nil
+		}
+		ret = append(ret, relay)
+	}
+	return ret
+}
+
+// sendWithRelay 通过中继服务器投递，配置了用户名时使用SMTP AUTH
+func sendWithRelay(ctx *context.Context, relay *config.Relay, from string, to []string, b []byte) (*Result, error) {
+	security := relay.Security
+	if security == "" {
+		security = config.RelaySecurityStartTLS
+	}
+	port := relay.Port
+	if port == 0 {
+		switch security {
+		case config.RelaySecurityTLS:
+			port = 465
+		case config.RelaySecurityNone:
+			port = 25
+		default:
+			port = 587
+		}
+	}
+	addr := net.JoinHostPort(relay.Host, strconv.Itoa(port))
+
+	var a netsmtp.Auth
+	if relay.Username != "" {
+		a = smtp.Auth(relay.Username, relay.Password)
+	}
+
+	ret := &Result{Host: addr, Policy: TLSPolicyRelay}
+	switch security {
+	case config.RelaySecurityTLS:
+		state, err := smtp.SendMailTLS(addr, &tls.Config{ServerName: relay.Host}, a, from, to, b)
+		return ret.finish(state, err)
+	case config.RelaySecurityNone:
+		log.WithContext(ctx).Warnf("Unsafe! Relay %s without TLS", addr)
+		err := smtp.SendMailUnsafe("", addr, a, from, to, b)
+		ret.Status = "plaintext"
+		if err != nil {
+			ret.Status = "failed"
+		}
+		return ret, err
+	}
+	state, err := smtp.SendMailStartTLS(addr, &tls.Config{ServerName: relay.Host}, a, from, to, b)
+	return ret.finish(state, err)
+}
@@ -0,0 +1,108 @@
+package send
+
+import (
+	"errors"
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+	"net"
+	"pmail/config"
+	"pmail/dto/parsemail"
+	"pmail/utils/context"
+	"strconv"
+	"testing"
+)
+
+func TestRelays(t *testing.T) {
+	def := &config.Relay{Host: "smtp.relay.com"}
+	qq := &config.Relay{Host: "smtp.qq-relay.com", Domains: []string{"qq.com", "*.foxmail.com"}}
+	direct := &config.Relay{Domains: []string{"example.com"}}
+	config.Instance = &config.Config{Relays: []*config.Relay{def, qq, direct}}
+	defer func() { config.Instance = nil }()
+
+	tests := map[string]*config.Relay{
+		"qq.com":           qq,
+		"QQ.com.":          qq,
+		"vip.foxmail.com":  qq,
+		"foxmail.com":      def,
+		"gmail.com":        def,
+		"example.com":      nil,
+		"mail.example.com": def,
+	}
+	for domain, want := range tests {
+		got := Relays(domain)
+		if want == nil {
+			if len(got) != 0 {
+				t.Errorf("Relays(%s) = %v, want direct", domain, got)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("Relays(%s) = %v, want %s", domain, got, want.Host)
+		}
+	}
+}
+
+type authBackend struct {
+	testBackend
+	mechs    []string
+	username string
+}
+
+func (b *authBackend) NewSession(c *gosmtp.Conn) (gosmtp.Session, error) {
+	return &authSession{testSession: &testSession{b: &b.testBackend}, b: b}, nil
+}
+
+type authSession struct {
+	*testSession
+	b *authBackend
+}
+
+func (s *authSession) AuthMechanisms() []string {
+	return s.b.mechs
+}
+
+func (s *authSession) Auth(mech string) (sasl.Server, error) {
+	check := func(username, password string) error {
+		if username != "user" || password != "secret" {
+			return errors.New("invalid credentials")
+		}
+		s.b.username = username
+		return nil
+	}
+	if mech == sasl.Login {
+		return sasl.NewLoginServer(check), nil
+	}
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		return check(username, password)
+	}), nil
+}
+
+func TestSendWithRelay(t *testing.T) {
+	for _, mechs := range [][]string{{sasl.Plain}, {sasl.Login}} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := &authBackend{mechs: mechs}
+		server := gosmtp.NewServer(backend)
+		server.Domain = "localhost"
+		server.AllowInsecureAuth = true
+		go server.Serve(ln)
+
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		p, _ := strconv.Atoi(port)
+		config.Instance = &config.Config{Relays: []*config.Relay{
+			{Host: "127.0.0.1", Port: p, Security: config.RelaySecurityNone, Username: "user", Password: "secret"},
+		}}
+
+		ret, err := SendToDomain(&context.Context{}, "gmail.com", "a@b.com", []*parsemail.User{{EmailAddress: "x@gmail.com"}}, []byte("Subject: test\r\n\r\nhello\r\n"))
+		if err != nil {
+			t.Errorf("%v: %v", mechs, err)
+		}
+		if ret.Policy != TLSPolicyRelay || ret.Host != ln.Addr().String() || backend.username != "user" || backend.rcpt != "x@gmail.com" {
+			t.Errorf("%v: result = %+v, username = %s", mechs, ret, backend.username)
+		}
+		server.Close()
+	}
+	config.Instance = nil
+}
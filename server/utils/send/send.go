@@ -1,202 +1,345 @@
 package send
 
 import (
+	oContext "context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"net/textproto"
 	"pmail/dto/parsemail"
 	"pmail/utils/array"
 	"pmail/utils/async"
 	"pmail/utils/context"
+	"pmail/utils/dane"
+	"pmail/utils/mtasts"
 	"pmail/utils/smtp"
+	"sort"
 	"strings"
 	"sync"
 )
 
-type mxDomain struct {
-	domain string
-	mxHost string
-}
-
 // Forward 转发邮件
 func Forward(ctx *context.Context, e *parsemail.Email, forwardAddress string) error {
 
 	log.WithContext(ctx).Debugf("开始转发邮件")
 	b := e.ForwardBuildBytes(ctx, forwardAddress)
 
-	var to []*parsemail.User
-	to = []*parsemail.User{
-		{EmailAddress: forwardAddress},
+	args := strings.Split(forwardAddress, "@")
+	if len(args) != 2 {
+		log.WithContext(ctx).Errorf("邮箱地址解析错误！ %s", forwardAddress)
+		return errors.New("邮箱地址解析错误：" + forwardAddress)
 	}
 
-	// 按域名整理
-	toByDomain := map[mxDomain][]*parsemail.User{}
-	for _, s := range to {
-		args := strings.Split(s.EmailAddress, "@")
-		if len(args) == 2 {
-			//查询dns mx记录
-			mxInfo, err := net.LookupMX(args[1])
-			address := mxDomain{
-				domain: "smtp." + args[1],
-				mxHost: "smtp." + args[1],
-			}
-			if err != nil {
-				log.WithContext(ctx).Errorf(s.EmailAddress, "域名mx记录查询失败")
-			}
-			if len(mxInfo) > 0 {
-				address = mxDomain{
-					domain: args[1],
-					mxHost: mxInfo[0].Host,
-				}
-			}
-			toByDomain[address] = append(toByDomain[address], s)
-		} else {
-			log.WithContext(ctx).Errorf("邮箱地址解析错误！ %s", s)
-			continue
-		}
+	_, err := SendToDomain(ctx, args[1], e.From.EmailAddress, []*parsemail.User{{EmailAddress: forwardAddress}}, b)
+	if err != nil {
+		return errors.New("以下收件人投递失败：" + forwardAddress)
 	}
+	return nil
+}
+
+func Send(ctx *context.Context, e *parsemail.Email) (error, map[string]error) {
+
+	b := e.BuildBytes(ctx, true)
+
+	log.WithContext(ctx).Debugf("Message Infos : %s", string(b))
+
+	var to []*parsemail.User
+	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
+
+	// 按域名整理
+	toByDomain := GroupByDomain(ctx, to)
 
 	var errEmailAddress []string
+	var lock sync.Mutex
+
+	errMap := sync.Map{}
 
 	as := async.New(ctx)
 	for domain, tos := range toByDomain {
 		domain := domain
 		tos := tos
 		as.WaitProcess(func(p any) {
-			err := smtp.SendMail("", domain.mxHost+":25", nil, e.From.EmailAddress, buildAddress(tos), b)
-			if err != nil {
-				log.WithContext(ctx).Warnf("SMTP Send Error! Error:%+v", err)
-			} else {
-				log.WithContext(ctx).Infof("SMTP Send Success !")
-			}
-
-			// 重新选取证书域名
-			if err != nil {
-				if certificateErr, ok := err.(*tls.CertificateVerificationError); ok {
-					if hostnameErr, is := certificateErr.Err.(x509.HostnameError); is {
-						if hostnameErr.Certificate != nil {
-							certificateHostName := hostnameErr.Certificate.DNSNames
-							err = smtp.SendMail(domainMatch(domain.domain, certificateHostName), domain.mxHost+":25", nil, e.From.EmailAddress, buildAddress(tos), b)
-							if err != nil {
-								log.WithContext(ctx).Warnf("SMTP Send Error! Error:%+v", err)
-							} else {
-								log.WithContext(ctx).Infof("SMTP Send Success !")
-							}
-						}
-					}
-				}
-			}
-
+			_, err := SendToDomain(ctx, domain, e.From.EmailAddress, tos, b)
 			if err != nil {
-				log.WithContext(ctx).Errorf("%v 邮件投递失败%+v", tos, err)
+				lock.Lock()
 				for _, user := range tos {
 					errEmailAddress = append(errEmailAddress, user.EmailAddress)
 				}
+				lock.Unlock()
 			}
+			errMap.Store(domain, err)
 		}, nil)
 	}
 	as.Wait()
 
+	orgMap := map[string]error{}
+	errMap.Range(func(key, value any) bool {
+		orgMap[key.(string)], _ = value.(error)
+		return true
+	})
+
 	if len(errEmailAddress) > 0 {
-		return errors.New("以下收件人投递失败：" + array.Join(errEmailAddress, ","))
+		return errors.New("以下收件人投递失败：" + array.Join(errEmailAddress, ",")), orgMap
 	}
-	return nil
+	return nil, orgMap
+
 }
 
-func Send(ctx *context.Context, e *parsemail.Email) (error, map[string]error) {
+// GroupByDomain 按收件域名整理收件人
+func GroupByDomain(ctx *context.Context, to []*parsemail.User) map[string][]*parsemail.User {
+	toByDomain := map[string][]*parsemail.User{}
+	for _, s := range to {
+		args := strings.Split(s.EmailAddress, "@")
+		if len(args) == 2 {
+			toByDomain[args[1]] = append(toByDomain[args[1]], s)
+		} else {
+			log.WithContext(ctx).Errorf("邮箱地址解析错误！ %s", s)
+		}
+	}
+	return toByDomain
+}
 
-	b := e.BuildBytes(ctx, true)
+// Resolver 查询MX和主机地址，测试时可以替换
+type Resolver interface {
+	LookupMX(ctx oContext.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx oContext.Context, host string) ([]net.IPAddr, error)
+}
 
-	log.WithContext(ctx).Debugf("Message Infos : %s", string(b))
+var DefaultResolver Resolver = net.DefaultResolver
+
+// smtpPort 投递端口，测试时可以替换
+var smtpPort = "25"
+
+// SendToDomain 向某个域名的邮件服务器投递邮件，返回接收邮件的MX主机和本次投递使用的TLS策略
+// 该域名配置了中继服务器时交给中继投递
+// MX按优先级依次尝试，每个MX的IPv4和IPv6地址都会尝试，对方明确拒绝(5xx)时不再尝试其他MX
+// MX主机有DNSSEC校验过的TLSA记录时使用DANE，其次是enforce模式的MTA-STS，这两种情况下不允许降级到明文
+func SendToDomain(ctx *context.Context, domainName string, from string, tos []*parsemail.User, b []byte) (*Result, error) {
+	to := buildAddress(tos)
+	ret := &Result{Status: "failed"}
+	var lastErr error
+
+	// 配置了中继服务器时按顺序尝试中继
+	if relays := Relays(domainName); len(relays) > 0 {
+		for _, relay := range relays {
+			ret, lastErr = sendWithRelay(ctx, relay, from, to, b)
+			log.WithContext(ctx).Infof("%s Relay %s TLS Policy: %s, %s", domainName, ret.Host, ret.Policy, ret.Status)
+			if lastErr == nil {
+				return ret, nil
+			}
+			log.WithContext(ctx).Warnf("%s Relay %s 投递失败 %v", domainName, ret.Host, lastErr)
+			if !IsTemporaryError(lastErr) {
+				break
+			}
+		}
+		log.WithContext(ctx).Errorf("%v 邮件投递失败%+v", tos, lastErr)
+		return ret, lastErr
+	}
 
-	var to []*parsemail.User
-	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
+	hosts, err := lookupMX(domainName)
+	if err != nil {
+		log.WithContext(ctx).Errorf("%s 域名mx记录查询失败 %v", domainName, err)
+		return ret, err
+	}
 
-	// 按域名整理
-	toByDomain := map[mxDomain][]*parsemail.User{}
-	for _, s := range to {
-		args := strings.Split(s.EmailAddress, "@")
-		if len(args) == 2 {
-			//查询dns mx记录
-			mxInfo, err := net.LookupMX(args[1])
-			address := mxDomain{
-				domain: "smtp." + args[1],
-				mxHost: "smtp." + args[1],
+	for _, host := range hosts {
+		addrs, err := DefaultResolver.LookupIPAddr(oContext.Background(), host)
+		if err != nil {
+			log.WithContext(ctx).Warnf("%s 地址查询失败 %v", host, err)
+			// 没有MX记录，域名本身也没有地址，域名不存在
+			var dnsErr *net.DNSError
+			if len(hosts) == 1 && host == domainName && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return ret, &textproto.Error{Code: 550, Msg: "5.1.2 domain " + domainName + " not found"}
 			}
-			if err != nil {
-				log.WithContext(ctx).Errorf(s.EmailAddress, "域名mx记录查询失败")
+			lastErr = err
+			continue
+		}
+
+		policy := getPolicy(ctx, domainName, host)
+		for _, addr := range addrs {
+			ret, err = deliver(ctx, policy, host, addr.IP.String(), from, to, b)
+			log.WithContext(ctx).Infof("%s MX %s(%s) TLS Policy: %s, %s", domainName, host, addr.IP, ret.Policy, ret.Status)
+			if err == nil {
+				return ret, nil
 			}
-			if len(mxInfo) > 0 {
-				address = mxDomain{
-					domain: args[1],
-					mxHost: mxInfo[0].Host,
-				}
+			log.WithContext(ctx).Warnf("%s MX %s(%s) 投递失败 %v", domainName, host, addr.IP, err)
+			lastErr = err
+			if !IsTemporaryError(err) {
+				log.WithContext(ctx).Errorf("%v 邮件投递失败%+v", tos, err)
+				return ret, err
 			}
-			toByDomain[address] = append(toByDomain[address], s)
-		} else {
-			log.WithContext(ctx).Errorf("邮箱地址解析错误！ %s", s)
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%s no available mx host", domainName)
+	}
+	log.WithContext(ctx).Errorf("%v 邮件投递失败%+v", tos, lastErr)
+	return ret, lastErr
+}
+
+// lookupMX 按优先级返回MX主机
+// 没有MX记录时使用域名本身(RFC 5321 隐式MX)，null MX(RFC 7505)表示域名不接收邮件，返回永久错误
+func lookupMX(domainName string) ([]string, error) {
+	mxs, err := DefaultResolver.LookupMX(oContext.Background(), domainName)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	if len(mxs) == 0 {
+		return []string{domainName}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	var hosts []string
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
 			continue
 		}
+		hosts = append(hosts, host)
 	}
+	if len(hosts) == 0 {
+		return nil, &textproto.Error{Code: 556, Msg: "5.1.10 domain " + domainName + " does not accept mail (null MX)"}
+	}
+	return hosts, nil
+}
 
-	var errEmailAddress []string
+// tlsPolicy 投递到某个MX主机时使用的TLS策略
+type tlsPolicy struct {
+	name    string
+	records []*dane.Record
+	err     error // MX不符合策略或者策略查询失败，不允许投递
+}
 
-	errMap := sync.Map{}
+func getPolicy(ctx *context.Context, domainName string, host string) *tlsPolicy {
+	// DANE
+	records, err := dane.Lookup(oContext.Background(), host, 25)
+	if err != nil {
+		// 有DNSSEC签名的区域TLSA查询失败时无法确定对方是否要求DANE，不能降级，该MX暂时不投递，见RFC 7672 2.2
+		log.WithContext(ctx).Warnf("%s TLSA Lookup Error: %v", host, err)
+		return &tlsPolicy{name: TLSPolicyDANE, err: fmt.Errorf("%w: %s %v", ErrTLSALookup, host, err)}
+	}
+	if len(records) > 0 {
+		return &tlsPolicy{name: TLSPolicyDANE, records: records}
+	}
 
-	as := async.New(ctx)
-	for domain, tos := range toByDomain {
-		domain := domain
-		tos := tos
-		as.WaitProcess(func(p any) {
+	// MTA-STS
+	policy := mtasts.Lookup(oContext.Background(), domainName)
+	if policy.Enforce() {
+		ret := &tlsPolicy{name: TLSPolicyMTASTS}
+		if !policy.Match(host) {
+			ret.err = fmt.Errorf("%w: MX %s not allowed by MTA-STS policy", ErrTLSRequired, host)
+		}
+		return ret
+	}
+	if policy != nil && policy.Mode == mtasts.ModeTesting && !policy.Match(host) {
+		log.WithContext(ctx).Warnf("MTA-STS testing: MX %s not allowed by policy of %s", host, domainName)
+	}
+	return &tlsPolicy{name: TLSPolicyOpportunistic}
+}
 
-			err := smtp.SendMail("", domain.mxHost+":25", nil, e.From.EmailAddress, buildAddress(tos), b)
+// deliver 按照TLS策略向MX主机的某个地址投递，证书按照MX主机名校验
+func deliver(ctx *context.Context, policy *tlsPolicy, host string, ip string, from string, to []string, b []byte) (*Result, error) {
+	ret := &Result{Host: host, Policy: policy.name}
+	addr := net.JoinHostPort(ip, smtpPort)
 
-			// 使用其他方式发送
-			if err != nil {
-				if errors.Is(err, smtp.NoSupportSTARTTLSError) {
-					err = smtp.SendMailWithTls("", domain.mxHost+":465", nil, e.From.EmailAddress, buildAddress(tos), b)
-					if err != nil {
-						log.WithContext(ctx).Warnf("Unsafe! %s Server Not Support SMTPS & STARTTLS", domain.domain)
-						err = smtp.SendMailUnsafe("", domain.mxHost+":25", nil, e.From.EmailAddress, buildAddress(tos), b)
-					}
-				}
+	if policy.err != nil {
+		ret.Status = "refused"
+		return ret, policy.err
+	}
 
-				// 证书错误，从新选取证书发送
-				if certificateErr, ok := err.(*tls.CertificateVerificationError); ok {
-					if hostnameErr, is := certificateErr.Err.(x509.HostnameError); is {
-						if hostnameErr.Certificate != nil {
-							certificateHostName := hostnameErr.Certificate.DNSNames
-							// 重新选取证书发送
-							err = smtp.SendMail(domainMatch(domain.domain, certificateHostName), domain.mxHost+":25", nil, e.From.EmailAddress, buildAddress(tos), b)
-						}
-					}
-				}
+	switch policy.name {
+	case TLSPolicyDANE:
+		state, err := smtp.SendMailStartTLS(addr, dane.Config(host, policy.records), nil, from, to, b)
+		return ret.finish(state, err)
+	case TLSPolicyMTASTS:
+		state, err := smtp.SendMailStartTLS(addr, &tls.Config{ServerName: host}, nil, from, to, b)
+		return ret.finish(state, err)
+	}
+
+	state, err := smtp.SendMailStartTLS(addr, &tls.Config{ServerName: host}, nil, from, to, b)
+
+	// 使用其他方式发送
+	if err != nil {
+		if errors.Is(err, smtp.NoSupportSTARTTLSError) {
+			err = smtp.SendMailWithTls(host, net.JoinHostPort(ip, "465"), nil, from, to, b)
+			if err == nil {
+				ret.Status = "smtps, unverified"
+				return ret, nil
 			}
+			log.WithContext(ctx).Warnf("Unsafe! %s Server Not Support SMTPS & STARTTLS", host)
+			err = smtp.SendMailUnsafe("", addr, nil, from, to, b)
+			ret.Status = "plaintext"
+			return ret, err
+		}
 
-			if err != nil {
-				log.WithContext(ctx).Errorf("%v 邮件投递失败%+v", tos, err)
-				for _, user := range tos {
-					errEmailAddress = append(errEmailAddress, user.EmailAddress)
+		// 证书错误，从新选取证书发送
+		if certificateErr, ok := err.(*tls.CertificateVerificationError); ok {
+			if hostnameErr, is := certificateErr.Err.(x509.HostnameError); is {
+				if hostnameErr.Certificate != nil {
+					certificateHostName := hostnameErr.Certificate.DNSNames
+					// 重新选取证书发送
+					state, err = smtp.SendMailStartTLS(addr, &tls.Config{ServerName: domainMatch(host, certificateHostName)}, nil, from, to, b)
 				}
 			}
-			errMap.Store(domain.domain, err)
-		}, nil)
+		}
 	}
-	as.Wait()
+	return ret.finish(state, err)
+}
 
-	orgMap := map[string]error{}
-	errMap.Range(func(key, value any) bool {
-		orgMap[key.(string)] = value.(error)
-		return true
-	})
+// TLS策略
+const (
+	TLSPolicyDANE          = "dane"
+	TLSPolicyMTASTS        = "mta-sts"
+	TLSPolicyOpportunistic = "opportunistic"
+	TLSPolicyRelay         = "relay"
+)
 
-	if len(errEmailAddress) > 0 {
-		return errors.New("以下收件人投递失败：" + array.Join(errEmailAddress, ",")), orgMap
+// ErrTLSRequired DANE、MTA-STS或者中继要求使用TLS，但是无法建立校验通过的TLS连接
+var ErrTLSRequired = errors.New("TLS required by policy")
+
+// ErrTLSALookup 有DNSSEC签名的区域TLSA记录查询失败，属于临时错误，稍后重试
+var ErrTLSALookup = errors.New("TLSA lookup failed")
+
+// Result 一次投递的结果，接收邮件的MX主机(或中继地址)以及使用的TLS策略和加密情况
+type Result struct {
+	Host   string
+	Policy string
+	Status string // 例如 TLS 1.3 TLS_AES_128_GCM_SHA256、plaintext
+}
+
+func (r *Result) finish(state tls.ConnectionState, err error) (*Result, error) {
+	if state.Version != 0 {
+		r.Status = tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+	} else if err != nil {
+		r.Status = "failed"
 	}
-	return nil, orgMap
+	// 策略要求TLS时，对方不支持STARTTLS不能降级
+	if r.Policy != TLSPolicyOpportunistic && errors.Is(err, smtp.NoSupportSTARTTLSError) {
+		err = fmt.Errorf("%w: %s", ErrTLSRequired, err)
+	}
+	return r, err
+}
 
+// IsTemporaryError 判断投递错误是否可以重试，4xx以及网络错误可以重试，5xx为永久失败
+func IsTemporaryError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code < 500
+	}
+	return true
 }
 
 func buildAddress(u []*parsemail.User) []string {
@@ -1,11 +1,20 @@
 package send
 
 import (
+	oContext "context"
+	"errors"
 	"fmt"
+	gosmtp "github.com/emersion/go-smtp"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/textproto"
 	"os"
 	"pmail/config"
 	"pmail/dto/parsemail"
+	"pmail/utils/context"
+	"pmail/utils/dane"
+	"pmail/utils/mtasts"
 	"testing"
 	"time"
 )
@@ -90,3 +99,232 @@ func Test_domainMatch(t *testing.T) {
 
 	fmt.Println(domain)
 }
+
+func TestIsTemporaryError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"4xx", &textproto.Error{Code: 451, Msg: "try again later"}, true},
+		{"5xx", &textproto.Error{Code: 550, Msg: "no such user"}, false},
+		{"wrapped 5xx", fmt.Errorf("rcpt: %w", &textproto.Error{Code: 554, Msg: "rejected"}), false},
+		{"network", errors.New("dial tcp: i/o timeout"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTemporaryError(tt.err); got != tt.want {
+				t.Errorf("IsTemporaryError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeTXT map[string][]string
+
+func (r fakeTXT) LookupTXT(ctx oContext.Context, name string) ([]string, error) {
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+type noTLSA struct{}
+
+func (r noTLSA) LookupTLSA(ctx oContext.Context, name string) ([]*dane.Record, bool, error) {
+	return nil, false, nil
+}
+
+func (r noTLSA) LookupSigned(ctx oContext.Context, host string) (bool, error) {
+	return false, nil
+}
+
+func TestSendWithPolicyRefuse(t *testing.T) {
+	dane.DefaultResolver = noTLSA{}
+	mtasts.DefaultResolver = fakeTXT{"_mta-sts.example.com": {"v=STSv1; id=1"}}
+	mtasts.Fetch = func(ctx oContext.Context, domain string) (string, error) {
+		return "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n", nil
+	}
+
+	// MX不在MTA-STS策略中，不连接直接拒绝
+	policy := getPolicy(&context.Context{}, "example.com", "evil.example.org")
+	ret, err := deliver(&context.Context{}, policy, "evil.example.org", "127.0.0.1", "a@b.com", []string{"x@example.com"}, []byte("x"))
+	if !errors.Is(err, ErrTLSRequired) {
+		t.Errorf("err = %v", err)
+	}
+	if ret.Policy != TLSPolicyMTASTS || ret.Status != "refused" {
+		t.Errorf("result = %+v", ret)
+	}
+}
+
+// failTLSA TLSA查询返回SERVFAIL，signed表示主机所在区域是否有DNSSEC签名
+type failTLSA struct {
+	signed bool
+}
+
+func (r failTLSA) LookupTLSA(ctx oContext.Context, name string) ([]*dane.Record, bool, error) {
+	return nil, false, errors.New("rcode SERVFAIL")
+}
+
+func (r failTLSA) LookupSigned(ctx oContext.Context, host string) (bool, error) {
+	return r.signed, nil
+}
+
+func TestSendWithTLSALookupError(t *testing.T) {
+	dane.DefaultResolver = failTLSA{signed: true}
+	defer func() { dane.DefaultResolver = noTLSA{} }()
+
+	// 有签名的区域TLSA查询失败时不能降级为opportunistic，返回可以重试的错误
+	policy := getPolicy(&context.Context{}, "example.com", "mail.example.com")
+	ret, err := deliver(&context.Context{}, policy, "mail.example.com", "127.0.0.1", "a@b.com", []string{"x@example.com"}, []byte("x"))
+	if !errors.Is(err, ErrTLSALookup) || !IsTemporaryError(err) {
+		t.Errorf("err = %v", err)
+	}
+	if ret.Policy != TLSPolicyDANE || ret.Status != "refused" {
+		t.Errorf("result = %+v", ret)
+	}
+}
+
+func TestSendWithTLSAServFail(t *testing.T) {
+	dane.DefaultResolver = failTLSA{}
+	mtasts.DefaultResolver = fakeTXT{}
+	defer func() { dane.DefaultResolver = noTLSA{} }()
+
+	// 解析服务器返回SERVFAIL并且区域没有签名时按照没有DANE策略处理
+	policy := getPolicy(&context.Context{}, "example.net", "mail.example.net")
+	if policy.err != nil || policy.name != TLSPolicyOpportunistic {
+		t.Errorf("policy = %+v", policy)
+	}
+}
+
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]net.IPAddr
+}
+
+func (r *fakeResolver) LookupMX(ctx oContext.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx oContext.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestLookupMX(t *testing.T) {
+	DefaultResolver = &fakeResolver{mx: map[string][]*net.MX{
+		"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+		"null.com":    {{Host: ".", Pref: 0}},
+	}}
+	defer func() { DefaultResolver = net.DefaultResolver }()
+
+	hosts, err := lookupMX("example.com")
+	if err != nil || len(hosts) != 2 || hosts[0] != "mx1.example.com" || hosts[1] != "mx2.example.com" {
+		t.Errorf("lookupMX = %v, %v", hosts, err)
+	}
+
+	// 没有MX记录时使用域名本身
+	hosts, err = lookupMX("implicit.com")
+	if err != nil || len(hosts) != 1 || hosts[0] != "implicit.com" {
+		t.Errorf("implicit MX = %v, %v", hosts, err)
+	}
+
+	// null MX 是永久错误
+	_, err = lookupMX("null.com")
+	if err == nil || IsTemporaryError(err) {
+		t.Errorf("null MX err = %v", err)
+	}
+}
+
+type testBackend struct {
+	rcpt string
+	data []byte
+}
+
+func (b *testBackend) NewSession(c *gosmtp.Conn) (gosmtp.Session, error) {
+	return &testSession{b: b}, nil
+}
+
+type testSession struct {
+	b *testBackend
+}
+
+func (s *testSession) Mail(from string, opts *gosmtp.MailOptions) error { return nil }
+
+func (s *testSession) Rcpt(to string, opts *gosmtp.RcptOptions) error {
+	if to == "reject@example.net" {
+		return &gosmtp.SMTPError{Code: 550, EnhancedCode: gosmtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	}
+	s.b.rcpt = to
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	var err error
+	s.b.data, err = io.ReadAll(r)
+	return err
+}
+
+func (s *testSession) Reset() {}
+
+func (s *testSession) Logout() error { return nil }
+
+func TestSendToDomainFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &testBackend{}
+	server := gosmtp.NewServer(backend)
+	server.Domain = "localhost"
+	go server.Serve(ln)
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	smtpPort = port
+	dane.DefaultResolver = noTLSA{}
+	mtasts.DefaultResolver = fakeTXT{}
+	// mx1优先级最高但是没有监听端口，IPv6地址也不可用，应该投递到mx2
+	DefaultResolver = &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.net": {{Host: "mx2.example.net.", Pref: 20}, {Host: "mx1.example.net.", Pref: 10}},
+		},
+		hosts: map[string][]net.IPAddr{
+			"mx1.example.net": {{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.2")}},
+			"mx2.example.net": {{IP: net.ParseIP("127.0.0.1")}},
+		},
+	}
+	defer func() {
+		smtpPort = "25"
+		DefaultResolver = net.DefaultResolver
+	}()
+
+	ctx := &context.Context{}
+	msg := []byte("Subject: test\r\n\r\nhello\r\n")
+	ret, err := SendToDomain(ctx, "example.net", "a@b.com", []*parsemail.User{{EmailAddress: "ok@example.net"}}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Host != "mx2.example.net" || backend.rcpt != "ok@example.net" || len(backend.data) == 0 {
+		t.Errorf("result = %+v, rcpt = %s", ret, backend.rcpt)
+	}
+
+	// 5xx是永久错误，不再尝试其他MX
+	DefaultResolver.(*fakeResolver).mx["example.net"] = []*net.MX{{Host: "mx2.example.net", Pref: 10}, {Host: "mx1.example.net", Pref: 20}}
+	ret, err = SendToDomain(ctx, "example.net", "a@b.com", []*parsemail.User{{EmailAddress: "reject@example.net"}}, msg)
+	if err == nil || IsTemporaryError(err) || ret.Host != "mx2.example.net" {
+		t.Errorf("reject result = %+v, err = %v", ret, err)
+	}
+
+	// 域名不存在
+	_, err = SendToDomain(ctx, "nxdomain.example", "a@b.com", []*parsemail.User{{EmailAddress: "x@nxdomain.example"}}, msg)
+	if err == nil || IsTemporaryError(err) {
+		t.Errorf("nxdomain err = %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package sieve
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// matchValues 任意一个值匹配任意一个key即为真
+func (r *runtime) matchValues(values []string, keys []string, b *bound) bool {
+	caseMap := true
+	if c := b.tags["comparator"]; c != nil && c.Strings[0] == ComparatorOctet {
+		caseMap = false
+	}
+
+	for _, key := range keys {
+		if b.has("matches") {
+			re := globRegexp(key, caseMap)
+			for _, v := range values {
+				if m := re.FindStringSubmatch(v); m != nil {
+					if r.script.require["variables"] {
+						r.match = m
+					}
+					return true
+				}
+			}
+			continue
+		}
+		for _, v := range values {
+			a, k := v, key
+			if caseMap {
+				a, k = asciiLower(a), asciiLower(k)
+			}
+			if b.has("contains") {
+				if strings.Contains(a, k) {
+					return true
+				}
+			} else if a == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globRegexp 把:matches的通配符转换成正则，*和?分别是一个分组，用于${1}等匹配变量
+func globRegexp(pattern string, caseMap bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s")
+	if caseMap {
+		b.WriteString("i")
+	}
+	b.WriteString(")^")
+	for i := 0; i < len(pattern); {
+		c, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch c {
+		case '*':
+			b.WriteString("(.*?)")
+		case '?':
+			b.WriteString("(.)")
+		case '\\':
+			if i < len(pattern) {
+				c, size = utf8.DecodeRuneInString(pattern[i:])
+				i += size
+			}
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+var variableReg = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*|[0-9]+)\}`)
+
+// str 替换字符串中的变量，没有require variables时原样返回
+func (r *runtime) str(s string) string {
+	if !r.script.require["variables"] {
+		return s
+	}
+	return variableReg.ReplaceAllStringFunc(s, func(v string) string {
+		name := v[2 : len(v)-1]
+		if name[0] >= '0' && name[0] <= '9' {
+			n, err := strconv.Atoi(name)
+			if err != nil || n >= len(r.match) {
+				return ""
+			}
+			return r.match[n]
+		}
+		return r.vars[strings.ToLower(name)]
+	})
+}
+
+func (r *runtime) strs(list []string) []string {
+	ret := make([]string, len(list))
+	for i, s := range list {
+		ret[i] = r.str(s)
+	}
+	return ret
+}
+
+// set 设置变量，修饰符按照RFC 5229的优先级执行
+func (r *runtime) set(b *bound) {
+	name := strings.ToLower(b.args[0].Strings[0])
+	value := r.str(b.args[1].Strings[0])
+
+	switch {
+	case b.has("lower"):
+		value = strings.ToLower(value)
+	case b.has("upper"):
+		value = strings.ToUpper(value)
+	}
+	if value != "" {
+		first, size := utf8.DecodeRuneInString(value)
+		switch {
+		case b.has("lowerfirst"):
+			value = string(unicode.ToLower(first)) + value[size:]
+		case b.has("upperfirst"):
+			value = string(unicode.ToUpper(first)) + value[size:]
+		}
+	}
+	if b.has("quotewildcard") {
+		value = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(value)
+	}
+	if b.has("length") {
+		value = strconv.Itoa(utf8.RuneCountInString(value))
+	}
+	r.vars[name] = value
+}
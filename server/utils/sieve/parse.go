@@ -0,0 +1,413 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 参数类型
+const (
+	ArgTag = iota + 1
+	ArgNumber
+	ArgString
+	ArgStringList
+)
+
+// Arg 命令或者测试的参数
+type Arg struct {
+	Type    int
+	Tag     string // 不带冒号，例如is、contains
+	Number  int64
+	Strings []string
+	Line    int
+}
+
+// Test 测试，例如 header :contains "Subject" "test"
+type Test struct {
+	Name  string
+	Args  []*Arg
+	Tests []*Test
+	Line  int
+}
+
+// Command 命令，例如 if、fileinto、stop
+type Command struct {
+	Name  string
+	Args  []*Arg
+	Tests []*Test
+	Block []*Command
+	Line  int
+}
+
+// Error 脚本语法错误或者运行错误，带有行号
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sieve: line %d: %s", e.Line, e.Msg)
+}
+
+func errorf(line int, format string, args ...any) *Error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// token类型
+const (
+	tokEOF = iota
+	tokIdentifier
+	tokTag
+	tokNumber
+	tokString
+	tokSpecial // [ ] ( ) , ; { }
+)
+
+type token struct {
+	typ   int
+	value string
+	num   int64
+	line  int
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) next() (*token, error) {
+	if err := l.skip(); err != nil {
+		return nil, err
+	}
+	if l.pos >= len(l.src) {
+		return &token{typ: tokEOF, line: l.line}, nil
+	}
+	line := l.line
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("[](),;{}", c) >= 0:
+		l.pos++
+		return &token{typ: tokSpecial, value: string(c), line: line}, nil
+	case c == '"':
+		s, err := l.quoted()
+		return &token{typ: tokString, value: s, line: line}, err
+	case c == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return nil, errorf(line, "bad tag")
+		}
+		return &token{typ: tokTag, value: strings.ToLower(name), line: line}, nil
+	case c >= '0' && c <= '9':
+		return l.number()
+	case isIdentStart(c):
+		name := l.identifier()
+		if strings.EqualFold(name, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiline()
+			return &token{typ: tokString, value: s, line: line}, err
+		}
+		return &token{typ: tokIdentifier, value: strings.ToLower(name), line: line}, nil
+	}
+	return nil, errorf(line, "unexpected character %q", c)
+}
+
+// skip 跳过空白和注释
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return errorf(l.line, "unterminated comment")
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if !isIdentStart(c) && !(c >= '0' && c <= '9') {
+			break
+		}
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+func (l *lexer) number() (*token, error) {
+	line := l.line
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.pos++
+	}
+	n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return nil, errorf(line, "bad number")
+	}
+	if l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case 'K', 'k':
+			n <<= 10
+			l.pos++
+		case 'M', 'm':
+			n <<= 20
+			l.pos++
+		case 'G', 'g':
+			n <<= 30
+			l.pos++
+		}
+	}
+	return &token{typ: tokNumber, num: n, line: line}, nil
+}
+
+func (l *lexer) quoted() (string, error) {
+	line := l.line
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return b.String(), nil
+		case '\\':
+			l.pos++
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return "", errorf(line, "unterminated string")
+}
+
+// multiline text:格式的多行字符串，以单独一行的.结束，..开头的行去掉一个点
+func (l *lexer) multiline() (string, error) {
+	line := l.line
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return "", errorf(line, "text: must be followed by a newline")
+	}
+	l.pos++
+	l.line++
+
+	var lines []string
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var s string
+		if end < 0 {
+			s = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			s = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+			l.line++
+		}
+		s = strings.TrimSuffix(s, "\r")
+		if s == "." {
+			if len(lines) == 0 {
+				return "", nil
+			}
+			return strings.Join(lines, "\r\n") + "\r\n", nil
+		}
+		if strings.HasPrefix(s, "..") {
+			s = s[1:]
+		}
+		lines = append(lines, s)
+	}
+	return "", errorf(line, "unterminated multi-line string")
+}
+
+type parser struct {
+	lex *lexer
+	tok *token
+}
+
+func (p *parser) advance() error {
+	var err error
+	p.tok, err = p.lex.next()
+	return err
+}
+
+func (p *parser) isSpecial(s string) bool {
+	return p.tok.typ == tokSpecial && p.tok.value == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.isSpecial(s) {
+		return errorf(p.tok.line, "expected %q", s)
+	}
+	return p.advance()
+}
+
+// commands 解析命令列表，直到文件结束或者}
+func (p *parser) commands() ([]*Command, error) {
+	ret := []*Command{}
+	for p.tok.typ != tokEOF && !p.isSpecial("}") {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cmd)
+	}
+	return ret, nil
+}
+
+func (p *parser) command() (*Command, error) {
+	if p.tok.typ != tokIdentifier {
+		return nil, errorf(p.tok.line, "expected command")
+	}
+	cmd := &Command{Name: p.tok.value, Line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	cmd.Args, cmd.Tests, err = p.arguments()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isSpecial(";") {
+		return cmd, p.advance()
+	}
+	if !p.isSpecial("{") {
+		return nil, errorf(p.tok.line, "expected ; or {")
+	}
+	if err = p.advance(); err != nil {
+		return nil, err
+	}
+	cmd.Block, err = p.commands()
+	if err != nil {
+		return nil, err
+	}
+	return cmd, p.expect("}")
+}
+
+// arguments 解析参数，以及后面可选的测试或者测试列表
+func (p *parser) arguments() ([]*Arg, []*Test, error) {
+	var args []*Arg
+	for {
+		switch {
+		case p.tok.typ == tokTag:
+			args = append(args, &Arg{Type: ArgTag, Tag: p.tok.value, Line: p.tok.line})
+		case p.tok.typ == tokNumber:
+			args = append(args, &Arg{Type: ArgNumber, Number: p.tok.num, Line: p.tok.line})
+		case p.tok.typ == tokString:
+			args = append(args, &Arg{Type: ArgString, Strings: []string{p.tok.value}, Line: p.tok.line})
+		case p.isSpecial("["):
+			arg, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, arg)
+			continue
+		case p.tok.typ == tokIdentifier:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []*Test{test}, nil
+		case p.isSpecial("("):
+			tests, err := p.testList()
+			return args, tests, err
+		default:
+			return args, nil, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() (*Arg, error) {
+	arg := &Arg{Type: ArgStringList, Line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	for {
+		if p.tok.typ != tokString {
+			return nil, errorf(p.tok.line, "expected string in string list")
+		}
+		arg.Strings = append(arg.Strings, p.tok.value)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.isSpecial("]") {
+			return arg, p.advance()
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) test() (*Test, error) {
+	if p.tok.typ != tokIdentifier {
+		return nil, errorf(p.tok.line, "expected test")
+	}
+	test := &Test{Name: p.tok.value, Line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	test.Args, test.Tests, err = p.arguments()
+	return test, err
+}
+
+func (p *parser) testList() ([]*Test, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var tests []*Test
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.isSpecial(")") {
+			return tests, p.advance()
+		}
+		if err = p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
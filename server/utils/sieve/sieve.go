@@ -0,0 +1,509 @@
+// Package sieve 实现RFC 5228 Sieve邮件过滤语言
+// 支持的扩展：fileinto、envelope、vacation(RFC 5230)、variables(RFC 5229)
+package sieve
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Capabilities 支持的扩展，ManageSieve的SIEVE能力也使用这个列表
+var Capabilities = []string{"fileinto", "envelope", "vacation", "variables", "comparator-i;octet", "comparator-i;ascii-casemap"}
+
+// 一个脚本最多执行的redirect次数
+const MaxRedirects = 5
+
+// 比较器
+const (
+	ComparatorOctet     = "i;octet"
+	ComparatorCaseMap   = "i;ascii-casemap"
+	defaultVacationDays = 7
+)
+
+// spec 命令或者测试的参数格式
+type spec struct {
+	ext   string         // 需要require的扩展
+	tags  map[string]int // 可以使用的tag，值为tag后面参数的个数
+	args  int            // 位置参数个数
+	str   bool           // 位置参数只能是单个字符串，不能是列表
+	tests int            // 0不需要测试，1一个测试，-1测试列表
+	block bool
+}
+
+var matchTags = map[string]int{"is": 0, "contains": 0, "matches": 0, "comparator": 1}
+
+var addressTags = map[string]int{"is": 0, "contains": 0, "matches": 0, "comparator": 1, "all": 0, "localpart": 0, "domain": 0}
+
+var commands = map[string]*spec{
+	"require":  {args: 1},
+	"if":       {tests: 1, block: true},
+	"elsif":    {tests: 1, block: true},
+	"else":     {block: true},
+	"stop":     {},
+	"keep":     {},
+	"discard":  {},
+	"redirect": {args: 1, str: true},
+	"fileinto": {ext: "fileinto", args: 1, str: true},
+	"vacation": {ext: "vacation", args: 1, str: true, tags: map[string]int{"days": 1, "subject": 1, "from": 1, "addresses": 1, "mime": 0, "handle": 1}},
+	"set":      {ext: "variables", args: 2, str: true, tags: map[string]int{"lower": 0, "upper": 0, "lowerfirst": 0, "upperfirst": 0, "quotewildcard": 0, "length": 0}},
+}
+
+var tests = map[string]*spec{
+	"address":  {args: 2, tags: addressTags},
+	"envelope": {ext: "envelope", args: 2, tags: addressTags},
+	"header":   {args: 2, tags: matchTags},
+	"string":   {ext: "variables", args: 2, tags: matchTags},
+	"exists":   {args: 1},
+	"size":     {args: 1, tags: map[string]int{"over": 0, "under": 0}},
+	"true":     {},
+	"false":    {},
+	"not":      {tests: 1},
+	"allof":    {tests: -1},
+	"anyof":    {tests: -1},
+}
+
+// 互斥的tag
+var exclusiveTags = [][]string{
+	{"is", "contains", "matches"},
+	{"all", "localpart", "domain"},
+	{"over", "under"},
+	{"lower", "upper"},
+	{"lowerfirst", "upperfirst"},
+}
+
+// bound 按照spec整理后的参数
+type bound struct {
+	tags map[string]*Arg // 没有参数的tag值为nil
+	args []*Arg
+}
+
+func (b *bound) has(tag string) bool {
+	_, ok := b.tags[tag]
+	return ok
+}
+
+func bind(name string, line int, args []*Arg, s *spec) (*bound, error) {
+	ret := &bound{tags: map[string]*Arg{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.Type != ArgTag {
+			ret.args = append(ret.args, arg)
+			continue
+		}
+		if len(ret.args) > 0 {
+			return nil, errorf(arg.Line, "%s: tag :%s must come before other arguments", name, arg.Tag)
+		}
+		count, ok := s.tags[arg.Tag]
+		if !ok {
+			return nil, errorf(arg.Line, "%s: unknown tag :%s", name, arg.Tag)
+		}
+		if ret.has(arg.Tag) {
+			return nil, errorf(arg.Line, "%s: duplicate tag :%s", name, arg.Tag)
+		}
+		ret.tags[arg.Tag] = nil
+		if count > 0 {
+			if i+1 >= len(args) || args[i+1].Type == ArgTag {
+				return nil, errorf(arg.Line, "%s: tag :%s needs an argument", name, arg.Tag)
+			}
+			i++
+			ret.tags[arg.Tag] = args[i]
+		}
+	}
+
+	if len(ret.args) != s.args {
+		return nil, errorf(line, "%s: expected %d arguments, got %d", name, s.args, len(ret.args))
+	}
+	for _, group := range exclusiveTags {
+		n := 0
+		for _, tag := range group {
+			if ret.has(tag) {
+				n++
+			}
+		}
+		if n > 1 {
+			return nil, errorf(line, "%s: tags :%s can not be used together", name, strings.Join(group, " :"))
+		}
+	}
+	if c, ok := ret.tags["comparator"]; ok {
+		if c.Type != ArgString || (c.Strings[0] != ComparatorOctet && c.Strings[0] != ComparatorCaseMap) {
+			return nil, errorf(c.Line, "%s: unsupported comparator", name)
+		}
+	}
+	// :days的参数是数字，其他tag的参数是字符串
+	for tag, v := range ret.tags {
+		if v != nil && (tag == "days") != (v.Type == ArgNumber) {
+			return nil, errorf(v.Line, "%s: bad argument for :%s", name, tag)
+		}
+	}
+	for _, arg := range ret.args {
+		if (name == "size") != (arg.Type == ArgNumber) || (s.str && arg.Type != ArgString) {
+			return nil, errorf(arg.Line, "%s: bad argument type", name)
+		}
+	}
+	if name == "size" && len(ret.tags) != 1 {
+		return nil, errorf(line, "size: needs :over or :under")
+	}
+	return ret, nil
+}
+
+// Script 解析后的脚本
+type Script struct {
+	Commands []*Command
+	require  map[string]bool
+}
+
+// Parse 解析并检查脚本，未知命令、缺少require等错误在这里返回
+func Parse(src string) (*Script, error) {
+	p := &parser{lex: &lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.typ != tokEOF {
+		return nil, errorf(p.tok.line, "unexpected }")
+	}
+
+	s := &Script{Commands: cmds, require: map[string]bool{}}
+	if err = s.check(cmds, true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Script) check(cmds []*Command, top bool) error {
+	requireAllowed := top
+	for i, cmd := range cmds {
+		sp, ok := commands[cmd.Name]
+		if !ok {
+			return errorf(cmd.Line, "unknown command %s", cmd.Name)
+		}
+		if sp.ext != "" && !s.require[sp.ext] {
+			return errorf(cmd.Line, "%s requires \"%s\"", cmd.Name, sp.ext)
+		}
+		if _, err := bind(cmd.Name, cmd.Line, cmd.Args, sp); err != nil {
+			return err
+		}
+
+		switch cmd.Name {
+		case "require":
+			if !requireAllowed {
+				return errorf(cmd.Line, "require must be at the beginning of the script")
+			}
+			for _, ext := range cmd.Args[0].Strings {
+				if !supported(ext) {
+					return errorf(cmd.Line, "unsupported extension %s", ext)
+				}
+				s.require[ext] = true
+			}
+		case "elsif", "else":
+			if i == 0 || (cmds[i-1].Name != "if" && cmds[i-1].Name != "elsif") {
+				return errorf(cmd.Line, "%s without if", cmd.Name)
+			}
+		}
+		if cmd.Name != "require" {
+			requireAllowed = false
+		}
+
+		if sp.tests == 1 && len(cmd.Tests) != 1 {
+			return errorf(cmd.Line, "%s needs a test", cmd.Name)
+		}
+		if sp.tests == 0 && len(cmd.Tests) > 0 {
+			return errorf(cmd.Line, "%s does not take a test", cmd.Name)
+		}
+		for _, t := range cmd.Tests {
+			if err := s.checkTest(t); err != nil {
+				return err
+			}
+		}
+		if sp.block != (cmd.Block != nil) {
+			if sp.block {
+				return errorf(cmd.Line, "%s needs a block", cmd.Name)
+			}
+			return errorf(cmd.Line, "%s does not take a block", cmd.Name)
+		}
+		if err := s.check(cmd.Block, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Script) checkTest(t *Test) error {
+	sp, ok := tests[t.Name]
+	if !ok {
+		return errorf(t.Line, "unknown test %s", t.Name)
+	}
+	if sp.ext != "" && !s.require[sp.ext] {
+		return errorf(t.Line, "%s requires \"%s\"", t.Name, sp.ext)
+	}
+	if _, err := bind(t.Name, t.Line, t.Args, sp); err != nil {
+		return err
+	}
+	switch {
+	case sp.tests == 1 && len(t.Tests) != 1:
+		return errorf(t.Line, "%s needs one test", t.Name)
+	case sp.tests == -1 && len(t.Tests) == 0:
+		return errorf(t.Line, "%s needs a test list", t.Name)
+	case sp.tests == 0 && len(t.Tests) > 0:
+		return errorf(t.Line, "%s does not take a test", t.Name)
+	}
+	for _, sub := range t.Tests {
+		if err := s.checkTest(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func supported(ext string) bool {
+	for _, c := range Capabilities {
+		if c == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Message 执行脚本需要的邮件信息
+type Message struct {
+	Header textproto.MIMEHeader // 已经解码的邮件头
+	Size   int64
+	From   string   // 信封发件人
+	To     []string // 信封收件人
+}
+
+// Vacation 自动回复
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	Mime      bool
+	Handle    string
+	Reason    string
+}
+
+// Result 脚本执行结果
+type Result struct {
+	Keep     bool // 保留在收件箱，包括没有执行fileinto、redirect、discard时的隐式keep
+	FileInto []string
+	Redirect []string
+	Discard  bool
+	Vacation *Vacation
+}
+
+// Execute 对邮件执行脚本，出错时按照RFC 5228应该执行隐式keep
+func (s *Script) Execute(msg *Message) (*Result, error) {
+	r := &runtime{
+		script:       s,
+		msg:          msg,
+		ret:          &Result{},
+		vars:         map[string]string{},
+		implicitKeep: true,
+	}
+	if err := r.exec(s.Commands); err != nil {
+		return nil, err
+	}
+	r.ret.Keep = r.ret.Keep || r.implicitKeep
+	return r.ret, nil
+}
+
+type runtime struct {
+	script       *Script
+	msg          *Message
+	ret          *Result
+	vars         map[string]string
+	match        []string // :matches匹配到的内容，${0}到${9}
+	implicitKeep bool
+	stopped      bool
+}
+
+func (r *runtime) exec(cmds []*Command) error {
+	taken := false
+	for _, cmd := range cmds {
+		if r.stopped {
+			return nil
+		}
+		b, err := bind(cmd.Name, cmd.Line, cmd.Args, commands[cmd.Name])
+		if err != nil {
+			return err
+		}
+
+		switch cmd.Name {
+		case "require":
+		case "if", "elsif":
+			if cmd.Name == "elsif" && taken {
+				continue
+			}
+			taken, err = r.test(cmd.Tests[0])
+			if err != nil {
+				return err
+			}
+			if taken {
+				if err = r.exec(cmd.Block); err != nil {
+					return err
+				}
+			}
+		case "else":
+			if !taken {
+				if err = r.exec(cmd.Block); err != nil {
+					return err
+				}
+			}
+		case "stop":
+			r.stopped = true
+		case "keep":
+			r.ret.Keep = true
+		case "discard":
+			r.ret.Discard = true
+			r.implicitKeep = false
+		case "fileinto":
+			r.ret.FileInto = append(r.ret.FileInto, r.str(b.args[0].Strings[0]))
+			r.implicitKeep = false
+		case "redirect":
+			address := r.str(b.args[0].Strings[0])
+			if _, err := mail.ParseAddress(address); err != nil {
+				return errorf(cmd.Line, "redirect: bad address %s", address)
+			}
+			if len(r.ret.Redirect) >= MaxRedirects {
+				return errorf(cmd.Line, "redirect: too many redirects")
+			}
+			r.ret.Redirect = append(r.ret.Redirect, address)
+			r.implicitKeep = false
+		case "vacation":
+			if r.ret.Vacation != nil {
+				return errorf(cmd.Line, "vacation: only one vacation action is allowed")
+			}
+			r.ret.Vacation = r.vacation(b)
+		case "set":
+			r.set(b)
+		}
+	}
+	return nil
+}
+
+func (r *runtime) vacation(b *bound) *Vacation {
+	v := &Vacation{Days: defaultVacationDays, Reason: r.str(b.args[0].Strings[0]), Mime: b.has("mime")}
+	if days := b.tags["days"]; days != nil {
+		v.Days = int(days.Number)
+	}
+	if subject := b.tags["subject"]; subject != nil {
+		v.Subject = r.str(subject.Strings[0])
+	}
+	if from := b.tags["from"]; from != nil {
+		v.From = r.str(from.Strings[0])
+	}
+	if handle := b.tags["handle"]; handle != nil {
+		v.Handle = r.str(handle.Strings[0])
+	}
+	if addresses := b.tags["addresses"]; addresses != nil {
+		v.Addresses = r.strs(addresses.Strings)
+	}
+	return v
+}
+
+func (r *runtime) test(t *Test) (bool, error) {
+	b, err := bind(t.Name, t.Line, t.Args, tests[t.Name])
+	if err != nil {
+		return false, err
+	}
+
+	switch t.Name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := r.test(t.Tests[0])
+		return !ok, err
+	case "allof", "anyof":
+		for _, sub := range t.Tests {
+			ok, err := r.test(sub)
+			if err != nil {
+				return false, err
+			}
+			// allof遇到false、anyof遇到true时短路
+			if ok == (t.Name == "anyof") {
+				return ok, nil
+			}
+		}
+		return t.Name == "allof", nil
+	case "exists":
+		for _, name := range r.strs(b.args[0].Strings) {
+			if len(r.msg.Header.Values(name)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		if b.has("over") {
+			return r.msg.Size > b.args[0].Number, nil
+		}
+		return r.msg.Size < b.args[0].Number, nil
+	case "header":
+		var values []string
+		for _, name := range r.strs(b.args[0].Strings) {
+			values = append(values, r.msg.Header.Values(name)...)
+		}
+		return r.matchValues(values, r.strs(b.args[1].Strings), b), nil
+	case "string":
+		return r.matchValues(r.strs(b.args[0].Strings), r.strs(b.args[1].Strings), b), nil
+	case "address":
+		var values []string
+		for _, name := range r.strs(b.args[0].Strings) {
+			for _, v := range r.msg.Header.Values(name) {
+				values = append(values, addressPart(parseAddresses(v), b)...)
+			}
+		}
+		return r.matchValues(values, r.strs(b.args[1].Strings), b), nil
+	case "envelope":
+		var values []string
+		for _, part := range r.strs(b.args[0].Strings) {
+			switch strings.ToLower(part) {
+			case "from":
+				values = append(values, addressPart([]string{r.msg.From}, b)...)
+			case "to":
+				values = append(values, addressPart(r.msg.To, b)...)
+			}
+		}
+		return r.matchValues(values, r.strs(b.args[1].Strings), b), nil
+	}
+	return false, errorf(t.Line, "unknown test %s", t.Name)
+}
+
+// parseAddresses 解析邮件头中的地址列表，格式错误时整体当作一个地址
+func parseAddresses(value string) []string {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return []string{strings.Trim(strings.TrimSpace(value), "<>")}
+	}
+	var ret []string
+	for _, a := range list {
+		ret = append(ret, a.Address)
+	}
+	return ret
+}
+
+func addressPart(addresses []string, b *bound) []string {
+	var ret []string
+	for _, a := range addresses {
+		idx := strings.LastIndex(a, "@")
+		switch {
+		case b.has("localpart"):
+			if idx >= 0 {
+				a = a[:idx]
+			}
+		case b.has("domain"):
+			if idx < 0 {
+				continue
+			}
+			a = a[idx+1:]
+		}
+		ret = append(ret, a)
+	}
+	return ret
+}
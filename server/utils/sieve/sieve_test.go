@@ -0,0 +1,149 @@
+package sieve
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func testMessage() *Message {
+	h := textproto.MIMEHeader{}
+	h.Set("From", "\"Boss\" <Boss@Example.com>")
+	h.Set("To", "me@example.org, other@example.net")
+	h.Set("Subject", "[project-x] Weekly report")
+	h.Set("List-Id", "<project-x.lists.example.com>")
+	return &Message{
+		Header: h,
+		Size:   20 * 1024,
+		From:   "bounce@lists.example.com",
+		To:     []string{"me@example.org"},
+	}
+}
+
+func run(t *testing.T, src string) *Result {
+	t.Helper()
+	s, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	ret, err := s.Execute(testMessage())
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	return ret
+}
+
+func TestParseError(t *testing.T) {
+	tests := map[string]string{
+		`fileinto "a";`:             "requires",
+		`require "imap4flags";`:     "unsupported extension",
+		`keep; require "fileinto";`: "beginning",
+		`if true;`:                  "block",
+		`else { keep; }`:            "without if",
+		`if header :is :contains "a" "b" { keep; }`:          "together",
+		`if size 100 { keep; }`:                              ":over or :under",
+		`foo;`:                                               "unknown command",
+		"if header \"Subject\" \"x\" {\n keep;\n":            "expected",
+		`redirect ["a@b.com", "c@d.com"];`:                   "bad argument type",
+		`if header :comparator "i;foo" "a" "b" {}`:           "comparator",
+		"require \"vacation\";\nvacation :days \"x\" \"r\";": "line 2",
+	}
+	for src, want := range tests {
+		_, err := Parse(src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) = %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	ret := run(t, `
+require ["fileinto", "envelope"];
+# 邮件列表放到单独的分组
+if header :contains "List-Id" "project-x" {
+	fileinto "Project";
+	stop;
+}
+keep;
+`)
+	if ret.Keep || len(ret.FileInto) != 1 || ret.FileInto[0] != "Project" {
+		t.Errorf("list result = %+v", ret)
+	}
+
+	ret = run(t, `
+require "fileinto";
+if address :domain :is "from" "example.COM" {
+	fileinto "Work";
+} elsif size :over 1K {
+	discard;
+} else {
+	redirect "a@b.com";
+}
+`)
+	if ret.Keep || len(ret.FileInto) != 1 || ret.Discard || len(ret.Redirect) != 0 {
+		t.Errorf("if result = %+v", ret)
+	}
+
+	ret = run(t, `
+require "envelope";
+if anyof (address :localpart "to" "nobody", exists "X-Spam") {
+	discard;
+}
+if envelope :is "from" "bounce@lists.example.com" {
+	keep;
+}
+`)
+	if ret.Discard || !ret.Keep {
+		t.Errorf("envelope result = %+v", ret)
+	}
+
+	ret = run(t, `
+require "envelope";
+if allof (size :under 10K, true) { discard; }
+if envelope :domain "to" "example.org" { discard; }
+`)
+	if !ret.Discard || ret.Keep {
+		t.Errorf("discard result = %+v", ret)
+	}
+
+	// 没有执行任何动作时隐式keep
+	ret = run(t, `if header :is "Subject" "nothing" { discard; }`)
+	if !ret.Keep || ret.Discard {
+		t.Errorf("implicit keep = %+v", ret)
+	}
+
+	// i;octet区分大小写
+	ret = run(t, `if address :comparator "i;octet" :is "from" "boss@example.com" { discard; }`)
+	if ret.Discard {
+		t.Errorf("octet comparator = %+v", ret)
+	}
+}
+
+func TestVariablesAndVacation(t *testing.T) {
+	ret := run(t, `
+require ["fileinto", "variables", "vacation"];
+if header :matches "Subject" "[*] *" {
+	set :upperfirst "list" "${1}";
+	fileinto "Lists/${list}";
+}
+set "reason" "I'm away";
+vacation :days 3 :subject "Re: ${2}" :addresses ["me@example.org"] text:
+${reason}.
+..
+.
+;
+`)
+	if len(ret.FileInto) != 1 || ret.FileInto[0] != "Lists/Project-x" {
+		t.Errorf("fileinto = %v", ret.FileInto)
+	}
+	v := ret.Vacation
+	if v == nil || v.Days != 3 || v.Subject != "Re: Weekly report" || v.Reason != "I'm away.\r\n.\r\n" || len(v.Addresses) != 1 {
+		t.Errorf("vacation = %+v", v)
+	}
+
+	// 没有require variables时不替换
+	ret = run(t, `require "fileinto"; fileinto "${1}";`)
+	if ret.FileInto[0] != "${1}" {
+		t.Errorf("no variables fileinto = %v", ret.FileInto)
+	}
+}
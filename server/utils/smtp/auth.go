@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"errors"
+	"net/smtp"
+)
+
+// Auth 根据服务器支持的认证方式选择PLAIN或者LOGIN
+// 和net/smtp的PlainAuth一样，只允许在加密连接或者本机连接上发送密码
+func Auth(username, password string) smtp.Auth {
+	return &auth{username: username, password: password}
+}
+
+type auth struct {
+	username string
+	password string
+	login    bool
+	step     int
+}
+
+func (a *auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("smtp: unencrypted connection")
+	}
+	a.login, a.step = false, 0
+	for _, mech := range server.Auth {
+		if mech == "PLAIN" {
+			return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+		}
+	}
+	for _, mech := range server.Auth {
+		if mech == "LOGIN" {
+			a.login = true
+			return "LOGIN", nil, nil
+		}
+	}
+	return "", nil, errors.New("smtp: server doesn't support PLAIN or LOGIN auth")
+}
+
+func (a *auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	if !a.login {
+		return nil, errors.New("smtp: unexpected server challenge")
+	}
+	// LOGIN先后询问用户名和密码，不同服务器的提示文本不一样，按顺序回复
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("smtp: unexpected LOGIN challenge " + string(fromServer))
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -402,36 +402,78 @@ func SendMailWithTls(domain string, addr string, a smtp.Auth, from string, to []
 // library.
 // 修复TSL验证问题
 func SendMail(domain string, addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	var config *tls.Config
+	if domain != "" {
+		config = &tls.Config{
+			ServerName: domain,
+		}
+	}
+	_, err := SendMailStartTLS(addr, config, a, from, to, msg)
+	return err
+}
+
+// SendMailStartTLS 使用指定的TLS配置执行STARTTLS后发送，服务器不支持STARTTLS时返回NoSupportSTARTTLSError
+// 返回TLS连接信息，用于记录投递时的加密情况
+func SendMailStartTLS(addr string, config *tls.Config, a smtp.Auth, from string, to []string, msg []byte) (tls.ConnectionState, error) {
+	var state tls.ConnectionState
 	if err := validateLine(from); err != nil {
-		return err
+		return state, err
 	}
 	for _, recp := range to {
 		if err := validateLine(recp); err != nil {
-			return err
+			return state, err
 		}
 	}
 	c, err := Dial(addr)
 	if err != nil {
-		return err
+		return state, err
 	}
 	defer c.Close()
 	if err = c.hello(); err != nil {
-		return err
+		return state, err
 	}
 	if ok, _ := c.Extension("STARTTLS"); !ok {
-		return NoSupportSTARTTLSError
+		return state, NoSupportSTARTTLSError
 	}
 
-	var config *tls.Config
-	if domain != "" {
-		config = &tls.Config{
-			ServerName: domain,
-		}
+	if err = c.StartTLS(config); err != nil {
+		return state, err
 	}
+	state, _ = c.TLSConnectionState()
+	return state, c.send(a, from, to, msg)
+}
 
-	if err = c.StartTLS(config); err != nil {
-		return err
+// SendMailTLS 直接建立TLS连接(SMTPS)后发送，证书按照config校验
+func SendMailTLS(addr string, config *tls.Config, a smtp.Auth, from string, to []string, msg []byte) (tls.ConnectionState, error) {
+	var state tls.ConnectionState
+	if err := validateLine(from); err != nil {
+		return state, err
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return state, err
+		}
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return state, err
 	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := NewClient(conn, host)
+	if err != nil {
+		return state, err
+	}
+	defer c.Close()
+	if err = c.hello(); err != nil {
+		return state, err
+	}
+	state = conn.ConnectionState()
+	return state, c.send(a, from, to, msg)
+}
+
+// send 发送邮件内容
+func (c *Client) send(a smtp.Auth, from string, to []string, msg []byte) error {
+	var err error
 	if a != nil && c.ext != nil {
 		if _, ok := c.ext["AUTH"]; !ok {
 			return errors.New("smtp: server doesn't support AUTH")
@@ -0,0 +1,74 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录B的测试向量，取后6位
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := Code(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, _ := Code(secret, now)
+
+	if !Validate(secret, code, now) {
+		t.Error("current code should be valid")
+	}
+	if !Validate(secret, code, now.Add(period*time.Second)) {
+		t.Error("code from the previous period should be valid")
+	}
+	if Validate(secret, code, now.Add(3*period*time.Second)) {
+		t.Error("old code should be invalid")
+	}
+	if Validate(secret, "", now) || Validate(secret, "12345", now) {
+		t.Error("malformed code should be invalid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("PMail", "admin@example.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/PMail:admin@example.com?") || !strings.Contains(uri, "secret=ABC") {
+		t.Errorf("URI() = %s", uri)
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	code, _ := Code(secret, now.Add(-period*time.Second))
+	step, ok := ValidateStep(secret, code, now)
+	if !ok || step != now.Unix()/period-1 {
+		t.Errorf("ValidateStep() = %d %v, want %d", step, ok, now.Unix()/period-1)
+	}
+}